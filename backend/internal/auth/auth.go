@@ -3,28 +3,88 @@ package auth
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
 	"github.com/cdsap/build-process-watcher/backend/internal/models"
 )
 
+var (
+	// ErrTokenExpired is returned by ValidateToken for a well-formed token past its expiry
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenInvalid is returned by ValidateToken for malformed, forged or mismatched tokens
+	ErrTokenInvalid = errors.New("token is invalid")
+)
+
 var (
 	secretKey   string
 	adminSecret string
+	hmacHash    func() hash.Hash = sha256.New
+
+	// adminSecretMu guards adminSecret, which can be rotated at runtime
+	adminSecretMu sync.RWMutex
 )
 
+// MinAdminSecretLength is the shortest secret accepted by RotateAdminSecret
+const MinAdminSecretLength = 16
+
 // Initialize loads secrets from environment variables
 func Initialize() {
 	secretKey = getSecretKey()
 	adminSecret = getAdminSecret()
+	hmacHash = getHMACHash()
+}
+
+// getHMACHash returns the hash function for token signatures from JWT_HMAC_ALG (defaults to SHA-256).
+// An unsupported algorithm is fatal.
+func getHMACHash() func() hash.Hash {
+	alg := os.Getenv("JWT_HMAC_ALG")
+	if alg == "" {
+		return sha256.New
+	}
+	h, err := HashForAlgorithm(alg)
+	if err != nil {
+		// Signing with another algorithm than the one configured would silently break
+		// token validation across instances, so refuse to start instead
+		log.Fatalf("❌ Invalid JWT_HMAC_ALG: %v", err)
+	}
+	return h
+}
+
+// HashForAlgorithm maps a JWT_HMAC_ALG value (sha256, sha384, sha512) to its hash function
+func HashForAlgorithm(alg string) (func() hash.Hash, error) {
+	switch strings.ToLower(strings.TrimSpace(alg)) {
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported HMAC algorithm %q", alg)
+	}
+}
+
+// SetHMACAlgorithmForTest allows tests to switch the token signing algorithm (test use only!)
+func SetHMACAlgorithmForTest(alg string) error {
+	h, err := HashForAlgorithm(alg)
+	if err != nil {
+		return err
+	}
+	hmacHash = h
+	return nil
 }
 
 // getSecretKey returns the secret key from environment variable or a default for development
@@ -57,52 +117,90 @@ func RequireAdminAuth(r *http.Request) bool {
 	if providedSecret == "" {
 		return false
 	}
+	adminSecretMu.RLock()
+	defer adminSecretMu.RUnlock()
 	return providedSecret == adminSecret
 }
 
+// RotateAdminSecret replaces the admin secret in memory. The change only applies to
+// this instance and is lost on restart, so ADMIN_SECRET must be updated as well.
+func RotateAdminSecret(newSecret string) error {
+	if len(newSecret) < MinAdminSecretLength {
+		return fmt.Errorf("admin secret must be at least %d characters", MinAdminSecretLength)
+	}
+	adminSecretMu.Lock()
+	defer adminSecretMu.Unlock()
+	adminSecret = newSecret
+	return nil
+}
+
 // SetAdminSecretForTest allows tests to override the admin secret (test use only!)
 func SetAdminSecretForTest(secret string) {
+	adminSecretMu.Lock()
+	defer adminSecretMu.Unlock()
 	adminSecret = secret
 }
 
 // GetAdminSecret returns the current admin secret (test use only!)
 func GetAdminSecret() string {
+	adminSecretMu.RLock()
+	defer adminSecretMu.RUnlock()
 	return adminSecret
 }
 
 // GenerateToken generates a JWT token for a specific run
 func GenerateToken(runID string) (string, time.Time, error) {
-	expiresAt := time.Now().Add(2 * time.Hour) // Token expires in 2 hours
-	
+	expiresAt := clock.Now().Add(2 * time.Hour) // Token expires in 2 hours
+	token, err := signToken(runID, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// GenerateTokenForTest signs a token with an arbitrary expiry, e.g. one already in the past (test use only!)
+func GenerateTokenForTest(runID string, expiresAt time.Time) (string, error) {
+	return signToken(runID, expiresAt)
+}
+
+// signToken encodes and signs the token data for runID
+func signToken(runID string, expiresAt time.Time) (string, error) {
 	tokenData := models.TokenData{
 		RunID:     runID,
 		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
+		CreatedAt: clock.Now(),
 	}
-	
+
 	// Encode token data as JSON
 	payload, err := json.Marshal(tokenData)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to marshal token data: %w", err)
+		return "", fmt.Errorf("failed to marshal token data: %w", err)
 	}
-	
+
 	// Create HMAC signature
-	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac := hmac.New(hmacHash, []byte(secretKey))
 	mac.Write(payload)
 	signature := mac.Sum(nil)
-	
+
 	// Combine payload and signature
-	token := base64.URLEncoding.EncodeToString(payload) + "." + hex.EncodeToString(signature)
-	
-	return token, expiresAt, nil
+	return base64.URLEncoding.EncodeToString(payload) + "." + hex.EncodeToString(signature), nil
 }
 
-// ValidateToken validates a JWT token for a specific run
+// ValidateToken validates a JWT token for a specific run.
+// Errors wrap ErrTokenExpired or ErrTokenInvalid so callers can pick a recovery path.
 func ValidateToken(token string, runID string) (bool, error) {
+	if _, err := ParseToken(token, runID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ParseToken validates a token for a specific run and returns its decoded data
+func ParseToken(token string, runID string) (*models.TokenData, error) {
 	// Split token into payload and signature
 	parts := strings.Split(token, ".")
 	if len(parts) != 2 {
-		return false, fmt.Errorf("invalid token format")
+		return nil, fmt.Errorf("%w: invalid token format", ErrTokenInvalid)
 	}
 	
 	payloadEncoded := parts[0]
@@ -111,40 +209,40 @@ func ValidateToken(token string, runID string) (bool, error) {
 	// Decode payload
 	payload, err := base64.URLEncoding.DecodeString(payloadEncoded)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode payload: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode payload: %w", ErrTokenInvalid, err)
 	}
 	
 	// Decode signature
 	signature, err := hex.DecodeString(signatureHex)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode signature: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode signature: %w", ErrTokenInvalid, err)
 	}
 	
 	// Verify signature
-	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac := hmac.New(hmacHash, []byte(secretKey))
 	mac.Write(payload)
 	expectedSignature := mac.Sum(nil)
 	
 	if !hmac.Equal(signature, expectedSignature) {
-		return false, fmt.Errorf("invalid signature")
+		return nil, fmt.Errorf("%w: invalid signature", ErrTokenInvalid)
 	}
 	
 	// Parse token data
 	var tokenData models.TokenData
 	if err := json.Unmarshal(payload, &tokenData); err != nil {
-		return false, fmt.Errorf("failed to unmarshal token data: %w", err)
+		return nil, fmt.Errorf("%w: failed to unmarshal token data: %w", ErrTokenInvalid, err)
 	}
 	
 	// Check if token has expired
-	if time.Now().After(tokenData.ExpiresAt) {
-		return false, fmt.Errorf("token has expired")
+	if clock.Now().After(tokenData.ExpiresAt) {
+		return nil, ErrTokenExpired
 	}
 	
 	// Check if token is for the correct run_id
 	if tokenData.RunID != runID {
-		return false, fmt.Errorf("token run_id mismatch")
+		return nil, fmt.Errorf("%w: token run_id mismatch", ErrTokenInvalid)
 	}
 	
-	return true, nil
+	return &tokenData, nil
 }
 
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+)
+
+func TestHMACAlgorithms_SignAndVerify(t *testing.T) {
+	defer SetHMACAlgorithmForTest("sha256")
+
+	for _, alg := range []string{"sha256", "sha384", "sha512"} {
+		t.Run(alg, func(t *testing.T) {
+			if err := SetHMACAlgorithmForTest(alg); err != nil {
+				t.Fatalf("Failed to set algorithm: %v", err)
+			}
+
+			token, _, err := GenerateToken("run-" + alg)
+			if err != nil {
+				t.Fatalf("GenerateToken failed: %v", err)
+			}
+
+			valid, err := ValidateToken(token, "run-"+alg)
+			if err != nil || !valid {
+				t.Fatalf("Token signed with %s should validate with %s: %v", alg, alg, err)
+			}
+		})
+	}
+}
+
+func TestHMACAlgorithms_CrossAlgorithmRejected(t *testing.T) {
+	defer SetHMACAlgorithmForTest("sha256")
+
+	algs := []string{"sha256", "sha384", "sha512"}
+	for _, signAlg := range algs {
+		for _, verifyAlg := range algs {
+			if signAlg == verifyAlg {
+				continue
+			}
+
+			SetHMACAlgorithmForTest(signAlg)
+			token, _, err := GenerateToken("cross-run")
+			if err != nil {
+				t.Fatalf("GenerateToken failed: %v", err)
+			}
+
+			SetHMACAlgorithmForTest(verifyAlg)
+			valid, err := ValidateToken(token, "cross-run")
+			if err == nil || valid {
+				t.Errorf("Token signed with %s should not validate with %s", signAlg, verifyAlg)
+			}
+		}
+	}
+}
+
+func TestHashForAlgorithm_Unsupported(t *testing.T) {
+	if _, err := HashForAlgorithm("md5"); err == nil {
+		t.Error("Expected error for unsupported algorithm")
+	}
+	if _, err := HashForAlgorithm("SHA384"); err != nil {
+		t.Errorf("Algorithm names should be case-insensitive: %v", err)
+	}
+}
+
+func TestGetHMACHash_DefaultsToSHA256(t *testing.T) {
+	t.Setenv("JWT_HMAC_ALG", "")
+	if size := getHMACHash()().Size(); size != 32 {
+		t.Errorf("Expected SHA-256 (32 byte) digest by default, got %d bytes", size)
+	}
+
+	t.Setenv("JWT_HMAC_ALG", "sha384")
+	if size := getHMACHash()().Size(); size != 48 {
+		t.Errorf("Expected SHA-384 (48 byte) digest, got %d bytes", size)
+	}
+}
+
+func TestValidateToken_DistinguishesExpiredFromInvalid(t *testing.T) {
+	expired, err := GenerateTokenForTest("run-1", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("GenerateTokenForTest failed: %v", err)
+	}
+	if _, err := ValidateToken(expired, "run-1"); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	valid, _, err := GenerateToken("run-1")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	invalidCases := map[string]string{
+		"malformed":     "not-a-token",
+		"bad payload":   "!!!." + strings.Split(valid, ".")[1],
+		"bad signature": strings.Split(valid, ".")[0] + ".deadbeef",
+	}
+	for name, token := range invalidCases {
+		if _, err := ValidateToken(token, "run-1"); !errors.Is(err, ErrTokenInvalid) || errors.Is(err, ErrTokenExpired) {
+			t.Errorf("%s: expected ErrTokenInvalid, got %v", name, err)
+		}
+	}
+
+	if _, err := ValidateToken(valid, "other-run"); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("run_id mismatch: expected ErrTokenInvalid, got %v", err)
+	}
+}
+
+func TestValidateToken_ExpiryBoundary(t *testing.T) {
+	defer func() { clock.Now = time.Now }()
+	issued := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock.Now = func() time.Time { return issued }
+
+	token, expiresAt, err := GenerateToken("run-clock")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	if !expiresAt.Equal(issued.Add(2 * time.Hour)) {
+		t.Fatalf("Expected expiry 2h after issue, got %v", expiresAt)
+	}
+
+	clock.Now = func() time.Time { return expiresAt }
+	if _, err := ValidateToken(token, "run-clock"); err != nil {
+		t.Errorf("Expected the token valid at its expiry instant, got %v", err)
+	}
+	clock.Now = func() time.Time { return expiresAt.Add(time.Nanosecond) }
+	if _, err := ValidateToken(token, "run-clock"); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired just past expiry, got %v", err)
+	}
+}
@@ -1,13 +1,18 @@
 package cleanup
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
 	"github.com/cdsap/build-process-watcher/backend/internal/storage"
 )
 
@@ -18,16 +23,81 @@ const (
 	DataRetentionPeriod = 3 * time.Hour
 )
 
+// StaleAction is what the stale sweep does with a run past BuildTimeout
+type StaleAction int
+
+const (
+	// StaleActionWait leaves a suspected run alone until its grace period ends
+	StaleActionWait StaleAction = iota
+	// StaleActionSuspect marks the run as suspected stale
+	StaleActionSuspect
+	// StaleActionFinish marks the run as finished
+	StaleActionFinish
+	// StaleActionDelete deletes a run that never stored samples instead of finishing it
+	StaleActionDelete
+)
+
 // Service handles cleanup operations
 type Service struct {
-	storage *storage.Client
+	storage         *storage.Client
+	gracePeriod     time.Duration // Extra quiet time after suspicion before finishing, 0 finishes immediately
+	deleteEmptyRuns bool          // Delete stale runs without samples instead of finishing them
 }
 
 // NewService creates a new cleanup service
 func NewService(storageClient *storage.Client) *Service {
 	return &Service{
-		storage: storageClient,
+		storage:         storageClient,
+		gracePeriod:     getGracePeriod(),
+		deleteEmptyRuns: getEnvBool("STALE_DELETE_EMPTY_RUNS"),
+	}
+}
+
+// getEnvBool reports whether the environment variable is set to a true value
+func getEnvBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+// getGracePeriod returns the stale grace period from STALE_GRACE_PERIOD (e.g. "10m")
+func getGracePeriod() time.Duration {
+	value := os.Getenv("STALE_GRACE_PERIOD")
+	if value == "" {
+		return 0
+	}
+	grace, err := time.ParseDuration(value)
+	if err != nil || grace < 0 {
+		log.Printf("⚠️  WARNING: invalid STALE_GRACE_PERIOD %q, finishing stale runs immediately", value)
+		return 0
+	}
+	return grace
+}
+
+// DecideStaleAction applies two-stage stale handling to a run already past the timeout:
+// it is first suspected, then finished once it stays quiet for the grace period.
+// A suspicion recorded before the run's last update is outdated, so the run starts over.
+func DecideStaleAction(runDoc *models.RunDoc, now time.Time, gracePeriod time.Duration) StaleAction {
+	if gracePeriod <= 0 {
+		return StaleActionFinish
+	}
+	if runDoc.SuspectedStaleAt.IsZero() || runDoc.SuspectedStaleAt.Before(runDoc.UpdatedAt) {
+		return StaleActionSuspect
+	}
+	if now.Sub(runDoc.SuspectedStaleAt) >= gracePeriod {
+		return StaleActionFinish
 	}
+	return StaleActionWait
+}
+
+// staleAction decides what the sweep does with a stale run. With STALE_DELETE_EMPTY_RUNS
+// a run that would be finished but never stored a sample is deleted instead, so runs
+// that only authed do not clutter listings; runs with data are always kept.
+func (s *Service) staleAction(runDoc *models.RunDoc, now time.Time) StaleAction {
+	action := DecideStaleAction(runDoc, now, s.gracePeriod)
+	if action == StaleActionFinish && s.deleteEmptyRuns && storage.IsEmptyRun(runDoc) && !runDoc.RetainForever {
+		return StaleActionDelete
+	}
+	return action
 }
 
 // HandleManualStaleCleanup handles manual cleanup of stale runs (admin only)
@@ -70,31 +140,122 @@ func (s *Service) HandleManualStaleCleanup(w http.ResponseWriter, r *http.Reques
 
 	log.Printf("🧹 Found %d stale runs", len(staleRuns))
 
-	// Mark stale runs as finished
-	var cleanedRuns []string
-	for _, runID := range staleRuns {
-		err := s.storage.MarkRunAsFinished(runID)
-		if err != nil {
-			log.Printf("❌ Error cleaning up stale run %s: %v", runID, err)
-		} else {
-			log.Printf("✅ Successfully marked stale run %s as finished", runID)
-			cleanedRuns = append(cleanedRuns, runID)
+	// Suspect, finish or delete stale runs depending on the grace period and their samples
+	var cleanedRuns, suspectedRuns, deletedRuns []string
+	now := clock.Now()
+	for i := range staleRuns {
+		runID := staleRuns[i].RunID
+		switch s.staleAction(&staleRuns[i], now) {
+		case StaleActionSuspect:
+			if err := s.storage.MarkRunSuspectedStale(r.Context(), runID); err != nil {
+				log.Printf("❌ Error marking run %s as suspected stale: %v", runID, err)
+			} else {
+				log.Printf("⏳ Marked run %s as suspected stale, finishing after %v without activity", runID, s.gracePeriod)
+				suspectedRuns = append(suspectedRuns, runID)
+			}
+		case StaleActionFinish:
+			if err := s.storage.MarkRunAsFinished(storage.WithFinishStatus(r.Context(), storage.FinishStatusStale), runID); err != nil {
+				log.Printf("❌ Error cleaning up stale run %s: %v", runID, err)
+			} else {
+				log.Printf("✅ Successfully marked stale run %s as finished", runID)
+				cleanedRuns = append(cleanedRuns, runID)
+			}
+		case StaleActionDelete:
+			if err := s.storage.DeleteStaleRun(r.Context(), runID, BuildTimeout); errors.Is(err, storage.ErrRunChanged) {
+				log.Printf("↩️ Kept run %s, it stored samples or was updated since the sweep found it", runID)
+			} else if err != nil {
+				log.Printf("❌ Error deleting empty stale run %s: %v", runID, err)
+			} else {
+				log.Printf("🗑️ Deleted stale run %s, it never stored samples", runID)
+				deletedRuns = append(deletedRuns, runID)
+			}
 		}
 	}
 
 	response := map[string]interface{}{
-		"success":       true,
-		"total_checked": len(staleRuns),
-		"stale_found":   len(staleRuns),
-		"cleaned_up":    len(cleanedRuns),
-		"cleaned_runs":  cleanedRuns,
+		"success":        true,
+		"total_checked":  len(staleRuns),
+		"stale_found":    len(staleRuns),
+		"cleaned_up":     len(cleanedRuns),
+		"cleaned_runs":   cleanedRuns,
+		"suspected":      len(suspectedRuns),
+		"suspected_runs": suspectedRuns,
+		"deleted":        len(deletedRuns),
+		"deleted_runs":   deletedRuns,
 	}
 
 	if len(staleRuns) > 0 {
-		log.Printf("🧹 Manual cleanup completed: cleaned up %d stale runs", len(cleanedRuns))
+		log.Printf("🧹 Manual cleanup completed: cleaned up %d stale runs, deleted %d empty runs", len(cleanedRuns), len(deletedRuns))
 	} else {
 		log.Printf("🧹 Manual cleanup completed: no stale runs found")
 	}
 
-	json.NewEncoder(w).Encode(response)
+	httpjson.NewEncoder(w, r).Encode(response)
+}
+
+// ParseOlderThan validates the required ?older_than= duration of the finished-runs purge
+func ParseOlderThan(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("older_than is required (e.g. ?older_than=1h)")
+	}
+	olderThan, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid older_than %q: %v", value, err)
+	}
+	if olderThan <= 0 {
+		return 0, fmt.Errorf("older_than must be positive, got %q", value)
+	}
+	return olderThan, nil
+}
+
+// HandleFinishedCleanup handles POST /admin/cleanup/finished?older_than=1h (admin only).
+// It immediately deletes finished runs older than the given duration, independently of
+// retention. Runs flagged retain_forever are kept.
+func (s *Service) HandleFinishedCleanup(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Require admin authentication
+	if !auth.RequireAdminAuth(r) {
+		log.Printf("⚠️  Unauthorized finished-runs purge attempt from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized - admin secret required", http.StatusUnauthorized)
+		return
+	}
+
+	olderThan, err := ParseOlderThan(r.URL.Query().Get("older_than"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("🧹 Purge of finished runs older than %v triggered by %s", olderThan, r.RemoteAddr)
+
+	deletedRuns, err := s.storage.DeleteFinishedRuns(r.Context(), olderThan)
+	if err != nil {
+		log.Printf("❌ Error purging finished runs: %v", err)
+		http.Error(w, fmt.Sprintf("Error purging finished runs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🧹 Purge completed: deleted %d finished runs", len(deletedRuns))
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"success":      true,
+		"older_than":   olderThan.String(),
+		"deleted":      len(deletedRuns),
+		"deleted_runs": deletedRuns,
+	})
 }
@@ -0,0 +1,119 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestDecideStaleAction_NoGracePeriodFinishesImmediately(t *testing.T) {
+	now := time.Now()
+	run := models.RunDoc{UpdatedAt: now.Add(-10 * time.Minute)}
+
+	if action := DecideStaleAction(&run, now, 0); action != StaleActionFinish {
+		t.Errorf("Expected finish without grace period, got %v", action)
+	}
+}
+
+func TestDecideStaleAction_SuspectedToFinished(t *testing.T) {
+	grace := 10 * time.Minute
+	lastUpdate := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	run := models.RunDoc{UpdatedAt: lastUpdate}
+
+	// First sweep past the timeout: suspect
+	firstSweep := lastUpdate.Add(BuildTimeout + time.Second)
+	if action := DecideStaleAction(&run, firstSweep, grace); action != StaleActionSuspect {
+		t.Fatalf("Expected suspect on first sweep, got %v", action)
+	}
+	run.SuspectedStaleAt = firstSweep
+
+	// Within the grace period: wait
+	if action := DecideStaleAction(&run, firstSweep.Add(5*time.Minute), grace); action != StaleActionWait {
+		t.Fatalf("Expected wait within grace period, got %v", action)
+	}
+
+	// Still quiet after the grace period: finish
+	if action := DecideStaleAction(&run, firstSweep.Add(grace), grace); action != StaleActionFinish {
+		t.Fatalf("Expected finish after grace period, got %v", action)
+	}
+}
+
+func TestDecideStaleAction_SuspectedToRecovered(t *testing.T) {
+	grace := 10 * time.Minute
+	suspectedAt := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+
+	// The run ingested after being suspected, then went quiet again: the old
+	// suspicion no longer counts and the run must be suspected afresh
+	run := models.RunDoc{
+		SuspectedStaleAt: suspectedAt,
+		UpdatedAt:        suspectedAt.Add(2 * time.Minute),
+	}
+	later := suspectedAt.Add(grace + BuildTimeout)
+	if action := DecideStaleAction(&run, later, grace); action != StaleActionSuspect {
+		t.Errorf("Expected recovered run to be suspected again rather than finished, got %v", action)
+	}
+
+	// An ingest clears the flag entirely
+	run.SuspectedStaleAt = time.Time{}
+	if action := DecideStaleAction(&run, later, grace); action != StaleActionSuspect {
+		t.Errorf("Expected cleared run to restart at suspect, got %v", action)
+	}
+}
+
+func TestStaleAction_EmptyRun(t *testing.T) {
+	now := time.Now()
+	empty := models.RunDoc{UpdatedAt: now.Add(-10 * time.Minute)}
+	withData := models.RunDoc{UpdatedAt: now.Add(-10 * time.Minute), SampleCount: 3, Samples: make([]models.Sample, 3)}
+
+	deleting := &Service{deleteEmptyRuns: true}
+	if action := deleting.staleAction(&empty, now); action != StaleActionDelete {
+		t.Errorf("Expected the empty run deleted when enabled, got %v", action)
+	}
+	if action := deleting.staleAction(&withData, now); action != StaleActionFinish {
+		t.Errorf("Expected a run with samples finished, got %v", action)
+	}
+
+	finishing := &Service{}
+	if action := finishing.staleAction(&empty, now); action != StaleActionFinish {
+		t.Errorf("Expected the empty run finished when disabled, got %v", action)
+	}
+
+	// The grace period still applies before an empty run is deleted
+	grace := &Service{deleteEmptyRuns: true, gracePeriod: 10 * time.Minute}
+	if action := grace.staleAction(&empty, now); action != StaleActionSuspect {
+		t.Errorf("Expected the empty run suspected first, got %v", action)
+	}
+}
+
+func TestGetGracePeriod(t *testing.T) {
+	t.Setenv("STALE_GRACE_PERIOD", "15m")
+	if grace := getGracePeriod(); grace != 15*time.Minute {
+		t.Errorf("Expected 15m, got %v", grace)
+	}
+
+	t.Setenv("STALE_GRACE_PERIOD", "bogus")
+	if grace := getGracePeriod(); grace != 0 {
+		t.Errorf("Expected invalid value to disable the grace period, got %v", grace)
+	}
+}
+
+func TestParseOlderThan_RequiresPositiveDuration(t *testing.T) {
+	if olderThan, err := ParseOlderThan("1h"); err != nil || olderThan != time.Hour {
+		t.Errorf("Expected 1h, got %v (%v)", olderThan, err)
+	}
+	for _, value := range []string{"", "soon", "0s", "-1h"} {
+		if _, err := ParseOlderThan(value); err == nil {
+			t.Errorf("Expected error for older_than %q", value)
+		}
+	}
+}
+
+func TestNewService_DeleteEmptyRunsFlag(t *testing.T) {
+	for value, want := range map[string]bool{"": false, "true": true, "1": true, "TRUE": true, "false": false, "yes": false} {
+		t.Setenv("STALE_DELETE_EMPTY_RUNS", value)
+		if got := NewService(nil).deleteEmptyRuns; got != want {
+			t.Errorf("STALE_DELETE_EMPTY_RUNS=%q: expected %v, got %v", value, want, got)
+		}
+	}
+}
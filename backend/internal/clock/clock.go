@@ -0,0 +1,9 @@
+// Package clock holds the time source shared by token expiry, ingest timestamps and the
+// stale and retention cutoffs, so tests can move all of them with one fixed clock.
+package clock
+
+import "time"
+
+// Now returns the current time. Tests replace it with a fixed clock and restore
+// time.Now when done.
+var Now = time.Now
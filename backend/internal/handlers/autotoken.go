@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// Response headers carrying a token issued by the first ingest of a run
+const (
+	AutoTokenHeader          = "X-Run-Token"
+	AutoTokenExpiresAtHeader = "X-Run-Token-Expires-At"
+)
+
+// autoTokenConfig lets agents on trusted networks skip /auth/run: the first ingest of a
+// new run ID is accepted without a token and the response carries one for the next ingests
+type autoTokenConfig struct {
+	enabled bool
+	trusted []*net.IPNet
+}
+
+// getAutoTokenConfig reads AUTO_ISSUE_TOKENS and AUTO_ISSUE_TRUSTED_CIDRS, a comma-separated
+// list such as "10.0.0.0/8,192.168.1.0/24". Tokens are only issued with both set.
+func getAutoTokenConfig() autoTokenConfig {
+	if !getEnvBool("AUTO_ISSUE_TOKENS") {
+		return autoTokenConfig{}
+	}
+	config := autoTokenConfig{enabled: true}
+	for _, value := range strings.Split(os.Getenv("AUTO_ISSUE_TRUSTED_CIDRS"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Printf("⚠️  WARNING: invalid AUTO_ISSUE_TRUSTED_CIDRS entry %q, ignoring it", value)
+			continue
+		}
+		config.trusted = append(config.trusted, network)
+	}
+	if len(config.trusted) == 0 {
+		log.Printf("⚠️  WARNING: AUTO_ISSUE_TOKENS is set without AUTO_ISSUE_TRUSTED_CIDRS, no token will be issued on ingest")
+	}
+	return config
+}
+
+// isTrusted reports whether the request's remote address is in a trusted network
+func (c autoTokenConfig) isTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeFirstIngest authorizes an ingest like authorizeIngest, except that a request
+// without an Authorization header from a trusted network may claim a run ID that does not
+// exist yet. The run is created atomically, so of concurrent tokenless ingests only one
+// claims it and the others need a token. The ingest must respond through the returned
+// writer, which adds the run's token to the headers only when it answers 200, i.e. once
+// its samples are stored. A claimed run whose first ingest fails stays claimed; its agent
+// then gets a token from /auth/run.
+func (h *Handlers) authorizeFirstIngest(w http.ResponseWriter, r *http.Request, runID string) (http.ResponseWriter, bool) {
+	if !h.autoToken.enabled || runID == "" || r.Header.Get("Authorization") != "" || !h.autoToken.isTrusted(r) {
+		return w, h.authorizeIngest(w, r, runID)
+	}
+	if h.runIDAge.tooOld(runID, clock.Now()) || !h.claimRun(r, runID) {
+		return w, h.authorizeIngest(w, r, runID)
+	}
+	return &tokenIssuingWriter{ResponseWriter: w, runID: runID, remoteAddr: r.RemoteAddr}, true
+}
+
+// claimRun creates runID and reports whether this request created it. Storage errors are
+// logged and treated as the run existing, so a token is never issued for a run that may exist.
+func (h *Handlers) claimRun(r *http.Request, runID string) bool {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	err := h.storage.CreateRun(ctx, runID)
+	if err != nil && !errors.Is(err, storage.ErrRunExists) {
+		log.Printf("Warning: Failed to create run %s for a tokenless ingest: %v", runID, err)
+	}
+	return err == nil
+}
+
+// tokenIssuingWriter adds the token of a run claimed by its first ingest to a successful
+// response. The token is minted when the status is written, after the ingest stored its
+// samples, so failed ingests never hand one out.
+type tokenIssuingWriter struct {
+	http.ResponseWriter
+	runID       string
+	remoteAddr  string
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (tw *tokenIssuingWriter) WriteHeader(code int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		if code == http.StatusOK {
+			tw.issueToken()
+		}
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter
+func (tw *tokenIssuingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *tokenIssuingWriter) issueToken() {
+	token, expiresAt, err := auth.GenerateToken(tw.runID)
+	if err != nil {
+		log.Printf("Failed to generate token for run_id %s: %v", tw.runID, err)
+		return
+	}
+	tw.Header().Set(AutoTokenHeader, token)
+	tw.Header().Set(AutoTokenExpiresAtHeader, expiresAt.Format(time.RFC3339))
+
+	log.Printf("🔐 Issued token on first ingest for run_id %s from %s", tw.runID, tw.remoteAddr)
+}
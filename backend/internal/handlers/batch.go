@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// MaxBatchOperations bounds the number of operations accepted by POST /batch
+const MaxBatchOperations = 100
+
+// opRecorder captures the response of a single batch operation
+type opRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newOpRecorder() *opRecorder {
+	return &opRecorder{header: make(http.Header)}
+}
+
+func (o *opRecorder) Header() http.Header { return o.header }
+
+func (o *opRecorder) Write(b []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	return o.body.Write(b)
+}
+
+func (o *opRecorder) WriteHeader(status int) {
+	if o.status == 0 {
+		o.status = status
+	}
+}
+
+// result converts the captured response into a BatchResult
+func (o *opRecorder) result(index int, op string) models.BatchResult {
+	result := models.BatchResult{Index: index, Op: op, Status: o.status}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	// Headers of an operation are not sent, so its Retry-After travels in the result
+	if retryAfter, err := strconv.Atoi(o.header.Get("Retry-After")); err == nil {
+		result.RetryAfter = retryAfter
+	}
+	body := bytes.TrimSpace(o.body.Bytes())
+	if result.Status < http.StatusBadRequest && json.Valid(body) {
+		result.Result = json.RawMessage(body)
+	} else {
+		result.Error = string(body)
+	}
+	return result
+}
+
+// Batch handles POST /batch, running ingest and finish operations for one run in order
+// with a single token check. The body is bounded by the same limit as /ingest. Execution stops at the first failed operation; the
+// remaining ones are reported as skipped with 424 Failed Dependency. An operation's
+// headers are not sent: a Retry-After it set, e.g. by the ingest rate limit, is reported
+// as the result's retry_after and as the Retry-After of the batch response.
+func (h *Handlers) Batch(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CI-Provider, X-Data-Format")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxIngestBodyBytes)).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.authorizeIngest(w, r, req.RunID) {
+		return
+	}
+
+	if req.RunID == "" {
+		http.Error(w, "Missing run_id", http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > MaxBatchOperations {
+		http.Error(w, fmt.Sprintf("Expected 1 to %d operations", MaxBatchOperations), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	results := make([]models.BatchResult, 0, len(req.Operations))
+	failed := -1
+	for i, op := range req.Operations {
+		if failed >= 0 {
+			results = append(results, models.BatchResult{
+				Index:  i,
+				Op:     op.Op,
+				Status: http.StatusFailedDependency,
+				Error:  fmt.Sprintf("skipped after operation %d failed", failed),
+			})
+			continue
+		}
+
+		recorder := newOpRecorder()
+		switch strings.ToLower(op.Op) {
+		case "ingest":
+			if h.allowIngestWrite(recorder, req.RunID) {
+				h.ingestAuthorized(ctx, recorder, r, models.IngestRequest{
+					RunID:       req.RunID,
+					Data:        op.Data,
+					ProcessInfo: op.ProcessInfo,
+					Provider:    op.Provider,
+					Machine:     op.Machine,
+				})
+			}
+		case "finish":
+			h.finishAuthorized(ctx, recorder, r, req.RunID)
+		default:
+			http.Error(recorder, fmt.Sprintf("Unknown operation %q, expected ingest or finish", op.Op), http.StatusBadRequest)
+		}
+
+		result := recorder.result(i, op.Op)
+		if result.Status >= http.StatusBadRequest {
+			failed = i
+			if result.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(result.RetryAfter))
+			}
+			log.Printf("⚠️  Batch operation %d (%s) for run %s failed with %d", i, op.Op, req.RunID, result.Status)
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(models.BatchResponse{RunID: req.RunID, Results: results})
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// csvColumns maps CSV export column names to sample field formatters, in default order
+var csvColumns = []struct {
+	name   string
+	format func(models.Sample) string
+}{
+	{"timestamp", func(s models.Sample) string { return strconv.FormatInt(s.Timestamp, 10) }},
+	{"elapsed_time", func(s models.Sample) string { return strconv.Itoa(s.ElapsedTime) }},
+	{"pid", func(s models.Sample) string { return s.PID }},
+	{"name", func(s models.Sample) string { return s.Name }},
+	{"heap_used", func(s models.Sample) string { return strconv.Itoa(s.HeapUsed) }},
+	{"heap_cap", func(s models.Sample) string { return strconv.Itoa(s.HeapCap) }},
+	{"rss", func(s models.Sample) string { return strconv.Itoa(s.RSS) }},
+	{"gc_time", func(s models.Sample) string { return strconv.Itoa(s.GCTime) }},
+}
+
+// parseCSVColumns resolves ?columns=a,b,c into column indexes, defaulting to all columns
+func parseCSVColumns(param string) ([]int, error) {
+	if strings.TrimSpace(param) == "" {
+		indexes := make([]int, len(csvColumns))
+		for i := range csvColumns {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+
+	var indexes []int
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		found := -1
+		for i, column := range csvColumns {
+			if column.name == name {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		indexes = append(indexes, found)
+	}
+	return indexes, nil
+}
+
+// csvCommentReplacer keeps metadata values on their own comment line
+var csvCommentReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// writeCSVMeta writes the run's context as "#" comment lines ahead of the CSV header,
+// labels sorted by key
+func writeCSVMeta(w io.Writer, runID string, runDoc *models.RunDoc) {
+	fmt.Fprintf(w, "# run_id: %s\n", csvCommentReplacer.Replace(runID))
+	fmt.Fprintf(w, "# start_time: %s\n", runDoc.StartTime.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "# finished: %t\n", runDoc.Finished)
+	keys := make([]string, 0, len(runDoc.Tags))
+	for key := range runDoc.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "# label: %s=%s\n", csvCommentReplacer.Replace(key), csvCommentReplacer.Replace(runDoc.Tags[key]))
+	}
+}
+
+// exportCSV writes a run's samples as CSV, limited to the requested ?columns= in that order.
+// ?include_meta=true prefixes the CSV with comment lines describing the run.
+func (h *Handlers) exportCSV(w http.ResponseWriter, r *http.Request, runID string) {
+	columns, err := parseCSVColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var includeMeta bool
+	if param := r.URL.Query().Get("include_meta"); param != "" {
+		if includeMeta, err = strconv.ParseBool(param); err != nil {
+			http.Error(w, "Invalid include_meta, expected true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", runID+".csv"))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if includeMeta {
+		writeCSVMeta(w, runID, runDoc)
+	}
+	writer := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, index := range columns {
+		header[i] = csvColumns[index].name
+	}
+	writer.Write(header)
+
+	record := make([]string, len(columns))
+	for _, sample := range runDoc.Samples {
+		for i, index := range columns {
+			record[i] = csvColumns[index].format(sample)
+		}
+		writer.Write(record)
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing CSV export for run %s: %v", runID, err)
+	}
+}
+
+// NDJSONFlushEvery is how many samples the NDJSON export writes between flushes
+const NDJSONFlushEvery = 500
+
+// exportNDJSON streams a run's samples one JSON object per line, using the same keys
+// as GetRun, flushing periodically so consumers can process the run incrementally. Samples
+// are written as they are read from storage rather than after loading the whole run.
+func (h *Handlers) exportNDJSON(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	// Headers go out with the first sample, so a missing run can still get a 404
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			started = true
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+	err := h.storage.EachSample(ctx, runID, func(sample models.Sample) error {
+		start()
+		if err := encoder.Encode(sample); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%NDJSONFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if started {
+			log.Printf("Error writing NDJSON export for run %s: %v", runID, err)
+			return
+		}
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	start()
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// anonymizeSamples keeps only the numeric time series of samples. Each process (see
+// ProcessKey) becomes "process-N", numbered by first appearance, so the same process maps
+// to the same alias throughout an export without revealing its PID, name or machine.
+func anonymizeSamples(samples []models.Sample) models.AnonymizedRun {
+	aliases := make(map[string]string)
+	anonymized := make([]models.AnonymizedSample, 0, len(samples))
+	for _, sample := range samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		alias, ok := aliases[key]
+		if !ok {
+			alias = fmt.Sprintf("process-%d", len(aliases)+1)
+			aliases[key] = alias
+		}
+		anonymized = append(anonymized, models.AnonymizedSample{
+			Process:     alias,
+			ElapsedTime: sample.ElapsedTime,
+			HeapUsed:    sample.HeapUsed,
+			HeapCap:     sample.HeapCap,
+			RSS:         sample.RSS,
+			GCTime:      sample.GCTime,
+		})
+	}
+	return models.AnonymizedRun{Processes: len(aliases), Samples: anonymized}
+}
+
+// exportAnonymized returns a run's samples with identifying fields removed, for sharing a
+// run's shape outside the team. Labels, provider and other run metadata are left out.
+func (h *Handlers) exportAnonymized(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(anonymizeSamples(runDoc.Samples))
+}
+
+// prometheusLabelReplacer escapes label values for the Prometheus text exposition format
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// runPrometheusMetrics derives a run's summary metrics: the highest heap used, the run's
+// duration (to FinishedAt once finished, else to its last sample) and the total GC time,
+// summing each process's cumulative GC time
+func runPrometheusMetrics(runDoc *models.RunDoc) (peakHeapBytes float64, durationSeconds float64, gcSeconds float64) {
+	peak, _ := heapSummary(runDoc.Samples)
+	peakHeapBytes = float64(peak) * 1024 * 1024
+
+	gcMillis := make(map[string]int)
+	var lastElapsed int
+	for _, sample := range runDoc.Samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if sample.GCTime > gcMillis[key] {
+			gcMillis[key] = sample.GCTime
+		}
+		if sample.ElapsedTime > lastElapsed {
+			lastElapsed = sample.ElapsedTime
+		}
+	}
+	for _, millis := range gcMillis {
+		gcSeconds += float64(millis) / 1000
+	}
+
+	durationSeconds = float64(lastElapsed)
+	if runDoc.Finished && !runDoc.StartTime.IsZero() && runDoc.FinishedAt.After(runDoc.StartTime) {
+		durationSeconds = runDoc.FinishedAt.Sub(runDoc.StartTime).Seconds()
+	}
+	return peakHeapBytes, durationSeconds, gcSeconds
+}
+
+// exportPrometheus writes a run's summary stats in the Prometheus text exposition format,
+// labelled with the run ID, for CI jobs that drop them into a node_exporter textfile
+func (h *Handlers) exportPrometheus(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	peakHeapBytes, durationSeconds, gcSeconds := runPrometheusMetrics(runDoc)
+	label := fmt.Sprintf(`{run_id="%s"}`, prometheusLabelReplacer.Replace(runID))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"build_watcher_build_peak_heap_used_bytes", "Highest heap used by any process of the run.", peakHeapBytes},
+		{"build_watcher_build_duration_seconds", "Duration of the run, up to its last sample while unfinished.", durationSeconds},
+		{"build_watcher_build_gc_time_seconds", "Total GC time of the run's processes.", gcSeconds},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", metric.name)
+		fmt.Fprintf(w, "%s%s %s\n", metric.name, label, strconv.FormatFloat(metric.value, 'g', -1, 64))
+	}
+}
@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStore is an in-memory Store used by handler tests
+type fakeStore struct {
+	mu         sync.Mutex
+	runs       map[string]*models.RunDoc
+	processes  map[string]*models.ProcessDoc
+	getRunErr  error            // Returned by GetRun when set, to simulate storage failures
+	statusErrs map[string]error // Per-run errors returned by GetRunStatuses
+	// staleResumeWindow mirrors the storage client's STALE_RESUME_WINDOW
+	staleResumeWindow time.Duration
+	finishRace        storage.FinishRacePolicy // Mirrors FINISH_RACE_POLICY and FINISH_GRACE_WINDOW
+	// endTimeLimit mirrors the storage client's REJECT_AFTER_END_TIME and END_TIME_SLACK
+	endTimeLimit storage.EndTimeLimit
+	maxProcesses int // Mirrors MAX_PROCESSES_PER_RUN
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		runs:      make(map[string]*models.RunDoc),
+		processes: make(map[string]*models.ProcessDoc),
+	}
+}
+
+func (f *fakeStore) GetRun(ctx context.Context, runID string) (*models.RunDoc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.getRunErr != nil {
+		return nil, f.getRunErr
+	}
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	copied := *runDoc
+	copied.Samples = append([]models.Sample(nil), runDoc.Samples...)
+	return &copied, nil
+}
+
+// GetRunHeap ignores getRunErr, so tests can tell it apart from a full GetRun
+func (f *fakeStore) GetRunHeap(ctx context.Context, runID string) (*models.RunDoc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	return &models.RunDoc{RunID: runID, PeakHeapUsedMB: runDoc.PeakHeapUsedMB, LatestHeap: runDoc.LatestHeap}, nil
+}
+
+// GetRunMeta ignores getRunErr, so tests can tell it apart from a full GetRun
+func (f *fakeStore) GetRunMeta(ctx context.Context, runID string) (*models.RunDoc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	return &models.RunDoc{RunID: runID, StartTime: runDoc.StartTime, Provider: runDoc.Provider}, nil
+}
+
+// GetRunSince ignores getRunErr, so tests can tell it apart from a full GetRun
+func (f *fakeStore) GetRunSince(ctx context.Context, runID string, sinceTS int64) (*models.RunDoc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	copied := *runDoc
+	copied.Samples = nil
+	for _, sample := range runDoc.Samples {
+		if sample.Timestamp > sinceTS {
+			copied.Samples = append(copied.Samples, sample)
+		}
+	}
+	return &copied, nil
+}
+
+func (f *fakeStore) StoreSamples(ctx context.Context, runID string, samples []models.Sample) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		runDoc = &models.RunDoc{ID: runID, RunID: runID, StartTime: now, CreatedAt: now}
+		f.runs[runID] = runDoc
+	}
+	if runDoc.Archived {
+		return storage.ErrRunArchived
+	}
+	if runDoc.Paused {
+		return storage.ErrRunPaused
+	}
+	if _, err := storage.ResumeForIngest(runDoc, now, f.staleResumeWindow, f.finishRace); err != nil {
+		return err
+	}
+	if processDoc, ok := f.processes[runID]; ok {
+		samples = storage.ApplyStartOffsets(samples, storage.StartOffsets(processDoc.ProcessInfo))
+	}
+	if err := f.endTimeLimit.Check(samples, runDoc.EndTime); err != nil {
+		return err
+	}
+	runDoc.Samples = append(runDoc.Samples, samples...)
+	runDoc.PeakHeapUsedMB = storage.PeakHeapUsed(runDoc.PeakHeapUsedMB, samples)
+	runDoc.LatestHeap = storage.LatestHeap(runDoc.LatestHeap, samples)
+	runDoc.UpdatedAt = now
+	return nil
+}
+
+func (f *fakeStore) CreateRun(ctx context.Context, runID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.runs[runID]; ok {
+		return storage.ErrRunExists
+	}
+	now := time.Now()
+	f.runs[runID] = &models.RunDoc{ID: runID, RunID: runID, StartTime: now, CreatedAt: now}
+	return nil
+}
+
+func (f *fakeStore) StoreProcessInfo(ctx context.Context, runID string, processInfo models.ProcessInfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if runDoc, ok := f.runs[runID]; ok && runDoc.Archived {
+		return storage.ErrRunArchived
+	}
+
+	processDoc, ok := f.processes[runID]
+	if !ok {
+		processDoc = &models.ProcessDoc{RunID: runID, ProcessInfo: make(map[string]models.ProcessInfo)}
+		f.processes[runID] = processDoc
+	}
+	processInfo.LastSeen = time.Now()
+	processDoc.ProcessInfo[models.ProcessKey(processInfo.Machine, processInfo.PID)] = processInfo
+	storage.EvictProcesses(processDoc.ProcessInfo, f.maxProcesses)
+	return nil
+}
+
+func (f *fakeStore) GetProcesses(ctx context.Context, runID string) (*models.ProcessDoc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	processDoc, ok := f.processes[runID]
+	if !ok {
+		return &models.ProcessDoc{RunID: runID, ProcessInfo: make(map[string]models.ProcessInfo)}, nil
+	}
+	return processDoc, nil
+}
+
+func (f *fakeStore) MarkRunAsFinished(ctx context.Context, runID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return fmt.Errorf("run %s not found", runID)
+	}
+	if !runDoc.Finished {
+		runDoc.Finished = true
+		runDoc.FinishedAt = time.Now()
+	}
+	return nil
+}
+
+func (f *fakeStore) SetRunProvider(ctx context.Context, runID string, provider string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return fmt.Errorf("run %s not found", runID)
+	}
+	runDoc.Provider = provider
+	return nil
+}
+
+func (f *fakeStore) SetRunPaused(ctx context.Context, runID string, paused bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return fmt.Errorf("run %s not found", runID)
+	}
+	if runDoc.Archived {
+		return storage.ErrRunArchived
+	}
+	runDoc.Paused = paused
+	return nil
+}
+
+func (f *fakeStore) SetRunArchived(ctx context.Context, runID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return fmt.Errorf("run %s not found", runID)
+	}
+	if !runDoc.Finished {
+		return storage.ErrRunNotFinished
+	}
+	runDoc.Archived = true
+	return nil
+}
+
+func (f *fakeStore) SetRunRetainForever(ctx context.Context, runID string, retain bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return fmt.Errorf("run %s not found", runID)
+	}
+	runDoc.RetainForever = retain
+	return nil
+}
+
+func (f *fakeStore) StoreBackfill(ctx context.Context, runID string, startTime time.Time, samples []models.Sample) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.runs[runID]; ok {
+		return status.Errorf(codes.AlreadyExists, "run %s already exists", runID)
+	}
+	runDoc := storage.NewBackfillRun(runID, startTime, samples, time.Now(), false)
+	f.runs[runID] = &runDoc
+	return nil
+}
+
+func (f *fakeStore) ImportRuns(ctx context.Context, archives []storage.RunArchive) ([]string, map[string]error, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var imported []string
+	for i := range archives {
+		runDoc := storage.NewImportedRun(&archives[i], time.Now())
+		f.runs[runDoc.RunID] = &runDoc
+		if len(archives[i].ProcessInfo) > 0 {
+			f.processes[runDoc.RunID] = &models.ProcessDoc{RunID: runDoc.RunID, ProcessInfo: archives[i].ProcessInfo}
+		}
+		imported = append(imported, runDoc.RunID)
+	}
+	return imported, map[string]error{}, nil
+}
+
+func (f *fakeStore) TailSamples(ctx context.Context, runID string, n int) ([]models.Sample, error) {
+	runDoc, err := f.GetRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	return storage.TailOf(runDoc.Samples, n), nil
+}
+
+func (f *fakeStore) EachSample(ctx context.Context, runID string, fn func(models.Sample) error) error {
+	runDoc, err := f.GetRun(ctx, runID)
+	if err != nil {
+		return err
+	}
+	for _, sample := range runDoc.Samples {
+		if err := fn(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) GetRunStatuses(ctx context.Context, runIDs []string) (map[string]models.RunStatus, map[string]error, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	statuses := make(map[string]models.RunStatus)
+	errs := make(map[string]error)
+	for _, runID := range runIDs {
+		if err, ok := f.statusErrs[runID]; ok {
+			errs[runID] = err
+			continue
+		}
+		if runDoc, ok := f.runs[runID]; ok {
+			statuses[runID] = models.RunStatus{
+				Finished:    runDoc.Finished,
+				UpdatedAt:   runDoc.UpdatedAt,
+				SampleCount: len(runDoc.Samples),
+			}
+		}
+	}
+	return statuses, errs, nil
+}
+
+// runsInWindow returns copies of the runs updated within [from, to), newest first
+func (f *fakeStore) runsInWindow(from, to time.Time) []models.RunDoc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var runs []models.RunDoc
+	for _, runDoc := range f.runs {
+		if !runDoc.UpdatedAt.Before(from) && runDoc.UpdatedAt.Before(to) {
+			runs = append(runs, *runDoc)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].UpdatedAt.After(runs[j].UpdatedAt) })
+	return runs
+}
+
+func (f *fakeStore) RunStatsInWindow(ctx context.Context, from, to time.Time, limit int) ([]models.RunDoc, error) {
+	runs := f.runsInWindow(from, to)
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	for i, run := range runs {
+		runs[i] = models.RunDoc{RunID: run.RunID, Finished: run.Finished, FinishStatus: run.FinishStatus, PeakHeapUsedMB: run.PeakHeapUsedMB, SampleCount: run.SampleCount}
+	}
+	return runs, nil
+}
+
+func (f *fakeStore) RunTagsInWindow(ctx context.Context, from, to time.Time) ([]models.RunDoc, error) {
+	runs := f.runsInWindow(from, to)
+	for i, run := range runs {
+		runs[i] = models.RunDoc{RunID: run.RunID, Tags: run.Tags}
+	}
+	return runs, nil
+}
+
+func (f *fakeStore) UpdateRunTags(ctx context.Context, runID string, set map[string]string, remove []string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	if runDoc.Archived {
+		return nil, storage.ErrRunArchived
+	}
+	tags, err := storage.MergeTags(runDoc.Tags, set, remove)
+	if err != nil {
+		return nil, err
+	}
+	runDoc.Tags = tags
+	return tags, nil
+}
+
+func (f *fakeStore) SearchRunsByPeakHeap(ctx context.Context, minPeakMB int, limit int) ([]models.RunSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	summaries := []models.RunSummary{}
+	for _, runDoc := range f.runs {
+		if runDoc.PeakHeapUsedMB == 0 || runDoc.PeakHeapUsedMB < minPeakMB {
+			continue
+		}
+		summaries = append(summaries, models.RunSummary{
+			RunID:          runDoc.RunID,
+			Finished:       runDoc.Finished,
+			SampleCount:    len(runDoc.Samples),
+			PeakHeapUsedMB: runDoc.PeakHeapUsedMB,
+		})
+	}
+	// Same order as the Firestore query, run ID breaking ties for a stable result
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].PeakHeapUsedMB != summaries[j].PeakHeapUsedMB {
+			return summaries[i].PeakHeapUsedMB > summaries[j].PeakHeapUsedMB
+		}
+		return summaries[i].RunID < summaries[j].RunID
+	})
+	if len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries, nil
+}
+
+func (f *fakeStore) SummarizeRuns(ctx context.Context, staleTimeout time.Duration) (models.SystemSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var unfinished []models.RunSummary
+	finished := 0
+	for _, runDoc := range f.runs {
+		if runDoc.Finished {
+			finished++
+			continue
+		}
+		unfinished = append(unfinished, models.RunSummary{
+			RunID:       runDoc.RunID,
+			StartTime:   runDoc.StartTime,
+			UpdatedAt:   runDoc.UpdatedAt,
+			SampleCount: len(runDoc.Samples),
+		})
+	}
+	now := time.Now()
+	return storage.SummarizeRunStates(unfinished, finished, now.Add(-staleTimeout), now), nil
+}
+
+func (f *fakeStore) ListRuns(ctx context.Context, provider string, order storage.RunSort, limit int, cursor string) ([]models.RunSummary, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var afterKey int64
+	var afterRunID string
+	if cursor != "" {
+		var err error
+		if afterKey, afterRunID, err = storage.DecodeRunCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	summaries := []models.RunSummary{}
+	for _, runDoc := range f.runs {
+		if provider != "" && runDoc.Provider != provider {
+			continue
+		}
+		summaries = append(summaries, models.RunSummary{
+			RunID:              runDoc.RunID,
+			Provider:           runDoc.Provider,
+			StartTime:          runDoc.StartTime,
+			UpdatedAt:          runDoc.UpdatedAt,
+			Finished:           runDoc.Finished,
+			SampleCount:        len(runDoc.Samples),
+			UpdatedAtTimestamp: storage.ToMillis(runDoc.UpdatedAt),
+		})
+	}
+	// Same order as the Firestore query, run ID breaking ties
+	sort.Slice(summaries, func(i, j int) bool {
+		return order.Less(summaries[i], summaries[j])
+	})
+	if cursor != "" {
+		start := len(summaries)
+		for i, summary := range summaries {
+			if order.After(summary, afterKey, afterRunID) {
+				start = i
+				break
+			}
+		}
+		summaries = summaries[start:]
+	}
+	if len(summaries) > limit+1 {
+		summaries = summaries[:limit+1]
+	}
+	page, next := storage.PageRuns(summaries, order, limit)
+	return page, next, nil
+}
+
+// putRun seeds the fake store with a run document
+func (f *fakeStore) putRun(runDoc models.RunDoc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs[runDoc.RunID] = &runDoc
+}
+
+// newIngestRequest builds an authenticated ingest request for runID with the given JSON body
+func newIngestRequest(t *testing.T, runID, body string) *http.Request {
+	t.Helper()
+
+	token, _, err := auth.GenerateToken(runID)
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func (f *fakeStore) CompactRun(ctx context.Context, runID string, budget int) (models.CompactionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runDoc, ok := f.runs[runID]
+	if !ok {
+		return models.CompactionResult{}, fmt.Errorf("run %s not found", runID)
+	}
+	if runDoc.Archived {
+		return models.CompactionResult{}, storage.ErrRunArchived
+	}
+	result := models.CompactionResult{SamplesBefore: len(runDoc.Samples)}
+	result.BytesBefore, _ = storage.StoredSamplesSize(runDoc)
+	runDoc.Samples = storage.CompactSamples(runDoc.Samples, budget, storage.DefaultCompactionWeights)
+	result.SamplesAfter = len(runDoc.Samples)
+	result.BytesAfter, _ = storage.StoredSamplesSize(runDoc)
+	return result, nil
+}
@@ -1,38 +1,419 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
 	"github.com/cdsap/build-process-watcher/backend/internal/models"
 	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+const (
+	// DefaultRequestTimeout bounds how long a handler waits on Firestore
+	DefaultRequestTimeout = 30 * time.Second
+	// ListRunsLimit is the default and maximum page size of the runs listing,
+	// the maximum can be changed with LIST_RUNS_MAX_PAGE
+	ListRunsLimit = 100
+	// MaxBinaryIngestBytes bounds the size of a binary ingest payload
+	MaxBinaryIngestBytes = 8 << 20
+	// DefaultTailSamples is the number of samples returned by /runs/{runId}/tail without ?n=
+	DefaultTailSamples = 50
+	// DefaultMaxIngestBodyBytes bounds the size of a JSON ingest body, change it with MAX_INGEST_BODY_BYTES
+	DefaultMaxIngestBodyBytes = 1 << 20
+	// TypicalSampleBytes is the approximate size of one sample line in an ingest body,
+	// e.g. "00:01:05 | 12345 | GradleDaemon | 812MB | 1024MB | 1300MB | 15ms"
+	TypicalSampleBytes = 72
+	// DefaultNoSamplesStatus answers an ingest whose non-empty data parsed to zero samples,
+	// change it with NO_SAMPLES_STATUS (200 restores the old silent success)
+	DefaultNoSamplesStatus = http.StatusBadRequest
+	// MaxStatusRunIDs bounds how many runs a single POST /runs:statuses can ask for
+	MaxStatusRunIDs = 100
+)
+
+// Store is the subset of storage operations used by the handlers
+type Store interface {
+	GetRun(ctx context.Context, runID string) (*models.RunDoc, error)
+	GetRunHeap(ctx context.Context, runID string) (*models.RunDoc, error)
+	GetRunMeta(ctx context.Context, runID string) (*models.RunDoc, error)
+	GetRunSince(ctx context.Context, runID string, sinceTS int64) (*models.RunDoc, error)
+	StoreSamples(ctx context.Context, runID string, samples []models.Sample) error
+	StoreProcessInfo(ctx context.Context, runID string, processInfo models.ProcessInfo) error
+	GetProcesses(ctx context.Context, runID string) (*models.ProcessDoc, error)
+	MarkRunAsFinished(ctx context.Context, runID string) error
+	SetRunProvider(ctx context.Context, runID string, provider string) error
+	ListRuns(ctx context.Context, provider string, sort storage.RunSort, limit int, cursor string) ([]models.RunSummary, string, error)
+	SetRunPaused(ctx context.Context, runID string, paused bool) error
+	SetRunArchived(ctx context.Context, runID string) error
+	SetRunRetainForever(ctx context.Context, runID string, retain bool) error
+	StoreBackfill(ctx context.Context, runID string, startTime time.Time, samples []models.Sample) error
+	TailSamples(ctx context.Context, runID string, n int) ([]models.Sample, error)
+	EachSample(ctx context.Context, runID string, fn func(models.Sample) error) error
+	GetRunStatuses(ctx context.Context, runIDs []string) (map[string]models.RunStatus, map[string]error, error)
+	RunStatsInWindow(ctx context.Context, from, to time.Time, limit int) ([]models.RunDoc, error)
+	RunTagsInWindow(ctx context.Context, from, to time.Time) ([]models.RunDoc, error)
+	UpdateRunTags(ctx context.Context, runID string, set map[string]string, remove []string) (map[string]string, error)
+	CompactRun(ctx context.Context, runID string, budget int) (models.CompactionResult, error)
+	ImportRuns(ctx context.Context, archives []storage.RunArchive) ([]string, map[string]error, error)
+	SearchRunsByPeakHeap(ctx context.Context, minPeakMB int, limit int) ([]models.RunSummary, error)
+	SummarizeRuns(ctx context.Context, staleTimeout time.Duration) (models.SystemSummary, error)
+	CreateRun(ctx context.Context, runID string) error
+}
+
 // Handlers contains all HTTP handlers
 type Handlers struct {
-	storage *storage.Client
+	storage             Store
+	requestTimeout      time.Duration
+	finishOnEmptyIngest bool // Treat an ingest with a run_id but no data as a finish signal
+	rejectActiveRunAuth bool // Refuse tokens for an existing unfinished run unless ?force=true
+	runIDAge            runIDAgeCheck
+	listRunsMaxPage     int // Upper bound on ?limit= for the runs listing
+	maxIngestBodyBytes  int64
+	noSamplesStatus     int // Status for non-empty ingest data without a valid sample
+	heapTrend           heapTrendConfig
+	ingestLimiter       *runRateLimiter
+	retryAfterUnit      time.Duration // Granularity of Retry-After on 429 responses
+	allowedOrigins      []string      // Browser origins allowed to open run streams
+	streamPollInterval  time.Duration
+	strictQueryParams   bool        // Reject GetRun requests with unrecognized query parameters
+	ingestLogs          *logSampler // Keeps 1 in INGEST_LOG_SAMPLE_RATE successful ingests verbose
+	labels              *labelsCache
+	summary             *summaryCache
+	dashboardBaseURL    string // Base of the run_url returned by Auth, empty omits it
+	ingestFields        storage.FieldRange
+	commentPrefix       string          // Ingest data lines starting with it are skipped
+	autoToken           autoTokenConfig // Issue tokens on the first ingest of new runs from trusted networks
+	maxResponseBytes    int             // GetRun keeps only the most recent samples fitting this size, 0 disables it
+	aggregateMaxRuns    int             // Most recently updated runs GET /stats/aggregate reads
+	sampleCeilingMB     int             // Ingested samples above this heap or RSS are dropped, 0 keeps them
+	retainBackfill      bool            // Backfilled runs are exempt from retention, as in storage
 }
 
 // NewHandlers creates a new handlers instance
-func NewHandlers(storageClient *storage.Client) *Handlers {
+func NewHandlers(storageClient Store) *Handlers {
 	return &Handlers{
-		storage: storageClient,
+		storage:             storageClient,
+		requestTimeout:      getRequestTimeout(),
+		finishOnEmptyIngest: getEnvBool("FINISH_ON_EMPTY_INGEST"),
+		rejectActiveRunAuth: getEnvBool("AUTH_REJECT_ACTIVE_RUNS"),
+		runIDAge:            getRunIDAgeCheck(),
+		listRunsMaxPage:     getListRunsMaxPage(),
+		maxIngestBodyBytes:  getMaxIngestBodyBytes(),
+		noSamplesStatus:     getNoSamplesStatus(),
+		heapTrend:           getHeapTrendConfig(),
+		ingestLimiter:       newRunRateLimiterFromEnv(),
+		retryAfterUnit:      getRetryAfterUnit(),
+		allowedOrigins:      getAllowedOrigins(),
+		streamPollInterval:  DefaultStreamPollInterval,
+		strictQueryParams:   getEnvBool("STRICT_QUERY_PARAMS"),
+		ingestLogs:          getIngestLogSampler(),
+		labels:              newLabelsCacheFromEnv(),
+		summary:             newSummaryCacheFromEnv(),
+		dashboardBaseURL:    strings.TrimRight(strings.TrimSpace(os.Getenv("DASHBOARD_BASE_URL")), "/"),
+		ingestFields:        getIngestFieldRange(),
+		commentPrefix:       getCommentPrefix(),
+		autoToken:           getAutoTokenConfig(),
+		maxResponseBytes:    getMaxResponseBytes(),
+		aggregateMaxRuns:    getAggregateMaxRuns(),
+		sampleCeilingMB:     getSampleCeilingMB(),
+		retainBackfill:      getEnvBool("BACKFILL_SKIP_RETENTION"),
+	}
+}
+
+// getEnvBool reports whether the environment variable is set to a true value
+func getEnvBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+// getRequestTimeout returns the handler deadline from HANDLER_TIMEOUT (e.g. "10s"), 0 disables it
+func getRequestTimeout() time.Duration {
+	value := os.Getenv("HANDLER_TIMEOUT")
+	if value == "" {
+		return DefaultRequestTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		log.Printf("⚠️  WARNING: invalid HANDLER_TIMEOUT %q, using %v", value, DefaultRequestTimeout)
+		return DefaultRequestTimeout
+	}
+	return timeout
+}
+
+// getListRunsMaxPage returns the runs listing page size cap from LIST_RUNS_MAX_PAGE
+func getListRunsMaxPage() int {
+	value := os.Getenv("LIST_RUNS_MAX_PAGE")
+	if value == "" {
+		return ListRunsLimit
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("⚠️  WARNING: invalid LIST_RUNS_MAX_PAGE %q, using %d", value, ListRunsLimit)
+		return ListRunsLimit
+	}
+	return n
+}
+
+// runIDAgeCheck rejects tokens for run IDs whose embedded timestamp is too old
+type runIDAgeCheck struct {
+	pattern *regexp.Regexp // First capture group holds a Unix timestamp in seconds or milliseconds
+	maxAge  time.Duration
+}
+
+// getRunIDAgeCheck reads RUN_ID_TIMESTAMP_PATTERN and RUN_ID_MAX_AGE (e.g. "24h").
+// The check is disabled unless both are set and valid.
+func getRunIDAgeCheck() runIDAgeCheck {
+	pattern := os.Getenv("RUN_ID_TIMESTAMP_PATTERN")
+	maxAge := os.Getenv("RUN_ID_MAX_AGE")
+	if pattern == "" || maxAge == "" {
+		return runIDAgeCheck{}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil || re.NumSubexp() < 1 {
+		log.Printf("⚠️  WARNING: invalid RUN_ID_TIMESTAMP_PATTERN %q, it needs a capture group for the timestamp", pattern)
+		return runIDAgeCheck{}
+	}
+	age, err := time.ParseDuration(maxAge)
+	if err != nil || age <= 0 {
+		log.Printf("⚠️  WARNING: invalid RUN_ID_MAX_AGE %q, run ID age check disabled", maxAge)
+		return runIDAgeCheck{}
+	}
+	return runIDAgeCheck{pattern: re, maxAge: age}
+}
+
+// tooOld reports whether runID embeds a timestamp older than maxAge. Run IDs that
+// don't match the pattern, or when no pattern is configured, are never too old.
+func (c runIDAgeCheck) tooOld(runID string, now time.Time) bool {
+	if c.pattern == nil {
+		return false
+	}
+	match := c.pattern.FindStringSubmatch(runID)
+	if match == nil {
+		return false
+	}
+	ts, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	// Values past year 5138 in seconds are taken as milliseconds
+	minted := time.Unix(ts, 0)
+	if ts > 1e11 {
+		minted = time.UnixMilli(ts)
+	}
+	return now.Sub(minted) > c.maxAge
+}
+
+// getMaxIngestBodyBytes returns the JSON ingest body limit from MAX_INGEST_BODY_BYTES
+func getMaxIngestBodyBytes() int64 {
+	value := os.Getenv("MAX_INGEST_BODY_BYTES")
+	if value == "" {
+		return DefaultMaxIngestBodyBytes
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("⚠️  WARNING: invalid MAX_INGEST_BODY_BYTES %q, using %d", value, DefaultMaxIngestBodyBytes)
+		return DefaultMaxIngestBodyBytes
+	}
+	return n
+}
+
+// getSampleCeilingMB reads INGEST_MAX_SAMPLE_MB, the ceiling on ingested heap and RSS
+// values, 0 (the default) disables it
+func getSampleCeilingMB() int {
+	value := os.Getenv("INGEST_MAX_SAMPLE_MB")
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("⚠️  WARNING: invalid INGEST_MAX_SAMPLE_MB %q, keeping every sample", value)
+		return 0
+	}
+	return n
+}
+
+// getCommentPrefix reads INGEST_COMMENT_PREFIX, defaulting to storage.DefaultCommentPrefix
+func getCommentPrefix() string {
+	if prefix := strings.TrimSpace(os.Getenv("INGEST_COMMENT_PREFIX")); prefix != "" {
+		return prefix
+	}
+	return storage.DefaultCommentPrefix
+}
+
+// parseConfig returns how ingest payloads are parsed
+func (h *Handlers) parseConfig() storage.ParseConfig {
+	return storage.ParseConfig{Fields: h.ingestFields, CommentPrefix: h.commentPrefix}
+}
+
+// getIngestFieldRange returns the accepted pipe field counts from INGEST_MIN_FIELDS and
+// INGEST_MAX_FIELDS, each defaulting to storage.DefaultFieldRange's bound
+func getIngestFieldRange() storage.FieldRange {
+	fields := storage.DefaultFieldRange
+	for _, bound := range []struct {
+		name  string
+		value *int
+	}{
+		{"INGEST_MIN_FIELDS", &fields.Min},
+		{"INGEST_MAX_FIELDS", &fields.Max},
+	} {
+		value := os.Getenv(bound.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("⚠️  WARNING: invalid %s %q, using %d", bound.name, value, *bound.value)
+			continue
+		}
+		*bound.value = n
+	}
+	if !fields.Valid() {
+		log.Printf("⚠️  WARNING: invalid ingest field range %d-%d, using %d-%d", fields.Min, fields.Max, storage.DefaultFieldRange.Min, storage.DefaultFieldRange.Max)
+		return storage.DefaultFieldRange
+	}
+	return fields
+}
+
+// getNoSamplesStatus returns the HTTP status from NO_SAMPLES_STATUS for data without valid samples
+func getNoSamplesStatus() int {
+	value := os.Getenv("NO_SAMPLES_STATUS")
+	if value == "" {
+		return DefaultNoSamplesStatus
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 200 || code > 599 {
+		log.Printf("⚠️  WARNING: invalid NO_SAMPLES_STATUS %q, using %d", value, DefaultNoSamplesStatus)
+		return DefaultNoSamplesStatus
+	}
+	return code
+}
+
+// rejectNoSamples writes the configured error when non-empty data parsed to no samples,
+// so agents don't mistake a batch of malformed lines for a successful ingest
+func (h *Handlers) rejectNoSamples(w http.ResponseWriter, runID string, samples []models.Sample) bool {
+	if len(samples) > 0 || h.noSamplesStatus == http.StatusOK {
+		return false
+	}
+	log.Printf("⚠️  Ingest for run %s contained no valid samples", runID)
+	http.Error(w, "No valid samples found in data", h.noSamplesStatus)
+	return true
+}
+
+// RecommendedBatchSize is how many samples an agent should send per ingest so the body
+// stays within maxBodyBytes, keeping a quarter of it as headroom for the JSON envelope,
+// process info and unusually long process names
+func RecommendedBatchSize(maxBodyBytes int64) int {
+	size := int(maxBodyBytes * 3 / 4 / TypicalSampleBytes)
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// requestContext derives the context passed to storage calls so that client
+// cancellations and the configured deadline propagate to Firestore
+func (h *Handlers) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if h.requestTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), h.requestTimeout)
+}
+
+// writeTokenError responds 401 with a machine-readable reason so agents can
+// refresh expired tokens and re-authorize on invalid ones
+func writeTokenError(w http.ResponseWriter, err error) {
+	reason := "token_invalid"
+	if errors.Is(err, auth.ErrTokenExpired) {
+		reason = "token_expired"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
+
+// writeStorageError maps a storage failure to an HTTP response. While the storage
+// circuit breaker is open clients get a fast 503 with Retry-After instead of a 500,
+// and Firestore permission errors get a 503 so misconfigured credentials stand out.
+func writeStorageError(w http.ResponseWriter, err error) {
+	var circuitErr *storage.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		retryAfter := int(math.Ceil(circuitErr.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// A misconfigured service account is not a server bug, so it gets its own 503
+	if storage.IsPermissionDenied(err) {
+		http.Error(w, "Storage permission denied", http.StatusServiceUnavailable)
+		return
 	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// storageErrorMessage is the client-facing description of a storage error that is
+// reported inside a response rather than as its status code
+func storageErrorMessage(err error) string {
+	if storage.IsPermissionDenied(err) {
+		return "Storage permission denied"
+	}
+	return "Storage error"
 }
 
 // Health returns a simple health check
 func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "healthy"})
+}
+
+// Config returns ingest settings agents can use to tune themselves
+func (h *Handlers) Config(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"max_ingest_body_bytes":  h.maxIngestBodyBytes,
+		"recommended_batch_size": RecommendedBatchSize(h.maxIngestBodyBytes),
+	})
 }
 
-// Auth generates a JWT token for a run
+// Auth generates a JWT token for a run. With AUTH_REJECT_ACTIVE_RUNS enabled, a run ID that
+// already belongs to an unfinished run is rejected with 409 so colliding CI jobs surface early;
+// agents re-authorizing their own run (e.g. after token expiry) must pass ?force=true.
 func (h *Handlers) Auth(w http.ResponseWriter, r *http.Request) {
 	// Extract run_id from URL path
 	runID := strings.TrimPrefix(r.URL.Path, "/auth/run/")
@@ -43,6 +424,20 @@ func (h *Handlers) Auth(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("🔐 Auth request for run_id: %s", runID)
 
+	if h.runIDAge.tooOld(runID, clock.Now()) {
+		log.Printf("⚠️  Rejected auth for run_id %s: embedded timestamp is older than %v", runID, h.runIDAge.maxAge)
+		http.Error(w, fmt.Sprintf("Run ID timestamp is older than %v", h.runIDAge.maxAge), http.StatusBadRequest)
+		return
+	}
+
+	if h.rejectActiveRunAuth && r.URL.Query().Get("force") != "true" {
+		if h.runIsActive(r, runID) {
+			log.Printf("⚠️  Rejected auth for run_id %s: run already exists and is not finished", runID)
+			http.Error(w, "Run already exists and is not finished, pass force=true to reuse it", http.StatusConflict)
+			return
+		}
+	}
+
 	// Generate token
 	token, expiresAt, err := auth.GenerateToken(runID)
 	if err != nil {
@@ -54,21 +449,43 @@ func (h *Handlers) Auth(w http.ResponseWriter, r *http.Request) {
 	response := models.TokenResponse{
 		Token:     token,
 		ExpiresAt: expiresAt,
+		RunURL:    h.runURL(runID),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(response)
+	httpjson.NewEncoder(w, r).Encode(response)
 
 	log.Printf("✅ Generated token for run_id: %s, expires at: %s", runID, expiresAt.Format(time.RFC3339))
 }
 
-// Ingest receives and stores monitoring data
-func (h *Handlers) Ingest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("=== INGEST HANDLER CALLED ===")
-	log.Printf("Method: %s", r.Method)
-	log.Printf("Headers: %v", r.Header)
+// runURL returns the dashboard page of runID, or "" when DASHBOARD_BASE_URL is not set
+func (h *Handlers) runURL(runID string) string {
+	if h.dashboardBaseURL == "" {
+		return ""
+	}
+	return h.dashboardBaseURL + "/runs/" + url.PathEscape(runID)
+}
 
+// runIsActive reports whether runID exists and is not finished. Storage errors are
+// logged and treated as inactive so the collision check never blocks a build.
+func (h *Handlers) runIsActive(r *http.Request, runID string) bool {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			log.Printf("Warning: Failed to check run %s for an active collision: %v", runID, err)
+		}
+		return false
+	}
+	return !runDoc.Finished
+}
+
+// ValidateAuth checks a token for a run without touching storage, so agents can
+// verify it at startup. The token may also be sent as a Bearer Authorization header.
+func (h *Handlers) ValidateAuth(w http.ResponseWriter, r *http.Request) {
 	// Handle CORS preflight
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -79,70 +496,162 @@ func (h *Handlers) Ingest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method != http.MethodPost {
-		log.Printf("Wrong method: %s", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse request body to get run_id
-	var req models.IngestRequest
-
+	var req models.TokenValidateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Failed to parse request body: %v", err)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-
-	// Verify token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Printf("No authorization header provided")
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+	if req.Token == "" {
+		req.Token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if req.RunID == "" || req.Token == "" {
+		http.Error(w, "Missing run_id or token", http.StatusBadRequest)
 		return
 	}
 
-	// Extract token from "Bearer <token>"
-	tokenParts := strings.Split(authHeader, " ")
-	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-		log.Printf("Invalid authorization header format")
-		http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+	tokenData, err := auth.ParseToken(req.Token, req.RunID)
+	if err != nil {
+		log.Printf("Token check failed for run %s: %v", req.RunID, err)
+		writeTokenError(w, err)
 		return
 	}
 
-	token := tokenParts[1]
-	valid, err := auth.ValidateToken(token, req.RunID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(models.TokenValidateResponse{
+		Valid:      true,
+		RunID:      tokenData.RunID,
+		ExpiresAt:  tokenData.ExpiresAt,
+		TTLSeconds: int64(tokenData.ExpiresAt.Sub(clock.Now()).Seconds()),
+	})
+}
+
+// DurableIngestHeader set to "true" is the header form of POST /ingest?durable=true
+const DurableIngestHeader = "X-Durable-Ingest"
+
+// durableIngest reports whether the agent asked, with ?durable= or DurableIngestHeader,
+// for its samples to be stored before the response
+func durableIngest(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("durable")
+	if value == "" {
+		value = r.Header.Get(DurableIngestHeader)
+	}
+	if value == "" {
+		return false, nil
+	}
+	durable, err := strconv.ParseBool(value)
 	if err != nil {
-		log.Printf("Token validation failed: %v", err)
-		http.Error(w, "Token validation failed", http.StatusUnauthorized)
+		return false, fmt.Errorf("invalid durable %q, expected true or false", value)
+	}
+	return durable, nil
+}
+
+// Ingest receives and stores monitoring data. Every ingest is written to Firestore before
+// the response, so a 200 always means the samples are stored; ?durable=true states that
+// requirement explicitly, and must keep bypassing any write buffering added later.
+func (h *Handlers) Ingest(w http.ResponseWriter, r *http.Request) {
+	// Successful ingests are only logged 1 in INGEST_LOG_SAMPLE_RATE times, errors always
+	r = h.ingestLogs.sampleRequest(r)
+	ingestLogf(r, "=== INGEST HANDLER CALLED ===")
+	ingestLogf(r, "Method: %s", r.Method)
+	ingestLogf(r, "Headers: %v", r.Header)
+
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CI-Provider, X-Data-Format, X-Durable-Ingest")
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	if !valid {
-		log.Printf("Invalid token for run_id: %s", req.RunID)
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	if r.Method != http.MethodPost {
+		log.Printf("Wrong method: %s", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if durable, err := durableIngest(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if durable {
+		ingestLogf(r, "Durable ingest requested, storing synchronously")
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/octet-stream" {
+		h.ingestBinary(w, r)
+		return
+	}
+
+	// Parse request body to get run_id
+	var req models.IngestRequest
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxIngestBodyBytes)).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Failed to parse request body: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("✅ Token validated successfully for run_id: %s", req.RunID)
+	w, authorized := h.authorizeFirstIngest(w, r, req.RunID)
+	if !authorized {
+		return
+	}
 
 	if req.RunID == "" {
 		http.Error(w, "Missing run_id", http.StatusBadRequest)
 		return
 	}
 
+	if !h.allowIngestWrite(w, req.RunID) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	h.ingestAuthorized(ctx, w, r, req)
+}
+
+// ingestAuthorized stores an ingest request whose token has already been validated
+func (h *Handlers) ingestAuthorized(ctx context.Context, w http.ResponseWriter, r *http.Request, req models.IngestRequest) {
 	// Allow empty data if ProcessInfo is provided (for VM flags-only requests)
 	if req.Data == "" && req.ProcessInfo == nil {
+		if h.finishOnEmptyIngest {
+			h.finishFromEmptyIngest(ctx, w, r, req.RunID)
+			return
+		}
 		http.Error(w, "Missing data or process_info", http.StatusBadRequest)
 		return
 	}
 
+	// Agents on several machines may share a run, so their reports carry the machine
+	machine := strings.TrimSpace(req.Machine)
+	if req.ProcessInfo != nil {
+		if req.ProcessInfo.Machine == "" {
+			req.ProcessInfo.Machine = machine
+		}
+		*req.ProcessInfo = storage.CapDisplayHints(*req.ProcessInfo)
+	}
+
 	// Handle process info first (if provided) - this can work independently
 	if req.ProcessInfo != nil {
-		if err := h.storage.StoreProcessInfo(req.RunID, *req.ProcessInfo); err != nil {
+		if err := h.storage.StoreProcessInfo(ctx, req.RunID, *req.ProcessInfo); errors.Is(err, storage.ErrRunArchived) {
+			http.Error(w, "Run is archived", http.StatusConflict)
+			return
+		} else if err != nil {
 			log.Printf("Failed to store process info: %v", err)
 			// Don't fail the request if process info storage fails, just log it
 		} else {
-			log.Printf("✅ Stored process info for PID: %s", req.ProcessInfo.PID)
+			ingestLogf(r, "✅ Stored process info for PID: %s", req.ProcessInfo.PID)
 		}
 	}
 
@@ -150,86 +659,304 @@ func (h *Handlers) Ingest(w http.ResponseWriter, r *http.Request) {
 	if req.Data == "" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "success", "process_info": "stored"})
+		httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "success", "process_info": "stored"})
 		return
 	}
 
-	// Get the run to determine its StartTime
+	provider := strings.TrimSpace(req.Provider)
+	if provider == "" {
+		provider = strings.TrimSpace(r.Header.Get("X-CI-Provider"))
+	}
+
+	// X-Data-Format selects the parser explicitly; without it the format is detected by field count
+	format := strings.TrimSpace(r.Header.Get("X-Data-Format"))
+
+	if req.Backfill {
+		h.ingestBackfill(ctx, w, r, req, provider, format)
+		return
+	}
+
+	// Parse the data with the run's StartTime for consistent timestamps
+	h.storeIngestedSamples(ctx, w, r, req.RunID, provider, func(startTime time.Time) ([]models.Sample, error) {
+		samples, err := storage.ParseDataFormat(format, req.Data, startTime, h.parseConfig())
+		return storage.SetMachine(samples, machine), err
+	})
+}
+
+// authorizeIngest checks the Bearer token of an ingest request against runID,
+// writing the 401 response and returning false when it is missing or invalid
+func (h *Handlers) authorizeIngest(w http.ResponseWriter, r *http.Request, runID string) bool {
+	// Verify token
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		log.Printf("No authorization header provided")
+		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		return false
+	}
+
+	// Extract token from "Bearer <token>"
+	tokenParts := strings.Split(authHeader, " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		log.Printf("Invalid authorization header format")
+		http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+		return false
+	}
+
+	token := tokenParts[1]
+	valid, err := auth.ValidateToken(token, runID)
+	if err != nil {
+		log.Printf("Token validation failed: %v", err)
+		writeTokenError(w, err)
+		return false
+	}
+
+	if !valid {
+		log.Printf("Invalid token for run_id: %s", runID)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+
+	ingestLogf(r, "✅ Token validated successfully for run_id: %s", runID)
+	return true
+}
+
+// allowIngestWrite applies the per-run write-rate limit, responding 429 when it is exceeded.
+// Retry-After holds the seconds until the run's bucket refills a token, rounded up to
+// RETRY_AFTER_UNIT.
+func (h *Handlers) allowIngestWrite(w http.ResponseWriter, runID string) bool {
+	allowed, wait := h.ingestLimiter.allow(runID)
+	if allowed {
+		return true
+	}
+	log.Printf("⚠️  Ingest rate limit exceeded for run %s", runID)
+	h.writeTooManyRequests(w, "Too many writes for this run", wait)
+	return false
+}
+
+// storeIngestedSamples resolves the run's StartTime, parses the payload with it and stores
+// the samples, recording the CI provider when it changed
+func (h *Handlers) storeIngestedSamples(ctx context.Context, w http.ResponseWriter, r *http.Request, runID string, provider string, parse func(startTime time.Time) ([]models.Sample, error)) {
+	// Get the run to determine its StartTime, without reading its samples
 	var startTime time.Time
-	runDoc, err := h.storage.GetRun(req.RunID)
+	var currentProvider string
+	runDoc, err := h.storage.GetRunMeta(ctx, runID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			// New run, use current time
-			startTime = time.Now()
-			log.Printf("New run, using current time as StartTime: %v", startTime)
+			startTime = clock.Now()
+			ingestLogf(r, "New run, using current time as StartTime: %v", startTime)
 		} else {
 			log.Printf("Error getting run document: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
 	} else {
 		startTime = runDoc.StartTime
-		log.Printf("Using existing StartTime: %v", startTime)
+		currentProvider = runDoc.Provider
+		ingestLogf(r, "Using existing StartTime: %v", startTime)
 	}
 
-	// Parse the data with StartTime for consistent timestamps
-	samples, err := storage.ParseData(req.Data, startTime)
+	samples, err := parse(startTime)
 	if err != nil {
 		log.Printf("Failed to parse data: %v", err)
-		http.Error(w, "Invalid data format", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid data format: %v", err), http.StatusBadRequest)
+		return
+	}
+	samples = storage.DropImplausibleSamples(samples, h.sampleCeilingMB)
+	if h.rejectNoSamples(w, runID, samples) {
 		return
 	}
 
-	// Store in Firestore
-	if err := h.storage.StoreSamples(req.RunID, samples); err != nil {
+	// Store in Firestore, which also aligns processes with a start offset
+	if err := h.storage.StoreSamples(storage.WithIngestSource(ctx, r.RemoteAddr), runID, samples); err != nil {
+		if errors.Is(err, storage.ErrRunPaused) {
+			http.Error(w, "Run is paused", http.StatusLocked)
+			return
+		}
+		if errors.Is(err, storage.ErrRunArchived) {
+			http.Error(w, "Run is archived", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrRunFinished) {
+			http.Error(w, "Run is finished", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrSamplesAfterEnd) {
+			http.Error(w, "Samples are after the run's end time", http.StatusUnprocessableEntity)
+			return
+		}
 		log.Printf("Failed to store samples: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
 
+	// Record the CI provider once per run (or when it changes)
+	if provider != "" && provider != currentProvider {
+		if err := h.storage.SetRunProvider(ctx, runID, provider); err != nil {
+			log.Printf("Failed to store provider for run %s: %v", runID, err)
+		}
+	}
+
+	ingestLogf(r, "✅ Stored %d samples for run %s", len(samples), runID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "success", "samples": fmt.Sprintf("%d", len(samples))})
+	httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "success", "samples": fmt.Sprintf("%d", len(samples))})
 }
 
-// GetRun retrieves run data
-func (h *Handlers) GetRun(w http.ResponseWriter, r *http.Request) {
-	log.Printf("runsHandler called with path: %s, method: %s", r.URL.Path, r.Method)
-
-	// Handle CORS preflight
-	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.WriteHeader(http.StatusOK)
+// ingestBinary handles POST /ingest?run_id={runId} with Content-Type application/octet-stream,
+// a batch of samples in the storage.EncodeSamplesBinary format
+func (h *Handlers) ingestBinary(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("run_id")
+	w, authorized := h.authorizeFirstIngest(w, r, runID)
+	if !authorized {
 		return
 	}
 
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if runID == "" {
+		http.Error(w, "Missing run_id", http.StatusBadRequest)
 		return
 	}
 
-	// Extract run_id from URL path
-	path := strings.TrimPrefix(r.URL.Path, "/runs/")
-	log.Printf("Extracted path: %s", path)
-	if path == "" {
-		http.Error(w, "Run ID required", http.StatusBadRequest)
+	if !h.allowIngestWrite(w, runID) {
 		return
 	}
 
-	runID := path
-	log.Printf("Fetching data for run ID: %s", runID)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBinaryIngestBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Reject malformed payloads before touching storage
+	if _, err := storage.DecodeSamplesBinary(body, time.Time{}); err != nil {
+		log.Printf("Failed to decode binary samples: %v", err)
+		http.Error(w, fmt.Sprintf("Invalid data format: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	provider := strings.TrimSpace(r.Header.Get("X-CI-Provider"))
+	h.storeIngestedSamples(ctx, w, r, runID, provider, func(startTime time.Time) ([]models.Sample, error) {
+		return storage.DecodeSamplesBinary(body, startTime)
+	})
+}
+
+// finishFromEmptyIngest marks a run as finished when an agent signals end-of-build with an empty ingest
+func (h *Handlers) finishFromEmptyIngest(ctx context.Context, w http.ResponseWriter, r *http.Request, runID string) {
+	log.Printf("Empty ingest for run %s, treating as finish signal", runID)
+
+	if err := h.storage.MarkRunAsFinished(ctx, runID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error finishing run %s: %v", runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "success", "finished": "true"})
+
+	log.Printf("✅ Successfully marked run %s as finished from empty ingest", runID)
+}
+
+// GetRun retrieves run data
+func (h *Handlers) GetRun(w http.ResponseWriter, r *http.Request) {
+	log.Printf("runsHandler called with path: %s, method: %s", r.URL.Path, r.Method)
+
+	// Tags are written from the dashboard, so they have their own methods and preflight
+	if runID, subresource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/runs/"), "/"); runID != "" && subresource == "tags" {
+		h.runTags(w, r, runID)
+		return
+	}
+
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract run_id from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/runs/")
+	log.Printf("Extracted path: %s", path)
+	if path == "" {
+		http.Error(w, "Run ID required", http.StatusBadRequest)
+		return
+	}
+
+	// Sub-resources live under /runs/{runId}/...
+	runID, subresource, _ := strings.Cut(path, "/")
+	if subresource != "" {
+		h.runSubresource(w, r, runID, subresource)
+		return
+	}
+	log.Printf("Fetching data for run ID: %s", runID)
+
+	// In strict mode a typo'd parameter fails loudly instead of being ignored
+	if h.strictQueryParams {
+		if unknown := unknownQueryParams(r.URL.Query(), runQueryParams); len(unknown) > 0 {
+			http.Error(w, fmt.Sprintf("unknown query parameters: %s", strings.Join(unknown, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query, err := parseRunQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgpackResponse := acceptsMsgpack(r)
+	if msgpackResponse && query.camel {
+		http.Error(w, "naming=camel is only available as JSON", http.StatusNotAcceptable)
+		return
+	}
 
-	runDoc, err := h.storage.GetRun(runID)
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	// HEAD lets live widgets poll the heap headers without downloading samples, so it reads
+	// only the maintained heap fields. Runs not written since they were maintained, and
+	// ?as_of_ts= which needs the samples up to then, fall through to the full read.
+	if r.Method == http.MethodHead && !query.hasAsOf {
+		heapDoc, err := h.storage.GetRunHeap(ctx, runID)
+		if err != nil {
+			log.Printf("Error getting run heap: %v", err)
+			writeStorageError(w, err)
+			return
+		}
+		if heapDoc.LatestHeap != nil {
+			setRunHeaders(w)
+			setHeapHeaders(w, heapDoc.PeakHeapUsedMB, storage.CurrentHeapUsed(heapDoc.LatestHeap))
+			return
+		}
+	}
+
+	runDoc, err := h.readRunForQuery(ctx, runID, query)
 	if err != nil {
 		log.Printf("Error getting run document: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
 
 	// Get process info from processes collection
-	processDoc, err := h.storage.GetProcesses(runID)
+	processDoc, err := h.storage.GetProcesses(ctx, runID)
 	if err != nil {
 		log.Printf("Warning: Failed to get process info for run %s: %v", runID, err)
 		// Continue without process info rather than failing
@@ -240,26 +967,428 @@ func (h *Handlers) GetRun(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var response models.RunResponse
-	response.Samples = runDoc.Samples
-	response.ProcessInfo = processDoc.ProcessInfo
-	response.Finished = runDoc.Finished
+	response.Samples = query.apply(runDoc.Samples)
+	response.ProcessInfo = limitVMFlags(processDoc.ProcessInfo, query.maxFlags)
+	response.Finished, response.FinishedAt = query.finishedAsOf(runDoc)
 	response.UpdatedAt = runDoc.UpdatedAt
-	if !runDoc.FinishedAt.IsZero() {
-		response.FinishedAt = &runDoc.FinishedAt
-	}
+	response.NextSinceTS = query.nextSince(runDoc.Samples)
+	response.Archived = runDoc.Archived
+	response.Tags = runDoc.Tags
+	response.RetainForever = runDoc.RetainForever
 
 	log.Printf("Found %d samples for run ID %s, finished: %v", len(response.Samples), runID, response.Finished)
 
+	setRunHeaders(w)
+	peak, current := runHeap(runDoc)
+	if query.hasAsOf {
+		peak, current = heapSummary(query.asOfSamples(runDoc.Samples))
+	}
+	setHeapHeaders(w, peak, current)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	data, truncated, err := h.encodeRunResponse(runID, query, response, msgpackResponse, httpjson.Pretty(r))
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if truncated {
+		log.Printf("✂️ Truncated run %s response to %d bytes", runID, len(data))
+		w.Header().Set(TruncatedHeader, "true")
+		w.Header().Add("Access-Control-Expose-Headers", TruncatedHeader)
+	}
+	if msgpackResponse {
+		w.Header().Set("Content-Type", MsgpackContentType)
+	}
+	w.Write(data)
+}
+
+// runPayload shapes a run response according to ?naming=, ?group_by= and ?format=
+func runPayload(runID string, query runQuery, response models.RunResponse) interface{} {
+	var payload interface{} = response
+	if query.camel {
+		payload = models.CamelCaseRunResponse{
+			Samples:     models.CamelCaseSamples(response.Samples),
+			ProcessInfo: response.ProcessInfo,
+			Finished:    response.Finished,
+			FinishedAt:  response.FinishedAt,
+			UpdatedAt:   response.UpdatedAt,
+			NextSinceTS: response.NextSinceTS,
+			Truncated:   response.Truncated,
+		}
+	}
+	if query.groupByPID {
+		groups := models.GroupByPID(response.Samples)
+		if query.processes {
+			for i := range groups {
+				if info, ok := response.ProcessInfo[models.ProcessKey(groups[i].Machine, groups[i].PID)]; ok {
+					groups[i].ProcessInfo = &info
+				}
+			}
+		}
+		payload = models.GroupedRunResponse{
+			Groups:      groups,
+			Finished:    response.Finished,
+			FinishedAt:  response.FinishedAt,
+			UpdatedAt:   response.UpdatedAt,
+			NextSinceTS: response.NextSinceTS,
+			Truncated:   response.Truncated,
+		}
+	}
+	if query.tree {
+		payload = models.TreeRunResponse{
+			Root:        models.ToTree(runID, response.Samples, query.bucketSecs),
+			Finished:    response.Finished,
+			FinishedAt:  response.FinishedAt,
+			UpdatedAt:   response.UpdatedAt,
+			NextSinceTS: response.NextSinceTS,
+			Truncated:   response.Truncated,
+		}
+	}
+	if query.columnar {
+		payload = models.ColumnarRunResponse{
+			Samples:     models.ToColumnar(response.Samples),
+			ProcessInfo: response.ProcessInfo,
+			Finished:    response.Finished,
+			FinishedAt:  response.FinishedAt,
+			UpdatedAt:   response.UpdatedAt,
+			NextSinceTS: response.NextSinceTS,
+			Truncated:   response.Truncated,
+		}
+	}
+	return payload
+}
+
+// heapSummary returns the highest heap usage of any sample and the highest heap usage
+// among each process's newest sample, both in MB
+func heapSummary(samples []models.Sample) (peak int, current int) {
+	latest := make(map[string]models.Sample)
+	for _, sample := range samples {
+		if sample.HeapUsed > peak {
+			peak = sample.HeapUsed
+		}
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if previous, ok := latest[key]; !ok || sample.Timestamp >= previous.Timestamp {
+			latest[key] = sample
+		}
+	}
+	for _, sample := range latest {
+		if sample.HeapUsed > current {
+			current = sample.HeapUsed
+		}
+	}
+	return peak, current
+}
+
+// runHeap returns a run's peak and current heap from the fields maintained on ingest,
+// computing them from its samples for runs not written since the fields were maintained
+func runHeap(runDoc *models.RunDoc) (peak int, current int) {
+	if runDoc.LatestHeap == nil {
+		return heapSummary(runDoc.Samples)
+	}
+	return runDoc.PeakHeapUsedMB, storage.CurrentHeapUsed(runDoc.LatestHeap)
+}
+
+// readRunForQuery reads the run for GetRun. ?since_ts= reads only the newer samples, except
+// for runs not written since the heap was maintained, whose heap headers need every sample.
+func (h *Handlers) readRunForQuery(ctx context.Context, runID string, query runQuery) (*models.RunDoc, error) {
+	if !query.hasSince || query.hasAsOf {
+		return h.storage.GetRun(ctx, runID)
+	}
+	runDoc, err := h.storage.GetRunSince(ctx, runID, query.since)
+	if err != nil || runDoc.LatestHeap != nil {
+		return runDoc, err
+	}
+	return h.storage.GetRun(ctx, runID)
+}
+
+// setRunHeaders sets the content and CORS headers of GET and HEAD /runs/{runId}
+func setRunHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+// setHeapHeaders sets X-Peak-Heap and X-Current-Heap (MB) and exposes them to browser clients
+func setHeapHeaders(w http.ResponseWriter, peak int, current int) {
+	w.Header().Set("X-Peak-Heap", strconv.Itoa(peak))
+	w.Header().Set("X-Current-Heap", strconv.Itoa(current))
+	w.Header().Set("Access-Control-Expose-Headers", "X-Peak-Heap, X-Current-Heap")
+}
+
+// runSubresource dispatches GET /runs/{runId}/{subresource}
+func (h *Handlers) runSubresource(w http.ResponseWriter, r *http.Request, runID string, subresource string) {
+	switch subresource {
+	case "export.csv":
+		h.exportCSV(w, r, runID)
+	case "samples.ndjson":
+		h.exportNDJSON(w, r, runID)
+	case "metrics.prom":
+		h.exportPrometheus(w, r, runID)
+	case "export/anonymized":
+		h.exportAnonymized(w, r, runID)
+	case "stats":
+		h.runStats(w, r, runID)
+	case "tail":
+		h.tailSamples(w, r, runID)
+	case "stream":
+		h.streamRun(w, r, runID)
+	case "processes":
+		h.runProcesses(w, r, runID)
+	case "retention":
+		h.getRunRetention(w, r, runID)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// tailSamples handles GET /runs/{runId}/tail?n=N, returning the newest N samples oldest first
+func (h *Handlers) tailSamples(w http.ResponseWriter, r *http.Request, runID string) {
+	n := DefaultTailSamples
+	if param := r.URL.Query().Get("n"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid n, expected a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	samples, err := h.storage.TailSamples(ctx, runID, n)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error reading tail of run %s: %v", runID, err)
+		writeStorageError(w, err)
 		return
 	}
+	if samples == nil {
+		samples = []models.Sample{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":  runID,
+		"samples": samples,
+	})
+}
+
+// RunStatuses handles POST /runs:statuses, returning the finished state, last update and
+// sample count of many runs at once. Runs that do not exist map to null and runs that
+// could not be read map to an error object, while the response as a whole stays 200.
+func (h *Handlers) RunStatuses(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.RunStatusesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.RunIDs) == 0 {
+		http.Error(w, "run_ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.RunIDs) > MaxStatusRunIDs {
+		http.Error(w, fmt.Sprintf("At most %d run_ids per request", MaxStatusRunIDs), http.StatusBadRequest)
+		return
+	}
+	for _, runID := range req.RunIDs {
+		if runID == "" || strings.Contains(runID, "/") {
+			http.Error(w, fmt.Sprintf("Invalid run ID %q", runID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	statuses, errs, err := h.storage.GetRunStatuses(ctx, req.RunIDs)
+	if err != nil {
+		log.Printf("Error getting run statuses: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	// Each run is reported on its own: a status, null when missing, or an error entry
+	response := make(map[string]any, len(req.RunIDs))
+	for _, runID := range req.RunIDs {
+		if status, ok := statuses[runID]; ok {
+			response[runID] = status
+		} else if err, ok := errs[runID]; ok {
+			log.Printf("Error getting status of run %s: %v", runID, err)
+			response[runID] = models.RunStatusError{Error: storageErrorMessage(err)}
+		} else {
+			response[runID] = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(response)
+}
+
+// runProcesses handles GET /runs/{runId}/processes?max_flags=N, returning the run's process info
+func (h *Handlers) runProcesses(w http.ResponseWriter, r *http.Request, runID string) {
+	maxFlags, err := parseMaxFlags(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	processDoc, err := h.storage.GetProcesses(ctx, runID)
+	if err != nil {
+		log.Printf("Error getting processes of run %s: %v", runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	processInfo := limitVMFlags(processDoc.ProcessInfo, maxFlags)
+	if processInfo == nil {
+		processInfo = map[string]models.ProcessInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":       runID,
+		"process_info": processInfo,
+	})
+}
+
+// ListRuns returns a page of summaries of recent runs, optionally filtered with ?provider=.
+// Pages hold at most ?limit= runs (capped by LIST_RUNS_MAX_PAGE); pass next_cursor as ?cursor= to continue.
+func (h *Handlers) ListRuns(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	limit, err := h.runsPageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sort, err := storage.ParseRunSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	provider := strings.TrimSpace(r.URL.Query().Get("provider"))
+	cursor := r.URL.Query().Get("cursor")
+	runs, nextCursor, err := h.storage.ListRuns(ctx, provider, sort, limit, cursor)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error listing runs: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(models.RunSummaryPage{Runs: runs, NextCursor: nextCursor})
+}
+
+// runsPageLimit returns ?limit= capped by LIST_RUNS_MAX_PAGE, ListRunsLimit without it
+func (h *Handlers) runsPageLimit(r *http.Request) (int, error) {
+	limit := h.listRunsMaxPage
+	if limit > ListRunsLimit {
+		limit = ListRunsLimit
+	}
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed <= 0 {
+			return 0, errors.New("Invalid limit, expected a positive integer")
+		}
+		limit = parsed
+	}
+	if limit > h.listRunsMaxPage {
+		limit = h.listRunsMaxPage
+	}
+	return limit, nil
+}
+
+// ingestBackfill imports a historical run using the start time supplied by the client.
+// The run is created finished, so it is skipped by the stale sweep.
+func (h *Handlers) ingestBackfill(ctx context.Context, w http.ResponseWriter, r *http.Request, req models.IngestRequest, provider string, format string) {
+	if req.StartTime.IsZero() {
+		http.Error(w, "Backfill requires start_time", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := storage.ParseDataFormat(format, req.Data, req.StartTime, h.parseConfig())
+	if err != nil {
+		log.Printf("Failed to parse backfill data: %v", err)
+		http.Error(w, fmt.Sprintf("Invalid data format: %v", err), http.StatusBadRequest)
+		return
+	}
+	samples = storage.DropImplausibleSamples(samples, h.sampleCeilingMB)
+	samples = storage.SetMachine(samples, strings.TrimSpace(req.Machine))
+	if h.rejectNoSamples(w, req.RunID, samples) {
+		return
+	}
+
+	if err := h.storage.StoreBackfill(ctx, req.RunID, req.StartTime, samples); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			http.Error(w, "Run already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to store backfill for run %s: %v", req.RunID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	if provider != "" {
+		if err := h.storage.SetRunProvider(ctx, req.RunID, provider); err != nil {
+			log.Printf("Failed to store provider for run %s: %v", req.RunID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "success", "samples": fmt.Sprintf("%d", len(samples)), "backfill": "true"})
 }
 
 // FinishRun marks a run as finished (requires JWT)
@@ -307,7 +1436,7 @@ func (h *Handlers) FinishRun(w http.ResponseWriter, r *http.Request) {
 	valid, err := auth.ValidateToken(token, runID)
 	if err != nil {
 		log.Printf("⚠️  Token validation failed for run %s: %v", runID, err)
-		http.Error(w, "Token validation failed", http.StatusUnauthorized)
+		writeTokenError(w, err)
 		return
 	}
 
@@ -318,23 +1447,332 @@ func (h *Handlers) FinishRun(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("✅ Token validated successfully for finishing run: %s", runID)
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	h.finishAuthorized(ctx, w, r, runID)
+}
+
+// finishAuthorized marks a run as finished once its token has been validated
+func (h *Handlers) finishAuthorized(ctx context.Context, w http.ResponseWriter, r *http.Request, runID string) {
 	log.Printf("Manually finishing run: %s", runID)
 
 	// Mark the run as finished
-	err = h.storage.MarkRunAsFinished(runID)
+	err := h.storage.MarkRunAsFinished(ctx, runID)
 	if err != nil {
 		log.Printf("Error finishing run %s: %v", runID, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
+	httpjson.NewEncoder(w, r).Encode(map[string]string{
 		"status":  "success",
 		"message": fmt.Sprintf("Run %s marked as finished", runID),
 	})
 
 	log.Printf("✅ Successfully marked run %s as finished", runID)
 }
+
+// AdminRuns handles admin-only per-run endpoints under /admin/runs/{runId}/...
+func (h *Handlers) AdminRuns(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Require admin authentication
+	if !auth.RequireAdminAuth(r) {
+		log.Printf("⚠️  Unauthorized admin request from %s for path: %s", r.RemoteAddr, r.URL.Path)
+		http.Error(w, "Unauthorized - admin secret required", http.StatusUnauthorized)
+		return
+	}
+
+	// Extract run_id and action from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/admin/runs/")
+	runID, action, _ := strings.Cut(path, "/")
+	if runID == "" {
+		http.Error(w, "Run ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "history":
+		h.getIngestHistory(w, r, runID)
+	case "pause":
+		h.setRunPaused(w, r, runID, true)
+	case "resume":
+		h.setRunPaused(w, r, runID, false)
+	case "archive":
+		h.setRunArchived(w, r, runID)
+	case "retain":
+		h.setRunRetainForever(w, r, runID, true)
+	case "release":
+		h.setRunRetainForever(w, r, runID, false)
+	case "compact":
+		h.compactRun(w, r, runID)
+	case "schema":
+		h.getRunSchema(w, r, runID)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// getRunSchema handles GET /admin/runs/{runId}/schema, reporting the layout version the
+// run is stored with next to the one this service writes
+func (h *Handlers) getRunSchema(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":                 runID,
+		"schema_version":         runDoc.SchemaVersion,
+		"current_schema_version": storage.CurrentSchemaVersion,
+	})
+}
+
+// compactRun handles POST /admin/runs/{runId}/compact?budget=N, dropping the least
+// important samples of the run until at most N remain
+func (h *Handlers) compactRun(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	budget, err := strconv.Atoi(r.URL.Query().Get("budget"))
+	if err != nil || budget <= 0 {
+		http.Error(w, "Invalid budget, expected a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	result, err := h.storage.CompactRun(ctx, runID, budget)
+	if err != nil {
+		switch {
+		case status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "not found"):
+			http.Error(w, "Run not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrRunArchived):
+			http.Error(w, "Run is archived", http.StatusConflict)
+		case errors.Is(err, storage.ErrCompactionUnsupported):
+			http.Error(w, "Compaction is not available with SAMPLES_SUBCOLLECTION", http.StatusConflict)
+		default:
+			log.Printf("Error compacting run %s: %v", runID, err)
+			writeStorageError(w, err)
+		}
+		return
+	}
+
+	dropped := result.SamplesBefore - result.SamplesAfter
+	log.Printf("🗜️ Run %s compacted by admin from %s, dropped %d samples", runID, r.RemoteAddr, dropped)
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":         runID,
+		"budget":         budget,
+		"dropped":        dropped,
+		"samples_before": result.SamplesBefore,
+		"samples_after":  result.SamplesAfter,
+		"bytes_before":   result.BytesBefore,
+		"bytes_after":    result.BytesAfter,
+	})
+}
+
+// RotateAdminSecret handles POST /admin/rotate-secret with body {"new_secret": "..."}.
+// It must be authenticated with the current secret. The new secret only takes effect on
+// the instance that served the request and is lost on restart: with several instances,
+// rotate each of them (or redeploy with the new ADMIN_SECRET).
+func (h *Handlers) RotateAdminSecret(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.RequireAdminAuth(r) {
+		log.Printf("⚠️  Unauthorized admin secret rotation attempt from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized - admin secret required", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		NewSecret string `json:"new_secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := auth.RotateAdminSecret(req.NewSecret); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("🔑 Admin secret rotated by %s (this instance only, update ADMIN_SECRET to persist)", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]string{"status": "rotated"})
+}
+
+// getIngestHistory returns the recorded ingest events for a run
+func (h *Handlers) getIngestHistory(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	events := runDoc.IngestHistory
+	if events == nil {
+		events = []models.IngestEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id": runID,
+		"events": events,
+	})
+}
+
+// setRunPaused pauses or resumes ingestion for a run; reads remain allowed while paused
+func (h *Handlers) setRunPaused(w http.ResponseWriter, r *http.Request, runID string, paused bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	if err := h.storage.SetRunPaused(ctx, runID, paused); err != nil {
+		if status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrRunArchived) {
+			http.Error(w, "Run is archived", http.StatusConflict)
+			return
+		}
+		log.Printf("Error setting paused=%v for run %s: %v", paused, runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	log.Printf("✅ Run %s paused=%v by admin from %s", runID, paused, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id": runID,
+		"paused": paused,
+	})
+}
+
+// setRunRetainForever handles POST /admin/runs/{runId}/retain and /release, exempting a
+// run from retention (e.g. a benchmark baseline) or returning it to the normal policy
+func (h *Handlers) setRunRetainForever(w http.ResponseWriter, r *http.Request, runID string, retain bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	if err := h.storage.SetRunRetainForever(ctx, runID, retain); err != nil {
+		if status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error setting retain_forever=%v for run %s: %v", retain, runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	log.Printf("📌 Run %s retain_forever=%v by admin from %s", runID, retain, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":         runID,
+		"retain_forever": retain,
+	})
+}
+
+// setRunArchived handles POST /admin/runs/{runId}/archive, typically after the run was
+// exported. Archived runs stay readable but reject every write.
+func (h *Handlers) setRunArchived(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	if err := h.storage.SetRunArchived(ctx, runID); err != nil {
+		if status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrRunNotFinished) {
+			http.Error(w, "Only finished runs can be archived", http.StatusConflict)
+			return
+		}
+		log.Printf("Error archiving run %s: %v", runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	log.Printf("🗄️ Run %s archived by admin from %s", runID, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id":   runID,
+		"archived": true,
+	})
+}
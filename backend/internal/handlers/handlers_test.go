@@ -1,10 +1,34 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
 	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+	"github.com/prometheus/common/expfmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestIngestHandler_RequestWithProcessInfo(t *testing.T) {
@@ -113,3 +137,3500 @@ func TestRunResponse_WithoutProcessInfo(t *testing.T) {
 		t.Error("ProcessInfo should be nil or empty when not present")
 	}
 }
+
+func TestAdminRuns_HistoryRequiresAdminSecret(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	h := NewHandlers(nil)
+	req := httptest.NewRequest(http.MethodGet, "/admin/runs/run-1/history", nil)
+	w := httptest.NewRecorder()
+
+	h.AdminRuns(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin secret, got %d", w.Code)
+	}
+}
+
+func TestAdminRuns_UnknownAction(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	h := NewHandlers(nil)
+	req := httptest.NewRequest(http.MethodGet, "/admin/runs/run-1/unknown", nil)
+	req.Header.Set("X-Admin-Secret", "admin-test-secret")
+	w := httptest.NewRecorder()
+
+	h.AdminRuns(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown action, got %d", w.Code)
+	}
+}
+
+func TestIngest_EmptyDataFinishesRunWhenEnabled(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-finish", StartTime: time.Now()})
+
+	h := NewHandlers(store)
+	h.finishOnEmptyIngest = true
+
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-finish", `{"run_id":"run-finish","data":""}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	runDoc, _ := store.GetRun(context.Background(), "run-finish")
+	if !runDoc.Finished {
+		t.Error("Expected run to be marked finished by empty ingest")
+	}
+}
+
+func TestIngest_EmptyDataRejectedByDefault(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-default", StartTime: time.Now()})
+
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-default", `{"run_id":"run-default","data":""}`))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", w.Code)
+	}
+
+	runDoc, _ := store.GetRun(context.Background(), "run-default")
+	if runDoc.Finished {
+		t.Error("Run should not be finished when the option is disabled")
+	}
+}
+
+func TestTokenErrors_DistinctResponseBodies(t *testing.T) {
+	expired, err := auth.GenerateTokenForTest("run-token", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("GenerateTokenForTest failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{"expired", expired, "token_expired"},
+		{"invalid", "garbage.token", "token_invalid"},
+	}
+
+	h := NewHandlers(newFakeStore())
+	for _, tt := range tests {
+		requests := map[string]func() *httptest.ResponseRecorder{
+			"ingest": func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"run_id":"run-token","data":"x"}`))
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+				w := httptest.NewRecorder()
+				h.Ingest(w, req)
+				return w
+			},
+			"finish": func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/finish/run-token", nil)
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+				w := httptest.NewRecorder()
+				h.FinishRun(w, req)
+				return w
+			},
+		}
+
+		for endpoint, do := range requests {
+			t.Run(tt.name+"/"+endpoint, func(t *testing.T) {
+				w := do()
+				if w.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected 401, got %d", w.Code)
+				}
+				var body map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Expected JSON body, got %q: %v", w.Body.String(), err)
+				}
+				if body["error"] != tt.expected {
+					t.Errorf("Expected error %q, got %q", tt.expected, body["error"])
+				}
+			})
+		}
+	}
+}
+
+func TestIngest_RecordsProvider(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+	line := "00:00:01 | 12345 | GradleDaemon | 100MB | 200MB | 300MB"
+
+	// Provider from the request body
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-gh", `{"run_id":"run-gh","provider":"github","data":"`+line+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Provider from the header, unknown values stored as-is
+	req := newIngestRequest(t, "run-custom", `{"run_id":"run-custom","data":"`+line+`"}`)
+	req.Header.Set("X-CI-Provider", "BuildKite-Custom")
+	w = httptest.NewRecorder()
+	h.Ingest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if runDoc, _ := store.GetRun(context.Background(), "run-gh"); runDoc.Provider != "github" {
+		t.Errorf("Expected provider github, got %q", runDoc.Provider)
+	}
+	if runDoc, _ := store.GetRun(context.Background(), "run-custom"); runDoc.Provider != "BuildKite-Custom" {
+		t.Errorf("Expected provider BuildKite-Custom, got %q", runDoc.Provider)
+	}
+}
+
+func TestListRuns_FilterByProvider(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	store.putRun(models.RunDoc{RunID: "gh-1", Provider: "github", UpdatedAt: now})
+	store.putRun(models.RunDoc{RunID: "gh-2", Provider: "github", UpdatedAt: now.Add(-time.Minute)})
+	store.putRun(models.RunDoc{RunID: "jenkins-1", Provider: "jenkins", UpdatedAt: now})
+
+	h := NewHandlers(store)
+
+	list := func(query string) []models.RunSummary {
+		w := httptest.NewRecorder()
+		h.ListRuns(w, httptest.NewRequest(http.MethodGet, "/runs"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var body struct {
+			Runs []models.RunSummary `json:"runs"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return body.Runs
+	}
+
+	if runs := list(""); len(runs) != 3 {
+		t.Errorf("Expected 3 runs without filter, got %d", len(runs))
+	}
+
+	runs := list("?provider=github")
+	if len(runs) != 2 {
+		t.Fatalf("Expected 2 github runs, got %d", len(runs))
+	}
+	if runs[0].RunID != "gh-1" || runs[1].RunID != "gh-2" {
+		t.Errorf("Expected most recently updated first, got %s, %s", runs[0].RunID, runs[1].RunID)
+	}
+	for _, run := range runs {
+		if run.Provider != "github" {
+			t.Errorf("Filter returned run with provider %q", run.Provider)
+		}
+	}
+}
+
+// getRunResponse calls GetRun for path and decodes the JSON response
+func getRunResponse(t *testing.T, h *Handlers, path string) models.RunResponse {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for %s, got %d: %s", path, w.Code, w.Body.String())
+	}
+
+	var response models.RunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response
+}
+
+func TestGetRun_OrderDescending(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-order", Samples: []models.Sample{
+		{Timestamp: 1000, PID: "1"},
+		{Timestamp: 2000, PID: "1"},
+		{Timestamp: 3000, PID: "1"},
+	}})
+	h := NewHandlers(store)
+
+	asc := getRunResponse(t, h, "/runs/run-order")
+	desc := getRunResponse(t, h, "/runs/run-order?order=desc")
+
+	if len(desc.Samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(desc.Samples))
+	}
+	for i := range desc.Samples {
+		if asc.Samples[i].Timestamp != int64(1000*(i+1)) {
+			t.Errorf("Default order should be ascending, got %d at %d", asc.Samples[i].Timestamp, i)
+		}
+		if desc.Samples[i].Timestamp != int64(1000*(3-i)) {
+			t.Errorf("Expected descending order, got %d at %d", desc.Samples[i].Timestamp, i)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-order?order=sideways", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid order, got %d", w.Code)
+	}
+}
+
+func TestGetRun_CircuitOpenMapsTo503(t *testing.T) {
+	store := newFakeStore()
+	store.getRunErr = &storage.CircuitOpenError{RetryAfter: 12500 * time.Millisecond}
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-1", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while breaker is open, got %d", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "13" {
+		t.Errorf("Expected Retry-After 13, got %q", retryAfter)
+	}
+}
+
+func TestGetRun_PermissionDeniedMapsTo503(t *testing.T) {
+	store := newFakeStore()
+	store.getRunErr = status.Error(codes.PermissionDenied, "Missing or insufficient permissions.")
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-1", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 for a permission-denied error, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "permission denied") {
+		t.Errorf("Expected the body to name the permission problem, got %q", w.Body.String())
+	}
+}
+
+func TestGetRun_ColumnarFormat(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-columnar", Samples: []models.Sample{
+		{Timestamp: 1000, PID: "1", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 200, RSS: 300},
+		{Timestamp: 2000, PID: "2", Name: "KotlinCompileDaemon", HeapUsed: 110, HeapCap: 210, RSS: 310, GCTime: 5},
+		{Timestamp: 3000, PID: "1", Name: "GradleDaemon", HeapUsed: 120, HeapCap: 220, RSS: 320},
+	}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-columnar?format=columnar", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var raw struct {
+		Samples map[string][]interface{} `json:"samples"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("Expected columnar object under samples: %v", err)
+	}
+	for _, column := range []string{"timestamps", "elapsed_times", "pids", "names", "heap_used", "heap_cap", "rss", "gc_time"} {
+		values, ok := raw.Samples[column]
+		if !ok {
+			t.Errorf("Missing column %q", column)
+			continue
+		}
+		if len(values) != 3 {
+			t.Errorf("Column %q has %d entries, expected 3", column, len(values))
+		}
+	}
+
+	var response models.ColumnarRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode columnar response: %v", err)
+	}
+	if response.Samples.PIDs[1] != "2" || response.Samples.HeapUsed[2] != 120 || response.Samples.GCTime[1] != 5 {
+		t.Errorf("Unexpected column values: %+v", response.Samples)
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	valid, _, err := auth.GenerateToken("run-validate")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	expired, err := auth.GenerateTokenForTest("run-validate", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("GenerateTokenForTest failed: %v", err)
+	}
+
+	// A nil store proves the endpoint never touches storage
+	h := NewHandlers(nil)
+	validate := func(token, runID string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(models.TokenValidateRequest{Token: token, RunID: runID})
+		w := httptest.NewRecorder()
+		h.ValidateAuth(w, httptest.NewRequest(http.MethodPost, "/auth/validate", strings.NewReader(string(body))))
+		return w
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		w := validate(valid, "run-validate")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response models.TokenValidateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if !response.Valid || response.TTLSeconds <= 0 || response.TTLSeconds > int64((2*time.Hour).Seconds()) {
+			t.Errorf("Unexpected response: %+v", response)
+		}
+	})
+
+	for name, tc := range map[string]struct {
+		token, runID, reason string
+	}{
+		"expired":        {expired, "run-validate", "token_expired"},
+		"mismatched run": {valid, "other-run", "token_invalid"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := validate(tc.token, tc.runID)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected 401, got %d", w.Code)
+			}
+			var body map[string]string
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body["error"] != tc.reason {
+				t.Errorf("Expected error %q, got %q", tc.reason, body["error"])
+			}
+		})
+	}
+}
+
+func TestValidateAuth_TTLFollowsClock(t *testing.T) {
+	defer func() { clock.Now = time.Now }()
+	issued := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock.Now = func() time.Time { return issued }
+	token, expiresAt, err := auth.GenerateToken("run-clock")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	h := NewHandlers(nil)
+	validate := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(models.TokenValidateRequest{Token: token, RunID: "run-clock"})
+		w := httptest.NewRecorder()
+		h.ValidateAuth(w, httptest.NewRequest(http.MethodPost, "/auth/validate", strings.NewReader(string(body))))
+		return w
+	}
+
+	// The TTL and the expiry decision read the same clock
+	clock.Now = func() time.Time { return expiresAt.Add(-90 * time.Second) }
+	w := validate()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 before expiry, got %d: %s", w.Code, w.Body.String())
+	}
+	var response models.TokenValidateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.TTLSeconds != 90 {
+		t.Errorf("Expected a 90s TTL, got %d", response.TTLSeconds)
+	}
+
+	clock.Now = func() time.Time { return expiresAt.Add(time.Nanosecond) }
+	if w := validate(); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 just past expiry, got %d", w.Code)
+	}
+}
+
+func TestExportCSV_SelectedColumns(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-csv", Samples: []models.Sample{
+		{Timestamp: 1000, PID: "1", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 200, RSS: 300},
+		{Timestamp: 2000, PID: "1", Name: "GradleDaemon", HeapUsed: 150, HeapCap: 200, RSS: 310},
+	}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-csv/export.csv?columns=heap_used,timestamp", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expected := "heap_used,timestamp\n100,1000\n150,2000\n"
+	if w.Body.String() != expected {
+		t.Errorf("Unexpected CSV:\n%s\nexpected:\n%s", w.Body.String(), expected)
+	}
+
+	// All columns by default
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-csv/export.csv", nil))
+	if header := strings.SplitN(w.Body.String(), "\n", 2)[0]; header != "timestamp,elapsed_time,pid,name,heap_used,heap_cap,rss,gc_time" {
+		t.Errorf("Unexpected default header: %s", header)
+	}
+
+	// Unknown columns are rejected
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-csv/export.csv?columns=heap,timestamp", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown column, got %d", w.Code)
+	}
+}
+
+func TestExportAnonymized(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{
+		RunID:     "run-anon",
+		StartTime: time.Now(),
+		Provider:  "jenkins",
+		Tags:      map[string]string{"team": "payments-internal"},
+		Samples: []models.Sample{
+			{Timestamp: 1760000001000, ElapsedTime: 1, PID: "4242", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 512, RSS: 600, Phase: "compiling", Extra: map[string]float64{"metaspace": 80}},
+			{Timestamp: 1760000001000, ElapsedTime: 1, PID: "4243", Name: "KotlinCompileDaemon", HeapUsed: 50, HeapCap: 256, RSS: 300, Machine: "ci-host-7"},
+			{Timestamp: 1760000002000, ElapsedTime: 2, PID: "4242", Name: "GradleDaemon", HeapUsed: 120, HeapCap: 512, RSS: 610, GCTime: 30},
+		},
+	})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-anon/export/anonymized", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body := w.Body.String()
+	for _, identifying := range []string{"4242", "4243", "GradleDaemon", "Kotlin", "ci-host-7", "compiling", "metaspace", "payments", "jenkins", "run-anon", "1760000001000"} {
+		if strings.Contains(body, identifying) {
+			t.Errorf("Expected %q to be stripped from the export, got %s", identifying, body)
+		}
+	}
+
+	var run models.AnonymizedRun
+	if err := json.Unmarshal(w.Body.Bytes(), &run); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := []models.AnonymizedSample{
+		{Process: "process-1", ElapsedTime: 1, HeapUsed: 100, HeapCap: 512, RSS: 600},
+		{Process: "process-2", ElapsedTime: 1, HeapUsed: 50, HeapCap: 256, RSS: 300},
+		{Process: "process-1", ElapsedTime: 2, HeapUsed: 120, HeapCap: 512, RSS: 610, GCTime: 30},
+	}
+	if run.Processes != 2 || !reflect.DeepEqual(run.Samples, expected) {
+		t.Errorf("Expected the same PID to map to the same alias, got %+v", run)
+	}
+}
+
+func TestExportPrometheus(t *testing.T) {
+	start := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	store := newFakeStore()
+	store.putRun(models.RunDoc{
+		RunID:      `run-"prom"`,
+		StartTime:  start,
+		Finished:   true,
+		FinishedAt: start.Add(90 * time.Second),
+		Samples: []models.Sample{
+			{ElapsedTime: 10, PID: "1", HeapUsed: 100, GCTime: 200},
+			{ElapsedTime: 20, PID: "1", HeapUsed: 300, GCTime: 500},
+			{ElapsedTime: 20, PID: "2", HeapUsed: 50, GCTime: 250},
+		},
+	})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/"+url.PathEscape(`run-"prom"`)+"/metrics.prom", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(w.Body.String()))
+	if err != nil {
+		t.Fatalf("Expected valid exposition format, got %v:\n%s", err, w.Body.String())
+	}
+	expected := map[string]float64{
+		"build_watcher_build_peak_heap_used_bytes": 300 * 1024 * 1024,
+		"build_watcher_build_duration_seconds":     90,
+		"build_watcher_build_gc_time_seconds":      0.75,
+	}
+	for name, value := range expected {
+		family, ok := families[name]
+		if !ok || len(family.Metric) != 1 {
+			t.Errorf("Expected a single %s metric, got %v", name, family)
+			continue
+		}
+		metric := family.Metric[0]
+		if got := metric.GetGauge().GetValue(); got != value {
+			t.Errorf("Expected %s %v, got %v", name, value, got)
+		}
+		if len(metric.Label) != 1 || metric.Label[0].GetName() != "run_id" || metric.Label[0].GetValue() != `run-"prom"` {
+			t.Errorf("Expected the run_id label on %s, got %v", name, metric.Label)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/missing/metrics.prom", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing run, got %d", w.Code)
+	}
+}
+
+func TestExportCSV_IncludeMeta(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{
+		RunID:     "run-meta",
+		StartTime: time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC),
+		Finished:  true,
+		Tags:      map[string]string{"team": "android", "branch": "main"},
+		Samples:   []models.Sample{{Timestamp: 1000, PID: "1", HeapUsed: 100}},
+	})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-meta/export.csv?columns=timestamp,heap_used&include_meta=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	expected := "# run_id: run-meta\n" +
+		"# start_time: 2025-03-04T05:06:07Z\n" +
+		"# finished: true\n" +
+		"# label: branch=main\n" +
+		"# label: team=android\n" +
+		"timestamp,heap_used\n1000,100\n"
+	if w.Body.String() != expected {
+		t.Errorf("Unexpected CSV:\n%s\nexpected:\n%s", w.Body.String(), expected)
+	}
+
+	// Without the flag the export starts with the header
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-meta/export.csv", nil))
+	if strings.HasPrefix(w.Body.String(), "#") {
+		t.Errorf("Expected no metadata by default, got:\n%s", w.Body.String())
+	}
+}
+
+func TestExportNDJSON_ReconstructsSamples(t *testing.T) {
+	samples := make([]models.Sample, NDJSONFlushEvery+3)
+	for i := range samples {
+		samples[i] = models.Sample{Timestamp: int64(1000 * i), PID: "1", Name: "GradleDaemon", HeapUsed: 100 + i, HeapCap: 2048, RSS: 300, Phase: "compile"}
+	}
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-ndjson", Samples: samples})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-ndjson/samples.ndjson", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Expected application/x-ndjson, got %q", contentType)
+	}
+
+	var decoded []models.Sample
+	decoder := json.NewDecoder(w.Body)
+	for decoder.More() {
+		var sample models.Sample
+		if err := decoder.Decode(&sample); err != nil {
+			t.Fatalf("Failed to decode NDJSON line %d: %v", len(decoded), err)
+		}
+		decoded = append(decoded, sample)
+	}
+	if len(decoded) != len(samples) {
+		t.Fatalf("Expected %d samples, got %d", len(samples), len(decoded))
+	}
+	for i := range samples {
+		if decoded[i].Timestamp != samples[i].Timestamp || decoded[i].HeapUsed != samples[i].HeapUsed || decoded[i].Phase != samples[i].Phase {
+			t.Fatalf("Sample %d did not round-trip: got %+v, expected %+v", i, decoded[i], samples[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/missing/samples.ndjson", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing run, got %d", w.Code)
+	}
+}
+
+func TestAdminRuns_PauseRejectsIngestUntilResumed(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-pause", StartTime: time.Now()})
+	h := NewHandlers(store)
+
+	admin := func(action string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/runs/run-pause/"+action, nil)
+		req.Header.Set("X-Admin-Secret", "admin-test-secret")
+		w := httptest.NewRecorder()
+		h.AdminRuns(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", action, w.Code, w.Body.String())
+		}
+	}
+	ingest := func() int {
+		w := httptest.NewRecorder()
+		body := `{"run_id":"run-pause","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+		h.Ingest(w, newIngestRequest(t, "run-pause", body))
+		return w.Code
+	}
+
+	admin("pause")
+	if code := ingest(); code != http.StatusLocked {
+		t.Fatalf("Expected 423 while paused, got %d", code)
+	}
+
+	// Reads stay available while paused
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-pause", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected GetRun to succeed while paused, got %d", w.Code)
+	}
+
+	admin("resume")
+	if code := ingest(); code != http.StatusOK {
+		t.Fatalf("Expected 200 after resume, got %d", code)
+	}
+	runDoc, _ := store.GetRun(context.Background(), "run-pause")
+	if len(runDoc.Samples) != 1 {
+		t.Errorf("Expected 1 sample after resume, got %d", len(runDoc.Samples))
+	}
+}
+
+func TestAdminRuns_PauseUnknownRun(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	h := NewHandlers(newFakeStore())
+	req := httptest.NewRequest(http.MethodPost, "/admin/runs/missing/pause", nil)
+	req.Header.Set("X-Admin-Secret", "admin-test-secret")
+	w := httptest.NewRecorder()
+
+	h.AdminRuns(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown run, got %d", w.Code)
+	}
+}
+
+func TestAdminRuns_RetainForever(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-baseline", Finished: true, Samples: []models.Sample{{PID: "1", HeapUsed: 100}}})
+	h := NewHandlers(store)
+
+	admin := func(action string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/runs/run-baseline/"+action, nil)
+		req.Header.Set("X-Admin-Secret", "admin-test-secret")
+		w := httptest.NewRecorder()
+		h.AdminRuns(w, req)
+		return w.Code
+	}
+
+	if code := admin("retain"); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if response := getRunResponse(t, h, "/runs/run-baseline"); !response.RetainForever || len(response.Samples) != 1 {
+		t.Errorf("Expected the retained run readable and flagged, got %+v", response)
+	}
+	if code := admin("release"); code != http.StatusOK || store.runs["run-baseline"].RetainForever {
+		t.Errorf("Expected release to clear the flag, got %d", code)
+	}
+}
+
+func TestRunRetention(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	retention := 3 * time.Hour
+
+	// A long unfinished run keeps being updated, but retention counts from its creation
+	running := runRetention("run-1", &models.RunDoc{CreatedAt: now.Add(-150 * time.Minute), UpdatedAt: now.Add(-time.Minute)}, now, retention, false)
+	if running.DeletesAt == nil || !running.DeletesAt.Equal(now.Add(30*time.Minute)) || *running.SecondsRemaining != 1800 {
+		t.Errorf("Expected deletion 3h after creation, 1800s away, got %+v", running)
+	}
+
+	finished := runRetention("run-2", &models.RunDoc{CreatedAt: now.Add(-2 * time.Hour), FinishedAt: now.Add(-time.Hour), ExpireAt: now.Add(30 * time.Minute)}, now, retention, false)
+	if *finished.SecondsRemaining != 1800 {
+		t.Errorf("Expected the TTL's earlier expire_at to win, got %d seconds", *finished.SecondsRemaining)
+	}
+
+	imported := runRetention("run-3", &models.RunDoc{CreatedAt: now.Add(-48 * time.Hour), FinishedAt: now.Add(-47 * time.Hour), ImportedAt: now.Add(-time.Hour)}, now, retention, false)
+	if *imported.SecondsRemaining != 7200 {
+		t.Errorf("Expected retention counted from the import, got %d seconds", *imported.SecondsRemaining)
+	}
+
+	overdue := runRetention("run-4", &models.RunDoc{CreatedAt: now.Add(-5 * time.Hour)}, now, retention, false)
+	if *overdue.SecondsRemaining != 0 {
+		t.Errorf("Expected an overdue run to report 0 seconds, got %d", *overdue.SecondsRemaining)
+	}
+
+	backfill := &models.RunDoc{CreatedAt: now.Add(-5 * time.Hour), FinishedAt: now.Add(-5 * time.Hour), Backfill: true}
+	if kept := runRetention("run-5", backfill, now, retention, true); kept.DeletesAt != nil {
+		t.Errorf("Expected no deletion for a backfilled run with BACKFILL_SKIP_RETENTION, got %v", kept.DeletesAt)
+	}
+	if due := runRetention("run-5", backfill, now, retention, false); due.DeletesAt == nil || *due.SecondsRemaining != 0 {
+		t.Errorf("Expected a backfilled run to be due without BACKFILL_SKIP_RETENTION, got %+v", due)
+	}
+
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-baseline", UpdatedAt: now, RetainForever: true})
+	w := httptest.NewRecorder()
+	NewHandlers(store).GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-baseline/retention", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body["retain_forever"] != true || body["deletes_at"] != nil || body["seconds_remaining"] != nil {
+		t.Errorf("Expected null deletion for a retained run, got %v", body)
+	}
+}
+
+func TestIngest_BackfillCreatesFinishedRun(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	body := `{"run_id":"run-backfill","backfill":true,"start_time":"2025-01-02T03:00:00Z",` +
+		`"data":"00:00:10 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-backfill", body))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	runDoc, err := store.GetRun(context.Background(), "run-backfill")
+	if err != nil {
+		t.Fatalf("Expected backfilled run to exist: %v", err)
+	}
+	if !runDoc.Finished || !runDoc.Backfill {
+		t.Errorf("Expected backfilled run to be finished and flagged: %+v", runDoc)
+	}
+	start := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	if len(runDoc.Samples) != 1 || runDoc.Samples[0].Timestamp != storage.ToMillis(start.Add(10*time.Second)) {
+		t.Errorf("Expected sample timestamp derived from provided start_time, got %+v", runDoc.Samples)
+	}
+
+	// A second backfill for the same run is rejected rather than merged
+	w = httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-backfill", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for existing run, got %d", w.Code)
+	}
+}
+
+func TestIngest_BackfillRequiresStartTime(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+
+	body := `{"run_id":"run-nostart","backfill":true,"data":"00:00:10 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-nostart", body))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without start_time, got %d", w.Code)
+	}
+}
+
+func TestRunStats_CountsNonMonotonicElapsedPerPID(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-stats", Samples: []models.Sample{
+		{PID: "1", ElapsedTime: 1},
+		{PID: "2", ElapsedTime: 1},
+		{PID: "1", ElapsedTime: 2},
+		{PID: "1", ElapsedTime: 1}, // went backward
+		{PID: "2", ElapsedTime: 2},
+		{PID: "1", ElapsedTime: 3},
+	}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-stats/stats", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats models.RunStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.SampleCount != 6 {
+		t.Errorf("Expected 6 samples, got %d", stats.SampleCount)
+	}
+	if stats.NonMonotonicElapsed["1"] != 1 {
+		t.Errorf("Expected 1 non-monotonic elapsed time for PID 1, got %d", stats.NonMonotonicElapsed["1"])
+	}
+	if _, ok := stats.NonMonotonicElapsed["2"]; ok {
+		t.Errorf("PID 2 is monotonic and should not be reported: %v", stats.NonMonotonicElapsed)
+	}
+}
+
+func TestRunStats_KeysProcessesByMachine(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-machines", Samples: []models.Sample{
+		{Machine: "a", PID: "1", ElapsedTime: 5},
+		{Machine: "b", PID: "1", ElapsedTime: 1}, // same PID on another machine, not a step back
+		{Machine: "a", PID: "1", ElapsedTime: 6},
+		{Machine: "b", PID: "1", ElapsedTime: 2},
+	}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-machines/stats", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var stats models.RunStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if len(stats.NonMonotonicElapsed) != 0 {
+		t.Errorf("Expected no non-monotonic elapsed times across machines, got %v", stats.NonMonotonicElapsed)
+	}
+	if _, ok := stats.HeapTrend[models.ProcessKey("a", "1")]; !ok {
+		t.Errorf("Expected a heap trend for a/1, got %v", stats.HeapTrend)
+	}
+	if _, ok := stats.HeapTrend[models.ProcessKey("b", "1")]; !ok {
+		t.Errorf("Expected a heap trend for b/1, got %v", stats.HeapTrend)
+	}
+}
+
+func TestIngest_DataFormatHeader(t *testing.T) {
+	tests := map[string]string{
+		storage.DataFormatPipe6:  "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB",
+		storage.DataFormatPipe7:  "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 0.1s",
+		storage.DataFormatCSV:    "1,1,GradleDaemon,100,200,300",
+		storage.DataFormatNDJSON: `{"elapsed_time":1,"pid":"1","name":"GradleDaemon","heap_used":100,"heap_cap":200,"rss":300}`,
+	}
+
+	for format, data := range tests {
+		t.Run(format, func(t *testing.T) {
+			store := newFakeStore()
+			h := NewHandlers(store)
+
+			body, _ := json.Marshal(models.IngestRequest{RunID: "run-format", Data: data})
+			req := newIngestRequest(t, "run-format", string(body))
+			req.Header.Set("X-Data-Format", format)
+			w := httptest.NewRecorder()
+			h.Ingest(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			runDoc, _ := store.GetRun(context.Background(), "run-format")
+			if len(runDoc.Samples) != 1 || runDoc.Samples[0].HeapUsed != 100 {
+				t.Errorf("Unexpected samples: %+v", runDoc.Samples)
+			}
+		})
+	}
+}
+
+func TestIngest_SampleCeilingAppliesToEveryFormat(t *testing.T) {
+	tests := map[string]string{
+		"":                       "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB\n00:00:02 | 1 | GradleDaemon | 4294967MB | 200MB | 300MB",
+		storage.DataFormatCSV:    "1,1,GradleDaemon,100,200,300\n2,1,GradleDaemon,4294967,200,300",
+		storage.DataFormatNDJSON: `{"elapsed_time":1,"pid":"1","heap_used":100,"heap_cap":200,"rss":300}` + "\n" + `{"elapsed_time":2,"pid":"1","heap_used":100,"heap_cap":200,"rss":4294967}`,
+	}
+
+	for format, data := range tests {
+		t.Run(format, func(t *testing.T) {
+			store := newFakeStore()
+			h := NewHandlers(store)
+			h.sampleCeilingMB = 65536
+
+			body, _ := json.Marshal(models.IngestRequest{RunID: "run-ceiling", Data: data})
+			req := newIngestRequest(t, "run-ceiling", string(body))
+			req.Header.Set("X-Data-Format", format)
+			w := httptest.NewRecorder()
+			h.Ingest(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			runDoc, _ := store.GetRun(context.Background(), "run-ceiling")
+			if len(runDoc.Samples) != 1 || runDoc.Samples[0].ElapsedTime != 1 {
+				t.Errorf("Expected only the plausible sample stored, got %+v", runDoc.Samples)
+			}
+		})
+	}
+}
+
+func TestIngest_CommentPrefixFromConfig(t *testing.T) {
+	t.Setenv("INGEST_COMMENT_PREFIX", "//")
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	data := "// agent v2.1\n00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"
+	body, _ := json.Marshal(models.IngestRequest{RunID: "run-comments", Data: data})
+	req := newIngestRequest(t, "run-comments", string(body))
+	req.Header.Set("X-Data-Format", storage.DataFormatPipe6)
+	w := httptest.NewRecorder()
+	h.Ingest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the comment line skipped, got %d: %s", w.Code, w.Body.String())
+	}
+	if runDoc, _ := store.GetRun(context.Background(), "run-comments"); len(runDoc.Samples) != 1 {
+		t.Errorf("Expected 1 sample, got %+v", runDoc.Samples)
+	}
+}
+
+func TestIngest_DataFormatHeaderMismatchRejected(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+
+	body := `{"run_id":"run-format","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+	req := newIngestRequest(t, "run-format", body)
+	req.Header.Set("X-Data-Format", storage.DataFormatPipe7)
+	w := httptest.NewRecorder()
+	h.Ingest(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a 6-field line declared as v1-pipe7, got %d", w.Code)
+	}
+}
+
+func TestRunTail_ReturnsNewestSamples(t *testing.T) {
+	store := newFakeStore()
+	var samples []models.Sample
+	for i := 1; i <= 10; i++ {
+		samples = append(samples, models.Sample{PID: "1", Timestamp: int64(i)})
+	}
+	store.putRun(models.RunDoc{RunID: "run-tail", Samples: samples})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-tail/tail?n=3", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Samples []models.Sample `json:"samples"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Samples) != 3 || response.Samples[0].Timestamp != 8 || response.Samples[2].Timestamp != 10 {
+		t.Errorf("Expected samples 8..10, got %+v", response.Samples)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-tail/tail?n=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for n=0, got %d", w.Code)
+	}
+}
+
+func TestListRuns_PaginatesWithCursor(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	for i := 0; i < 7; i++ {
+		// Two runs share each timestamp to exercise the run ID tie-breaker
+		updatedAt := now.Add(-time.Duration(i/2) * time.Minute)
+		store.putRun(models.RunDoc{RunID: fmt.Sprintf("run-%d", i), UpdatedAt: updatedAt})
+	}
+
+	h := NewHandlers(store)
+	h.listRunsMaxPage = 3
+
+	seen := make(map[string]bool)
+	cursor := ""
+	pages := 0
+	for {
+		// ?limit= above the maximum is capped
+		path := "/runs?limit=10"
+		if cursor != "" {
+			path += "&cursor=" + cursor
+		}
+		w := httptest.NewRecorder()
+		h.ListRuns(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var page models.RunSummaryPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		pages++
+		if len(page.Runs) > 3 {
+			t.Fatalf("Page %d has %d runs, expected at most 3", pages, len(page.Runs))
+		}
+		for _, run := range page.Runs {
+			if seen[run.RunID] {
+				t.Errorf("Run %s returned on more than one page", run.RunID)
+			}
+			seen[run.RunID] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if pages != 3 || len(seen) != 7 {
+		t.Errorf("Expected 7 runs over 3 pages, got %d runs over %d pages", len(seen), pages)
+	}
+
+	w := httptest.NewRecorder()
+	h.ListRuns(w, httptest.NewRequest(http.MethodGet, "/runs?cursor=not-a-cursor", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cursor, got %d", w.Code)
+	}
+}
+
+func TestListRuns_Sort(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	samples := func(n int) []models.Sample { return make([]models.Sample, n) }
+	// run-a started first but was updated last, run-c has the most samples
+	store.putRun(models.RunDoc{RunID: "run-a", StartTime: now.Add(-3 * time.Hour), UpdatedAt: now, Samples: samples(2)})
+	store.putRun(models.RunDoc{RunID: "run-b", StartTime: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-2 * time.Minute), Samples: samples(1)})
+	store.putRun(models.RunDoc{RunID: "run-c", StartTime: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Minute), Samples: samples(3)})
+	h := NewHandlers(store)
+	h.listRunsMaxPage = 2
+
+	// Pages through the listing so the cursor is exercised with every sort
+	list := func(sort string) []string {
+		t.Helper()
+		var runIDs []string
+		cursor := ""
+		for {
+			path := "/runs?sort=" + sort
+			if cursor != "" {
+				path += "&cursor=" + cursor
+			}
+			w := httptest.NewRecorder()
+			h.ListRuns(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("sort=%s: expected 200, got %d: %s", sort, w.Code, w.Body.String())
+			}
+			var page models.RunSummaryPage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			for _, run := range page.Runs {
+				runIDs = append(runIDs, run.RunID)
+			}
+			if page.NextCursor == "" {
+				return runIDs
+			}
+			cursor = page.NextCursor
+		}
+	}
+
+	cases := map[string][]string{
+		"":             {"run-a", "run-c", "run-b"},
+		"updated":      {"run-a", "run-c", "run-b"},
+		"updated:asc":  {"run-b", "run-c", "run-a"},
+		"started":      {"run-c", "run-b", "run-a"},
+		"started:asc":  {"run-a", "run-b", "run-c"},
+		"samples":      {"run-c", "run-a", "run-b"},
+		"samples:asc":  {"run-b", "run-a", "run-c"},
+		"samples:desc": {"run-c", "run-a", "run-b"},
+	}
+	for sort, want := range cases {
+		if got := list(sort); !reflect.DeepEqual(got, want) {
+			t.Errorf("sort=%s: expected %v, got %v", sort, want, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ListRuns(w, httptest.NewRequest(http.MethodGet, "/runs?sort=name", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown sort, got %d", w.Code)
+	}
+}
+
+func TestRotateAdminSecret(t *testing.T) {
+	auth.SetAdminSecretForTest("old-admin-secret-value")
+	defer auth.SetAdminSecretForTest("")
+
+	h := NewHandlers(newFakeStore())
+	history := func(secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/runs/run-1/history", nil)
+		req.Header.Set("X-Admin-Secret", secret)
+		w := httptest.NewRecorder()
+		h.AdminRuns(w, req)
+		return w.Code
+	}
+	rotate := func(secret, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/rotate-secret", strings.NewReader(body))
+		req.Header.Set("X-Admin-Secret", secret)
+		w := httptest.NewRecorder()
+		h.RotateAdminSecret(w, req)
+		return w.Code
+	}
+
+	if code := rotate("wrong-secret", `{"new_secret":"new-admin-secret-value"}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with a wrong secret, got %d", code)
+	}
+	if code := rotate("old-admin-secret-value", `{"new_secret":"short"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a short secret, got %d", code)
+	}
+	if code := rotate("old-admin-secret-value", `{"new_secret":"new-admin-secret-value"}`); code != http.StatusOK {
+		t.Fatalf("Expected 200 for rotation, got %d", code)
+	}
+
+	if code := history("old-admin-secret-value"); code != http.StatusUnauthorized {
+		t.Errorf("Old secret should stop working, got %d", code)
+	}
+	if code := history("new-admin-secret-value"); code == http.StatusUnauthorized {
+		t.Error("New secret should be accepted after rotation")
+	}
+}
+
+func TestClassifyHeapTrend(t *testing.T) {
+	config := heapTrendConfig{threshold: 1, minSamples: 10, gcDipRatio: 0.2}
+
+	// Heap grows 10MB per minute with a GC dip every fifth sample
+	var growing []models.Sample
+	for i := 0; i < 30; i++ {
+		heap := 100 + i*10
+		if i%5 == 4 {
+			heap = 50
+		}
+		growing = append(growing, models.Sample{PID: "1", ElapsedTime: i * 60, HeapUsed: heap})
+	}
+	trend := classifyHeapTrend(growing, config)
+	if trend.Classification != models.HeapTrendGrowing {
+		t.Errorf("Expected growing, got %+v", trend)
+	}
+	if trend.SlopeMBPerMinute < 9 || trend.SlopeMBPerMinute > 11 {
+		t.Errorf("Expected a slope near 10 MB/min once GC dips are filtered, got %.2f", trend.SlopeMBPerMinute)
+	}
+	if trend.Samples != 24 {
+		t.Errorf("Expected 6 GC dips to be filtered out of 30 samples, got %d used", trend.Samples)
+	}
+
+	var flat []models.Sample
+	for i := 0; i < 20; i++ {
+		flat = append(flat, models.Sample{PID: "1", ElapsedTime: i * 60, HeapUsed: 200 + i%2})
+	}
+	if trend := classifyHeapTrend(flat, config); trend.Classification != models.HeapTrendStable {
+		t.Errorf("Expected stable, got %+v", trend)
+	}
+
+	if trend := classifyHeapTrend(growing[:5], config); trend.Classification != models.HeapTrendInsufficientData {
+		t.Errorf("Expected insufficient_data for a short run, got %+v", trend)
+	}
+}
+
+func TestGetRun_CamelCaseNaming(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-camel", Samples: []models.Sample{
+		{Timestamp: 1000, ElapsedTime: 1, PID: "1", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 200, RSS: 300, GCTime: 5},
+	}})
+	h := NewHandlers(store)
+
+	decodeSample := func(path string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		h.GetRun(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", path, w.Code, w.Body.String())
+		}
+		var body struct {
+			Samples []map[string]interface{} `json:"samples"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(body.Samples) != 1 {
+			t.Fatalf("Expected 1 sample, got %d", len(body.Samples))
+		}
+		return body.Samples[0]
+	}
+
+	camel := decodeSample("/runs/run-camel?naming=camel")
+	for _, key := range []string{"timestamp", "elapsedTime", "pid", "heapUsed", "heapCap", "rss", "gcTime"} {
+		if _, ok := camel[key]; !ok {
+			t.Errorf("Expected camelCase key %q, got %v", key, camel)
+		}
+	}
+	if camel["heapUsed"] != float64(100) {
+		t.Errorf("Expected heapUsed 100, got %v", camel["heapUsed"])
+	}
+
+	// The default encoding is unchanged
+	defaults := decodeSample("/runs/run-camel")
+	if _, ok := defaults["HeapUsed"]; !ok {
+		t.Errorf("Expected default key HeapUsed without the option, got %v", defaults)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-camel?naming=kebab", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown naming, got %d", w.Code)
+	}
+}
+
+func TestIngest_BinaryPayload(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	payload, err := storage.EncodeSamplesBinary([]models.Sample{
+		{ElapsedTime: 1, PID: "1", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 200, RSS: 300},
+		{ElapsedTime: 2, PID: "1", Name: "GradleDaemon", HeapUsed: 110, HeapCap: 200, RSS: 310},
+	})
+	if err != nil {
+		t.Fatalf("EncodeSamplesBinary failed: %v", err)
+	}
+
+	binaryRequest := func(body []byte) *http.Request {
+		req := newIngestRequest(t, "run-binary", "")
+		req.URL.RawQuery = "run_id=run-binary"
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	h.Ingest(w, binaryRequest(payload))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	runDoc, _ := store.GetRun(context.Background(), "run-binary")
+	if len(runDoc.Samples) != 2 || runDoc.Samples[1].HeapUsed != 110 {
+		t.Errorf("Unexpected stored samples: %+v", runDoc.Samples)
+	}
+
+	w = httptest.NewRecorder()
+	h.Ingest(w, binaryRequest(payload[:len(payload)-2]))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a truncated payload, got %d", w.Code)
+	}
+}
+
+func TestIngest_PerRunRateLimit(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+	h.ingestLimiter = newRunRateLimiter(1, 2)
+	now := time.Now()
+	h.ingestLimiter.now = func() time.Time { return now }
+
+	ingest := func(runID string) int {
+		body := `{"run_id":"` + runID + `","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, runID, body))
+		return w.Code
+	}
+
+	// The burst of 2 is allowed, the third write within the same instant is not
+	for i := 0; i < 2; i++ {
+		if code := ingest("run-chatty"); code != http.StatusOK {
+			t.Fatalf("Write %d: expected 200, got %d", i+1, code)
+		}
+	}
+	if code := ingest("run-chatty"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once the rate is exceeded, got %d", code)
+	}
+
+	// Other runs have their own bucket
+	if code := ingest("run-quiet"); code != http.StatusOK {
+		t.Errorf("Expected another run to be unaffected, got %d", code)
+	}
+
+	// Tokens refill at the configured rate
+	now = now.Add(time.Second)
+	if code := ingest("run-chatty"); code != http.StatusOK {
+		t.Errorf("Expected a write to be allowed after refill, got %d", code)
+	}
+}
+
+func TestLogSampler_Rate(t *testing.T) {
+	sampler := newLogSampler(10)
+	logged := 0
+	for i := 0; i < 1000; i++ {
+		if sampler.sample() {
+			logged++
+		}
+	}
+	if logged != 100 {
+		t.Errorf("Expected 100 of 1000 calls to be sampled at 1-in-10, got %d", logged)
+	}
+
+	if !newLogSampler(0).sample() || !newLogSampler(1).sample() {
+		t.Error("Expected a rate of 0 or 1 to log every call")
+	}
+}
+
+func TestIngest_SamplesSuccessLogsButNotErrors(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := NewHandlers(newFakeStore())
+	h.ingestLogs = newLogSampler(5)
+
+	for i := 0; i < 20; i++ {
+		body := `{"run_id":"run-logs","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, "run-logs", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Ingest %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+	if n := strings.Count(logs.String(), "✅ Stored 1 samples"); n != 4 {
+		t.Errorf("Expected 4 of 20 successful ingests to be logged, got %d", n)
+	}
+
+	logs.Reset()
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, "run-logs", `{"run_id":"run-logs","data":"not a sample"}`))
+	}
+	if n := strings.Count(logs.String(), "contained no valid samples"); n != 5 {
+		t.Errorf("Expected every failed ingest to be logged, got %d", n)
+	}
+}
+
+func TestIngest_RateLimitRetryAfter(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+	// One write every 10 seconds
+	h.ingestLimiter = newRunRateLimiter(0.1, 1)
+	now := time.Now()
+	h.ingestLimiter.now = func() time.Time { return now }
+
+	ingest := func() *httptest.ResponseRecorder {
+		body := `{"run_id":"run-slow","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, "run-slow", body))
+		return w
+	}
+
+	if w := ingest(); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first write to pass, got %d", w.Code)
+	}
+	w := ingest()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("Expected Retry-After 10 for an empty bucket, got %q", retryAfter)
+	}
+
+	// Part of the token has refilled, so the wait shrinks
+	now = now.Add(7 * time.Second)
+	if retryAfter := ingest().Header().Get("Retry-After"); retryAfter != "3" {
+		t.Errorf("Expected Retry-After 3 after 7s, got %q", retryAfter)
+	}
+
+	// A coarser unit rounds the wait up
+	h.retryAfterUnit = 5 * time.Second
+	if retryAfter := ingest().Header().Get("Retry-After"); retryAfter != "5" {
+		t.Errorf("Expected Retry-After rounded up to 5, got %q", retryAfter)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	cases := []struct {
+		wait, unit time.Duration
+		want       int
+	}{
+		{0, time.Second, 1},
+		{200 * time.Millisecond, time.Second, 1},
+		{2500 * time.Millisecond, time.Second, 3},
+		{2500 * time.Millisecond, 10 * time.Second, 10},
+		{11 * time.Second, 10 * time.Second, 20},
+	}
+	for _, c := range cases {
+		if got := retryAfterSeconds(c.wait, c.unit); got != c.want {
+			t.Errorf("retryAfterSeconds(%v, %v) = %d, want %d", c.wait, c.unit, got, c.want)
+		}
+	}
+}
+
+func TestRunRateLimiter_ExpiresIdleRuns(t *testing.T) {
+	limiter := newRunRateLimiter(1, 1)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	limiter.allow("run-1")
+	now = now.Add(rateLimiterIdleTTL)
+	limiter.allow("run-2")
+
+	if _, ok := limiter.buckets["run-1"]; ok {
+		t.Error("Expected the idle run's bucket to be dropped")
+	}
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected only the active run's bucket, got %d", len(limiter.buckets))
+	}
+}
+
+func TestGetRun_IncludeProcessesPerGroup(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-groups", Samples: []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 100},
+		{PID: "2", Timestamp: 1000, HeapUsed: 50},
+		{PID: "1", Timestamp: 2000, HeapUsed: 110},
+	}})
+	store.StoreProcessInfo(context.Background(), "run-groups", models.ProcessInfo{
+		PID: "1", Name: "GradleDaemon", VMFlags: []string{"-Xmx2g"},
+	})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-groups?include=processes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response models.GroupedRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(response.Groups))
+	}
+
+	daemon, other := response.Groups[0], response.Groups[1]
+	if daemon.PID != "1" || len(daemon.Samples) != 2 {
+		t.Errorf("Expected PID 1 with 2 samples first, got %+v", daemon)
+	}
+	if daemon.ProcessInfo == nil || daemon.ProcessInfo.Name != "GradleDaemon" || len(daemon.ProcessInfo.VMFlags) != 1 {
+		t.Errorf("Expected embedded process info for PID 1, got %+v", daemon.ProcessInfo)
+	}
+	if other.PID != "2" || other.ProcessInfo != nil {
+		t.Errorf("Expected PID 2 without process info, got %+v", other)
+	}
+
+	// The default response is unchanged
+	if response := getRunResponse(t, h, "/runs/run-groups"); len(response.Samples) != 3 {
+		t.Errorf("Expected flat samples by default, got %d", len(response.Samples))
+	}
+}
+
+func TestIngest_AppliesProcessStartOffset(t *testing.T) {
+	store := newFakeStore()
+	start := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	store.putRun(models.RunDoc{RunID: "run-offset", StartTime: start})
+	h := NewHandlers(store)
+
+	body := `{"run_id":"run-offset","data":"00:00:05 | 200 | KotlinDaemon | 50MB | 100MB | 150MB",` +
+		`"process_info":{"pid":"200","name":"KotlinDaemon","vm_flags":[],"start_offset_seconds":60}}`
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-offset", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	runDoc, _ := store.GetRun(context.Background(), "run-offset")
+	if len(runDoc.Samples) != 1 || runDoc.Samples[0].Timestamp != storage.ToMillis(start.Add(65*time.Second)) {
+		t.Errorf("Expected timestamp at start+65s, got %+v", runDoc.Samples)
+	}
+}
+
+func TestBatch_MixedOperations(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	batch := func(body string) models.BatchResponse {
+		t.Helper()
+		req := newIngestRequest(t, "run-batch", body)
+		req.URL.Path = "/batch"
+		w := httptest.NewRecorder()
+		h.Batch(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response models.BatchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	response := batch(`{"run_id":"run-batch","operations":[
+		{"op":"ingest","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB","process_info":{"pid":"1","name":"GradleDaemon","vm_flags":["-Xmx1g"]}},
+		{"op":"ingest","data":"00:00:02 | 1 | GradleDaemon | 110MB | 200MB | 310MB"},
+		{"op":"finish"}
+	]}`)
+	if len(response.Results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(response.Results))
+	}
+	for _, result := range response.Results {
+		if result.Status != http.StatusOK {
+			t.Errorf("Operation %d (%s): expected 200, got %d: %s", result.Index, result.Op, result.Status, result.Error)
+		}
+	}
+
+	runDoc, _ := store.GetRun(context.Background(), "run-batch")
+	if len(runDoc.Samples) != 2 || !runDoc.Finished {
+		t.Errorf("Expected 2 samples and a finished run, got %d samples, finished=%v", len(runDoc.Samples), runDoc.Finished)
+	}
+	processes, _ := store.GetProcesses(context.Background(), "run-batch")
+	if _, ok := processes.ProcessInfo["1"]; !ok {
+		t.Error("Expected process info from the batch to be stored")
+	}
+
+	// A failing operation stops the batch
+	response = batch(`{"run_id":"run-batch","operations":[{"op":"reboot"},{"op":"finish"}]}`)
+	if response.Results[0].Status != http.StatusBadRequest || response.Results[1].Status != http.StatusFailedDependency {
+		t.Errorf("Expected 400 then 424, got %d then %d", response.Results[0].Status, response.Results[1].Status)
+	}
+}
+
+func TestBatch_ReportsRetryAfterOfRateLimitedIngest(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+	h.ingestLimiter = newRunRateLimiter(0.5, 1)
+
+	req := newIngestRequest(t, "run-batch", `{"run_id":"run-batch","operations":[
+		{"op":"ingest","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"},
+		{"op":"ingest","data":"00:00:02 | 1 | GradleDaemon | 110MB | 200MB | 310MB"}
+	]}`)
+	req.URL.Path = "/batch"
+	w := httptest.NewRecorder()
+	h.Batch(w, req)
+
+	var response models.BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Results) != 2 || response.Results[1].Status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the second ingest rate limited, got %+v", response.Results)
+	}
+	if response.Results[1].RetryAfter < 1 {
+		t.Errorf("Expected retry_after on the rate limited result, got %d", response.Results[1].RetryAfter)
+	}
+	if w.Header().Get("Retry-After") != fmt.Sprint(response.Results[1].RetryAfter) {
+		t.Errorf("Expected the batch response to carry Retry-After %d, got %q", response.Results[1].RetryAfter, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestBatch_RequiresToken(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`{"run_id":"run-batch","operations":[{"op":"finish"}]}`))
+	w := httptest.NewRecorder()
+	h.Batch(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestBatch_BodyTooLarge(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-big", StartTime: time.Now()})
+	h := NewHandlers(store)
+	h.maxIngestBodyBytes = 64
+
+	body := fmt.Sprintf(`{"run_id":"run-big","operations":[{"op":"ingest","data":%q}]}`, strings.Repeat("00:00:01 | 1 | GradleDaemon | 1MB | 2MB\n", 10))
+	w := httptest.NewRecorder()
+	h.Batch(w, newIngestRequest(t, "run-big", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetRun_DownsamplingKeepsGCEvents(t *testing.T) {
+	store := newFakeStore()
+	var samples []models.Sample
+	for i := 0; i < 100; i++ {
+		sample := models.Sample{PID: "1", Timestamp: int64(i * 1000), HeapUsed: 100}
+		if i == 13 || i == 57 || i == 91 {
+			sample.GCTime = 800
+		}
+		samples = append(samples, sample)
+	}
+	store.putRun(models.RunDoc{RunID: "run-gc", Samples: samples})
+	h := NewHandlers(store)
+
+	response := getRunResponse(t, h, "/runs/run-gc?max_points=10")
+	if len(response.Samples) != 10 {
+		t.Fatalf("Expected 10 samples, got %d", len(response.Samples))
+	}
+
+	var gcEvents int
+	for i, sample := range response.Samples {
+		if sample.GCTime == 800 {
+			gcEvents++
+		}
+		if i > 0 && sample.Timestamp <= response.Samples[i-1].Timestamp {
+			t.Errorf("Downsampled samples should stay in time order")
+		}
+	}
+	if gcEvents != 3 {
+		t.Errorf("Expected all 3 GC spikes to survive downsampling, got %d", gcEvents)
+	}
+
+	// A budget smaller than the number of spikes keeps the longest ones
+	if response := getRunResponse(t, h, "/runs/run-gc?max_points=2"); len(response.Samples) != 2 ||
+		response.Samples[0].GCTime != 800 || response.Samples[1].GCTime != 800 {
+		t.Errorf("Expected only GC spikes with a budget of 2, got %+v", response.Samples)
+	}
+}
+
+func TestStreamRun_OriginCheck(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{
+		RunID:    "run-stream",
+		Finished: true,
+		Samples:  []models.Sample{{PID: "1", Timestamp: 1000, HeapUsed: 64}},
+	})
+	h := NewHandlers(store)
+	h.allowedOrigins = []string{"https://watcher.example.com", "http://localhost:*"}
+
+	stream := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/runs/run-stream/stream", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.GetRun(w, req)
+		return w
+	}
+
+	for _, origin := range []string{"https://evil.example.com", "http://localhost", "http://localhost:abc", "null"} {
+		w := stream(origin)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Origin %q: expected status 403, got %d", origin, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "event:") {
+			t.Errorf("Origin %q: stream should not start for a rejected origin", origin)
+		}
+	}
+
+	for _, origin := range []string{"https://watcher.example.com", "http://localhost:3000", ""} {
+		w := stream(origin)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Origin %q: expected status 200, got %d: %s", origin, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Origin %q: expected text/event-stream, got %q", origin, ct)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("Origin %q: expected the origin to be echoed, got %q", origin, got)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "event: samples") || !strings.Contains(body, "event: finished") {
+			t.Errorf("Origin %q: expected samples and finished events, got %q", origin, body)
+		}
+	}
+}
+
+func TestNewStreamSamples_TracksTimestampsPerProcess(t *testing.T) {
+	lastSent := make(map[string]int64)
+	first := newStreamSamples([]models.Sample{
+		{PID: "1", Timestamp: 1000}, {PID: "1", Timestamp: 2000}, {PID: "1", Timestamp: 3000},
+		{PID: "2", Machine: "agent-b", Timestamp: 1500},
+	}, lastSent)
+	if len(first) != 4 || streamCursor(lastSent) != 1500 {
+		t.Fatalf("Expected every sample and cursor 1500, got %d samples and cursor %d", len(first), streamCursor(lastSent))
+	}
+
+	// Compaction dropped sample 2000, so the run is shorter than what was sent, and the
+	// next read returns samples out of order
+	next := newStreamSamples([]models.Sample{
+		{PID: "2", Machine: "agent-b", Timestamp: 2500},
+		{PID: "1", Timestamp: 1000}, {PID: "1", Timestamp: 4000}, {PID: "1", Timestamp: 3000},
+		{PID: "2", Machine: "agent-b", Timestamp: 1500},
+	}, lastSent)
+	var sent []string
+	for _, sample := range next {
+		sent = append(sent, fmt.Sprintf("%s:%d", sample.PID, sample.Timestamp))
+	}
+	if fmt.Sprint(sent) != "[2:2500 1:4000]" {
+		t.Errorf("Expected only the new sample of each process, got %v", sent)
+	}
+	if cursor := streamCursor(lastSent); cursor != 2500 {
+		t.Errorf("Expected cursor 2500, got %d", cursor)
+	}
+}
+
+func TestOriginAllowed_IgnoresWildcard(t *testing.T) {
+	if originAllowed("https://anything.example.com", []string{"*"}) {
+		t.Error("A bare * entry must not allow every origin for streams")
+	}
+}
+
+func TestGetRun_DedupWindow(t *testing.T) {
+	store := newFakeStore()
+	stored := []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 100},
+		{PID: "2", Timestamp: 1005, HeapUsed: 200},
+		{PID: "1", Timestamp: 1030, HeapUsed: 101},
+		{PID: "1", Timestamp: 1050, HeapUsed: 102},
+		{PID: "1", Timestamp: 1051, HeapUsed: 103},
+		{PID: "2", Timestamp: 1020, HeapUsed: 201},
+	}
+	store.putRun(models.RunDoc{RunID: "run-dedup", Samples: slices.Clone(stored)})
+	h := NewHandlers(store)
+
+	response := getRunResponse(t, h, "/runs/run-dedup?dedup_ms=50")
+	var kept []string
+	for _, sample := range response.Samples {
+		kept = append(kept, fmt.Sprintf("%s@%d", sample.PID, sample.Timestamp))
+	}
+	// 1030 and 1050 fall within 50ms of PID 1's representative at 1000, 1051 does not;
+	// PID 2's sample at 1005 is kept even though PID 1 has one 5ms earlier
+	if expected := []string{"1@1000", "2@1005", "1@1051"}; !reflect.DeepEqual(kept, expected) {
+		t.Errorf("Expected %v, got %v", expected, kept)
+	}
+
+	if full := getRunResponse(t, h, "/runs/run-dedup"); len(full.Samples) != len(stored) {
+		t.Errorf("Expected every sample without dedup_ms, got %d", len(full.Samples))
+	}
+	if !reflect.DeepEqual(store.runs["run-dedup"].Samples, stored) {
+		t.Errorf("Expected the stored samples to be left untouched")
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-dedup?dedup_ms=-5", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative dedup_ms, got %d", w.Code)
+	}
+}
+
+func TestGetRun_Stride(t *testing.T) {
+	store := newFakeStore()
+	var samples []models.Sample
+	for i := 0; i < 10; i++ {
+		samples = append(samples, models.Sample{PID: "1", Timestamp: int64(1000 + i)})
+	}
+	store.putRun(models.RunDoc{RunID: "run-stride", Samples: samples})
+	h := NewHandlers(store)
+
+	timestamps := func(path string) []int64 {
+		var kept []int64
+		for _, sample := range getRunResponse(t, h, path).Samples {
+			kept = append(kept, sample.Timestamp)
+		}
+		return kept
+	}
+	// Every 4th sample from the first, then the last one between strides
+	if kept := timestamps("/runs/run-stride?stride=4"); !reflect.DeepEqual(kept, []int64{1000, 1004, 1008, 1009}) {
+		t.Errorf("Expected stride 4 to keep 1000, 1004, 1008 and the last, got %v", kept)
+	}
+	// The last sample already falls on a stride
+	if kept := timestamps("/runs/run-stride?stride=3"); !reflect.DeepEqual(kept, []int64{1000, 1003, 1006, 1009}) {
+		t.Errorf("Expected stride 3 to keep 1000, 1003, 1006, 1009, got %v", kept)
+	}
+	if kept := timestamps("/runs/run-stride?stride=1"); len(kept) != len(samples) {
+		t.Errorf("Expected stride 1 to keep every sample, got %d", len(kept))
+	}
+
+	for _, query := range []string{"stride=0", "stride=-2", "stride=two", "stride=2&max_points=5"} {
+		w := httptest.NewRecorder()
+		h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-stride?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestGetRun_TreeFormat(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-tree", Samples: []models.Sample{
+		{PID: "1", Name: "GradleDaemon", ElapsedTime: 5, HeapUsed: 100},
+		{PID: "2", Name: "KotlinCompileDaemon", ElapsedTime: 20, HeapUsed: 50},
+		{PID: "1", Name: "GradleDaemon", ElapsedTime: 35, HeapUsed: 120},
+		{PID: "1", Name: "GradleDaemon", ElapsedTime: 70, HeapUsed: 200},
+	}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-tree?format=tree&bucket_seconds=60", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response models.TreeRunResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode tree response: %v", err)
+	}
+
+	root := response.Root
+	if root.Name != "run-tree" || root.Value != 470 || root.Samples != 4 {
+		t.Errorf("Expected the run as root with value 470 over 4 samples, got %+v", root)
+	}
+	if len(root.Children) != 2 || root.Children[0].Name != "1 GradleDaemon" || root.Children[1].Name != "2 KotlinCompileDaemon" {
+		t.Fatalf("Expected one child per process in order of appearance, got %+v", root.Children)
+	}
+	var starts []int
+	for _, bucket := range root.Children[0].Children {
+		starts = append(starts, *bucket.Start)
+	}
+	if !reflect.DeepEqual(starts, []int{0, 60}) || root.Children[0].Children[0].Value != 220 {
+		t.Errorf("Expected PID 1 bucketed at 0s (220MB) and 60s, got %+v", root.Children[0].Children)
+	}
+	for _, process := range root.Children {
+		sum := 0
+		for _, bucket := range process.Children {
+			sum += bucket.Value
+		}
+		if sum != process.Value {
+			t.Errorf("Expected %s's value to be the sum of its buckets, got %d != %d", process.Name, process.Value, sum)
+		}
+	}
+
+	for _, query := range []string{"format=tree&bucket_seconds=0", "format=tree&naming=camel", "format=tree&group_by=pid"} {
+		w := httptest.NewRecorder()
+		h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-tree?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestGetRun_TruncatesToMaxResponseBytes(t *testing.T) {
+	store := newFakeStore()
+	var samples []models.Sample
+	for i := 0; i < 200; i++ {
+		samples = append(samples, models.Sample{PID: "1", Name: "GradleDaemon", Timestamp: int64(1000 + i), HeapUsed: 100 + i})
+	}
+	store.putRun(models.RunDoc{RunID: "run-large", Samples: samples})
+	store.putRun(models.RunDoc{RunID: "run-small", Samples: samples[:2]})
+	h := NewHandlers(store)
+	h.maxResponseBytes = 4096
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-large", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(TruncatedHeader) != "true" {
+		t.Errorf("Expected %s: true, got %q", TruncatedHeader, w.Header().Get(TruncatedHeader))
+	}
+	if w.Body.Len() > h.maxResponseBytes {
+		t.Errorf("Expected at most %d bytes, got %d", h.maxResponseBytes, w.Body.Len())
+	}
+	var response models.RunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !response.Truncated || len(response.Samples) == 0 || len(response.Samples) >= len(samples) {
+		t.Fatalf("Expected a truncated body with part of the samples, got %d samples, truncated=%v", len(response.Samples), response.Truncated)
+	}
+	if last := response.Samples[len(response.Samples)-1]; last.Timestamp != 1199 {
+		t.Errorf("Expected the most recent samples kept, last is %d", last.Timestamp)
+	}
+
+	kept := len(response.Samples)
+
+	// One more sample would not have fit
+	response.Samples = samples[len(samples)-kept-1:]
+	if data, _ := json.Marshal(response); len(data) < h.maxResponseBytes {
+		t.Errorf("Expected the largest tail that fits, %d more bytes were available", h.maxResponseBytes-len(data))
+	}
+
+	// Newest first, the kept samples are still the most recent, now at the front
+	desc := httptest.NewRecorder()
+	h.GetRun(desc, httptest.NewRequest(http.MethodGet, "/runs/run-large?order=desc", nil))
+	var descResponse models.RunResponse
+	if err := json.Unmarshal(desc.Body.Bytes(), &descResponse); err != nil {
+		t.Fatalf("Failed to decode order=desc response: %v", err)
+	}
+	if len(descResponse.Samples) != kept {
+		t.Fatalf("Expected order=desc to keep %d samples, got %d", kept, len(descResponse.Samples))
+	}
+	if first := descResponse.Samples[0]; first.Timestamp != 1199 {
+		t.Errorf("Expected order=desc to start with the most recent sample, got %d", first.Timestamp)
+	}
+	if oldest := descResponse.Samples[kept-1]; oldest.Timestamp != int64(1200-kept) {
+		t.Errorf("Expected order=desc to keep the most recent samples, oldest is %d", oldest.Timestamp)
+	}
+
+	small := httptest.NewRecorder()
+	h.GetRun(small, httptest.NewRequest(http.MethodGet, "/runs/run-small", nil))
+	if small.Header().Get(TruncatedHeader) != "" || strings.Contains(small.Body.String(), "truncated") {
+		t.Errorf("Expected a run under the cap not to be truncated")
+	}
+}
+
+func TestSearchRuns_MinPeakHeap(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+	for runID, heaps := range map[string][]int{"run-small": {100, 300}, "run-medium": {900, 1500, 1200}, "run-large": {2048, 4096}} {
+		var samples []models.Sample
+		for i, heap := range heaps {
+			samples = append(samples, models.Sample{PID: "1", Timestamp: int64(1000 + i), HeapUsed: heap})
+		}
+		if err := store.StoreSamples(context.Background(), runID, samples); err != nil {
+			t.Fatalf("StoreSamples failed: %v", err)
+		}
+	}
+
+	search := func(query string) (int, models.RunSummaryPage) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.SearchRuns(w, httptest.NewRequest(http.MethodGet, "/runs:search?"+query, nil))
+		var page models.RunSummaryPage
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, page
+	}
+
+	code, page := search("min_peak_heap=1500")
+	var found []string
+	for _, run := range page.Runs {
+		found = append(found, fmt.Sprintf("%s:%d", run.RunID, run.PeakHeapUsedMB))
+	}
+	if expected := []string{"run-large:4096", "run-medium:1500"}; code != http.StatusOK || !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, got %d %v", expected, code, found)
+	}
+	if page.Note == "" {
+		t.Errorf("Expected the response to note the runs without a maintained peak")
+	}
+	if _, page := search("min_peak_heap=0&limit=1"); len(page.Runs) != 1 || page.Runs[0].RunID != "run-large" {
+		t.Errorf("Expected the highest peak first within the limit, got %+v", page.Runs)
+	}
+	for _, query := range []string{"", "min_peak_heap=-1", "min_peak_heap=lots"} {
+		if code, _ := search(query); code != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestGetRun_SinceTimestamp(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-since", Samples: []models.Sample{
+		{PID: "1", Timestamp: 1000},
+		{PID: "1", Timestamp: 2000},
+		{PID: "1", Timestamp: 3000},
+	}})
+	h := NewHandlers(store)
+
+	full := getRunResponse(t, h, "/runs/run-since")
+	if len(full.Samples) != 3 || full.NextSinceTS != 3000 {
+		t.Fatalf("Expected 3 samples and cursor 3000, got %d samples and cursor %d", len(full.Samples), full.NextSinceTS)
+	}
+
+	response := getRunResponse(t, h, "/runs/run-since?since_ts=1000")
+	if len(response.Samples) != 2 || response.Samples[0].Timestamp != 2000 {
+		t.Errorf("Expected only the samples after 1000, got %+v", response.Samples)
+	}
+
+	// Nothing new yet, the cursor stays where the client is
+	response = getRunResponse(t, h, fmt.Sprintf("/runs/run-since?since_ts=%d", full.NextSinceTS))
+	if len(response.Samples) != 0 || response.NextSinceTS != 3000 {
+		t.Errorf("Expected no samples and cursor 3000, got %d samples and cursor %d", len(response.Samples), response.NextSinceTS)
+	}
+
+	store.putRun(models.RunDoc{RunID: "run-since", Samples: []models.Sample{
+		{PID: "1", Timestamp: 1000},
+		{PID: "1", Timestamp: 2000},
+		{PID: "1", Timestamp: 3000},
+		{PID: "1", Timestamp: 4000},
+	}})
+	response = getRunResponse(t, h, fmt.Sprintf("/runs/run-since?since_ts=%d", full.NextSinceTS))
+	if len(response.Samples) != 1 || response.Samples[0].Timestamp != 4000 || response.NextSinceTS != 4000 {
+		t.Errorf("Expected the new sample and cursor 4000, got %+v and cursor %d", response.Samples, response.NextSinceTS)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-since?since_ts=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid since_ts, got %d", w.Code)
+	}
+}
+
+func TestGetRun_AsOfTimestamp(t *testing.T) {
+	store := newFakeStore()
+	finishedAt := time.UnixMilli(3500)
+	store.putRun(models.RunDoc{RunID: "run-as-of", Finished: true, FinishedAt: finishedAt, Samples: []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 100},
+		{PID: "1", Timestamp: 2000, HeapUsed: 300},
+		{PID: "1", Timestamp: 3000, HeapUsed: 500},
+	}})
+	h := NewHandlers(store)
+
+	response := getRunResponse(t, h, "/runs/run-as-of?as_of_ts=2000")
+	if len(response.Samples) != 2 || response.Samples[1].Timestamp != 2000 {
+		t.Errorf("Expected the samples up to 2000, got %+v", response.Samples)
+	}
+	if response.Finished || response.FinishedAt != nil {
+		t.Errorf("Expected the run to be unfinished before its finish time, got finished=%v at %v", response.Finished, response.FinishedAt)
+	}
+	if response.NextSinceTS != 2000 {
+		t.Errorf("Expected the cursor at the cutoff's newest sample, got %d", response.NextSinceTS)
+	}
+
+	response = getRunResponse(t, h, "/runs/run-as-of?as_of_ts=4000")
+	if len(response.Samples) != 3 || !response.Finished {
+		t.Errorf("Expected all samples and a finished run after its finish time, got %d samples, finished=%v", len(response.Samples), response.Finished)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodHead, "/runs/run-as-of?as_of_ts=2000", nil))
+	if peak := w.Header().Get("X-Peak-Heap"); peak != "300" {
+		t.Errorf("Expected heap headers as of the cutoff, got %q", peak)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-as-of?as_of_ts=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid as_of_ts, got %d", w.Code)
+	}
+}
+
+func TestMaxFlagsTruncatesResponse(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-flags"})
+	store.StoreProcessInfo(context.Background(), "run-flags", models.ProcessInfo{
+		PID: "1", Name: "GradleDaemon", VMFlags: []string{"-Xmx4g", "-Xms1g", "-XX:+UseG1GC", "-Dfile.encoding=UTF-8"},
+	})
+	store.StoreProcessInfo(context.Background(), "run-flags", models.ProcessInfo{
+		PID: "2", Name: "KotlinDaemon", VMFlags: []string{"-Xmx2g"},
+	})
+	h := NewHandlers(store)
+
+	response := getRunResponse(t, h, "/runs/run-flags?max_flags=2")
+	daemon := response.ProcessInfo["1"]
+	if len(daemon.VMFlags) != 2 || daemon.VMFlags[0] != "-Xmx4g" || daemon.VMFlagsOmitted != 2 {
+		t.Errorf("Expected 2 flags with 2 omitted, got %v with %d omitted", daemon.VMFlags, daemon.VMFlagsOmitted)
+	}
+	if kotlin := response.ProcessInfo["2"]; len(kotlin.VMFlags) != 1 || kotlin.VMFlagsOmitted != 0 {
+		t.Errorf("Expected a short flag list to be untouched, got %+v", kotlin)
+	}
+
+	if all := getRunResponse(t, h, "/runs/run-flags"); len(all.ProcessInfo["1"].VMFlags) != 4 {
+		t.Errorf("Expected every flag without max_flags, got %v", all.ProcessInfo["1"].VMFlags)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-flags/processes?max_flags=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var processes struct {
+		ProcessInfo map[string]models.ProcessInfo `json:"process_info"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &processes); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if daemon := processes.ProcessInfo["1"]; len(daemon.VMFlags) != 1 || daemon.VMFlagsOmitted != 3 {
+		t.Errorf("Expected 1 flag with 3 omitted, got %v with %d omitted", daemon.VMFlags, daemon.VMFlagsOmitted)
+	}
+
+	// Truncating a response must not change what the store holds
+	stored, _ := store.GetProcesses(context.Background(), "run-flags")
+	if len(stored.ProcessInfo["1"].VMFlags) != 4 {
+		t.Errorf("Expected the stored flags to be untouched, got %v", stored.ProcessInfo["1"].VMFlags)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-flags?max_flags=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for max_flags=0, got %d", w.Code)
+	}
+}
+
+func TestIngest_ProcessDisplayHintsRoundTrip(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	longName := strings.Repeat("é", storage.MaxProcessDisplayNameLength+10)
+	body := `{"run_id":"run-hints","process_info":{"pid":"1","name":"GradleDaemon","color":"#1f77b4","display_name":"` + longName + `"}}`
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-hints", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-hints/processes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var processes struct {
+		ProcessInfo map[string]models.ProcessInfo `json:"process_info"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &processes); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	daemon := processes.ProcessInfo["1"]
+	if daemon.Color != "#1f77b4" {
+		t.Errorf("Expected the color to round-trip, got %q", daemon.Color)
+	}
+	if daemon.DisplayName != strings.Repeat("é", storage.MaxProcessDisplayNameLength) {
+		t.Errorf("Expected the display name capped at %d characters, got %q", storage.MaxProcessDisplayNameLength, daemon.DisplayName)
+	}
+}
+
+func TestIngest_ProcessInfoCappedPerRun(t *testing.T) {
+	store := newFakeStore()
+	store.maxProcesses = 3
+	h := NewHandlers(store)
+
+	report := func(pid string) {
+		t.Helper()
+		body := `{"run_id":"run-pids","process_info":{"pid":"` + pid + `","name":"Worker"}}`
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, "run-pids", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	// The daemon keeps reporting while short-lived workers come and go
+	for i := 1; i <= 6; i++ {
+		report("1")
+		report(fmt.Sprintf("%d", 100+i))
+	}
+
+	processes := store.processes["run-pids"].ProcessInfo
+	if len(processes) != 3 {
+		t.Fatalf("Expected 3 processes tracked, got %d", len(processes))
+	}
+	for _, pid := range []string{"1", "105", "106"} {
+		if _, ok := processes[pid]; !ok {
+			t.Errorf("Expected recently seen process %s to be kept, got %v", pid, processes)
+		}
+	}
+}
+
+func TestAuth_RejectsActiveRunWithoutForce(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-active", StartTime: time.Now()})
+	store.putRun(models.RunDoc{RunID: "run-done", StartTime: time.Now(), Finished: true})
+
+	h := NewHandlers(store)
+	h.rejectActiveRunAuth = true
+
+	authorize := func(path string) int {
+		w := httptest.NewRecorder()
+		h.Auth(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w.Code
+	}
+
+	if code := authorize("/auth/run/run-active"); code != http.StatusConflict {
+		t.Errorf("Expected 409 for an existing active run, got %d", code)
+	}
+	if code := authorize("/auth/run/run-active?force=true"); code != http.StatusOK {
+		t.Errorf("Expected force=true to mint a token, got %d", code)
+	}
+	if code := authorize("/auth/run/run-done"); code != http.StatusOK {
+		t.Errorf("Expected a finished run to be reusable, got %d", code)
+	}
+	if code := authorize("/auth/run/run-new"); code != http.StatusOK {
+		t.Errorf("Expected a new run to be authorized, got %d", code)
+	}
+
+	h.rejectActiveRunAuth = false
+	if code := authorize("/auth/run/run-active"); code != http.StatusOK {
+		t.Errorf("Expected the check to be off by default, got %d", code)
+	}
+}
+
+func TestConfig_RecommendedBatchSize(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+
+	w := httptest.NewRecorder()
+	h.Config(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var config map[string]int64
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	size, ok := config["recommended_batch_size"]
+	if !ok || size <= 0 {
+		t.Fatalf("Expected a positive recommended_batch_size, got %v", config)
+	}
+	if size*TypicalSampleBytes >= config["max_ingest_body_bytes"] {
+		t.Errorf("A recommended batch of %d samples should fit in %d bytes", size, config["max_ingest_body_bytes"])
+	}
+
+	if RecommendedBatchSize(10) != 1 {
+		t.Errorf("Expected at least one sample per batch for a tiny body limit")
+	}
+}
+
+func TestIngest_BodyTooLarge(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-big", StartTime: time.Now()})
+	h := NewHandlers(store)
+	h.maxIngestBodyBytes = 64
+
+	body := fmt.Sprintf(`{"run_id":"run-big","data":%q}`, strings.Repeat("00:00:01 | 1 | GradleDaemon | 1MB | 2MB\n", 10))
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-big", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRunStatuses(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-active", Samples: []models.Sample{{PID: "1"}, {PID: "1"}}})
+	store.putRun(models.RunDoc{RunID: "run-done", Finished: true, Samples: []models.Sample{{PID: "1"}}})
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.RunStatuses(w, httptest.NewRequest(http.MethodPost, "/runs:statuses",
+		strings.NewReader(`{"run_ids":["run-active","run-missing","run-done"]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "samples") {
+		t.Errorf("Statuses must not include samples: %s", w.Body.String())
+	}
+
+	var statuses map[string]*models.RunStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("Expected an entry per requested run, got %v", statuses)
+	}
+	if status := statuses["run-active"]; status == nil || status.Finished || status.SampleCount != 2 {
+		t.Errorf("Unexpected status for run-active: %+v", status)
+	}
+	if status := statuses["run-done"]; status == nil || !status.Finished || status.SampleCount != 1 {
+		t.Errorf("Unexpected status for run-done: %+v", status)
+	}
+	if status, ok := statuses["run-missing"]; !ok || status != nil {
+		t.Errorf("Expected null for a missing run, got %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	h.RunStatuses(w, httptest.NewRequest(http.MethodPost, "/runs:statuses", strings.NewReader(`{"run_ids":[]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without run_ids, got %d", w.Code)
+	}
+}
+
+func TestRunStatuses_PartialResults(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-ok", Samples: []models.Sample{{PID: "1"}}})
+	store.putRun(models.RunDoc{RunID: "run-broken"})
+	store.statusErrs = map[string]error{"run-broken": errors.New("decode failed")}
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.RunStatuses(w, httptest.NewRequest(http.MethodPost, "/runs:statuses",
+		strings.NewReader(`{"run_ids":["run-ok","run-missing","run-broken"]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	var ok models.RunStatus
+	if err := json.Unmarshal(response["run-ok"], &ok); err != nil || ok.SampleCount != 1 {
+		t.Errorf("Expected a status for run-ok, got %s", response["run-ok"])
+	}
+	if missing, found := response["run-missing"]; !found || string(missing) != "null" {
+		t.Errorf("Expected null for run-missing, got %s", missing)
+	}
+	var broken models.RunStatusError
+	if err := json.Unmarshal(response["run-broken"], &broken); err != nil || broken.Error == "" {
+		t.Errorf("Expected an error object for run-broken, got %s", response["run-broken"])
+	}
+	if strings.Contains(string(response["run-broken"]), "decode failed") {
+		t.Errorf("Storage error details must not leak to clients: %s", response["run-broken"])
+	}
+}
+
+func TestAuth_RejectsStaleRunIDTimestamp(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+	h.runIDAge = runIDAgeCheck{pattern: regexp.MustCompile(`^build-(\d+)-`), maxAge: 24 * time.Hour}
+
+	authorize := func(runID string) int {
+		w := httptest.NewRecorder()
+		h.Auth(w, httptest.NewRequest(http.MethodPost, "/auth/run/"+runID, nil))
+		return w.Code
+	}
+
+	stale := time.Now().Add(-48 * time.Hour)
+	if code := authorize(fmt.Sprintf("build-%d-linux", stale.Unix())); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a stale run ID, got %d", code)
+	}
+	if code := authorize(fmt.Sprintf("build-%d-linux", stale.UnixMilli())); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a stale run ID in milliseconds, got %d", code)
+	}
+	if code := authorize(fmt.Sprintf("build-%d-linux", time.Now().Unix())); code != http.StatusOK {
+		t.Errorf("Expected a fresh run ID to be authorized, got %d", code)
+	}
+	if code := authorize("manual-run"); code != http.StatusOK {
+		t.Errorf("Expected a run ID without a timestamp to be authorized, got %d", code)
+	}
+
+	h.runIDAge = runIDAgeCheck{}
+	if code := authorize(fmt.Sprintf("build-%d-linux", stale.Unix())); code != http.StatusOK {
+		t.Errorf("Expected no check without a pattern, got %d", code)
+	}
+}
+
+func TestAuth_RunURL(t *testing.T) {
+	h := NewHandlers(newFakeStore())
+
+	authorize := func(runID string) models.TokenResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.Auth(w, httptest.NewRequest(http.MethodPost, "/auth/run/"+runID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response models.TokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	if response := authorize("run-url"); response.RunURL != "" {
+		t.Errorf("Expected no run_url without DASHBOARD_BASE_URL, got %q", response.RunURL)
+	}
+
+	t.Setenv("DASHBOARD_BASE_URL", "https://process-watcher.example.com/")
+	h = NewHandlers(newFakeStore())
+	if response := authorize("run-url"); response.RunURL != "https://process-watcher.example.com/runs/run-url" {
+		t.Errorf("Expected the run's dashboard URL, got %q", response.RunURL)
+	}
+}
+
+// storedBeforeResponse records whether the run had samples when the response started
+type storedBeforeResponse struct {
+	*httptest.ResponseRecorder
+	store  *fakeStore
+	runID  string
+	stored *bool
+}
+
+func (w storedBeforeResponse) WriteHeader(code int) {
+	runDoc, ok := w.store.runs[w.runID]
+	*w.stored = ok && len(runDoc.Samples) > 0
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestIngest_DurableStoresBeforeResponding(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	for _, durable := range []func(*http.Request){
+		func(r *http.Request) { r.URL.RawQuery = "durable=true" },
+		func(r *http.Request) { r.Header.Set(DurableIngestHeader, "true") },
+	} {
+		runID := fmt.Sprintf("run-durable-%d", len(store.runs))
+		req := newIngestRequest(t, runID, `{"run_id":"`+runID+`","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 5ms"}`)
+		durable(req)
+		var stored bool
+		w := storedBeforeResponse{ResponseRecorder: httptest.NewRecorder(), store: store, runID: runID, stored: &stored}
+		h.Ingest(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if !stored {
+			t.Errorf("Expected the samples stored before the durable ingest responded")
+		}
+	}
+
+	req := newIngestRequest(t, "run-durable", `{"run_id":"run-durable","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 5ms"}`)
+	req.URL.RawQuery = "durable=maybe"
+	w := httptest.NewRecorder()
+	h.Ingest(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid durable value, got %d", w.Code)
+	}
+}
+
+func TestIngest_AutoIssuesTokenOnFirstIngest(t *testing.T) {
+	t.Setenv("AUTO_ISSUE_TOKENS", "true")
+	t.Setenv("AUTO_ISSUE_TRUSTED_CIDRS", "10.0.0.0/8")
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	ingest := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"run_id":"run-auto","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 5ms"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.Ingest(w, req)
+		return w
+	}
+
+	if w := ingest("203.0.113.5:4000", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 outside the trusted networks, got %d", w.Code)
+	}
+
+	w := ingest("10.1.2.3:4000", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the first ingest accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	token := w.Header().Get(AutoTokenHeader)
+	if token == "" || w.Header().Get(AutoTokenExpiresAtHeader) == "" {
+		t.Fatalf("Expected a token in the response headers, got %v", w.Header())
+	}
+	if runDoc, ok := store.runs["run-auto"]; !ok || len(runDoc.Samples) != 1 {
+		t.Fatalf("Expected the first ingest to create the run")
+	}
+
+	if w := ingest("10.1.2.3:4000", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a tokenless ingest once the run exists, got %d", w.Code)
+	}
+	if w := ingest("10.1.2.3:4000", token); w.Code != http.StatusOK || w.Header().Get(AutoTokenHeader) != "" {
+		t.Errorf("Expected the issued token accepted without a new one, got %d", w.Code)
+	}
+}
+
+func TestIngest_AutoTokenOnlyForStoredFirstIngest(t *testing.T) {
+	t.Setenv("AUTO_ISSUE_TOKENS", "true")
+	t.Setenv("AUTO_ISSUE_TRUSTED_CIDRS", "10.0.0.0/8")
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	ingest := func(runID, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(`{"run_id":"`+runID+`","data":"`+data+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "10.1.2.3:4000"
+		w := httptest.NewRecorder()
+		h.Ingest(w, req)
+		return w
+	}
+
+	// Nothing was stored, so no token is handed out
+	if w := ingest("run-invalid", "not a sample line"); w.Code == http.StatusOK || w.Header().Get(AutoTokenHeader) != "" {
+		t.Errorf("Expected a failed first ingest without a token, got %d %v", w.Code, w.Header())
+	}
+
+	// Of concurrent tokenless first ingests only the one that created the run gets a token
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	tokens := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := ingest("run-contended", "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 5ms")
+			if w.Header().Get(AutoTokenHeader) != "" {
+				mu.Lock()
+				tokens++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if tokens != 1 {
+		t.Errorf("Expected exactly one token issued, got %d", tokens)
+	}
+}
+
+func TestGetIngestFieldRange(t *testing.T) {
+	if fields := getIngestFieldRange(); fields != storage.DefaultFieldRange {
+		t.Errorf("Expected the default range, got %+v", fields)
+	}
+
+	t.Setenv("INGEST_MIN_FIELDS", "6")
+	t.Setenv("INGEST_MAX_FIELDS", "6")
+	if fields := getIngestFieldRange(); fields != (storage.FieldRange{Min: 6, Max: 6}) {
+		t.Errorf("Expected 6-6, got %+v", fields)
+	}
+
+	t.Setenv("INGEST_MAX_FIELDS", "9")
+	if fields := getIngestFieldRange(); fields != storage.DefaultFieldRange {
+		t.Errorf("Expected the default range for an unsupported bound, got %+v", fields)
+	}
+}
+
+func TestIngest_EnforcesFieldRange(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-fields", StartTime: time.Now()})
+	h := NewHandlers(store)
+	h.ingestFields = storage.FieldRange{Min: 7, Max: 7}
+
+	data := "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB\\n" +
+		"00:00:02 | 1 | GradleDaemon | 110MB | 200MB | 300MB | 0.1s"
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-fields", `{"run_id":"run-fields","data":"`+data+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if samples := store.runs["run-fields"].Samples; len(samples) != 1 || samples[0].ElapsedTime != 2 {
+		t.Errorf("Expected only the 7-field line stored, got %+v", samples)
+	}
+}
+
+func TestIngest_PhaseRoundTrip(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-phase", StartTime: time.Now()})
+	h := NewHandlers(store)
+
+	data := "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | phase=compiling\\n" +
+		"00:00:02 | 1 | GradleDaemon | 110MB | 200MB | 300MB | phase=compiling\\n" +
+		"00:00:03 | 1 | GradleDaemon | 120MB | 200MB | 300MB | phase=testing"
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-phase", `{"run_id":"run-phase","data":"`+data+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	response := getRunResponse(t, h, "/runs/run-phase")
+	var phases []string
+	for _, sample := range response.Samples {
+		phases = append(phases, sample.Phase)
+	}
+	if strings.Join(phases, ",") != "compiling,compiling,testing" {
+		t.Errorf("Expected phases to round-trip, got %v", phases)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-phase?naming=camel", nil))
+	if !strings.Contains(w.Body.String(), `"phase":"testing"`) {
+		t.Errorf("Expected the camelCase response to carry the phase, got %s", w.Body.String())
+	}
+}
+
+func TestAdminRuns_ArchivedRunRejectsWritesAndServesReads(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-active", StartTime: time.Now()})
+	store.putRun(models.RunDoc{
+		RunID:     "run-archive",
+		StartTime: time.Now(),
+		Finished:  true,
+		Samples:   []models.Sample{{PID: "1", Timestamp: 1000, HeapUsed: 100}},
+	})
+	h := NewHandlers(store)
+
+	archive := func(runID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/runs/"+runID+"/archive", nil)
+		req.Header.Set("X-Admin-Secret", "admin-test-secret")
+		w := httptest.NewRecorder()
+		h.AdminRuns(w, req)
+		return w.Code
+	}
+
+	if code := archive("run-active"); code != http.StatusConflict {
+		t.Errorf("Expected 409 when archiving an unfinished run, got %d", code)
+	}
+	if code := archive("run-missing"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing run, got %d", code)
+	}
+	if code := archive("run-archive"); code != http.StatusOK {
+		t.Fatalf("Expected 200 when archiving a finished run, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"run_id":"run-archive","data":"00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`
+	h.Ingest(w, newIngestRequest(t, "run-archive", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for ingest into an archived run, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body = `{"run_id":"run-archive","process_info":{"pid":"1","name":"GradleDaemon","vm_flags":["-Xmx1g"]}}`
+	h.Ingest(w, newIngestRequest(t, "run-archive", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for process info on an archived run, got %d", w.Code)
+	}
+
+	response := getRunResponse(t, h, "/runs/run-archive")
+	if !response.Archived || len(response.Samples) != 1 {
+		t.Errorf("Expected the archived run to stay readable, got %+v", response)
+	}
+}
+
+func TestGetRun_MsgpackMatchesJSON(t *testing.T) {
+	store := newFakeStore()
+	finishedAt := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	store.putRun(models.RunDoc{
+		RunID:      "run-msgpack",
+		Finished:   true,
+		FinishedAt: finishedAt,
+		UpdatedAt:  finishedAt,
+		Samples: []models.Sample{
+			{PID: "1", Name: "GradleDaemon", Timestamp: 1000, ElapsedTime: 1, HeapUsed: 100, HeapCap: 200, RSS: 300, GCTime: 12},
+			{PID: "2", Name: "KotlinDaemon", Timestamp: 2000, ElapsedTime: 2, HeapUsed: 50, HeapCap: 100, RSSMissing: true, Extra: map[string]float64{"metaspace": 85.5}},
+		},
+	})
+	store.StoreProcessInfo(context.Background(), "run-msgpack", models.ProcessInfo{PID: "1", Name: "GradleDaemon", VMFlags: []string{"-Xmx4g"}})
+	h := NewHandlers(store)
+
+	jsonResponse := getRunResponse(t, h, "/runs/run-msgpack")
+
+	req := httptest.NewRequest(http.MethodGet, "/runs/run-msgpack", nil)
+	req.Header.Set("Accept", "application/msgpack, application/json;q=0.5")
+	w := httptest.NewRecorder()
+	h.GetRun(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != MsgpackContentType {
+		t.Fatalf("Expected %s, got %q", MsgpackContentType, ct)
+	}
+
+	var msgpackResponse models.RunResponse
+	decoder := msgpack.NewDecoder(w.Body)
+	decoder.SetCustomStructTag("json")
+	if err := decoder.Decode(&msgpackResponse); err != nil {
+		t.Fatalf("Failed to decode msgpack response: %v", err)
+	}
+
+	// Compare through JSON so times are compared by instant rather than location
+	fromJSON, _ := json.Marshal(jsonResponse)
+	fromMsgpack, _ := json.Marshal(normalizeTimes(msgpackResponse))
+	if string(fromJSON) != string(fromMsgpack) {
+		t.Errorf("msgpack response differs from JSON:\njson:    %s\nmsgpack: %s", fromJSON, fromMsgpack)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/runs/run-msgpack?naming=camel", nil)
+	req.Header.Set("Accept", "application/msgpack")
+	w = httptest.NewRecorder()
+	h.GetRun(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for camel naming as msgpack, got %d", w.Code)
+	}
+}
+
+// normalizeTimes converts the response times to UTC, as decoded JSON times are
+func normalizeTimes(response models.RunResponse) models.RunResponse {
+	response.UpdatedAt = response.UpdatedAt.UTC()
+	if response.FinishedAt != nil {
+		finishedAt := response.FinishedAt.UTC()
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
+
+func TestAggregateStats(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now().UTC().Truncate(time.Second)
+	store.putRun(models.RunDoc{RunID: "run-1", UpdatedAt: now.Add(-time.Hour), Finished: true, FinishStatus: storage.FinishStatusCompleted,
+		PeakHeapUsedMB: 400, SampleCount: 2})
+	store.putRun(models.RunDoc{RunID: "run-2", UpdatedAt: now.Add(-2 * time.Hour), Finished: true, FinishStatus: storage.FinishStatusStale,
+		PeakHeapUsedMB: 800, SampleCount: 2})
+	store.putRun(models.RunDoc{RunID: "run-3", UpdatedAt: now.Add(-3 * time.Hour)})
+	store.putRun(models.RunDoc{RunID: "run-old", UpdatedAt: now.Add(-30 * 24 * time.Hour), Finished: true,
+		PeakHeapUsedMB: 10000, SampleCount: 1})
+	h := NewHandlers(store)
+
+	from := now.Add(-24 * time.Hour).Format(time.RFC3339)
+	to := now.Add(time.Minute).Format(time.RFC3339)
+	w := httptest.NewRecorder()
+	h.AggregateStats(w, httptest.NewRequest(http.MethodGet, "/stats/aggregate?from="+from+"&to="+to, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var stats models.AggregateStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if stats.RunCount != 3 {
+		t.Errorf("Expected 3 runs in the window, got %d", stats.RunCount)
+	}
+	// Peaks are 400 and 800, run-3 has no samples
+	if stats.MeanPeakHeapMB != 600 {
+		t.Errorf("Expected mean peak heap 600, got %v", stats.MeanPeakHeapMB)
+	}
+	if stats.FailedRuns != 1 || stats.FailureRate != 0.5 {
+		t.Errorf("Expected 1 failed run of 2 finished, got %d and rate %v", stats.FailedRuns, stats.FailureRate)
+	}
+
+	if stats.Truncated {
+		t.Error("Expected the window under the cap not to be truncated")
+	}
+
+	w = httptest.NewRecorder()
+	h.AggregateStats(w, httptest.NewRequest(http.MethodGet, "/stats/aggregate?from="+to+"&to="+from, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 when from is after to, got %d", w.Code)
+	}
+
+	// Over the cap, only the most recently updated runs are aggregated
+	h.aggregateMaxRuns = 2
+	w = httptest.NewRecorder()
+	h.AggregateStats(w, httptest.NewRequest(http.MethodGet, "/stats/aggregate?from="+from+"&to="+to, nil))
+	stats = models.AggregateStats{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !stats.Truncated || stats.RunCount != 2 || stats.MeanPeakHeapMB != 600 {
+		t.Errorf("Expected run-1 and run-2 aggregated and truncated set, got %+v", stats)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	store.putRun(models.RunDoc{RunID: "run-1", UpdatedAt: now.Add(-time.Minute), Tags: map[string]string{"team": "android", "ci": "github"}})
+	store.putRun(models.RunDoc{RunID: "run-2", UpdatedAt: now.Add(-2 * time.Minute), Tags: map[string]string{"team": "android"}})
+	store.putRun(models.RunDoc{RunID: "run-3", UpdatedAt: now.Add(-3 * time.Minute), Tags: map[string]string{"team": "ios", "ci": "github"}})
+	store.putRun(models.RunDoc{RunID: "run-4", UpdatedAt: now.Add(-4 * time.Minute)})
+	store.putRun(models.RunDoc{RunID: "run-expired", UpdatedAt: now.Add(-30 * 24 * time.Hour), Tags: map[string]string{"team": "web"}})
+	h := NewHandlers(store)
+	h.labels.now = func() time.Time { return now }
+
+	getLabels := func() models.LabelsResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.Labels(w, httptest.NewRequest(http.MethodGet, "/labels", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var labels models.LabelsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &labels); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return labels
+	}
+
+	labels := getLabels()
+	if labels.RunCount != 4 {
+		t.Errorf("Expected 4 runs within retention, got %d", labels.RunCount)
+	}
+	want := map[string]map[string]int{
+		"team": {"android": 2, "ios": 1},
+		"ci":   {"github": 2},
+	}
+	if !reflect.DeepEqual(labels.Labels, want) {
+		t.Errorf("Expected labels %v, got %v", want, labels.Labels)
+	}
+
+	// A new run is not visible until the cached result expires
+	store.putRun(models.RunDoc{RunID: "run-5", UpdatedAt: now, Tags: map[string]string{"team": "ios"}})
+	if labels := getLabels(); labels.Labels["team"]["ios"] != 1 {
+		t.Errorf("Expected the cached labels to be served, got %v", labels.Labels)
+	}
+	now = now.Add(DefaultLabelsCacheTTL)
+	if labels := getLabels(); labels.Labels["team"]["ios"] != 2 {
+		t.Errorf("Expected the labels to be rescanned after the TTL, got %v", labels.Labels)
+	}
+}
+
+func TestIngest_NoValidSamples(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-invalid", StartTime: time.Now()})
+	h := NewHandlers(store)
+
+	body := `{"run_id":"run-invalid","data":"not a sample\nneither | is | this"}`
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-invalid", body))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for data without valid samples, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "No valid samples") {
+		t.Errorf("Expected a clear message, got %q", w.Body.String())
+	}
+
+	h.noSamplesStatus = http.StatusUnprocessableEntity
+	w = httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-invalid", body))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the configured status 422, got %d", w.Code)
+	}
+
+	// Empty finish-signal ingests are unaffected
+	h.finishOnEmptyIngest = true
+	w = httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-invalid", `{"run_id":"run-invalid","data":""}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected an empty finish signal to succeed, got %d", w.Code)
+	}
+}
+
+func TestRunTags_AddOverwriteRemove(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-tags", StartTime: time.Now(), Finished: true})
+	h := NewHandlers(store)
+
+	token, _, err := auth.GenerateToken("run-tags")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	tagRequest := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.GetRun(w, req)
+		return w
+	}
+
+	if w := tagRequest(http.MethodPost, "/runs/run-tags/tags", `{"tags":{"status":"investigated","note":"OOM in kapt"}}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 adding tags, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := tagRequest(http.MethodPost, "/runs/run-tags/tags", `{"tags":{"note":"fixed by raising -Xmx"}}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 overwriting a tag, got %d: %s", w.Code, w.Body.String())
+	}
+	response := getRunResponse(t, h, "/runs/run-tags")
+	if response.Tags["status"] != "investigated" || response.Tags["note"] != "fixed by raising -Xmx" {
+		t.Errorf("Expected merged and overwritten tags, got %v", response.Tags)
+	}
+
+	if w := tagRequest(http.MethodDelete, "/runs/run-tags/tags?key=note", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 removing a tag, got %d: %s", w.Code, w.Body.String())
+	}
+	response = getRunResponse(t, h, "/runs/run-tags")
+	if _, ok := response.Tags["note"]; ok || response.Tags["status"] != "investigated" {
+		t.Errorf("Expected only the note to be removed, got %v", response.Tags)
+	}
+
+	if w := tagRequest(http.MethodPost, "/runs/run-tags/tags", `{"tags":{"`+strings.Repeat("k", storage.MaxTagKeyLength+1)+`":"v"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an overlong key, got %d", w.Code)
+	}
+	tooMany := make(map[string]string)
+	for i := 0; i < storage.MaxRunTags; i++ {
+		tooMany[fmt.Sprintf("tag-%d", i)] = "x"
+	}
+	body, _ := json.Marshal(models.RunTagsRequest{Tags: tooMany})
+	if w := tagRequest(http.MethodPost, "/runs/run-tags/tags", string(body)); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 past the tag count cap, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodPost, "/runs/run-tags/tags", strings.NewReader(`{"tags":{"a":"b"}}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", w.Code)
+	}
+}
+
+func TestGetRun_HeapHeaders(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-heap", Samples: []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 300},
+		{PID: "2", Timestamp: 1000, HeapUsed: 900},
+		{PID: "1", Timestamp: 2000, HeapUsed: 500},
+		{PID: "2", Timestamp: 2000, HeapUsed: 400},
+	}})
+	h := NewHandlers(store)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		h.GetRun(w, httptest.NewRequest(method, "/runs/run-heap", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", method, w.Code)
+		}
+		if peak := w.Header().Get("X-Peak-Heap"); peak != "900" {
+			t.Errorf("%s: expected X-Peak-Heap 900, got %q", method, peak)
+		}
+		// Newest samples are 500 (PID 1) and 400 (PID 2)
+		if current := w.Header().Get("X-Current-Heap"); current != "500" {
+			t.Errorf("%s: expected X-Current-Heap 500, got %q", method, current)
+		}
+		if method == http.MethodHead && w.Body.Len() != 0 {
+			t.Errorf("HEAD: expected no body, got %d bytes", w.Body.Len())
+		}
+	}
+}
+
+func TestGetRun_HeadReadsOnlyMaintainedHeap(t *testing.T) {
+	store := newFakeStore()
+	err := store.StoreSamples(context.Background(), "run-heap", []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 300},
+		{PID: "2", Timestamp: 1000, HeapUsed: 900},
+		{PID: "1", Timestamp: 2000, HeapUsed: 500},
+	})
+	if err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	// Loading the samples would fail, so a 200 shows HEAD never did
+	store.getRunErr = status.Error(codes.Unavailable, "samples read")
+	h := NewHandlers(store)
+
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodHead, "/runs/run-heap", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if peak, current := w.Header().Get("X-Peak-Heap"), w.Header().Get("X-Current-Heap"); peak != "900" || current != "900" {
+		t.Errorf("Expected X-Peak-Heap 900 and X-Current-Heap 900, got %q and %q", peak, current)
+	}
+}
+
+func TestGetRun_SinceReadsOnlyNewerSamples(t *testing.T) {
+	store := newFakeStore()
+	err := store.StoreSamples(context.Background(), "run-since", []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 300},
+		{PID: "1", Timestamp: 2000, HeapUsed: 500},
+	})
+	if err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	// Loading every sample would fail, so a 200 shows ?since_ts= never did
+	store.getRunErr = status.Error(codes.Unavailable, "samples read")
+	h := NewHandlers(store)
+
+	response := getRunResponse(t, h, "/runs/run-since?since_ts=1000")
+	if len(response.Samples) != 1 || response.Samples[0].Timestamp != 2000 || response.NextSinceTS != 2000 {
+		t.Errorf("Expected the sample after 1000 and cursor 2000, got %+v and cursor %d", response.Samples, response.NextSinceTS)
+	}
+
+	// Ingest only needs the run's start time, not its samples
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-since", `{"run_id":"run-since","data":"00:00:05 | 1 | GradleDaemon | 100MB | 200MB | 300MB"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected ingest to succeed without reading samples, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetRun_UnknownQueryParams(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-strict", Samples: []models.Sample{{PID: "1", Timestamp: 1000}}})
+	h := NewHandlers(store)
+
+	// Lenient by default: the typo is ignored
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-strict?limt=100&order=desc", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("lenient: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	h.strictQueryParams = true
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-strict?limt=100&order=desc&zoom=2", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("strict: expected status 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "limt, zoom") {
+		t.Errorf("expected unknown keys in the error, got %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-strict?order=desc&max_points=10", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("strict: expected known parameters to pass, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIngest_ResumesStaleFinishedRun(t *testing.T) {
+	store := newFakeStore()
+	store.staleResumeWindow = 30 * time.Minute
+	finishedAt := time.Now().Add(-5 * time.Minute)
+	store.putRun(models.RunDoc{RunID: "run-stale", Finished: true, FinishedAt: finishedAt, FinishStatus: storage.FinishStatusStale})
+	store.putRun(models.RunDoc{RunID: "run-done", Finished: true, FinishedAt: finishedAt, FinishStatus: storage.FinishStatusCompleted})
+	h := NewHandlers(store)
+	line := "00:00:01 | 12345 | GradleDaemon | 100MB | 200MB | 300MB"
+
+	w := httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-stale", `{"run_id":"run-stale","data":"`+line+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a stale-finished run, got %d: %s", w.Code, w.Body.String())
+	}
+	if runDoc := store.runs["run-stale"]; runDoc.Finished || len(runDoc.Samples) != 1 {
+		t.Errorf("Expected the stale run to reopen with 1 sample, got finished=%v samples=%d", runDoc.Finished, len(runDoc.Samples))
+	}
+
+	w = httptest.NewRecorder()
+	h.Ingest(w, newIngestRequest(t, "run-done", `{"run_id":"run-done","data":"`+line+`"}`))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a manually finished run, got %d: %s", w.Code, w.Body.String())
+	}
+	if runDoc := store.runs["run-done"]; !runDoc.Finished || len(runDoc.Samples) != 0 {
+		t.Errorf("Expected the finished run to stay untouched, got finished=%v samples=%d", runDoc.Finished, len(runDoc.Samples))
+	}
+}
+
+func TestIngest_RejectsSamplesAfterEndTime(t *testing.T) {
+	store := newFakeStore()
+	store.endTimeLimit = storage.EndTimeLimit{Enabled: true, Slack: time.Minute}
+	start := time.Now().Add(-10 * time.Minute)
+	store.putRun(models.RunDoc{RunID: "run-ended", StartTime: start, EndTime: start.Add(time.Minute)})
+	h := NewHandlers(store)
+
+	ingest := func(elapsed string) int {
+		body := `{"run_id":"run-ended","data":"` + elapsed + ` | 12345 | GradleDaemon | 100MB | 200MB | 300MB"}`
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, "run-ended", body))
+		return w.Code
+	}
+
+	if code := ingest("00:01:30"); code != http.StatusOK {
+		t.Fatalf("Expected a sample within the slack to be stored, got %d", code)
+	}
+	if code := ingest("00:05:00"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for a sample after the end time, got %d", code)
+	}
+	if n := len(store.runs["run-ended"].Samples); n != 1 {
+		t.Errorf("Expected only the in-window sample to be stored, got %d", n)
+	}
+}
+
+// The concurrent merge itself is covered against Firestore transactions in the storage tests
+func TestIngest_AgentsOnDifferentMachinesKeptApart(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+	const batches = 20
+
+	// Two agents report the same PID from different machines
+	for i := 0; i < batches; i++ {
+		for _, machine := range []string{"agent-a", "agent-b"} {
+			body := fmt.Sprintf(`{"run_id":"run-multi","machine":%q,"data":"00:00:%02d | 4242 | GradleDaemon | 100MB | 200MB | 300MB","process_info":{"pid":"4242","name":"GradleDaemon","vm_flags":["-Xmx2g"]}}`, machine, i)
+			w := httptest.NewRecorder()
+			h.Ingest(w, newIngestRequest(t, "run-multi", body))
+			if w.Code != http.StatusOK {
+				t.Errorf("%s batch %d: expected 200, got %d: %s", machine, i, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	runDoc, err := store.GetRun(context.Background(), "run-multi")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	perMachine := make(map[string]int)
+	for _, sample := range runDoc.Samples {
+		perMachine[sample.Machine]++
+	}
+	if perMachine["agent-a"] != batches || perMachine["agent-b"] != batches {
+		t.Errorf("Expected %d samples from each machine, got %v", batches, perMachine)
+	}
+
+	processDoc, err := store.GetProcesses(context.Background(), "run-multi")
+	if err != nil {
+		t.Fatalf("GetProcesses failed: %v", err)
+	}
+	for _, key := range []string{"agent-a/4242", "agent-b/4242"} {
+		if info, ok := processDoc.ProcessInfo[key]; !ok || info.PID != "4242" {
+			t.Errorf("Expected process info under %q, got %v", key, processDoc.ProcessInfo)
+		}
+	}
+
+	// Grouping keeps the two processes apart
+	w := httptest.NewRecorder()
+	h.GetRun(w, httptest.NewRequest(http.MethodGet, "/runs/run-multi?group_by=pid", nil))
+	var grouped models.GroupedRunResponse
+	if err := json.NewDecoder(w.Body).Decode(&grouped); err != nil {
+		t.Fatalf("Failed to decode grouped response: %v", err)
+	}
+	if len(grouped.Groups) != 2 {
+		t.Errorf("Expected one group per machine, got %d", len(grouped.Groups))
+	}
+}
+
+func TestAdminRuns_Compact(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	var samples []models.Sample
+	for i := 0; i < 20; i++ {
+		samples = append(samples, models.Sample{PID: "1", Timestamp: int64(1000 * i), HeapUsed: 100})
+	}
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-compact", Samples: samples})
+	h := NewHandlers(store)
+
+	compact := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/runs/run-compact/compact"+query, nil)
+		req.Header.Set("X-Admin-Secret", "admin-test-secret")
+		w := httptest.NewRecorder()
+		h.AdminRuns(w, req)
+		return w
+	}
+
+	if w := compact("?budget=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid budget, got %d", w.Code)
+	}
+
+	w := compact("?budget=5")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Dropped int `json:"dropped"`
+		models.CompactionResult
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Dropped != 15 || len(store.runs["run-compact"].Samples) != 5 {
+		t.Errorf("Expected 15 dropped and 5 kept, got %d dropped and %d kept", body.Dropped, len(store.runs["run-compact"].Samples))
+	}
+	if body.SamplesBefore != 20 || body.SamplesAfter != 5 {
+		t.Errorf("Expected 20 samples before and 5 after, got %d and %d", body.SamplesBefore, body.SamplesAfter)
+	}
+	beforeBytes, _ := json.Marshal(samples)
+	afterBytes, _ := json.Marshal(store.runs["run-compact"].Samples)
+	if body.BytesBefore != len(beforeBytes) || body.BytesAfter != len(afterBytes) {
+		t.Errorf("Expected %d bytes before and %d after, got %d and %d", len(beforeBytes), len(afterBytes), body.BytesBefore, body.BytesAfter)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/runs/run-missing/compact?budget=5", nil)
+	req.Header.Set("X-Admin-Secret", "admin-test-secret")
+	w = httptest.NewRecorder()
+	h.AdminRuns(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing run, got %d", w.Code)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("done"))
+	})
+	handler := TimeoutMiddleware(slow, 20*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/aggregate", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from a slow handler, got %d", w.Code)
+	}
+
+	// Streaming endpoints are not buffered or cut off
+	fast := TimeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Expected streaming requests to keep a flushable writer")
+		}
+		time.Sleep(40 * time.Millisecond)
+		w.Write([]byte("streamed"))
+	}), 20*time.Millisecond)
+	w = httptest.NewRecorder()
+	fast.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/runs/run-1/stream", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "streamed" {
+		t.Errorf("Expected the stream to bypass the timeout, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateIngest(t *testing.T) {
+	store := newFakeStore()
+	h := NewHandlers(store)
+
+	validate := func(body string) models.IngestValidateResponse {
+		t.Helper()
+		// No Authorization header: validation does not need a token
+		w := httptest.NewRecorder()
+		h.ValidateIngest(w, httptest.NewRequest(http.MethodPost, "/ingest/validate", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response models.IngestValidateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	valid := validate(`{"run_id":"run-validate","data":"00:00:01|1|GradleDaemon|100MB|512MB|600MB\n00:00:02|1|GradleDaemon|120MB|512MB|610MB"}`)
+	if !valid.Valid || valid.Samples != 2 || len(valid.Errors) != 0 {
+		t.Errorf("Expected 2 valid samples and no errors, got %+v", valid)
+	}
+
+	invalid := validate(`{"run_id":"run-validate","data":"00:00:01|1|GradleDaemon|100MB|512MB|600MB\n00:01|1|GradleDaemon|100MB|512MB\n\n00:00:03|1|GradleDaemon|abcMB|512MB"}`)
+	if invalid.Valid || invalid.Samples != 1 {
+		t.Errorf("Expected an invalid payload with 1 sample, got %+v", invalid)
+	}
+	if len(invalid.Errors) != 2 || invalid.Errors[0].Line != 2 || invalid.Errors[1].Line != 4 {
+		t.Errorf("Expected errors for lines 2 and 4, got %+v", invalid.Errors)
+	}
+
+	if len(store.runs) != 0 || len(store.processes) != 0 {
+		t.Errorf("Expected nothing stored, got %d runs and %d process docs", len(store.runs), len(store.processes))
+	}
+
+	w := httptest.NewRecorder()
+	h.ValidateIngest(w, httptest.NewRequest(http.MethodPost, "/ingest/validate", strings.NewReader("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed body, got %d", w.Code)
+	}
+}
+
+func TestRequireHTTPSMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	request := func(handler http.Handler, path string, proto string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://watcher.example.com"+path, nil)
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	reject := RequireHTTPSMiddleware(next, httpsConfig{mode: HTTPSModeReject, protoHeader: DefaultForwardedProtoHeader})
+	if w := request(reject, "/runs/run-1", "http"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for plain HTTP, got %d", w.Code)
+	}
+	if w := request(reject, "/runs/run-1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a forwarded proto, got %d", w.Code)
+	}
+	if w := request(reject, "/runs/run-1", "https, http"); w.Code != http.StatusOK {
+		t.Errorf("Expected HTTPS from the client to pass, got %d", w.Code)
+	}
+
+	redirect := RequireHTTPSMiddleware(next, httpsConfig{mode: HTTPSModeRedirect, protoHeader: DefaultForwardedProtoHeader})
+	w := request(redirect, "/runs/run-1?format=columnar", "http")
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected 308 for plain HTTP, got %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://watcher.example.com/runs/run-1?format=columnar" {
+		t.Errorf("Expected a redirect to the HTTPS URL, got %q", location)
+	}
+
+	for _, handler := range []http.Handler{reject, redirect} {
+		if w := request(handler, "/healthz", "http"); w.Code != http.StatusOK {
+			t.Errorf("Expected health checks to be exempt, got %d", w.Code)
+		}
+	}
+
+	t.Setenv("REQUIRE_HTTPS", "redirect")
+	t.Setenv("FORWARDED_PROTO_HEADER", "X-Scheme")
+	if config := getHTTPSConfig(); config.mode != HTTPSModeRedirect || config.protoHeader != "X-Scheme" {
+		t.Errorf("Expected redirect mode on X-Scheme, got %+v", config)
+	}
+}
+
+func TestImportRuns_SkipsMalformedEntries(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	start := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	archiveLine := func(archive storage.RunArchive) string {
+		line, err := json.Marshal(archive)
+		if err != nil {
+			t.Fatalf("Failed to encode archive: %v", err)
+		}
+		return string(line)
+	}
+	lines := []string{
+		archiveLine(storage.RunArchive{
+			RunID:       "run-old-1",
+			Run:         &models.RunDoc{RunID: "run-old-1", StartTime: start, Finished: true, FinishedAt: start.Add(time.Minute), Samples: []models.Sample{{PID: "1", Name: "GradleDaemon", HeapUsed: 100}}},
+			ProcessInfo: map[string]models.ProcessInfo{"1": {PID: "1", Name: "GradleDaemon"}},
+		}),
+		`{"run_id":"run-broken","run":`,
+		archiveLine(storage.RunArchive{RunID: "run-no-start", Run: &models.RunDoc{}}),
+		"",
+		archiveLine(storage.RunArchive{RunID: "run-old-2", Run: &models.RunDoc{StartTime: start, Finished: true}}),
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(strings.Join(lines, "\n")))
+	gz.Close()
+
+	store := newFakeStore()
+	h := NewHandlers(store)
+	req := httptest.NewRequest(http.MethodPost, "/admin/import", &body)
+	req.Header.Set("X-Admin-Secret", "admin-test-secret")
+	w := httptest.NewRecorder()
+	h.ImportRuns(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result models.ImportResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result.Imported != 2 || result.Failed != 2 {
+		t.Errorf("Expected 2 imported and 2 failed, got %+v", result)
+	}
+	if len(result.Errors) != 2 || result.Errors[0].Line != 2 || result.Errors[1].Line != 3 || result.Errors[1].RunID != "run-no-start" {
+		t.Errorf("Expected errors for lines 2 and 3, got %+v", result.Errors)
+	}
+
+	imported := store.runs["run-old-1"]
+	if imported == nil || !imported.Finished || len(imported.Samples) != 1 || imported.SampleCount != 1 {
+		t.Errorf("Expected run-old-1 imported with its samples, got %+v", imported)
+	}
+	if processes := store.processes["run-old-1"]; processes == nil || processes.ProcessInfo["1"].Name != "GradleDaemon" {
+		t.Errorf("Expected run-old-1's process info imported, got %+v", processes)
+	}
+	if imported := store.runs["run-old-2"]; imported == nil || imported.RunID != "run-old-2" {
+		t.Errorf("Expected run-old-2 imported under its archive run ID, got %+v", imported)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader("not gzip"))
+	req.Header.Set("X-Admin-Secret", "admin-test-secret")
+	w = httptest.NewRecorder()
+	h.ImportRuns(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a body that is not gzipped, got %d", w.Code)
+	}
+}
+
+func TestIngest_FinishRacePolicy(t *testing.T) {
+	const sample = "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 5ms"
+	ingest := func(h *Handlers, runID string) int {
+		w := httptest.NewRecorder()
+		h.Ingest(w, newIngestRequest(t, runID, `{"run_id":"`+runID+`","data":"`+sample+`"}`))
+		return w.Code
+	}
+	finish := func(h *Handlers, runID string) int {
+		token, _, err := auth.GenerateToken(runID)
+		if err != nil {
+			t.Fatalf("GenerateToken failed: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/finish/"+runID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.FinishRun(w, req)
+		return w.Code
+	}
+	// raceFinish sends concurrent ingests while the run is finished and returns their codes
+	raceFinish := func(h *Handlers, runID string) []int {
+		var wg sync.WaitGroup
+		codes := make([]int, 20)
+		for i := range codes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes[i] = ingest(h, runID)
+			}(i)
+		}
+		if code := finish(h, runID); code != http.StatusOK {
+			t.Fatalf("Expected the finish to succeed, got %d", code)
+		}
+		wg.Wait()
+		return codes
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		store := newFakeStore()
+		store.finishRace = storage.FinishRacePolicy{Mode: storage.FinishRacePolicyReject}
+		h := NewHandlers(store)
+		if code := ingest(h, "run-reject"); code != http.StatusOK {
+			t.Fatalf("Expected the first ingest to succeed, got %d", code)
+		}
+
+		// Ingests racing the finish either land before it or are rejected, never both
+		accepted := 1
+		for _, code := range raceFinish(h, "run-reject") {
+			switch code {
+			case http.StatusOK:
+				accepted++
+			case http.StatusConflict:
+			default:
+				t.Errorf("Expected 200 or 409 while racing the finish, got %d", code)
+			}
+		}
+		runDoc := store.runs["run-reject"]
+		if !runDoc.Finished || len(runDoc.Samples) != accepted {
+			t.Errorf("Expected a finished run with the %d accepted samples, got finished=%v with %d", accepted, runDoc.Finished, len(runDoc.Samples))
+		}
+		if code := ingest(h, "run-reject"); code != http.StatusConflict {
+			t.Errorf("Expected 409 for an ingest after the finish, got %d", code)
+		}
+	})
+
+	t.Run("grace", func(t *testing.T) {
+		store := newFakeStore()
+		store.finishRace = storage.FinishRacePolicy{Mode: storage.FinishRacePolicyGrace, Grace: time.Minute}
+		h := NewHandlers(store)
+		if code := ingest(h, "run-grace"); code != http.StatusOK {
+			t.Fatalf("Expected the first ingest to succeed, got %d", code)
+		}
+
+		codes := raceFinish(h, "run-grace")
+		for _, code := range codes {
+			if code != http.StatusOK {
+				t.Errorf("Expected every ingest within the grace window to succeed, got %d", code)
+			}
+		}
+		if got := len(store.runs["run-grace"].Samples); got != len(codes)+1 {
+			t.Errorf("Expected all %d samples stored, got %d", len(codes)+1, got)
+		}
+
+		// A late sample reopens the run, and once the window has passed the finish holds
+		finish(h, "run-grace")
+		if code := ingest(h, "run-grace"); code != http.StatusOK || store.runs["run-grace"].Finished {
+			t.Errorf("Expected an ingest within the grace window to reopen the run, got %d", code)
+		}
+		finish(h, "run-grace")
+		store.runs["run-grace"].FinishedAt = time.Now().Add(-2 * time.Minute)
+		if code := ingest(h, "run-grace"); code != http.StatusConflict {
+			t.Errorf("Expected 409 once the grace window has passed, got %d", code)
+		}
+	})
+}
+
+func TestAdminSummary(t *testing.T) {
+	auth.SetAdminSecretForTest("admin-test-secret")
+	defer auth.SetAdminSecretForTest("")
+
+	now := time.Now()
+	samples := func(n int) []models.Sample { return make([]models.Sample, n) }
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-active-old", StartTime: now.Add(-time.Hour), UpdatedAt: now, Samples: samples(3)})
+	store.putRun(models.RunDoc{RunID: "run-active-new", StartTime: now.Add(-time.Minute), UpdatedAt: now, Samples: samples(2)})
+	store.putRun(models.RunDoc{RunID: "run-stale", StartTime: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-time.Hour), Samples: samples(7)})
+	store.putRun(models.RunDoc{RunID: "run-finished-1", Finished: true, Samples: samples(5)})
+	store.putRun(models.RunDoc{RunID: "run-finished-2", Finished: true})
+	h := NewHandlers(store)
+
+	summary := func() models.SystemSummary {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/admin/summary", nil)
+		req.Header.Set("X-Admin-Secret", "admin-test-secret")
+		w := httptest.NewRecorder()
+		h.AdminSummary(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response models.SystemSummary
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode summary: %v", err)
+		}
+		return response
+	}
+
+	got := summary()
+	if got.ActiveRuns != 2 || got.StaleRuns != 1 || got.FinishedRuns != 2 || got.ActiveSamples != 5 {
+		t.Errorf("Expected 2 active runs with 5 samples, 1 stale and 2 finished, got %+v", got)
+	}
+	if got.OldestActiveRunID != "run-active-old" || got.OldestActiveAgeSeconds < 3600 || got.OldestActiveAgeSeconds > 3660 {
+		t.Errorf("Expected run-active-old about an hour old, got %s at %ds", got.OldestActiveRunID, got.OldestActiveAgeSeconds)
+	}
+
+	// Served from cache until the TTL passes
+	store.putRun(models.RunDoc{RunID: "run-finished-3", Finished: true})
+	if cached := summary(); cached.FinishedRuns != 2 {
+		t.Errorf("Expected the cached summary, got %d finished runs", cached.FinishedRuns)
+	}
+	h.summary.now = func() time.Time { return now.Add(time.Hour) }
+	if fresh := summary(); fresh.FinishedRuns != 3 {
+		t.Errorf("Expected a fresh summary once the cache expired, got %d finished runs", fresh.FinishedRuns)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/summary", nil)
+	w := httptest.NewRecorder()
+	h.AdminSummary(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin secret, got %d", w.Code)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	store := newFakeStore()
+	store.putRun(models.RunDoc{RunID: "run-pretty", Samples: []models.Sample{{PID: "1", Name: "GradleDaemon", HeapUsed: 100}}})
+	h := NewHandlers(store)
+	// pretty is a known run query parameter, not rejected under STRICT_QUERY_PARAMS
+	h.strictQueryParams = true
+
+	for name, handler := range map[string]struct {
+		path  string
+		serve http.HandlerFunc
+	}{
+		"run":  {"/runs/run-pretty", h.GetRun},
+		"list": {"/runs", h.ListRuns},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for query, indented := range map[string]bool{"": false, "?pretty=false": false, "?pretty=true": true} {
+				w := httptest.NewRecorder()
+				handler.serve(w, httptest.NewRequest(http.MethodGet, handler.path+query, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+				}
+				body := w.Body.String()
+				if got := strings.Contains(body, "\n  \""); got != indented {
+					t.Errorf("%q: expected indented=%v, got %s", query, indented, body)
+				}
+				if !json.Valid(w.Body.Bytes()) {
+					t.Errorf("%q: expected valid JSON, got %s", query, body)
+				}
+			}
+		})
+	}
+}
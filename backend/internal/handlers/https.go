@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// REQUIRE_HTTPS modes for plain HTTP requests
+const (
+	HTTPSModeReject   = "reject"   // Answer 400
+	HTTPSModeRedirect = "redirect" // Answer 308 to the https:// URL
+)
+
+// DefaultForwardedProtoHeader is where the ingress reports the client's scheme,
+// overridable with FORWARDED_PROTO_HEADER
+const DefaultForwardedProtoHeader = "X-Forwarded-Proto"
+
+// httpsConfig controls RequireHTTPSMiddleware, an empty mode disables it
+type httpsConfig struct {
+	mode        string
+	protoHeader string
+}
+
+// getHTTPSConfig reads REQUIRE_HTTPS ("reject", "redirect", or "true" for reject) and
+// FORWARDED_PROTO_HEADER
+func getHTTPSConfig() httpsConfig {
+	config := httpsConfig{protoHeader: DefaultForwardedProtoHeader}
+	if header := strings.TrimSpace(os.Getenv("FORWARDED_PROTO_HEADER")); header != "" {
+		config.protoHeader = header
+	}
+	switch value := os.Getenv("REQUIRE_HTTPS"); value {
+	case "", "false":
+	case "true", HTTPSModeReject:
+		config.mode = HTTPSModeReject
+	case HTTPSModeRedirect:
+		config.mode = HTTPSModeRedirect
+	default:
+		log.Printf("⚠️  WARNING: invalid REQUIRE_HTTPS %q, rejecting plain HTTP requests", value)
+		config.mode = HTTPSModeReject
+	}
+	return config
+}
+
+// isHTTPS reports whether the client reached the service over HTTPS, either directly or
+// through an ingress that terminated TLS. With a proxy chain the first entry is the client's.
+func (c httpsConfig) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get(c.protoHeader), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// RequireHTTPSMiddleware rejects or redirects requests that did not arrive over HTTPS.
+// Health checks are exempt, since load balancers probe them over plain HTTP.
+func RequireHTTPSMiddleware(next http.Handler, config httpsConfig) http.Handler {
+	if config.mode == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || config.isHTTPS(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if config.mode == HTTPSModeRedirect {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		http.Error(w, "HTTPS required", http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// ImportRuns handles POST /admin/import: a gzipped NDJSON stream with one run archive per
+// line, in the format runs are exported to ARCHIVE_BUCKET. Valid runs are stored in
+// batches; malformed lines and runs that fail to store are reported without stopping
+// the import.
+func (h *Handlers) ImportRuns(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.RequireAdminAuth(r) {
+		log.Printf("⚠️  Unauthorized import attempt from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized - admin secret required", http.StatusUnauthorized)
+		return
+	}
+
+	archive, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+		return
+	}
+	defer archive.Close()
+
+	result := models.ImportResult{Errors: []models.ImportError{}}
+	var pending []storage.RunArchive
+	var pendingLines []int
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		_, failed, err := h.storage.ImportRuns(r.Context(), pending)
+		for i, run := range pending {
+			runErr := err
+			if runErr == nil {
+				runErr = failed[run.RunID]
+			}
+			if runErr != nil {
+				result.Errors = append(result.Errors, models.ImportError{Line: pendingLines[i], RunID: run.RunID, Error: storageErrorMessage(runErr)})
+				result.Failed++
+				continue
+			}
+			result.Imported++
+		}
+		pending, pendingLines = nil, nil
+	}
+	fail := func(line int, runID string, message string) {
+		result.Errors = append(result.Errors, models.ImportError{Line: line, RunID: runID, Error: message})
+		result.Failed++
+	}
+
+	reader := bufio.NewReader(archive)
+	for line := 1; ; line++ {
+		text, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			// A truncated archive still keeps the runs read so far
+			fail(line, "", "failed to read archive: "+readErr.Error())
+			break
+		}
+		if text = bytes.TrimSpace(text); len(text) > 0 {
+			var run storage.RunArchive
+			if err := json.Unmarshal(text, &run); err != nil {
+				fail(line, "", "invalid JSON: "+err.Error())
+			} else if err := storage.ValidateRunArchive(&run); err != nil {
+				fail(line, run.RunID, err.Error())
+			} else {
+				pending = append(pending, run)
+				pendingLines = append(pendingLines, line)
+				if len(pending) == storage.ImportBatchRuns {
+					flush()
+				}
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	flush()
+
+	log.Printf("📥 Import by %s: %d runs imported, %d failed", r.RemoteAddr, result.Imported, result.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(result)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/cleanup"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// DefaultLabelsCacheTTL is how long GET /labels reuses its last scan, overridable with LABELS_CACHE_TTL
+const DefaultLabelsCacheTTL = 30 * time.Second
+
+// labelsCache holds the last GET /labels result so the dashboard's filter sidebar
+// does not scan every recent run on each page load
+type labelsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration // 0 disables caching
+	now     func() time.Time
+	labels  models.LabelsResponse
+	expires time.Time
+}
+
+// newLabelsCacheFromEnv reads LABELS_CACHE_TTL (e.g. "30s")
+func newLabelsCacheFromEnv() *labelsCache {
+	ttl := DefaultLabelsCacheTTL
+	if value := os.Getenv("LABELS_CACHE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("⚠️  WARNING: invalid LABELS_CACHE_TTL %q, using %v", value, DefaultLabelsCacheTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+	return &labelsCache{ttl: ttl, now: time.Now}
+}
+
+// get returns the cached labels if they have not expired yet
+func (c *labelsCache) get() (models.LabelsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || !c.now().Before(c.expires) {
+		return models.LabelsResponse{}, false
+	}
+	return c.labels, true
+}
+
+// set caches labels for the TTL
+func (c *labelsCache) set(labels models.LabelsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.labels = labels
+	c.expires = c.now().Add(c.ttl)
+}
+
+// aggregateLabels counts, for each label key, the runs carrying each value
+func aggregateLabels(from, to time.Time, runs []models.RunDoc) models.LabelsResponse {
+	labels := models.LabelsResponse{From: from, To: to, RunCount: len(runs), Labels: make(map[string]map[string]int)}
+	for _, run := range runs {
+		for key, value := range run.Tags {
+			if labels.Labels[key] == nil {
+				labels.Labels[key] = make(map[string]int)
+			}
+			labels.Labels[key][value]++
+		}
+	}
+	return labels
+}
+
+// Labels handles GET /labels, returning the label keys in use on runs updated within the
+// retention window, with the number of runs carrying each value
+func (h *Handlers) Labels(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	labels, ok := h.labels.get()
+	if !ok {
+		ctx, cancel := h.requestContext(r)
+		defer cancel()
+
+		to := h.labels.now()
+		from := to.Add(-cleanup.DataRetentionPeriod)
+		runs, err := h.storage.RunTagsInWindow(ctx, from, to)
+		if err != nil {
+			log.Printf("Error loading runs between %v and %v: %v", from, to, err)
+			writeStorageError(w, err)
+			return
+		}
+		labels = aggregateLabels(from, to, runs)
+		h.labels.set(labels)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(labels)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// logSampler keeps 1 in every N ingest requests verbose. Errors are logged with
+// log.Printf directly and never go through the sampler.
+type logSampler struct {
+	every uint64 // 1 (or 0) logs every request
+	count atomic.Uint64
+}
+
+// newLogSampler creates a sampler logging 1 in every requests
+func newLogSampler(every int) *logSampler {
+	if every < 1 {
+		every = 1
+	}
+	return &logSampler{every: uint64(every)}
+}
+
+// getIngestLogSampler reads INGEST_LOG_SAMPLE_RATE, the N in "log 1 in N successful ingests"
+func getIngestLogSampler() *logSampler {
+	value := os.Getenv("INGEST_LOG_SAMPLE_RATE")
+	if value == "" {
+		return newLogSampler(1)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("⚠️  WARNING: invalid INGEST_LOG_SAMPLE_RATE %q, logging every ingest", value)
+		return newLogSampler(1)
+	}
+	return newLogSampler(n)
+}
+
+// sample reports whether the next request should be logged verbosely
+func (s *logSampler) sample() bool {
+	if s == nil || s.every <= 1 {
+		return true
+	}
+	return (s.count.Add(1)-1)%s.every == 0
+}
+
+type verboseLogKey struct{}
+
+// sampleRequest records on r whether its success logs are kept, in storage as well
+func (s *logSampler) sampleRequest(r *http.Request) *http.Request {
+	verbose := s.sample()
+	ctx := context.WithValue(r.Context(), verboseLogKey{}, verbose)
+	return r.WithContext(storage.WithVerboseLogs(ctx, verbose))
+}
+
+// ingestLogf logs a success message for r if the request was sampled. Requests that
+// did not go through sampleRequest are always logged.
+func ingestLogf(r *http.Request, format string, args ...any) {
+	if verbose, ok := r.Context().Value(verboseLogKey{}).(bool); ok && !verbose {
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackContentType is returned by GetRun for clients sending Accept: application/msgpack
+const MsgpackContentType = "application/msgpack"
+
+// acceptsMsgpack reports whether the Accept header asks for MessagePack
+func acceptsMsgpack(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if mediaType == MsgpackContentType || mediaType == "application/x-msgpack" {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeMsgpack encodes payload using its json struct tags, so the MessagePack
+// form has the same keys and omissions as the JSON response
+func encodeMsgpack(payload interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
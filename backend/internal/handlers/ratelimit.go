@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiterIdleTTL is how long a run's bucket is kept after its last write
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// runRateLimiter is a token bucket per run ID limiting ingest writes. Buckets of runs
+// that stopped ingesting are dropped after rateLimiterIdleTTL so the map stays small.
+type runRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Tokens added per second, 0 disables the limiter
+	burst   float64 // Bucket capacity
+	idleTTL time.Duration
+	now     func() time.Time
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// newRunRateLimiter creates a limiter allowing rate writes per second per run with the
+// given burst; a burst below 1 defaults to the rate rounded up
+func newRunRateLimiter(rate float64, burst int) *runRateLimiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &runRateLimiter{
+		rate:    rate,
+		burst:   b,
+		idleTTL: rateLimiterIdleTTL,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// newRunRateLimiterFromEnv reads INGEST_RATE_LIMIT (writes per second per run) and INGEST_RATE_BURST
+func newRunRateLimiterFromEnv() *runRateLimiter {
+	return newRunRateLimiter(getEnvFloat("INGEST_RATE_LIMIT", 0), int(getEnvFloat("INGEST_RATE_BURST", 0)))
+}
+
+// allow reports whether runID may write now, consuming a token if so. When it may not,
+// the duration is how long until the bucket holds a token again.
+func (l *runRateLimiter) allow(runID string) (bool, time.Duration) {
+	if l == nil || l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[runID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[runID] = bucket
+	} else {
+		elapsed := now.Sub(bucket.lastSeen).Seconds()
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.lastSeen = now
+	}
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// DefaultRetryAfterUnit is the granularity Retry-After waits are rounded up to
+const DefaultRetryAfterUnit = time.Second
+
+// getRetryAfterUnit reads RETRY_AFTER_UNIT (e.g. "5s"), the granularity of Retry-After on 429s
+func getRetryAfterUnit() time.Duration {
+	value := os.Getenv("RETRY_AFTER_UNIT")
+	if value == "" {
+		return DefaultRetryAfterUnit
+	}
+	unit, err := time.ParseDuration(value)
+	if err != nil || unit < time.Second {
+		log.Printf("⚠️  WARNING: invalid RETRY_AFTER_UNIT %q, expected at least 1s, using %v", value, DefaultRetryAfterUnit)
+		return DefaultRetryAfterUnit
+	}
+	return unit
+}
+
+// retryAfterSeconds rounds wait up to a whole number of units, at least one, and returns
+// it in seconds as Retry-After expects
+func retryAfterSeconds(wait, unit time.Duration) int {
+	units := int(math.Ceil(float64(wait) / float64(unit)))
+	if units < 1 {
+		units = 1
+	}
+	return int(math.Ceil((time.Duration(units) * unit).Seconds()))
+}
+
+// writeTooManyRequests answers 429 with a Retry-After telling the client when the limiter
+// will next accept its request, so agents back off instead of retrying immediately
+func (h *Handlers) writeTooManyRequests(w http.ResponseWriter, message string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait, h.retryAfterUnit)))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// sweep drops buckets idle for longer than idleTTL, at most once per idleTTL
+func (l *runRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTTL {
+		return
+	}
+	l.lastSweep = now
+	for runID, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) >= l.idleTTL {
+			delete(l.buckets, runID)
+		}
+	}
+}
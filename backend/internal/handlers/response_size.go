@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// TruncatedHeader is set to "true" on GetRun responses cut to MAX_RESPONSE_BYTES
+const TruncatedHeader = "X-Truncated"
+
+// getMaxResponseBytes returns the GetRun response size cap from MAX_RESPONSE_BYTES, 0 disables it
+func getMaxResponseBytes() int {
+	value := os.Getenv("MAX_RESPONSE_BYTES")
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("⚠️  WARNING: invalid MAX_RESPONSE_BYTES %q, response size is not capped", value)
+		return 0
+	}
+	return n
+}
+
+// encodeRunPayload encodes a GetRun payload as msgpack, or as JSON indented when pretty
+func encodeRunPayload(payload interface{}, msgpackResponse bool, pretty bool) ([]byte, error) {
+	if msgpackResponse {
+		return encodeMsgpack(payload)
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeRunResponse encodes response in the requested shape. When it exceeds
+// maxResponseBytes, only the most recent samples that fit are kept and truncated is
+// true; clients fetch the older ones with ?as_of_ts= set before the oldest kept sample.
+// Indented JSON counts against the cap like compact JSON.
+func (h *Handlers) encodeRunResponse(runID string, query runQuery, response models.RunResponse, msgpackResponse bool, pretty bool) ([]byte, bool, error) {
+	data, err := encodeRunPayload(runPayload(runID, query, response), msgpackResponse, pretty)
+	if err != nil || h.maxResponseBytes <= 0 || len(data) <= h.maxResponseBytes {
+		return data, false, err
+	}
+
+	// Rank the samples newest first, so the kept ones are the most recent by timestamp
+	// whatever order the response lists them in
+	samples := response.Samples
+	newest := make([]int, len(samples))
+	for i := range newest {
+		newest[i] = i
+	}
+	sort.SliceStable(newest, func(i, j int) bool {
+		return samples[newest[i]].Timestamp > samples[newest[j]].Timestamp
+	})
+	response.Truncated = true
+	encodeRecent := func(n int) ([]byte, error) {
+		kept := make([]bool, len(samples))
+		for _, i := range newest[:n] {
+			kept[i] = true
+		}
+		recent := make([]models.Sample, 0, n)
+		for i, sample := range samples {
+			if kept[i] {
+				recent = append(recent, sample)
+			}
+		}
+		response.Samples = recent
+		return encodeRunPayload(runPayload(runID, query, response), msgpackResponse, pretty)
+	}
+
+	// The size grows with the number of samples kept, so search for the most that fit
+	var encodeErr error
+	kept := sort.Search(len(samples)+1, func(n int) bool {
+		encoded, err := encodeRecent(n)
+		if err != nil {
+			encodeErr = err
+			return true
+		}
+		return len(encoded) > h.maxResponseBytes
+	}) - 1
+	if encodeErr != nil {
+		return nil, false, encodeErr
+	}
+	// Even without samples the rest of the response may not fit, it is sent anyway
+	data, err = encodeRecent(max(kept, 0))
+	return data, true, err
+}
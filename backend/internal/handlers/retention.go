@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/cleanup"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// runRetention estimates when runDoc will be deleted: at the earlier of its expire_at, when
+// the Firestore TTL policy removes it, and the end of the retention period DeleteOldRuns
+// counts from storage.RetentionStart. Runs DeleteOldRuns keeps, see storage.RetainedForever,
+// are never deleted unless they carry an expire_at.
+func runRetention(runID string, runDoc *models.RunDoc, now time.Time, retention time.Duration, retainBackfill bool) models.RunRetention {
+	result := models.RunRetention{RunID: runID, RetainForever: runDoc.RetainForever}
+	var deletesAt time.Time
+	if !storage.RetainedForever(runDoc, retainBackfill) {
+		deletesAt = storage.RetentionStart(runDoc).Add(retention)
+	}
+	if !runDoc.ExpireAt.IsZero() && (deletesAt.IsZero() || runDoc.ExpireAt.Before(deletesAt)) {
+		deletesAt = runDoc.ExpireAt
+	}
+	if deletesAt.IsZero() {
+		return result
+	}
+	// A run past its deadline is due at the next TTL sweep
+	remaining := int64(max(deletesAt.Sub(now), 0) / time.Second)
+	result.DeletesAt = &deletesAt
+	result.SecondsRemaining = &remaining
+	return result
+}
+
+// getRunRetention handles GET /runs/{runId}/retention, so dashboards can warn before a
+// run is deleted
+func (h *Handlers) getRunRetention(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(runRetention(runID, runDoc, clock.Now(), cleanup.DataRetentionPeriod, h.retainBackfill))
+}
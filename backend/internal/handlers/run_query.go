@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// runQuery holds the sample transformations requested via GetRun query parameters
+type runQuery struct {
+	descending bool // ?order=desc returns newest samples first
+	columnar   bool // ?format=columnar returns parallel arrays instead of sample objects
+	tree       bool // ?format=tree returns a process / time bucket hierarchy for flame charts
+	bucketSecs int  // ?bucket_seconds= is the width of ?format=tree's time buckets
+	camel      bool // ?naming=camel returns sample objects with camelCase keys
+	groupByPID bool // ?group_by=pid returns samples grouped per process
+	processes  bool // ?include=processes embeds each group's ProcessInfo, implies group_by=pid
+	maxPoints  int  // ?max_points=N downsamples to at most N samples, 0 keeps all
+	gcMillis   int  // ?gc_threshold_ms= samples with more GC time always survive downsampling
+	since      int64
+	hasSince   bool // ?since_ts= returns only samples with a newer timestamp
+	asOf       int64
+	hasAsOf    bool  // ?as_of_ts= returns the run as it was at that timestamp
+	maxFlags   int   // ?max_flags=N returns at most N VM flags per process, 0 returns all
+	dedupMs    int64 // ?dedup_ms=N collapses a process's samples at most N ms apart, 0 keeps all
+	stride     int   // ?stride=K keeps every Kth sample plus the last, 0 keeps all
+}
+
+// runQueryParams lists every query parameter GetRun understands
+var runQueryParams = []string{
+	"order", "format", "naming", "group_by", "include",
+	"since_ts", "as_of_ts", "max_points", "gc_threshold_ms", "max_flags", "dedup_ms",
+	"bucket_seconds", "stride", "pretty",
+}
+
+// unknownQueryParams returns the sorted keys of values that are not in known
+func unknownQueryParams(values url.Values, known []string) []string {
+	var unknown []string
+	for key := range values {
+		if !slices.Contains(known, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// DefaultDownsampleGCThreshold is the GC time in milliseconds above which a sample
+// is treated as a GC event and kept by the downsampler
+const DefaultDownsampleGCThreshold = 100
+
+// DefaultTreeBucketSeconds is the width of ?format=tree's time buckets
+const DefaultTreeBucketSeconds = 60
+
+// parseRunQuery validates the GetRun query parameters
+func parseRunQuery(values url.Values) (runQuery, error) {
+	q := runQuery{gcMillis: DefaultDownsampleGCThreshold, bucketSecs: DefaultTreeBucketSeconds}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.descending = true
+	default:
+		return q, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+
+	switch format := values.Get("format"); format {
+	case "", "objects":
+	case "columnar":
+		q.columnar = true
+	case "tree":
+		q.tree = true
+	default:
+		return q, fmt.Errorf("invalid format %q, expected objects, columnar or tree", format)
+	}
+	if value := values.Get("bucket_seconds"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid bucket_seconds %q, expected a positive integer", value)
+		}
+		q.bucketSecs = n
+	}
+
+	switch naming := values.Get("naming"); naming {
+	case "", "default":
+	case "camel":
+		q.camel = true
+	default:
+		return q, fmt.Errorf("invalid naming %q, expected default or camel", naming)
+	}
+	if q.camel && (q.columnar || q.tree) {
+		return q, fmt.Errorf("naming=camel applies to sample objects and cannot be combined with format=%s", values.Get("format"))
+	}
+
+	switch groupBy := values.Get("group_by"); groupBy {
+	case "":
+	case "pid":
+		q.groupByPID = true
+	default:
+		return q, fmt.Errorf("invalid group_by %q, expected pid", groupBy)
+	}
+
+	switch include := values.Get("include"); include {
+	case "":
+	case "processes":
+		q.processes = true
+		q.groupByPID = true
+	default:
+		return q, fmt.Errorf("invalid include %q, expected processes", include)
+	}
+	if q.groupByPID && (q.columnar || q.tree || q.camel) {
+		return q, fmt.Errorf("group_by=pid cannot be combined with format=columnar, format=tree or naming=camel")
+	}
+
+	maxFlags, err := parseMaxFlags(values)
+	if err != nil {
+		return q, err
+	}
+	q.maxFlags = maxFlags
+
+	if value := values.Get("since_ts"); value != "" {
+		ts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ts < 0 {
+			return q, fmt.Errorf("invalid since_ts %q, expected a timestamp in milliseconds", value)
+		}
+		q.since = ts
+		q.hasSince = true
+	}
+
+	if value := values.Get("as_of_ts"); value != "" {
+		ts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ts < 0 {
+			return q, fmt.Errorf("invalid as_of_ts %q, expected a timestamp in milliseconds", value)
+		}
+		q.asOf = ts
+		q.hasAsOf = true
+	}
+
+	if value := values.Get("max_points"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid max_points %q, expected a positive integer", value)
+		}
+		q.maxPoints = n
+	}
+	if value := values.Get("stride"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid stride %q, expected a positive integer", value)
+		}
+		q.stride = n
+	}
+	if q.stride > 0 && q.maxPoints > 0 {
+		return q, fmt.Errorf("stride and max_points are alternative downsamplings and cannot be combined")
+	}
+	if value := values.Get("gc_threshold_ms"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid gc_threshold_ms %q, expected a non-negative integer", value)
+		}
+		q.gcMillis = n
+	}
+	if value := values.Get("dedup_ms"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid dedup_ms %q, expected a non-negative integer", value)
+		}
+		q.dedupMs = n
+	}
+
+	return q, nil
+}
+
+// asOfSamples returns the samples that had been taken by ?as_of_ts=, all of them without it
+func (q runQuery) asOfSamples(samples []models.Sample) []models.Sample {
+	if !q.hasAsOf {
+		return samples
+	}
+	result := make([]models.Sample, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Timestamp <= q.asOf {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+// finishedAsOf returns the run's finished state and finish time as of ?as_of_ts=. A run
+// finished after that point is reported unfinished; one finished without a recorded
+// finish time is reported as stored.
+func (q runQuery) finishedAsOf(runDoc *models.RunDoc) (bool, *time.Time) {
+	if runDoc.FinishedAt.IsZero() {
+		return runDoc.Finished, nil
+	}
+	if q.hasAsOf && storage.ToMillis(runDoc.FinishedAt) > q.asOf {
+		return false, nil
+	}
+	finishedAt := runDoc.FinishedAt
+	return runDoc.Finished, &finishedAt
+}
+
+// apply returns the samples to send to the client. Ordering is applied last,
+// after any filtering, so it composes with the other options.
+func (q runQuery) apply(samples []models.Sample) []models.Sample {
+	samples = q.asOfSamples(samples)
+	result := make([]models.Sample, 0, len(samples))
+	for _, sample := range samples {
+		if !q.hasSince || sample.Timestamp > q.since {
+			result = append(result, sample)
+		}
+	}
+
+	if q.dedupMs > 0 {
+		result = dedupSamples(result, q.dedupMs)
+	}
+
+	if q.stride > 0 {
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].Timestamp < result[j].Timestamp
+		})
+		result = strideSamples(result, q.stride)
+	}
+
+	// Downsample in time order so uniform picks are evenly spread over the run
+	if q.maxPoints > 0 {
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].Timestamp < result[j].Timestamp
+		})
+		result = downsample(result, q.maxPoints, q.gcMillis)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if q.descending {
+			return result[i].Timestamp > result[j].Timestamp
+		}
+		return result[i].Timestamp < result[j].Timestamp
+	})
+
+	return result
+}
+
+// parseMaxFlags reads ?max_flags=, 0 when absent
+func parseMaxFlags(values url.Values) (int, error) {
+	value := values.Get("max_flags")
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid max_flags %q, expected a positive integer", value)
+	}
+	return n, nil
+}
+
+// limitVMFlags returns a copy of processInfo with each process's VMFlags cut to maxFlags,
+// recording how many were left out in VMFlagsOmitted. A maxFlags of 0 keeps every flag.
+func limitVMFlags(processInfo map[string]models.ProcessInfo, maxFlags int) map[string]models.ProcessInfo {
+	if maxFlags <= 0 || processInfo == nil {
+		return processInfo
+	}
+	result := make(map[string]models.ProcessInfo, len(processInfo))
+	for pid, info := range processInfo {
+		if len(info.VMFlags) > maxFlags {
+			info.VMFlagsOmitted = len(info.VMFlags) - maxFlags
+			info.VMFlags = info.VMFlags[:maxFlags:maxFlags]
+		}
+		result[pid] = info
+	}
+	return result
+}
+
+// nextSince returns the cursor for the next incremental fetch: the newest sample
+// timestamp, or the requested since_ts when no newer sample exists
+func (q runQuery) nextSince(samples []models.Sample) int64 {
+	cursor := q.since
+	for _, sample := range q.asOfSamples(samples) {
+		if sample.Timestamp > cursor {
+			cursor = sample.Timestamp
+		}
+	}
+	return cursor
+}
+
+// dedupSamples collapses each process's samples taken within windowMs of the sample kept
+// before them, keeping the earliest as the representative. Samples of different
+// processes never collapse into each other. The result is in time order.
+func dedupSamples(samples []models.Sample, windowMs int64) []models.Sample {
+	ordered := slices.Clone(samples)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Timestamp < ordered[j].Timestamp
+	})
+
+	kept := make(map[string]int64)
+	result := ordered[:0]
+	for _, sample := range ordered {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if last, ok := kept[key]; ok && sample.Timestamp-last <= windowMs {
+			continue
+		}
+		kept[key] = sample.Timestamp
+		result = append(result, sample)
+	}
+	return result
+}
+
+// strideSamples keeps every stride-th sample starting with the first, and the last sample
+// even when it falls between strides
+func strideSamples(samples []models.Sample, stride int) []models.Sample {
+	if stride <= 1 || len(samples) <= 2 {
+		return samples
+	}
+	result := make([]models.Sample, 0, len(samples)/stride+2)
+	for i := 0; i < len(samples); i += stride {
+		result = append(result, samples[i])
+	}
+	if (len(samples)-1)%stride != 0 {
+		result = append(result, samples[len(samples)-1])
+	}
+	return result
+}
+
+// downsample reduces samples to at most maxPoints, keeping their order. Samples with
+// GCTime above gcMillis are always kept (the longest ones if they alone exceed the
+// budget) and the remaining budget is filled by uniform sampling of the others.
+func downsample(samples []models.Sample, maxPoints int, gcMillis int) []models.Sample {
+	if len(samples) <= maxPoints {
+		return samples
+	}
+
+	var gcEvents, others []int
+	for i, sample := range samples {
+		if sample.GCTime > gcMillis {
+			gcEvents = append(gcEvents, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+
+	if len(gcEvents) > maxPoints {
+		sort.SliceStable(gcEvents, func(a, b int) bool {
+			return samples[gcEvents[a]].GCTime > samples[gcEvents[b]].GCTime
+		})
+		gcEvents = gcEvents[:maxPoints]
+		others = nil
+	}
+
+	keep := make(map[int]bool, maxPoints)
+	for _, i := range gcEvents {
+		keep[i] = true
+	}
+	if budget := maxPoints - len(gcEvents); budget > 0 && len(others) > 0 {
+		step := float64(len(others)) / float64(budget)
+		for k := 0; k < budget && k < len(others); k++ {
+			keep[others[int(float64(k)*step)]] = true
+		}
+	}
+
+	result := make([]models.Sample, 0, len(keep))
+	for i, sample := range samples {
+		if keep[i] {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// searchNote tells clients that GET /runs:search only covers runs with a maintained peak
+const searchNote = "Runs last written before peak heaps were kept have no peak_heap_used_mb and are not searched"
+
+// SearchRuns handles GET /runs:search?min_peak_heap={MB}, returning summaries of the runs
+// whose peak heap reached the threshold, highest first. It reads the peak maintained on each
+// run as samples arrive instead of scanning samples, so runs last written before peaks were
+// kept are never matched; the response's note says so. ?limit= works as in ListRuns.
+func (h *Handlers) SearchRuns(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	param := r.URL.Query().Get("min_peak_heap")
+	minPeak, err := strconv.Atoi(param)
+	if err != nil || minPeak < 0 {
+		http.Error(w, "min_peak_heap is required, expected a non-negative number of MB", http.StatusBadRequest)
+		return
+	}
+	limit, err := h.runsPageLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runs, err := h.storage.SearchRunsByPeakHeap(ctx, minPeak, limit)
+	if err != nil {
+		log.Printf("Error searching runs by peak heap: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(models.RunSummaryPage{Runs: runs, Note: searchNote})
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// Heap trend defaults, overridable with HEAP_TREND_THRESHOLD_MB_PER_MIN,
+// HEAP_TREND_MIN_SAMPLES and HEAP_TREND_GC_DIP_RATIO
+const (
+	DefaultHeapTrendThreshold  = 1.0 // MB per minute
+	DefaultHeapTrendMinSamples = 10
+	DefaultHeapTrendGCDipRatio = 0.2
+)
+
+// DefaultAggregateWindow is the window of GET /stats/aggregate when ?from= is omitted
+const DefaultAggregateWindow = 7 * 24 * time.Hour
+
+// DefaultAggregateMaxRuns caps the runs GET /stats/aggregate reads, overridable with AGGREGATE_MAX_RUNS
+const DefaultAggregateMaxRuns = 5000
+
+// getAggregateMaxRuns reads AGGREGATE_MAX_RUNS
+func getAggregateMaxRuns() int {
+	value := os.Getenv("AGGREGATE_MAX_RUNS")
+	if value == "" {
+		return DefaultAggregateMaxRuns
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("⚠️  WARNING: invalid AGGREGATE_MAX_RUNS %q, using %d", value, DefaultAggregateMaxRuns)
+		return DefaultAggregateMaxRuns
+	}
+	return n
+}
+
+// heapTrendConfig controls how heap growth is classified
+type heapTrendConfig struct {
+	threshold  float64 // Slope in MB/min beyond which the heap counts as growing or shrinking
+	minSamples int     // Fewer samples (after filtering) report insufficient_data
+	gcDipRatio float64 // A drop of more than this fraction from the previous sample is a GC dip
+}
+
+// getHeapTrendConfig reads the heap trend thresholds from the environment
+func getHeapTrendConfig() heapTrendConfig {
+	return heapTrendConfig{
+		threshold:  getEnvFloat("HEAP_TREND_THRESHOLD_MB_PER_MIN", DefaultHeapTrendThreshold),
+		minSamples: int(getEnvFloat("HEAP_TREND_MIN_SAMPLES", DefaultHeapTrendMinSamples)),
+		gcDipRatio: getEnvFloat("HEAP_TREND_GC_DIP_RATIO", DefaultHeapTrendGCDipRatio),
+	}
+}
+
+// getEnvFloat reads a non-negative number from the environment, falling back to def
+func getEnvFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		log.Printf("⚠️  WARNING: invalid %s %q, using %v", name, value, def)
+		return def
+	}
+	return n
+}
+
+// computeRunStats derives informational statistics from a run's samples, in ingestion order
+func computeRunStats(runID string, samples []models.Sample, trendConfig heapTrendConfig) models.RunStats {
+	stats := models.RunStats{
+		RunID:               runID,
+		SampleCount:         len(samples),
+		NonMonotonicElapsed: make(map[string]int),
+		HeapTrend:           make(map[string]models.HeapTrend),
+	}
+
+	// A restarted process gets a new PID, so elapsed time going backward within
+	// the same process points at a misbehaving agent rather than a restart.
+	// Processes are keyed by machine and PID, since PIDs repeat across machines.
+	lastElapsed := make(map[string]int)
+	byProcess := make(map[string][]models.Sample)
+	for _, sample := range samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if last, ok := lastElapsed[key]; ok && sample.ElapsedTime < last {
+			stats.NonMonotonicElapsed[key]++
+		}
+		lastElapsed[key] = sample.ElapsedTime
+		byProcess[key] = append(byProcess[key], sample)
+	}
+	for key, processSamples := range byProcess {
+		stats.HeapTrend[key] = classifyHeapTrend(processSamples, trendConfig)
+	}
+
+	return stats
+}
+
+// classifyHeapTrend fits a least-squares line of HeapUsed over elapsed minutes for one
+// process. Samples right after a collection would drag the slope down, so a sample that
+// drops by more than gcDipRatio from the previous one is left out of the fit.
+func classifyHeapTrend(samples []models.Sample, config heapTrendConfig) models.HeapTrend {
+	var xs, ys []float64
+	previous := -1
+	for _, sample := range samples {
+		isDip := previous > 0 && float64(sample.HeapUsed) < float64(previous)*(1-config.gcDipRatio)
+		previous = sample.HeapUsed
+		if isDip {
+			continue
+		}
+		xs = append(xs, float64(sample.ElapsedTime)/60)
+		ys = append(ys, float64(sample.HeapUsed))
+	}
+
+	trend := models.HeapTrend{Classification: models.HeapTrendInsufficientData, Samples: len(xs)}
+	if len(xs) < config.minSamples || len(xs) < 2 {
+		return trend
+	}
+
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/float64(len(xs)), sumY/float64(len(ys))
+	var covariance, variance float64
+	for i := range xs {
+		covariance += (xs[i] - meanX) * (ys[i] - meanY)
+		variance += (xs[i] - meanX) * (xs[i] - meanX)
+	}
+	if variance == 0 {
+		// All samples at the same elapsed time, no trend to fit
+		return trend
+	}
+
+	trend.SlopeMBPerMinute = covariance / variance
+	switch {
+	case trend.SlopeMBPerMinute > config.threshold:
+		trend.Classification = models.HeapTrendGrowing
+	case trend.SlopeMBPerMinute < -config.threshold:
+		trend.Classification = models.HeapTrendShrinking
+	default:
+		trend.Classification = models.HeapTrendStable
+	}
+	return trend
+}
+
+// runStats handles GET /runs/{runId}/stats
+func (h *Handlers) runStats(w http.ResponseWriter, r *http.Request, runID string) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run document: %v", err)
+		writeStorageError(w, err)
+		return
+	}
+
+	stats := computeRunStats(runID, runDoc.Samples, h.heapTrend)
+	for pid, count := range stats.NonMonotonicElapsed {
+		log.Printf("⚠️  Run %s PID %s has %d non-monotonic elapsed times", runID, pid, count)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(stats)
+}
+
+// computeAggregateStats derives cross-run statistics for the runs of a window, read with
+// only their aggregate fields. Peaks come from the maintained peak_heap_used_mb.
+func computeAggregateStats(from, to time.Time, runs []models.RunDoc) models.AggregateStats {
+	stats := models.AggregateStats{From: from, To: to, RunCount: len(runs)}
+
+	var peakSum float64
+	var withSamples, finished int
+	for _, run := range runs {
+		if run.PeakHeapUsedMB > 0 {
+			peakSum += float64(run.PeakHeapUsedMB)
+			withSamples++
+		}
+		if run.Finished {
+			finished++
+			if run.FinishStatus == storage.FinishStatusStale {
+				stats.FailedRuns++
+			}
+		}
+	}
+
+	if withSamples > 0 {
+		stats.MeanPeakHeapMB = peakSum / float64(withSamples)
+	}
+	if finished > 0 {
+		stats.FailureRate = float64(stats.FailedRuns) / float64(finished)
+	}
+	return stats
+}
+
+// parseAggregateWindow reads ?from= and ?to= (RFC 3339), defaulting to the
+// DefaultAggregateWindow ending now
+func parseAggregateWindow(values url.Values, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if value := values.Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to %q, expected RFC 3339", value)
+		}
+		to = parsed
+	}
+	from := to.Add(-DefaultAggregateWindow)
+	if value := values.Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from %q, expected RFC 3339", value)
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// AggregateStats handles GET /stats/aggregate?from=&to=, aggregating the runs last updated
+// in the window. Only the AGGREGATE_MAX_RUNS most recently updated runs are read.
+func (h *Handlers) AggregateStats(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, to, err := parseAggregateWindow(r.URL.Query(), clock.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	// One run more than the cap tells whether the window held more runs than were aggregated
+	runs, err := h.storage.RunStatsInWindow(ctx, from, to, h.aggregateMaxRuns+1)
+	if err != nil {
+		log.Printf("Error loading runs between %v and %v: %v", from, to, err)
+		writeStorageError(w, err)
+		return
+	}
+	truncated := len(runs) > h.aggregateMaxRuns
+	if truncated {
+		runs = runs[:h.aggregateMaxRuns]
+	}
+	stats := computeAggregateStats(from, to, runs)
+	stats.Truncated = truncated
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(stats)
+}
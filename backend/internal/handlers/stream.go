@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// DefaultStreamPollInterval is how often /runs/{runId}/stream checks Firestore for new samples
+const DefaultStreamPollInterval = 2 * time.Second
+
+// getAllowedOrigins returns the browser origins allowed to open streams, from the
+// comma separated ALLOWED_ORIGINS (e.g. "https://watcher.example.com,http://localhost:*")
+func getAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// originAllowed reports whether a stream may be opened from origin. Requests without an
+// Origin header come from non-browser clients and are allowed. A "*" entry is ignored
+// because streams must not be readable from arbitrary sites. For local development an
+// entry may end in ":*" to accept any port, e.g. "http://localhost:*".
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	origin = strings.TrimSuffix(origin, "/")
+	for _, entry := range allowed {
+		if entry == origin {
+			return true
+		}
+		if host, ok := strings.CutSuffix(entry, ":*"); ok {
+			if rest, ok := strings.CutPrefix(origin, host+":"); ok && rest != "" && strings.Trim(rest, "0123456789") == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamRun handles GET /runs/{runId}/stream as Server-Sent Events. New samples are sent as
+// "samples" events until the run finishes, which is signalled with a "finished" event. Each
+// poll reads only the samples newer than those already sent.
+// The Origin is validated against ALLOWED_ORIGINS before the stream is opened.
+func (h *Handlers) streamRun(w http.ResponseWriter, r *http.Request, runID string) {
+	origin := r.Header.Get("Origin")
+	if !originAllowed(origin, h.allowedOrigins) {
+		log.Printf("🚫 Rejected stream for run %s from origin %q", runID, origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream outlives the request timeout, each poll gets its own deadline
+	ctx := r.Context()
+
+	runDoc, err := h.storage.GetRun(ctx, runID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting run %s for stream: %v", runID, err)
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	lastSent := make(map[string]int64)
+	ticker := time.NewTicker(h.streamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if samples := newStreamSamples(runDoc.Samples, lastSent); len(samples) > 0 {
+			data, err := json.Marshal(samples)
+			if err != nil {
+				log.Printf("Error encoding stream samples for run %s: %v", runID, err)
+				return
+			}
+			fmt.Fprintf(w, "event: samples\ndata: %s\n\n", data)
+		}
+		if runDoc.Finished {
+			fmt.Fprintf(w, "event: finished\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pollCtx, cancel := h.requestContext(r)
+		runDoc, err = h.storage.GetRunSince(pollCtx, runID, streamCursor(lastSent))
+		cancel()
+		if err != nil {
+			log.Printf("Error polling run %s for stream: %v", runID, err)
+			return
+		}
+	}
+}
+
+// newStreamSamples returns the samples newer than the last one sent for their process and
+// records them as sent. Progress is tracked by timestamp rather than by position, so it
+// holds when compaction shrinks the run or samples are read back in another order.
+func newStreamSamples(samples []models.Sample, lastSent map[string]int64) []models.Sample {
+	// Compared against the progress before this poll, whose samples may come in any order
+	before := maps.Clone(lastSent)
+	var fresh []models.Sample
+	for _, sample := range samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if last, ok := before[key]; ok && sample.Timestamp <= last {
+			continue
+		}
+		fresh = append(fresh, sample)
+		if last, ok := lastSent[key]; !ok || sample.Timestamp > last {
+			lastSent[key] = sample.Timestamp
+		}
+	}
+	return fresh
+}
+
+// streamCursor is the since_ts a stream polls with: the oldest of the timestamps last sent
+// per process, so no process misses samples newer than its own. 0 before any sample.
+func streamCursor(lastSent map[string]int64) int64 {
+	var cursor int64
+	first := true
+	for _, ts := range lastSent {
+		if first || ts < cursor {
+			cursor, first = ts, false
+		}
+	}
+	return cursor
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/cleanup"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// DefaultSummaryCacheTTL is how long GET /admin/summary reuses its last result, overridable
+// with SUMMARY_CACHE_TTL
+const DefaultSummaryCacheTTL = 10 * time.Second
+
+// summaryCache holds the last GET /admin/summary result, so wall displays polling it do
+// not scan the unfinished runs on every refresh
+type summaryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration // 0 disables caching
+	now     func() time.Time
+	summary models.SystemSummary
+	expires time.Time
+}
+
+// newSummaryCacheFromEnv reads SUMMARY_CACHE_TTL (e.g. "10s")
+func newSummaryCacheFromEnv() *summaryCache {
+	ttl := DefaultSummaryCacheTTL
+	if value := os.Getenv("SUMMARY_CACHE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("⚠️  WARNING: invalid SUMMARY_CACHE_TTL %q, using %v", value, DefaultSummaryCacheTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+	return &summaryCache{ttl: ttl, now: time.Now}
+}
+
+// get returns the cached summary if it has not expired yet
+func (c *summaryCache) get() (models.SystemSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || !c.now().Before(c.expires) {
+		return models.SystemSummary{}, false
+	}
+	return c.summary, true
+}
+
+// set caches summary for the TTL
+func (c *summaryCache) set(summary models.SystemSummary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary = summary
+	c.expires = c.now().Add(c.ttl)
+}
+
+// AdminSummary handles GET /admin/summary, counting runs by state along with the samples
+// and the oldest of the active runs
+func (h *Handlers) AdminSummary(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.RequireAdminAuth(r) {
+		log.Printf("⚠️  Unauthorized summary attempt from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized - admin secret required", http.StatusUnauthorized)
+		return
+	}
+
+	summary, ok := h.summary.get()
+	if !ok {
+		ctx, cancel := h.requestContext(r)
+		defer cancel()
+
+		var err error
+		summary, err = h.storage.SummarizeRuns(ctx, cleanup.BuildTimeout)
+		if err != nil {
+			log.Printf("Error summarizing runs: %v", err)
+			writeStorageError(w, err)
+			return
+		}
+		h.summary.set(summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(summary)
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/auth"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// runTags handles /runs/{runId}/tags. POST with {"tags": {...}} merges tags into the run,
+// DELETE with ?key=a&key=b removes them. Either the admin secret or the run's token is required.
+func (h *Handlers) runTags(w http.ResponseWriter, r *http.Request, runID string) {
+	// Handle CORS preflight
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Secret")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var set map[string]string
+	var remove []string
+	switch r.Method {
+	case http.MethodPost:
+		var req models.RunTagsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Tags) == 0 {
+			http.Error(w, "Invalid request body, expected {\"tags\": {...}}", http.StatusBadRequest)
+			return
+		}
+		set = req.Tags
+	case http.MethodDelete:
+		remove = r.URL.Query()["key"]
+		if len(remove) == 0 {
+			http.Error(w, "At least one ?key= is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.RequireAdminAuth(r) && !h.authorizeIngest(w, r, runID) {
+		return
+	}
+
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	tags, err := h.storage.UpdateRunTags(ctx, runID, set, remove)
+	if err != nil {
+		switch {
+		case status.Code(err) == codes.NotFound || strings.Contains(err.Error(), "not found"):
+			http.Error(w, "Run not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrInvalidTags):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, storage.ErrRunArchived):
+			http.Error(w, "Run is archived", http.StatusConflict)
+		default:
+			log.Printf("Error updating tags of run %s: %v", runID, err)
+			writeStorageError(w, err)
+		}
+		return
+	}
+	if tags == nil {
+		tags = map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(map[string]interface{}{
+		"run_id": runID,
+		"tags":   tags,
+	})
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// getServerRequestTimeout returns the hard per-request deadline from REQUEST_TIMEOUT
+// (e.g. "60s"), 0 when unset or invalid
+func getServerRequestTimeout() time.Duration {
+	value := os.Getenv("REQUEST_TIMEOUT")
+	if value == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		log.Printf("⚠️  WARNING: invalid REQUEST_TIMEOUT %q, requests will not time out", value)
+		return 0
+	}
+	return timeout
+}
+
+// isStreamingRequest reports whether r is for an endpoint that writes incrementally
+// (SSE run stream, NDJSON export), which a buffered timeout would break
+func isStreamingRequest(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/runs/") {
+		return false
+	}
+	return strings.HasSuffix(r.URL.Path, "/stream") || strings.HasSuffix(r.URL.Path, "/samples.ndjson")
+}
+
+// TimeoutMiddleware answers 503 for any request next has not finished within timeout.
+// Streaming endpoints are passed through untouched, and a timeout of 0 disables it.
+// Unlike HANDLER_TIMEOUT, which only bounds Firestore calls, this caps the whole handler.
+func TimeoutMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	limited := http.TimeoutHandler(next, timeout, "Request timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreamingRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// NewServerHandler wraps mux with the server-wide middleware configured from the environment
+func NewServerHandler(mux http.Handler) http.Handler {
+	return RequireHTTPSMiddleware(TimeoutMiddleware(mux, getServerRequestTimeout()), getHTTPSConfig())
+}
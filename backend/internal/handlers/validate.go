@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/httpjson"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	"github.com/cdsap/build-process-watcher/backend/internal/storage"
+)
+
+// ValidateIngest handles POST /ingest/validate: it parses an ingest body's data the way
+// POST /ingest would and reports the sample count and the lines that would be skipped.
+// No token is required and nothing is stored, so agents can check their output format.
+func (h *Handlers) ValidateIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.IngestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxIngestBodyBytes)).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	samples, lineErrors := storage.ValidateData(req.Data, clock.Now(), h.parseConfig(), h.sampleCeilingMB)
+	if lineErrors == nil {
+		lineErrors = []models.LineError{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	httpjson.NewEncoder(w, r).Encode(models.IngestValidateResponse{
+		Valid:   len(lineErrors) == 0 && len(samples) > 0,
+		Samples: len(samples),
+		Errors:  lineErrors,
+	})
+}
@@ -0,0 +1,27 @@
+// Package httpjson holds the JSON response helpers shared by the API handlers and the
+// cleanup endpoints.
+package httpjson
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Pretty reports whether the request asked for indented JSON with ?pretty=true, for
+// reading responses in curl. Clients get compact JSON by default, and invalid values are
+// ignored rather than failing the request.
+func Pretty(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
+
+// NewEncoder returns the encoder for a JSON response to r, indented under ?pretty=true
+func NewEncoder(w io.Writer, r *http.Request) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	if Pretty(r) {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder
+}
@@ -1,18 +1,28 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
 
 // Sample represents a single monitoring sample
 type Sample struct {
-	Timestamp   int64  `firestore:"timestamp"`
-	ElapsedTime int    `firestore:"elapsed_time"`
-	PID         string `firestore:"pid"`
-	Name        string `firestore:"name"`
-	HeapUsed    int    `firestore:"heap_used"`
-	HeapCap     int    `firestore:"heap_cap"`
-	RSS         int    `firestore:"rss"`
-	GCTime      int    `firestore:"gc_time,omitempty"` // GC time in milliseconds, optional
-	RunID       string `firestore:"run_id"`
+	Timestamp     int64              `firestore:"timestamp"`
+	ElapsedTime   int                `firestore:"elapsed_time"`
+	PID           string             `firestore:"pid"`
+	Name          string             `firestore:"name"`
+	HeapUsed      int                `firestore:"heap_used"`
+	HeapCap       int                `firestore:"heap_cap"`
+	RSS           int                `firestore:"rss"`
+	RSSMissing    bool               `firestore:"rss_missing,omitempty"`               // True when the agent did not report RSS (5-part lines)
+	GCTime        int                `firestore:"gc_time,omitempty"`                   // GC time in milliseconds, optional
+	GCTimeMissing bool               `firestore:"gc_time_missing,omitempty"`           // True when the agent reported GC time as N/A, empty or not at all, as opposed to 0ms of GC
+	Extra         map[string]float64 `json:",omitempty" firestore:"extra,omitempty"`   // Custom metrics (e.g. metaspace), stored verbatim
+	Phase         string             `json:",omitempty" firestore:"phase,omitempty"`   // Build phase label (e.g. "compiling"), consecutive samples sharing it form a band
+	Machine       string             `json:",omitempty" firestore:"machine,omitempty"` // Host of the agent that sent the sample, for runs fed by several machines
+	RunID         string             `firestore:"run_id"`
 }
 
 // ProcessInfo contains information about a specific process
@@ -20,6 +30,21 @@ type ProcessInfo struct {
 	PID     string   `json:"pid" firestore:"pid"`
 	Name    string   `json:"name" firestore:"name"`
 	VMFlags []string `json:"vm_flags" firestore:"vm_flags"`
+	// Machine is the host of the reporting agent; with it set the process is keyed
+	// "machine/pid" so identical PIDs on different machines stay apart
+	Machine string `json:"machine,omitempty" firestore:"machine,omitempty"`
+	// StartOffsetSeconds shifts this process's sample timestamps, so agents with their
+	// own elapsed-time origin line up on the run's timeline
+	StartOffsetSeconds int `json:"start_offset_seconds,omitempty" firestore:"start_offset_seconds,omitempty"`
+	// Color and DisplayName are presentation hints pinned by the agent so dashboards show the
+	// same process consistently across runs, e.g. "#1f77b4" and "Gradle daemon"
+	Color       string `json:"color,omitempty" firestore:"color,omitempty"`
+	DisplayName string `json:"display_name,omitempty" firestore:"display_name,omitempty"`
+	// LastSeen is when the agent last reported this process, used to evict the least
+	// recently seen processes once a run exceeds MAX_PROCESSES_PER_RUN
+	LastSeen time.Time `json:"-" firestore:"last_seen,omitempty"`
+	// VMFlagsOmitted counts flags left out of a response truncated with ?max_flags=, it is never stored
+	VMFlagsOmitted int `json:"vm_flags_omitted,omitempty" firestore:"-"`
 }
 
 // ProcessDoc represents a processes document in Firestore (one per run)
@@ -34,17 +59,138 @@ type ProcessDoc struct {
 
 // RunDoc represents a monitoring run document in Firestore
 type RunDoc struct {
-	ID                 string    `firestore:"id"`
-	RunID              string    `firestore:"run_id"`
-	StartTime          time.Time `firestore:"start_time"`
-	EndTime            time.Time `firestore:"end_time,omitempty"`
-	CreatedAt          time.Time `firestore:"created_at"`
-	UpdatedAt          time.Time `firestore:"updated_at"`
-	UpdatedAtTimestamp int64     `firestore:"updated_at_timestamp"` // Unix millis for timezone-independent queries
-	Samples            []Sample  `firestore:"samples"`
-	Finished           bool      `firestore:"finished,omitempty"`
-	FinishedAt         time.Time `firestore:"finished_at,omitempty"`
-	ExpireAt           time.Time `firestore:"expire_at,omitempty"` // TTL field - set manually in Firestore, used by TTL policy
+	ID                 string            `firestore:"id"`
+	RunID              string            `firestore:"run_id"`
+	StartTime          time.Time         `firestore:"start_time"`
+	EndTime            time.Time         `firestore:"end_time,omitempty"`
+	CreatedAt          time.Time         `firestore:"created_at"`
+	UpdatedAt          time.Time         `firestore:"updated_at"`
+	UpdatedAtTimestamp int64             `firestore:"updated_at_timestamp"` // Unix millis for timezone-independent queries
+	Samples            []Sample          `firestore:"samples"`
+	Finished           bool              `firestore:"finished"` // Always written so stale queries can filter on finished == false
+	FinishedAt         time.Time         `firestore:"finished_at,omitempty"`
+	ExpireAt           time.Time         `firestore:"expire_at,omitempty"`          // TTL field - set manually in Firestore, used by TTL policy
+	IngestHistory      []IngestEvent     `firestore:"ingest_history,omitempty"`     // Bounded ring of recent ingest batches, oldest first
+	Provider           string            `firestore:"provider,omitempty"`           // CI provider reported by the agent (github, jenkins, local, ...)
+	SuspectedStaleAt   time.Time         `firestore:"suspected_stale_at,omitempty"` // Set by the stale sweep before finishing, cleared by the next ingest
+	Paused             bool              `firestore:"paused,omitempty"`             // Set by admins to reject new samples without finishing the run
+	Backfill           bool              `firestore:"backfill,omitempty"`           // Imported historical run, created already finished
+	ImportedAt         time.Time         `firestore:"imported_at,omitempty"`        // When the run was restored from an archive, retention counts from here
+	Archived           bool              `firestore:"archived,omitempty"`           // Set by admins after export, the run is read-only from then on
+	RetainForever      bool              `firestore:"retain_forever,omitempty"`     // Set by admins to exempt the run from retention and TTL, e.g. benchmark baselines
+	PeakHeapUsedMB     int               `firestore:"peak_heap_used_mb,omitempty"`  // Highest heap used by any sample, maintained on ingest for GET /runs:search
+	FinishStatus       string            `firestore:"finish_status,omitempty"`      // How the run was finished: "completed" by its agent or "stale" by the sweep
+	Tags               map[string]string `firestore:"tags,omitempty"`               // Post-hoc annotations, e.g. investigated=true or a note
+	ProcessNames       map[string]string `firestore:"process_names,omitempty"`      // Process key -> name it reports, to detect recycled PIDs
+	// SamplesGzip holds the samples as gzipped JSON instead of Samples once a run exceeds
+	// COMPRESS_SAMPLES_THRESHOLD. Storage unpacks it on read, so callers only see Samples.
+	SamplesGzip []byte `firestore:"samples_gzip,omitempty"`
+	// SchemaVersion is the layout the document was written with, 0 for runs written
+	// before versioning. Storage migrates older layouts on read.
+	SchemaVersion int `firestore:"schema_version,omitempty"`
+	// SampleCount is the number of samples stored for the run, inline or in the subcollection,
+	// kept so the runs listing can sort by it
+	SampleCount int `firestore:"sample_count"`
+	// LatestHeap maps each process key to its newest heap reading, maintained on ingest so
+	// X-Current-Heap is answered without reading samples. Nil for runs not written since.
+	LatestHeap map[string]HeapReading `firestore:"latest_heap,omitempty"`
+	// Namespace is the RUN_ID_PREFIX of the deployment that wrote the run, filtered on
+	// server-side so namespaced queries only read their own runs. Empty without a prefix.
+	Namespace string `firestore:"namespace,omitempty"`
+}
+
+// RunSummary is a lightweight view of a run used by the runs listing
+type RunSummary struct {
+	RunID     string    `json:"run_id" firestore:"run_id"`
+	Provider  string    `json:"provider,omitempty" firestore:"provider,omitempty"`
+	StartTime time.Time `json:"start_time" firestore:"start_time"`
+	UpdatedAt time.Time `json:"updated_at" firestore:"updated_at"`
+	Finished  bool      `json:"finished" firestore:"finished"`
+	// SampleCount is counted for runs written before sample counts were kept by the
+	// legacy backfill at startup; until then such runs are left out of listings sorted
+	// by sample count
+	SampleCount int `json:"sample_count" firestore:"sample_count"`
+	// RetainForever marks runs an admin exempted from retention
+	RetainForever bool `json:"retain_forever,omitempty" firestore:"retain_forever,omitempty"`
+	// PeakHeapUsedMB is 0 for runs not written since peaks were kept
+	PeakHeapUsedMB int `json:"peak_heap_used_mb,omitempty" firestore:"peak_heap_used_mb,omitempty"`
+	// UpdatedAtTimestamp backs the listing cursor and is not part of the response
+	UpdatedAtTimestamp int64 `json:"-" firestore:"updated_at_timestamp"`
+}
+
+// RunSummaryPage is the response of the runs listing
+type RunSummaryPage struct {
+	Runs       []RunSummary `json:"runs"`
+	NextCursor string       `json:"next_cursor,omitempty"` // Pass as ?cursor= to fetch the next page
+	// Note qualifies the results, e.g. which runs GET /runs:search cannot find
+	Note string `json:"note,omitempty"`
+}
+
+// RunRetention is the response of GET /runs/{runId}/retention. DeletesAt and
+// SecondsRemaining are null for runs never deleted: flagged retain_forever, or backfilled
+// with BACKFILL_SKIP_RETENTION.
+type RunRetention struct {
+	RunID            string     `json:"run_id"`
+	RetainForever    bool       `json:"retain_forever"`
+	DeletesAt        *time.Time `json:"deletes_at"`
+	SecondsRemaining *int64     `json:"seconds_remaining"`
+}
+
+// SystemSummary is the response of GET /admin/summary. Unfinished runs are active until the
+// stale sweep's timeout passes without an ingest, then stale until the sweep finishes them.
+type SystemSummary struct {
+	ActiveRuns    int `json:"active_runs"`
+	StaleRuns     int `json:"stale_runs"`
+	FinishedRuns  int `json:"finished_runs"`
+	ActiveSamples int `json:"active_samples"` // Samples stored across active runs
+	// OldestActiveRunID and OldestActiveAgeSeconds, measured from its start, are empty
+	// without active runs
+	OldestActiveRunID      string    `json:"oldest_active_run_id,omitempty"`
+	OldestActiveAgeSeconds int64     `json:"oldest_active_age_seconds"`
+	GeneratedAt            time.Time `json:"generated_at"` // When the summary was computed, it may be served from cache
+}
+
+// RunTagsRequest is the request body of POST /runs/{runId}/tags
+type RunTagsRequest struct {
+	Tags map[string]string `json:"tags"`
+}
+
+// CompactionResult reports what compacting a run changed. Byte sizes cover the stored samples.
+type CompactionResult struct {
+	SamplesBefore int `json:"samples_before"`
+	SamplesAfter  int `json:"samples_after"`
+	BytesBefore   int `json:"bytes_before"`
+	BytesAfter    int `json:"bytes_after"`
+}
+
+// RunStatus is the compact state of a run returned by POST /runs:statuses
+type RunStatus struct {
+	Finished    bool      `json:"finished"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	SampleCount int       `json:"sample_count"`
+}
+
+// RunStatusError replaces a RunStatus in POST /runs:statuses when the run could not be read
+type RunStatusError struct {
+	Error string `json:"error"`
+}
+
+// RunStatusesRequest is the request body of POST /runs:statuses
+type RunStatusesRequest struct {
+	RunIDs []string `json:"run_ids"`
+}
+
+// HeapReading is the heap used by a process at its newest sample
+type HeapReading struct {
+	Timestamp  int64 `firestore:"timestamp"`
+	HeapUsedMB int   `firestore:"heap_used_mb"`
+}
+
+// IngestEvent records a single ingest batch for debugging data loss
+type IngestEvent struct {
+	Timestamp   time.Time `json:"timestamp" firestore:"timestamp"`
+	SampleCount int       `json:"sample_count" firestore:"sample_count"`
+	RemoteAddr  string    `json:"remote_addr" firestore:"remote_addr"`
 }
 
 // RunResponse is the API response for a run
@@ -54,6 +200,279 @@ type RunResponse struct {
 	Finished    bool                   `json:"finished"`
 	FinishedAt  *time.Time             `json:"finished_at,omitempty"`
 	UpdatedAt   time.Time              `json:"updated_at"`
+	// NextSinceTS is the newest sample timestamp, pass it as ?since_ts= to fetch only newer samples
+	NextSinceTS int64             `json:"next_since_ts"`
+	Archived    bool              `json:"archived,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// RetainForever is set on runs an admin exempted from retention
+	RetainForever bool `json:"retain_forever,omitempty"`
+	// Truncated is set when MAX_RESPONSE_BYTES dropped the oldest samples, page for them with ?as_of_ts=
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ColumnarSamples holds samples as parallel arrays, one entry per sample in each
+type ColumnarSamples struct {
+	Timestamps   []int64  `json:"timestamps"`
+	ElapsedTimes []int    `json:"elapsed_times"`
+	PIDs         []string `json:"pids"`
+	Names        []string `json:"names"`
+	HeapUsed     []int    `json:"heap_used"`
+	HeapCap      []int    `json:"heap_cap"`
+	RSS          []int    `json:"rss"`
+	GCTime       []int    `json:"gc_time"`
+}
+
+// RunStats is the response of GET /runs/{runId}/stats
+type RunStats struct {
+	RunID       string `json:"run_id"`
+	SampleCount int    `json:"sample_count"`
+	// NonMonotonicElapsed counts, per process key (see ProcessKey), samples whose elapsed
+	// time went backward compared to the previous sample of the same process. Informational only.
+	NonMonotonicElapsed map[string]int `json:"non_monotonic_elapsed"`
+	// HeapTrend classifies heap growth per process key, to spot probable leaks
+	HeapTrend map[string]HeapTrend `json:"heap_trend"`
+}
+
+// AggregateStats is the response of GET /stats/aggregate, computed over the runs
+// last updated within [From, To)
+type AggregateStats struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	RunCount int       `json:"run_count"`
+	// MeanPeakHeapMB averages each run's highest heap usage, over runs with a recorded peak.
+	// Runs last written before peaks were kept have none and are left out.
+	MeanPeakHeapMB float64 `json:"mean_peak_heap_mb"`
+	// FailedRuns counts finished runs the stale sweep had to finish because their agent stopped reporting
+	FailedRuns int `json:"failed_runs"`
+	// FailureRate is FailedRuns over the number of finished runs, 0 when none finished
+	FailureRate float64 `json:"failure_rate"`
+	// Truncated is true when the window held more runs than AGGREGATE_MAX_RUNS and only
+	// the most recently updated ones were aggregated
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// LabelsResponse is the response of GET /labels, computed over the runs last updated
+// within [From, To)
+type LabelsResponse struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	RunCount int       `json:"run_count"`
+	// Labels maps each label key to the number of runs carrying each of its values
+	Labels map[string]map[string]int `json:"labels"`
+}
+
+// Heap trend classifications reported in RunStats
+const (
+	HeapTrendStable           = "stable"
+	HeapTrendGrowing          = "growing"
+	HeapTrendShrinking        = "shrinking"
+	HeapTrendInsufficientData = "insufficient_data"
+)
+
+// HeapTrend is the linear trend of a process's heap usage over elapsed time
+type HeapTrend struct {
+	Classification   string  `json:"classification"`
+	SlopeMBPerMinute float64 `json:"slope_mb_per_minute"`
+	Samples          int     `json:"samples"` // Samples used after filtering GC dips
+}
+
+// ColumnarRunResponse is the RunResponse variant returned for ?format=columnar
+type ColumnarRunResponse struct {
+	Samples     ColumnarSamples        `json:"samples"`
+	ProcessInfo map[string]ProcessInfo `json:"process_info,omitempty"`
+	Finished    bool                   `json:"finished"`
+	FinishedAt  *time.Time             `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	NextSinceTS int64                  `json:"next_since_ts"`       // See RunResponse.NextSinceTS
+	Truncated   bool                   `json:"truncated,omitempty"` // See RunResponse.Truncated
+}
+
+// ToColumnar converts samples to parallel arrays
+func ToColumnar(samples []Sample) ColumnarSamples {
+	n := len(samples)
+	columns := ColumnarSamples{
+		Timestamps:   make([]int64, 0, n),
+		ElapsedTimes: make([]int, 0, n),
+		PIDs:         make([]string, 0, n),
+		Names:        make([]string, 0, n),
+		HeapUsed:     make([]int, 0, n),
+		HeapCap:      make([]int, 0, n),
+		RSS:          make([]int, 0, n),
+		GCTime:       make([]int, 0, n),
+	}
+	for _, sample := range samples {
+		columns.Timestamps = append(columns.Timestamps, sample.Timestamp)
+		columns.ElapsedTimes = append(columns.ElapsedTimes, sample.ElapsedTime)
+		columns.PIDs = append(columns.PIDs, sample.PID)
+		columns.Names = append(columns.Names, sample.Name)
+		columns.HeapUsed = append(columns.HeapUsed, sample.HeapUsed)
+		columns.HeapCap = append(columns.HeapCap, sample.HeapCap)
+		columns.RSS = append(columns.RSS, sample.RSS)
+		columns.GCTime = append(columns.GCTime, sample.GCTime)
+	}
+	return columns
+}
+
+// AnonymizedSample is a sample stripped of identifying fields: the process is an opaque
+// alias, and absolute timestamps, names, phases and custom metrics are dropped
+type AnonymizedSample struct {
+	Process     string `json:"process"`
+	ElapsedTime int    `json:"elapsed_time"`
+	HeapUsed    int    `json:"heap_used"`
+	HeapCap     int    `json:"heap_cap"`
+	RSS         int    `json:"rss"`
+	GCTime      int    `json:"gc_time"`
+}
+
+// AnonymizedRun is the response of GET /runs/{runId}/export/anonymized
+type AnonymizedRun struct {
+	Processes int                `json:"processes"`
+	Samples   []AnonymizedSample `json:"samples"`
+}
+
+// SampleGroup holds the samples of one process for ?group_by=pid
+type SampleGroup struct {
+	PID         string       `json:"pid"`
+	Machine     string       `json:"machine,omitempty"`
+	ProcessInfo *ProcessInfo `json:"process_info,omitempty"` // Set with ?include=processes
+	Samples     []Sample     `json:"samples"`
+}
+
+// GroupedRunResponse is the RunResponse variant returned for ?group_by=pid
+type GroupedRunResponse struct {
+	Groups      []SampleGroup `json:"groups"`
+	Finished    bool          `json:"finished"`
+	FinishedAt  *time.Time    `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	NextSinceTS int64         `json:"next_since_ts"`       // See RunResponse.NextSinceTS
+	Truncated   bool          `json:"truncated,omitempty"` // See RunResponse.Truncated
+}
+
+// GroupByPID groups samples per process (see ProcessKey), keeping sample order within
+// a group and ordering groups by the first appearance of their process
+func GroupByPID(samples []Sample) []SampleGroup {
+	groups := []SampleGroup{}
+	index := make(map[string]int)
+	for _, sample := range samples {
+		key := ProcessKey(sample.Machine, sample.PID)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, SampleGroup{PID: sample.PID, Machine: sample.Machine})
+		}
+		groups[i].Samples = append(groups[i].Samples, sample)
+	}
+	return groups
+}
+
+// TreeNode is a node of the ?format=tree hierarchy: the run, then its processes, then
+// time buckets of each process. A leaf's Value is the heap used (MB) summed over the
+// bucket's samples and every other node's Value is the sum of its children's.
+type TreeNode struct {
+	Name     string     `json:"name"`
+	Value    int        `json:"value"`
+	Samples  int        `json:"samples"`
+	Start    *int       `json:"start,omitempty"` // Elapsed seconds at which a bucket starts, set on leaves
+	Children []TreeNode `json:"children,omitempty"`
+}
+
+// TreeRunResponse is the RunResponse variant returned for ?format=tree
+type TreeRunResponse struct {
+	Root        TreeNode   `json:"root"`
+	Finished    bool       `json:"finished"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	NextSinceTS int64      `json:"next_since_ts"`       // See RunResponse.NextSinceTS
+	Truncated   bool       `json:"truncated,omitempty"` // See RunResponse.Truncated
+}
+
+// ToTree builds the ?format=tree hierarchy rooted at name. Processes are ordered by first
+// appearance (see GroupByPID) and named "key name" after their latest reported name;
+// buckets cover bucketSeconds of elapsed time each and are ordered by start.
+func ToTree(name string, samples []Sample, bucketSeconds int) TreeNode {
+	root := TreeNode{Name: name, Children: []TreeNode{}}
+	for _, group := range GroupByPID(samples) {
+		process := TreeNode{Name: ProcessKey(group.Machine, group.PID)}
+		buckets := make(map[int]*TreeNode)
+		var starts []int
+		for _, sample := range group.Samples {
+			if sample.Name != "" {
+				process.Name = ProcessKey(group.Machine, group.PID) + " " + sample.Name
+			}
+			start := sample.ElapsedTime - sample.ElapsedTime%bucketSeconds
+			bucket, ok := buckets[start]
+			if !ok {
+				bucketStart := start
+				bucket = &TreeNode{Name: fmt.Sprintf("%ds", start), Start: &bucketStart}
+				buckets[start] = bucket
+				starts = append(starts, start)
+			}
+			bucket.Value += sample.HeapUsed
+			bucket.Samples++
+		}
+		sort.Ints(starts)
+		for _, start := range starts {
+			process.Children = append(process.Children, *buckets[start])
+			process.Value += buckets[start].Value
+			process.Samples += buckets[start].Samples
+		}
+		root.Children = append(root.Children, process)
+		root.Value += process.Value
+		root.Samples += process.Samples
+	}
+	return root
+}
+
+// ProcessKey identifies a process within a run. PIDs are only unique per machine, so
+// processes reported with a machine are keyed "machine/pid" and others by PID alone.
+func ProcessKey(machine, pid string) string {
+	if machine == "" {
+		return pid
+	}
+	return machine + "/" + pid
+}
+
+// camelSample mirrors Sample with camelCase JSON keys
+type camelSample struct {
+	Timestamp     int64              `json:"timestamp"`
+	ElapsedTime   int                `json:"elapsedTime"`
+	PID           string             `json:"pid"`
+	Name          string             `json:"name"`
+	HeapUsed      int                `json:"heapUsed"`
+	HeapCap       int                `json:"heapCap"`
+	RSS           int                `json:"rss"`
+	RSSMissing    bool               `json:"rssMissing,omitempty"`
+	GCTime        int                `json:"gcTime"`
+	GCTimeMissing bool               `json:"gcTimeMissing,omitempty"`
+	Extra         map[string]float64 `json:"extra,omitempty"`
+	Phase         string             `json:"phase,omitempty"`
+	Machine       string             `json:"machine,omitempty"`
+	RunID         string             `json:"runId"`
+}
+
+// CamelCaseSamples marshals samples with camelCase keys (heapUsed, gcTime, ...),
+// leaving Sample's default encoding untouched for existing clients
+type CamelCaseSamples []Sample
+
+// MarshalJSON implements json.Marshaler
+func (samples CamelCaseSamples) MarshalJSON() ([]byte, error) {
+	converted := make([]camelSample, len(samples))
+	for i, sample := range samples {
+		converted[i] = camelSample(sample)
+	}
+	return json.Marshal(converted)
+}
+
+// CamelCaseRunResponse is the RunResponse variant returned for ?naming=camel
+type CamelCaseRunResponse struct {
+	Samples     CamelCaseSamples       `json:"samples"`
+	ProcessInfo map[string]ProcessInfo `json:"process_info,omitempty"`
+	Finished    bool                   `json:"finished"`
+	FinishedAt  *time.Time             `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	NextSinceTS int64                  `json:"next_since_ts"`       // See RunResponse.NextSinceTS
+	Truncated   bool                   `json:"truncated,omitempty"` // See RunResponse.Truncated
 }
 
 // TokenRequest is the request body for token generation
@@ -65,6 +484,82 @@ type TokenRequest struct {
 type TokenResponse struct {
 	Token     string    `json:"token"`
 	ExpiresAt time.Time `json:"expires_at"`
+	RunURL    string    `json:"run_url,omitempty"` // Dashboard page of the run, when DASHBOARD_BASE_URL is set
+}
+
+// TokenValidateRequest is the request body for checking a token without using it
+type TokenValidateRequest struct {
+	Token string `json:"token"`
+	RunID string `json:"run_id"`
+}
+
+// TokenValidateResponse reports a valid token's remaining lifetime
+type TokenValidateResponse struct {
+	Valid      bool      `json:"valid"`
+	RunID      string    `json:"run_id"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+}
+
+// BatchRequest is the body of POST /batch: operations for one run, executed in order
+type BatchRequest struct {
+	RunID      string           `json:"run_id"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single ingest or finish step of a batch
+type BatchOperation struct {
+	Op          string       `json:"op"` // "ingest" or "finish"
+	Data        string       `json:"data,omitempty"`
+	ProcessInfo *ProcessInfo `json:"process_info,omitempty"`
+	Provider    string       `json:"provider,omitempty"`
+	Machine     string       `json:"machine,omitempty"`
+}
+
+// BatchResult is the outcome of one batch operation, with the status and body
+// the equivalent standalone request would have returned
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Op     string          `json:"op"`
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// RetryAfter is the Retry-After, in seconds, the standalone request would have sent,
+	// e.g. with a 429 from the ingest rate limit
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// BatchResponse is the response of POST /batch
+type BatchResponse struct {
+	RunID   string        `json:"run_id"`
+	Results []BatchResult `json:"results"`
+}
+
+// LineError describes why a data line was skipped, Line is 1-based
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// IngestValidateResponse is the response of POST /ingest/validate
+type IngestValidateResponse struct {
+	Valid   bool        `json:"valid"`
+	Samples int         `json:"samples"`
+	Errors  []LineError `json:"errors"`
+}
+
+// ImportError describes an archive line POST /admin/import could not import, Line is 1-based
+type ImportError struct {
+	Line  int    `json:"line"`
+	RunID string `json:"run_id,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportResult is the response of POST /admin/import
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
 }
 
 // TokenData contains the data encoded in the JWT
@@ -79,4 +574,8 @@ type IngestRequest struct {
 	RunID       string       `json:"run_id"`
 	Data        string       `json:"data"`
 	ProcessInfo *ProcessInfo `json:"process_info,omitempty"` // Optional: VM flags for a new process
+	Provider    string       `json:"provider,omitempty"`     // Optional: CI provider, falls back to the X-CI-Provider header
+	Backfill    bool         `json:"backfill,omitempty"`     // Optional: import a historical run, created already finished
+	Machine     string       `json:"machine,omitempty"`      // Optional: host of the agent, set on its samples and process info
+	StartTime   time.Time    `json:"start_time,omitempty"`   // Required with backfill: original start of the run
 }
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// ObjectUploader writes an object to a bucket, it is satisfied by Google Cloud Storage
+type ObjectUploader interface {
+	Upload(ctx context.Context, bucket, object string, data []byte) error
+}
+
+// gcsUploader uploads objects with the Cloud Storage JSON API, the service is created on first use
+type gcsUploader struct {
+	once    sync.Once
+	service *gcs.Service
+	err     error
+}
+
+// Upload implements ObjectUploader
+func (u *gcsUploader) Upload(ctx context.Context, bucket, object string, data []byte) error {
+	u.once.Do(func() {
+		u.service, u.err = gcs.NewService(ctx)
+	})
+	if u.err != nil {
+		return fmt.Errorf("failed to create Cloud Storage client: %w", u.err)
+	}
+
+	_, err := u.service.Objects.Insert(bucket, &gcs.Object{
+		Name:        object,
+		ContentType: "application/json",
+	}).Media(bytes.NewReader(data)).Context(ctx).Do()
+	return err
+}
+
+// RunArchive is the JSON document written for an exported run
+type RunArchive struct {
+	RunID       string                        `json:"run_id"`
+	Run         *models.RunDoc                `json:"run"`
+	ProcessInfo map[string]models.ProcessInfo `json:"process_info,omitempty"`
+}
+
+// ArchiveObjectName is the object an exported run is written to
+func ArchiveObjectName(runID string) string {
+	return "runs/" + runID + ".json"
+}
+
+// ExportRunToGCS writes the run document and its process info to bucket as JSON
+func (c *Client) ExportRunToGCS(runID, bucket string) error {
+	runDoc, err := c.GetRun(c.ctx, runID)
+	if err != nil {
+		return err
+	}
+	archive := RunArchive{RunID: runID, Run: runDoc}
+	if processDoc, err := c.GetProcesses(c.ctx, runID); err == nil {
+		archive.ProcessInfo = processDoc.ProcessInfo
+	}
+
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return fmt.Errorf("failed to encode run %s: %w", runID, err)
+	}
+	if err := c.uploader.Upload(c.ctx, bucket, ArchiveObjectName(runID), data); err != nil {
+		return fmt.Errorf("failed to export run %s to gs://%s: %w", runID, bucket, err)
+	}
+
+	log.Printf("📦 Exported run %s to gs://%s/%s", runID, bucket, ArchiveObjectName(runID))
+	return nil
+}
+
+// exportThenDelete exports each run to bucket and deletes the ones that were exported.
+// A run whose export fails is kept so the next retention sweep retries it. With no
+// bucket configured nothing is exported and every run is deleted.
+func exportThenDelete(runIDs []string, bucket string, export func(runID, bucket string) error, remove func(runIDs []string) ([]string, error)) ([]string, error) {
+	if bucket == "" {
+		return remove(runIDs)
+	}
+
+	var exported []string
+	for _, runID := range runIDs {
+		if err := export(runID, bucket); err != nil {
+			log.Printf("❌ Keeping run %s, export before deletion failed: %v", runID, err)
+			continue
+		}
+		exported = append(exported, runID)
+	}
+	return remove(exported)
+}
+
+// ImportBatchRuns is how many runs ImportRuns writes per batch, each run taking up to two
+// writes (its run and process documents)
+const ImportBatchRuns = maxBatchWrites / 2
+
+// ErrInvalidArchive is returned by ValidateRunArchive for a run that cannot be imported
+var ErrInvalidArchive = errors.New("invalid run archive")
+
+// ValidateRunArchive checks that an archived run, as written by ExportRunToGCS, can be imported
+func ValidateRunArchive(archive *RunArchive) error {
+	if archive.RunID == "" || strings.Contains(archive.RunID, "/") {
+		return fmt.Errorf("%w: run_id %q is not a valid run ID", ErrInvalidArchive, archive.RunID)
+	}
+	if archive.Run == nil {
+		return fmt.Errorf("%w: run %s has no run document", ErrInvalidArchive, archive.RunID)
+	}
+	if archive.Run.RunID != "" && archive.Run.RunID != archive.RunID {
+		return fmt.Errorf("%w: run document of %s belongs to run %s", ErrInvalidArchive, archive.RunID, archive.Run.RunID)
+	}
+	if archive.Run.StartTime.IsZero() {
+		return fmt.Errorf("%w: run %s has no start time", ErrInvalidArchive, archive.RunID)
+	}
+	for i, sample := range archive.Run.Samples {
+		if sample.PID == "" || sample.ElapsedTime < 0 || sample.HeapUsed < 0 || sample.HeapCap < 0 || sample.RSS < 0 || sample.GCTime < 0 {
+			return fmt.Errorf("%w: run %s sample %d is missing its PID or has negative values", ErrInvalidArchive, archive.RunID, i)
+		}
+	}
+	return nil
+}
+
+// NewImportedRun builds the run document stored for a validated archive, keeping its
+// timestamps and state but restamping the IDs, sample count and schema version. The
+// archived TTL is dropped and ImportedAt set to now, so retention counts from the import
+// rather than expiring a restored run on the next sweep; finished runs get a fresh TTL
+// unless they are retained forever.
+func NewImportedRun(archive *RunArchive, now time.Time) models.RunDoc {
+	runDoc := *archive.Run
+	runDoc.ID = archive.RunID
+	runDoc.RunID = archive.RunID
+	runDoc.SampleCount = len(runDoc.Samples)
+	runDoc.PeakHeapUsedMB = PeakHeapUsed(0, runDoc.Samples)
+	runDoc.LatestHeap = LatestHeap(nil, runDoc.Samples)
+	runDoc.SchemaVersion = CurrentSchemaVersion
+	runDoc.ImportedAt = now
+	runDoc.ExpireAt = time.Time{}
+	if runDoc.Finished && !runDoc.RetainForever {
+		runDoc.ExpireAt = now.Add(3 * time.Hour)
+	}
+	return runDoc
+}
+
+// ImportRuns writes validated archived runs and their process info in batches of
+// ImportBatchRuns, replacing runs that already exist. When a batch fails to commit, e.g.
+// because one run is over the document size limit, its runs are retried one by one so
+// only the runs that cannot be written fail. With SAMPLES_SUBCOLLECTION the samples are
+// written to the subcollection, replacing the existing ones, after the run documents.
+// It returns the imported run IDs and the error of each run that was not imported.
+func (c *Client) ImportRuns(ctx context.Context, archives []RunArchive) ([]string, map[string]error, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	imported, failed := c.importRuns(ctx, archives)
+	// Only an import where every run failed points at Firestore trouble
+	var err error
+	if len(imported) == 0 {
+		err = firstError(failed)
+	}
+	c.breaker.record(err)
+	return imported, failed, nil
+}
+
+// importRuns is the ImportRuns implementation, called through the circuit breaker
+func (c *Client) importRuns(ctx context.Context, archives []RunArchive) ([]string, map[string]error) {
+	var imported []string
+	failed := make(map[string]error)
+	now := clock.Now()
+	for start := 0; start < len(archives); start += ImportBatchRuns {
+		end := min(start+ImportBatchRuns, len(archives))
+
+		var runs []importedRun
+		for i := range archives[start:end] {
+			archive := &archives[start+i]
+			run := importedRun{archive: archive, runDoc: NewImportedRun(archive, now)}
+			run.runDoc.Namespace = c.runIDPrefix
+			if c.samplesSubcollection {
+				run.samples = run.runDoc.Samples
+				run.runDoc.Samples = nil
+			} else if err := packSamples(&run.runDoc, c.compressThreshold); err != nil {
+				failed[archive.RunID] = err
+				continue
+			}
+			runs = append(runs, run)
+		}
+		if len(runs) == 0 {
+			continue
+		}
+
+		written := runs
+		if err := c.commitImport(ctx, runs, now); err != nil {
+			log.Printf("⚠️  Importing a batch of %d runs failed, retrying them one by one: %v", len(runs), err)
+			written = nil
+			for _, run := range runs {
+				if err := c.commitImport(ctx, []importedRun{run}, now); err != nil {
+					log.Printf("❌ Error importing run %s: %v", run.archive.RunID, err)
+					failed[run.archive.RunID] = err
+					continue
+				}
+				written = append(written, run)
+			}
+		}
+
+		for _, run := range written {
+			if c.samplesSubcollection {
+				if err := c.replaceSamples(ctx, run.archive.RunID, run.samples); err != nil {
+					log.Printf("❌ Error importing samples of run %s: %v", run.archive.RunID, err)
+					failed[run.archive.RunID] = err
+					continue
+				}
+			}
+			imported = append(imported, run.archive.RunID)
+		}
+	}
+	log.Printf("📥 Imported %d runs, %d failed", len(imported), len(failed))
+	return imported, failed
+}
+
+// importedRun is an archived run prepared for ImportRuns. With SAMPLES_SUBCOLLECTION its
+// samples are held apart from the run document, which is written without them.
+type importedRun struct {
+	archive *RunArchive
+	runDoc  models.RunDoc
+	samples []models.Sample
+}
+
+// commitImport writes the run and process documents of runs in a single batch
+func (c *Client) commitImport(ctx context.Context, runs []importedRun, now time.Time) error {
+	batch := c.firestore.Batch()
+	for _, run := range runs {
+		batch.Set(c.runRef(run.archive.RunID), run.runDoc)
+		if len(run.archive.ProcessInfo) > 0 {
+			batch.Set(c.processRef(run.archive.RunID), models.ProcessDoc{
+				RunID:              run.archive.RunID,
+				ProcessInfo:        run.archive.ProcessInfo,
+				CreatedAt:          now,
+				UpdatedAt:          now,
+				UpdatedAtTimestamp: ToMillis(now),
+			})
+		}
+	}
+	_, err := batch.Commit(ctx)
+	return err
+}
+
+// replaceSamples replaces the samples subcollection of a run with samples
+func (c *Client) replaceSamples(ctx context.Context, runID string, samples []models.Sample) error {
+	if err := c.deleteSamples(ctx, c.runRef(runID)); err != nil {
+		return err
+	}
+	return c.writeSamples(ctx, runID, samples)
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func archivedRun(runID string, samples int) RunArchive {
+	finished := time.Now().Add(-30 * 24 * time.Hour)
+	run := &models.RunDoc{
+		RunID:      runID,
+		StartTime:  finished.Add(-time.Hour),
+		CreatedAt:  finished.Add(-time.Hour),
+		Finished:   true,
+		FinishedAt: finished,
+		ExpireAt:   finished.Add(3 * time.Hour),
+	}
+	for i := 0; i < samples; i++ {
+		run.Samples = append(run.Samples, models.Sample{PID: "1", Name: "GradleDaemon", Timestamp: int64(i), HeapUsed: 100})
+	}
+	return RunArchive{RunID: runID, Run: run}
+}
+
+func TestNewImportedRun_RetentionCountsFromImport(t *testing.T) {
+	now := time.Now()
+	archive := archivedRun("run-1", 1)
+
+	runDoc := NewImportedRun(&archive, now)
+	if !runDoc.ExpireAt.Equal(now.Add(3 * time.Hour)) {
+		t.Errorf("Expected a TTL counted from the import, got %v", runDoc.ExpireAt)
+	}
+	if !runDoc.FinishedAt.Equal(archive.Run.FinishedAt) {
+		t.Errorf("Expected the archived finish time kept, got %v", runDoc.FinishedAt)
+	}
+	if runExpired(&runDoc, now.Add(-time.Hour), false) {
+		t.Error("Expected a run imported after the cutoff to survive retention")
+	}
+	if !runExpired(&runDoc, now.Add(time.Hour), false) {
+		t.Error("Expected a run imported before the cutoff to expire")
+	}
+
+	archive.Run.RetainForever = true
+	if retained := NewImportedRun(&archive, now); !retained.ExpireAt.IsZero() {
+		t.Errorf("Expected no TTL for a run retained forever, got %v", retained.ExpireAt)
+	}
+}
+
+func TestImportRuns_RetriesFailedBatchRunByRun(t *testing.T) {
+	client, fake := newFakeFirestoreClient(t)
+
+	// Far over the document size limit, so any batch including it fails to commit
+	archives := []RunArchive{archivedRun("run-1", 1), archivedRun("run-huge", 20000), archivedRun("run-2", 1)}
+	imported, failed, err := client.ImportRuns(context.Background(), archives)
+	if err != nil {
+		t.Fatalf("ImportRuns failed: %v", err)
+	}
+	if strings.Join(imported, ",") != "run-1,run-2" {
+		t.Errorf("Expected the runs that fit to be imported, got %v", imported)
+	}
+	if len(failed) != 1 || failed["run-huge"] == nil {
+		t.Errorf("Expected only the oversized run to fail, got %v", failed)
+	}
+	if fake.fields("runs/run-1") == nil || fake.fields("runs/run-huge") != nil {
+		t.Error("Expected run-1 stored and run-huge not")
+	}
+}
+
+func TestImportRuns_SamplesSubcollection(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "true")
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Samples left from an earlier copy of the run are replaced
+	if err := client.writeSamples(ctx, "run-1", archivedRun("run-1", 5).Run.Samples); err != nil {
+		t.Fatalf("writeSamples failed: %v", err)
+	}
+
+	imported, failed, err := client.ImportRuns(ctx, []RunArchive{archivedRun("run-1", 3)})
+	if err != nil || len(imported) != 1 || len(failed) != 0 {
+		t.Fatalf("Expected run-1 imported, got %v, %v, %v", imported, failed, err)
+	}
+	if samples := fake.fields("runs/run-1")["samples"]; len(samples.GetArrayValue().GetValues()) != 0 {
+		t.Errorf("Expected no inline samples, got %v", samples)
+	}
+	if n := fake.count("runs/run-1/samples"); n != 3 {
+		t.Errorf("Expected 3 samples in the subcollection, got %d", n)
+	}
+
+	runDoc, err := client.GetRun(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	if len(runDoc.Samples) != 3 || runDoc.SampleCount != 3 {
+		t.Errorf("Expected 3 samples read back, got %d (count %d)", len(runDoc.Samples), runDoc.SampleCount)
+	}
+}
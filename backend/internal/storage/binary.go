@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Binary ingest format (all integers big-endian):
+//
+//	magic   [4]byte "BPW1"
+//	count   uint32  number of samples that follow
+//	samples count × {
+//	    elapsed   uint32 seconds since the run started
+//	    pidLen    uint16, pid  [pidLen]byte
+//	    nameLen   uint16, name [nameLen]byte
+//	    heapUsed  uint32 MB
+//	    heapCap   uint32 MB
+//	    rss       uint32 MB
+//	    gcTime    uint32 milliseconds
+//	    flags     uint8  bit 0 set when RSS was not reported, bit 1 when GC time was unavailable
+//	}
+//
+// Trailing bytes after the last sample are rejected.
+var binaryMagic = [4]byte{'B', 'P', 'W', '1'}
+
+const (
+	binaryHeaderSize = 8
+	// binaryMinSampleSize is a sample with empty pid and name
+	binaryMinSampleSize = 4 + 2 + 2 + 4*4 + 1
+
+	binaryFlagRSSMissing    = 1 << 0
+	binaryFlagGCTimeMissing = 1 << 1
+)
+
+// ErrInvalidBinary is returned by DecodeSamplesBinary for malformed or truncated payloads
+var ErrInvalidBinary = errors.New("invalid binary sample payload")
+
+// EncodeSamplesBinary encodes samples in the binary ingest format. Timestamps are not
+// encoded; the server derives them from the run start and each sample's ElapsedTime.
+func EncodeSamplesBinary(samples []models.Sample) ([]byte, error) {
+	buf := make([]byte, 0, binaryHeaderSize+len(samples)*(binaryMinSampleSize+16))
+	buf = append(buf, binaryMagic[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(samples)))
+
+	for i, sample := range samples {
+		if len(sample.PID) > 0xFFFF || len(sample.Name) > 0xFFFF {
+			return nil, fmt.Errorf("sample %d: pid or name longer than %d bytes", i, 0xFFFF)
+		}
+		if sample.ElapsedTime < 0 || sample.HeapUsed < 0 || sample.HeapCap < 0 || sample.RSS < 0 || sample.GCTime < 0 {
+			return nil, fmt.Errorf("sample %d: negative values cannot be encoded", i)
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(sample.ElapsedTime))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(sample.PID)))
+		buf = append(buf, sample.PID...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(sample.Name)))
+		buf = append(buf, sample.Name...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(sample.HeapUsed))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(sample.HeapCap))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(sample.RSS))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(sample.GCTime))
+		var flags byte
+		if sample.RSSMissing {
+			flags |= binaryFlagRSSMissing
+		}
+		if sample.GCTimeMissing {
+			flags |= binaryFlagGCTimeMissing
+		}
+		buf = append(buf, flags)
+	}
+	return buf, nil
+}
+
+// DecodeSamplesBinary decodes a payload produced by EncodeSamplesBinary, deriving
+// timestamps from startTime like ParseData does
+func DecodeSamplesBinary(data []byte, startTime time.Time) ([]models.Sample, error) {
+	if len(data) < binaryHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than the header", ErrInvalidBinary, len(data))
+	}
+	if [4]byte(data[:4]) != binaryMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidBinary, data[:4])
+	}
+	count := binary.BigEndian.Uint32(data[4:8])
+	r := binaryReader{data: data[binaryHeaderSize:]}
+
+	// Reject counts the payload cannot possibly hold before allocating
+	if uint64(count)*binaryMinSampleSize > uint64(len(r.data)) {
+		return nil, fmt.Errorf("%w: %d samples declared in %d bytes", ErrInvalidBinary, count, len(r.data))
+	}
+
+	samples := make([]models.Sample, 0, count)
+	for i := uint32(0); i < count; i++ {
+		elapsed := r.uint32()
+		pid := r.string()
+		name := r.string()
+		heapUsed := r.uint32()
+		heapCap := r.uint32()
+		rss := r.uint32()
+		gcTime := r.uint32()
+		flags := r.byte()
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: sample %d truncated", ErrInvalidBinary, i)
+		}
+
+		samples = append(samples, models.Sample{
+			Timestamp:     ToMillis(startTime.Add(time.Duration(elapsed) * time.Second)),
+			ElapsedTime:   int(elapsed),
+			PID:           pid,
+			Name:          name,
+			HeapUsed:      int(heapUsed),
+			HeapCap:       int(heapCap),
+			RSS:           int(rss),
+			RSSMissing:    flags&binaryFlagRSSMissing != 0,
+			GCTime:        int(gcTime),
+			GCTimeMissing: flags&binaryFlagGCTimeMissing != 0,
+		})
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidBinary, len(r.data))
+	}
+	return samples, nil
+}
+
+// binaryReader consumes big-endian fields, recording the first short read in err
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = ErrInvalidBinary
+		return nil
+	}
+	chunk := r.data[:n]
+	r.data = r.data[n:]
+	return chunk
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if chunk := r.take(4); chunk != nil {
+		return binary.BigEndian.Uint32(chunk)
+	}
+	return 0
+}
+
+func (r *binaryReader) byte() byte {
+	if chunk := r.take(1); chunk != nil {
+		return chunk[0]
+	}
+	return 0
+}
+
+func (r *binaryReader) string() string {
+	chunk := r.take(2)
+	if chunk == nil {
+		return ""
+	}
+	return string(r.take(int(binary.BigEndian.Uint16(chunk))))
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive failures that opens the breaker
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long the breaker stays open before allowing a probe
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is matched by errors returned while the breaker short-circuits calls
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// CircuitOpenError is returned instead of calling Firestore while the breaker is open
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrCircuitOpen, e.RetryAfter)
+}
+
+// Is makes errors.Is(err, ErrCircuitOpen) match
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// circuitBreaker short-circuits Firestore calls after consecutive failures.
+// Once the cooldown elapses it half-opens and lets a single probe through:
+// success closes the breaker, failure re-opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+// newCircuitBreaker creates a breaker, a threshold of 0 disables it
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// newCircuitBreakerFromEnv reads STORAGE_BREAKER_THRESHOLD and STORAGE_BREAKER_COOLDOWN
+func newCircuitBreakerFromEnv() *circuitBreaker {
+	cooldown := DefaultBreakerCooldown
+	if value := os.Getenv("STORAGE_BREAKER_COOLDOWN"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("⚠️  WARNING: invalid STORAGE_BREAKER_COOLDOWN %q, using %v", value, DefaultBreakerCooldown)
+		} else {
+			cooldown = parsed
+		}
+	}
+	return newCircuitBreaker(getEnvInt("STORAGE_BREAKER_THRESHOLD", DefaultBreakerThreshold), cooldown)
+}
+
+// allow returns a CircuitOpenError if the call must be short-circuited
+func (b *circuitBreaker) allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+
+	elapsed := b.now().Sub(b.openedAt)
+	if elapsed < b.cooldown {
+		return &CircuitOpenError{RetryAfter: b.cooldown - elapsed}
+	}
+
+	// Half-open: let a single probe through to test recovery
+	if b.probing {
+		return &CircuitOpenError{RetryAfter: b.cooldown}
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of a call
+func (b *circuitBreaker) record(err error) {
+	// Every storage call reports here, breaker enabled or not
+	notePermissionDenied(err)
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isOutageError(err) {
+		if b.open {
+			log.Printf("✅ Storage circuit breaker closed")
+		}
+		b.failures = 0
+		b.open = false
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		if !b.open || b.probing {
+			log.Printf("⚠️  Storage circuit breaker opened after %d consecutive failures: %v", b.failures, err)
+		}
+		b.open = true
+		b.probing = false
+		b.openedAt = b.now()
+	}
+}
+
+// isOutageError reports whether err indicates Firestore trouble rather than a
+// normal outcome such as a missing document or a cancelled client request
+func isOutageError(err error) bool {
+	if err == nil || errors.Is(err, ErrRunPaused) || errors.Is(err, ErrRunArchived) || errors.Is(err, ErrRunNotFinished) || errors.Is(err, ErrRunFinished) || errors.Is(err, ErrSamplesAfterEnd) || errors.Is(err, ErrInvalidTags) || errors.Is(err, ErrCompactionUnsupported) || errors.Is(err, ErrRunExists) || errors.Is(err, ErrRunChanged) {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.NotFound, codes.Canceled, codes.InvalidArgument, codes.AlreadyExists:
+		return false
+	}
+	// Errors produced by this package for missing runs are not outages either
+	return !strings.Contains(err.Error(), "not found")
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	now := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(3, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	outage := status.Error(codes.Unavailable, "firestore down")
+	for i := 0; i < 3; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("Call %d should be allowed before threshold: %v", i, err)
+		}
+		b.record(outage)
+	}
+
+	err := b.allow()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen after threshold, got %v", err)
+	}
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) || circuitErr.RetryAfter != 30*time.Second {
+		t.Errorf("Expected RetryAfter of 30s, got %v", err)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := b.allow(); !errors.As(err, &circuitErr) || circuitErr.RetryAfter != 20*time.Second {
+		t.Errorf("Expected RetryAfter of 20s during cooldown, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbeClosesOnSuccess(t *testing.T) {
+	now := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(1, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	b.record(status.Error(codes.Unavailable, "firestore down"))
+	if err := b.allow(); err == nil {
+		t.Fatal("Breaker should be open")
+	}
+
+	now = now.Add(31 * time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("Probe should be allowed after cooldown: %v", err)
+	}
+	// Only a single probe is let through while half-open
+	if err := b.allow(); err == nil {
+		t.Fatal("Second call should be rejected while the probe is in flight")
+	}
+
+	b.record(nil)
+	for i := 0; i < 3; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("Breaker should be closed after successful probe: %v", err)
+		}
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbeReopensOnFailure(t *testing.T) {
+	now := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	b.record(status.Error(codes.Unavailable, "firestore down"))
+	b.record(status.Error(codes.Unavailable, "firestore down"))
+
+	now = now.Add(31 * time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("Probe should be allowed after cooldown: %v", err)
+	}
+	b.record(status.Error(codes.DeadlineExceeded, "still down"))
+
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Failed probe should re-open the breaker, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_IgnoresNonOutageErrors(t *testing.T) {
+	b := newCircuitBreaker(1, 30*time.Second)
+
+	b.record(status.Error(codes.NotFound, "no such document"))
+	b.record(errors.New("run abc not found"))
+	b.record(status.Error(codes.Canceled, "client went away"))
+
+	if err := b.allow(); err != nil {
+		t.Errorf("Not-found and cancelled errors should not open the breaker: %v", err)
+	}
+}
+
+func TestCircuitBreaker_DisabledWithZeroThreshold(t *testing.T) {
+	b := newCircuitBreaker(0, 30*time.Second)
+	for i := 0; i < 10; i++ {
+		b.record(status.Error(codes.Unavailable, "firestore down"))
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("Disabled breaker should never short-circuit: %v", err)
+	}
+}
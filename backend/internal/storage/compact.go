@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// ErrCompactionUnsupported is returned by CompactRun when samples are stored in the
+// samples subcollection, which compaction does not rewrite
+var ErrCompactionUnsupported = errors.New("compaction requires inline samples")
+
+// CompactionWeights scale the parts of a sample's importance score
+type CompactionWeights struct {
+	Distance float64 // Per MB the heap deviates from the line between its neighbours
+	GC       float64 // Per millisecond of GC time
+}
+
+// DefaultCompactionWeights weigh a MB of heap deviation the same as a millisecond of GC
+var DefaultCompactionWeights = CompactionWeights{Distance: 1, GC: 1}
+
+// getCompactionWeights reads COMPACT_WEIGHT_DISTANCE and COMPACT_WEIGHT_GC, keeping the
+// default for unset or invalid values
+func getCompactionWeights() CompactionWeights {
+	weights := DefaultCompactionWeights
+	for name, weight := range map[string]*float64{
+		"COMPACT_WEIGHT_DISTANCE": &weights.Distance,
+		"COMPACT_WEIGHT_GC":       &weights.GC,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			log.Printf("⚠️  WARNING: invalid %s %q, using %v", name, value, *weight)
+			continue
+		}
+		*weight = parsed
+	}
+	return weights
+}
+
+// ImportanceScores scores each sample by how much dropping it would change its process's
+// series: the distance of its heap from the line between its neighbours plus its GC time,
+// scaled by weights. The first and last sample of every process score +Inf.
+func ImportanceScores(samples []models.Sample, weights CompactionWeights) []float64 {
+	series := make(map[string][]int)
+	for i, sample := range samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		series[key] = append(series[key], i)
+	}
+
+	scores := make([]float64, len(samples))
+	for _, indexes := range series {
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return samples[indexes[a]].Timestamp < samples[indexes[b]].Timestamp
+		})
+		for k, i := range indexes {
+			if k == 0 || k == len(indexes)-1 {
+				scores[i] = math.Inf(1)
+				continue
+			}
+			prev, cur, next := samples[indexes[k-1]], samples[i], samples[indexes[k+1]]
+			expected := float64(prev.HeapUsed)
+			if span := next.Timestamp - prev.Timestamp; span > 0 {
+				expected += float64(next.HeapUsed-prev.HeapUsed) * float64(cur.Timestamp-prev.Timestamp) / float64(span)
+			}
+			scores[i] = weights.Distance*math.Abs(float64(cur.HeapUsed)-expected) + weights.GC*float64(cur.GCTime)
+		}
+	}
+	return scores
+}
+
+// CompactSamples keeps the budget most important samples (see ImportanceScores) in their
+// original order. Process endpoints are always kept, even when they alone exceed the budget.
+func CompactSamples(samples []models.Sample, budget int, weights CompactionWeights) []models.Sample {
+	if budget <= 0 || len(samples) <= budget {
+		return samples
+	}
+
+	scores := ImportanceScores(samples, weights)
+	order := make([]int, len(samples))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	keep := make([]bool, len(samples))
+	for rank, i := range order {
+		if rank < budget || math.IsInf(scores[i], 1) {
+			keep[i] = true
+		}
+	}
+
+	result := make([]models.Sample, 0, budget)
+	for i, sample := range samples {
+		if keep[i] {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+// AutoCompaction compacts inline samples during ingest once a run grows past Threshold
+type AutoCompaction struct {
+	Threshold int // Sample count that triggers compaction, 0 disables it
+	Budget    int // Samples kept after compacting, below Threshold so it does not rerun every batch
+}
+
+// getAutoCompaction reads AUTO_COMPACT_THRESHOLD and AUTO_COMPACT_BUDGET, the budget
+// defaulting to half the threshold
+func getAutoCompaction() AutoCompaction {
+	auto := AutoCompaction{Threshold: getEnvInt("AUTO_COMPACT_THRESHOLD", 0)}
+	if auto.Threshold == 0 {
+		return auto
+	}
+	auto.Budget = getEnvInt("AUTO_COMPACT_BUDGET", auto.Threshold/2)
+	if auto.Budget <= 0 || auto.Budget >= auto.Threshold {
+		log.Printf("⚠️  WARNING: AUTO_COMPACT_BUDGET must be between 1 and AUTO_COMPACT_THRESHOLD, using %d", auto.Threshold/2)
+		auto.Budget = auto.Threshold / 2
+	}
+	return auto
+}
+
+// apply compacts samples to the budget when they exceed the threshold, reporting whether it did
+func (a AutoCompaction) apply(samples []models.Sample, weights CompactionWeights) ([]models.Sample, bool) {
+	if a.Threshold <= 0 || len(samples) <= a.Threshold {
+		return samples, false
+	}
+	return CompactSamples(samples, a.Budget, weights), true
+}
+
+// CompactRun drops the least important samples of a run until at most budget remain,
+// reporting the sample counts and stored sizes before and after. Archived runs fail with
+// ErrRunArchived.
+func (c *Client) CompactRun(ctx context.Context, runID string, budget int) (models.CompactionResult, error) {
+	if err := c.breaker.allow(); err != nil {
+		return models.CompactionResult{}, err
+	}
+	result, err := c.compactRun(ctx, runID, budget)
+	c.breaker.record(err)
+	return result, err
+}
+
+// compactRun is the CompactRun implementation, called through the circuit breaker
+func (c *Client) compactRun(ctx context.Context, runID string, budget int) (models.CompactionResult, error) {
+	if c.samplesSubcollection {
+		return models.CompactionResult{}, ErrCompactionUnsupported
+	}
+
+	doc := c.runRef(runID)
+	var result models.CompactionResult
+	err := c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			return err
+		}
+		var runDoc models.RunDoc
+		if err := snapshot.DataTo(&runDoc); err != nil {
+			return err
+		}
+		if runDoc.Archived {
+			return ErrRunArchived
+		}
+		bytesBefore, err := StoredSamplesSize(&runDoc)
+		if err != nil {
+			return err
+		}
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			return err
+		}
+
+		kept := CompactSamples(runDoc.Samples, budget, c.compactWeights)
+		result = models.CompactionResult{
+			SamplesBefore: len(runDoc.Samples),
+			SamplesAfter:  len(kept),
+			BytesBefore:   bytesBefore,
+			BytesAfter:    bytesBefore,
+		}
+		if result.SamplesAfter == result.SamplesBefore {
+			return nil
+		}
+		runDoc.Samples = kept
+		runDoc.SampleCount = len(kept)
+		runDoc.SchemaVersion = CurrentSchemaVersion
+		runDoc.UpdatedAt = clock.Now()
+		runDoc.UpdatedAtTimestamp = ToMillis(runDoc.UpdatedAt)
+		if err := packSamples(&runDoc, c.compressThreshold); err != nil {
+			return err
+		}
+		if result.BytesAfter, err = StoredSamplesSize(&runDoc); err != nil {
+			return err
+		}
+		runDoc.Namespace = c.runIDPrefix
+		return tx.Set(doc, runDoc)
+	})
+	if err != nil {
+		return models.CompactionResult{}, fmt.Errorf("failed to compact run %s: %w", runID, err)
+	}
+
+	log.Printf("🗜️ Compacted run %s from %d to %d samples (%d to %d bytes)", runID, result.SamplesBefore, result.SamplesAfter, result.BytesBefore, result.BytesAfter)
+	return result, nil
+}
+
+// StoredSamplesSize returns the bytes a run document spends on samples: the gzipped blob
+// when packed, otherwise the JSON encoding of the inline samples as an estimate
+func StoredSamplesSize(runDoc *models.RunDoc) (int, error) {
+	if len(runDoc.SamplesGzip) > 0 {
+		return len(runDoc.SamplesGzip), nil
+	}
+	data, err := json.Marshal(runDoc.Samples)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
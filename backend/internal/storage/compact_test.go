@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestCompactSamples_KeepsPeakThinsFlatRegions(t *testing.T) {
+	// A flat heap at 100MB with a single sharp spike to 900MB in the middle
+	var samples []models.Sample
+	for i := 0; i < 50; i++ {
+		heap := 100
+		if i == 25 {
+			heap = 900
+		}
+		samples = append(samples, models.Sample{PID: "1", Timestamp: int64(1000 * i), HeapUsed: heap})
+	}
+
+	compacted := CompactSamples(samples, 5, DefaultCompactionWeights)
+	if len(compacted) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(compacted))
+	}
+	if compacted[0].Timestamp != 0 || compacted[len(compacted)-1].Timestamp != 49000 {
+		t.Errorf("Expected both endpoints to be kept, got %d..%d", compacted[0].Timestamp, compacted[len(compacted)-1].Timestamp)
+	}
+	var peakKept bool
+	for i, sample := range compacted {
+		if sample.HeapUsed == 900 {
+			peakKept = true
+		}
+		if i > 0 && sample.Timestamp <= compacted[i-1].Timestamp {
+			t.Errorf("Expected the original order to be kept, got %d after %d", sample.Timestamp, compacted[i-1].Timestamp)
+		}
+	}
+	if !peakKept {
+		t.Errorf("Expected the 900MB peak to survive compaction, got %+v", compacted)
+	}
+}
+
+func TestImportanceScores_Weights(t *testing.T) {
+	samples := []models.Sample{
+		{PID: "1", Timestamp: 0, HeapUsed: 100},
+		{PID: "1", Timestamp: 1000, HeapUsed: 100, GCTime: 40},
+		{PID: "1", Timestamp: 2000, HeapUsed: 160},
+		{PID: "1", Timestamp: 3000, HeapUsed: 100},
+	}
+
+	scores := ImportanceScores(samples, CompactionWeights{Distance: 1, GC: 0})
+	if !math.IsInf(scores[0], 1) || !math.IsInf(scores[3], 1) {
+		t.Errorf("Expected endpoints to score +Inf, got %v and %v", scores[0], scores[3])
+	}
+	// Sample 2 sits 60MB above the line between its neighbours, both at 100MB
+	if scores[2] != 60 {
+		t.Errorf("Expected a distance score of 60, got %v", scores[2])
+	}
+
+	scores = ImportanceScores(samples, CompactionWeights{Distance: 0, GC: 2})
+	if scores[1] != 80 || scores[2] != 0 {
+		t.Errorf("Expected GC-only scores 80 and 0, got %v and %v", scores[1], scores[2])
+	}
+}
+
+func TestAutoCompaction(t *testing.T) {
+	auto := AutoCompaction{Threshold: 10, Budget: 5}
+	var samples []models.Sample
+	for i := 0; i < 10; i++ {
+		samples = append(samples, models.Sample{PID: "1", Timestamp: int64(1000 * i), HeapUsed: 100 + i%3})
+	}
+
+	if kept, compacted := auto.apply(samples, DefaultCompactionWeights); compacted || len(kept) != 10 {
+		t.Errorf("Expected no compaction at the threshold, got compacted=%v with %d samples", compacted, len(kept))
+	}
+
+	samples = append(samples, models.Sample{PID: "1", Timestamp: 10000, HeapUsed: 100})
+	kept, compacted := auto.apply(samples, DefaultCompactionWeights)
+	if !compacted || len(kept) != 5 {
+		t.Errorf("Expected compaction to the budget past the threshold, got compacted=%v with %d samples", compacted, len(kept))
+	}
+
+	if _, compacted := (AutoCompaction{}).apply(samples, DefaultCompactionWeights); compacted {
+		t.Error("Expected auto-compaction to be disabled without a threshold")
+	}
+}
+
+func TestStoredSamplesSize(t *testing.T) {
+	var samples []models.Sample
+	for i := 0; i < 50; i++ {
+		samples = append(samples, models.Sample{PID: "1", Name: "GradleDaemon", Timestamp: int64(1000 * i), HeapUsed: 100})
+	}
+	runDoc := &models.RunDoc{RunID: "run-size", Samples: samples}
+
+	inline, err := StoredSamplesSize(runDoc)
+	if err != nil || inline == 0 {
+		t.Fatalf("Expected the JSON size of inline samples, got %d (%v)", inline, err)
+	}
+
+	if err := packSamples(runDoc, 1); err != nil {
+		t.Fatalf("packSamples failed: %v", err)
+	}
+	packed, err := StoredSamplesSize(runDoc)
+	if err != nil || packed != len(runDoc.SamplesGzip) {
+		t.Errorf("Expected the gzipped size %d for a packed run, got %d (%v)", len(runDoc.SamplesGzip), packed, err)
+	}
+	if packed >= inline {
+		t.Errorf("Expected repetitive samples to pack smaller, got %d packed vs %d inline", packed, inline)
+	}
+}
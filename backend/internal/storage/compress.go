@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// packSamples moves a run's inline samples into a gzipped blob when there are more
+// than threshold of them, keeping the plain array otherwise. A threshold of 0 never compresses.
+func packSamples(runDoc *models.RunDoc, threshold int) error {
+	if threshold <= 0 || len(runDoc.Samples) <= threshold {
+		runDoc.SamplesGzip = nil
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(runDoc.Samples); err != nil {
+		return fmt.Errorf("failed to compress samples of run %s: %w", runDoc.RunID, err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress samples of run %s: %w", runDoc.RunID, err)
+	}
+	runDoc.SamplesGzip = buf.Bytes()
+	runDoc.Samples = nil
+	return nil
+}
+
+// unpackSamples restores samples stored by packSamples, so readers see the plain array
+// whichever way the run was stored
+func unpackSamples(runDoc *models.RunDoc) error {
+	if len(runDoc.SamplesGzip) == 0 {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(runDoc.SamplesGzip))
+	if err != nil {
+		return fmt.Errorf("failed to decompress samples of run %s: %w", runDoc.RunID, err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("failed to decompress samples of run %s: %w", runDoc.RunID, err)
+	}
+	var samples []models.Sample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return fmt.Errorf("failed to decode samples of run %s: %w", runDoc.RunID, err)
+	}
+	runDoc.Samples = append(samples, runDoc.Samples...)
+	runDoc.SamplesGzip = nil
+	return nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestPackSamples(t *testing.T) {
+	samples := make([]models.Sample, 10)
+	for i := range samples {
+		samples[i] = models.Sample{PID: "1", Timestamp: int64(1000 * i), HeapUsed: 100 + i, Phase: "compile"}
+	}
+
+	// Small runs keep the plain array
+	small := models.RunDoc{RunID: "run-small", Samples: samples[:5]}
+	if err := packSamples(&small, 5); err != nil {
+		t.Fatalf("packSamples failed: %v", err)
+	}
+	if small.SamplesGzip != nil || len(small.Samples) != 5 {
+		t.Errorf("Expected a run at the threshold to stay uncompressed, got %d samples and %d gzip bytes", len(small.Samples), len(small.SamplesGzip))
+	}
+
+	// Larger runs move their samples into the blob
+	large := models.RunDoc{RunID: "run-large", Samples: samples}
+	if err := packSamples(&large, 5); err != nil {
+		t.Fatalf("packSamples failed: %v", err)
+	}
+	if len(large.SamplesGzip) == 0 || large.Samples != nil {
+		t.Fatalf("Expected a run above the threshold to be compressed, got %d samples and %d gzip bytes", len(large.Samples), len(large.SamplesGzip))
+	}
+
+	// Reads restore the original samples either way
+	if err := unpackSamples(&large); err != nil {
+		t.Fatalf("unpackSamples failed: %v", err)
+	}
+	if !reflect.DeepEqual(large.Samples, samples) || large.SamplesGzip != nil {
+		t.Errorf("Expected the compressed samples to round-trip, got %+v", large.Samples)
+	}
+	if err := unpackSamples(&small); err != nil || len(small.Samples) != 5 {
+		t.Errorf("Expected an uncompressed run to read unchanged, got %d samples, err %v", len(small.Samples), err)
+	}
+
+	// Threshold 0 never compresses
+	plain := models.RunDoc{RunID: "run-plain", Samples: samples}
+	if err := packSamples(&plain, 0); err != nil || plain.SamplesGzip != nil {
+		t.Errorf("Expected no compression with threshold 0, got %d gzip bytes, err %v", len(plain.SamplesGzip), err)
+	}
+}
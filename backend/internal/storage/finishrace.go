@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Policies for samples that reach a run after it was finished, typically an ingest racing
+// the agent's own finish call. Selected with FINISH_RACE_POLICY.
+const (
+	// FinishRacePolicyReject fails late samples with ErrRunFinished, answered 409
+	FinishRacePolicyReject = "reject"
+	// FinishRacePolicyGrace accepts samples up to FINISH_GRACE_WINDOW after the finish and
+	// reopens the run, later ones fail like FinishRacePolicyReject
+	FinishRacePolicyGrace = "grace"
+)
+
+// FinishRacePolicy decides whether a finished run takes late samples. The zero value keeps
+// the historical behavior: samples are stored and the run stays finished.
+type FinishRacePolicy struct {
+	Mode  string
+	Grace time.Duration // Window after FinishedAt in which FinishRacePolicyGrace reopens the run
+}
+
+// getFinishRacePolicy reads FINISH_RACE_POLICY and FINISH_GRACE_WINDOW (e.g. "30s")
+func getFinishRacePolicy() FinishRacePolicy {
+	switch mode := os.Getenv("FINISH_RACE_POLICY"); mode {
+	case "":
+		return FinishRacePolicy{}
+	case FinishRacePolicyReject:
+		return FinishRacePolicy{Mode: FinishRacePolicyReject}
+	case FinishRacePolicyGrace:
+		value := os.Getenv("FINISH_GRACE_WINDOW")
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace <= 0 {
+			log.Printf("⚠️  WARNING: invalid FINISH_GRACE_WINDOW %q, rejecting samples for finished runs", value)
+			return FinishRacePolicy{Mode: FinishRacePolicyReject}
+		}
+		return FinishRacePolicy{Mode: FinishRacePolicyGrace, Grace: grace}
+	default:
+		log.Printf("⚠️  WARNING: invalid FINISH_RACE_POLICY %q, finished runs keep accepting samples", mode)
+		return FinishRacePolicy{}
+	}
+}
+
+// ResumeForIngest decides whether runDoc accepts a batch of samples at now, reopening it
+// when allowed. Runs the stale sweep finished are handled by ResumeFinishedRun with
+// staleWindow first; any run still finished then goes through policy. Callers must read
+// and write runDoc in one transaction so a concurrent finish is either seen here or retried.
+func ResumeForIngest(runDoc *models.RunDoc, now time.Time, staleWindow time.Duration, policy FinishRacePolicy) (bool, error) {
+	resumed, err := ResumeFinishedRun(runDoc, now, staleWindow)
+	if resumed || !runDoc.Finished || policy.Mode == "" {
+		return resumed, err
+	}
+	if policy.Mode == FinishRacePolicyGrace && now.Sub(runDoc.FinishedAt) <= policy.Grace {
+		reopenRun(runDoc)
+		return true, nil
+	}
+	return false, ErrRunFinished
+}
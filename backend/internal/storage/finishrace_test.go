@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestResumeForIngest_Policies(t *testing.T) {
+	finishedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	grace := FinishRacePolicy{Mode: FinishRacePolicyGrace, Grace: 30 * time.Second}
+
+	tests := []struct {
+		name     string
+		policy   FinishRacePolicy
+		after    time.Duration
+		resumed  bool
+		finished bool
+		err      error
+	}{
+		{"legacy stores and keeps the finish", FinishRacePolicy{}, time.Second, false, true, nil},
+		{"reject", FinishRacePolicy{Mode: FinishRacePolicyReject}, time.Second, false, true, ErrRunFinished},
+		{"grace within window", grace, 30 * time.Second, true, false, nil},
+		{"grace after window", grace, 31 * time.Second, false, true, ErrRunFinished},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runDoc := &models.RunDoc{RunID: "run-race", Finished: true, FinishedAt: finishedAt, ExpireAt: finishedAt.Add(3 * time.Hour), FinishStatus: "finished"}
+			resumed, err := ResumeForIngest(runDoc, finishedAt.Add(tt.after), 0, tt.policy)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if resumed != tt.resumed || runDoc.Finished != tt.finished {
+				t.Errorf("Expected resumed=%v finished=%v, got resumed=%v finished=%v", tt.resumed, tt.finished, resumed, runDoc.Finished)
+			}
+			if resumed && !runDoc.ExpireAt.IsZero() {
+				t.Errorf("Expected the TTL cleared on a reopened run, got %v", runDoc.ExpireAt)
+			}
+		})
+	}
+}
+
+func TestGetFinishRacePolicy(t *testing.T) {
+	tests := []struct {
+		mode, grace string
+		expected    FinishRacePolicy
+	}{
+		{"", "", FinishRacePolicy{}},
+		{"reject", "", FinishRacePolicy{Mode: FinishRacePolicyReject}},
+		{"grace", "45s", FinishRacePolicy{Mode: FinishRacePolicyGrace, Grace: 45 * time.Second}},
+		{"grace", "", FinishRacePolicy{Mode: FinishRacePolicyReject}},
+		{"bogus", "", FinishRacePolicy{}},
+	}
+	for _, tt := range tests {
+		t.Setenv("FINISH_RACE_POLICY", tt.mode)
+		t.Setenv("FINISH_GRACE_WINDOW", tt.grace)
+		if policy := getFinishRacePolicy(); policy != tt.expected {
+			t.Errorf("FINISH_RACE_POLICY=%q FINISH_GRACE_WINDOW=%q: expected %+v, got %+v", tt.mode, tt.grace, tt.expected, policy)
+		}
+	}
+}
+
+func TestStoreSamples_FinishRaceSubcollection(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "true")
+	t.Setenv("FINISH_RACE_POLICY", FinishRacePolicyReject)
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	batch := []models.Sample{{PID: "1", Name: "GradleDaemon", Timestamp: 1000, HeapUsed: 100}}
+
+	if err := client.StoreSamples(ctx, "run-race", batch); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+
+	// The agent's finish lands right after its last ingest updates the run document
+	var finished bool
+	var finishErr error
+	fake.afterCommit = func(writes []*pb.Write) {
+		if !finished && strings.HasSuffix(writeName(writes[0]), "/runs/run-race") {
+			finished = true
+			finishErr = client.MarkRunAsFinished(ctx, "run-race")
+		}
+	}
+	if err := client.StoreSamples(ctx, "run-race", batch); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if finishErr != nil {
+		t.Fatalf("MarkRunAsFinished failed: %v", finishErr)
+	}
+
+	// The samples were committed with the run document, before the finish
+	finishedAt := fake.updateTime("runs/run-race")
+	for _, created := range fake.createTimes("runs/run-race/samples") {
+		if created.After(finishedAt) {
+			t.Fatal("Expected no sample written after the run was finished")
+		}
+	}
+	if n := fake.count("runs/run-race/samples"); n != 2 {
+		t.Errorf("Expected 2 samples, got %d", n)
+	}
+
+	if err := client.StoreSamples(ctx, "run-race", batch); !errors.Is(err, ErrRunFinished) {
+		t.Errorf("Expected ErrRunFinished after the finish, got %v", err)
+	}
+	if n := fake.count("runs/run-race/samples"); n != 2 {
+		t.Errorf("Expected the rejected samples not stored, got %d samples", n)
+	}
+}
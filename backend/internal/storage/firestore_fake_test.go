@@ -0,0 +1,760 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeFirestore is an in-memory Firestore served over gRPC at FIRESTORE_EMULATOR_HOST, so
+// storage tests run the real client, queries and transactions. It covers the subset of the
+// API the storage client uses. Like Firestore, a transaction holds a pessimistic lock on
+// every document it reads until it commits or rolls back, and other writes to those
+// documents wait for it.
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+
+	mu     sync.Mutex
+	unlock *sync.Cond
+	docs   map[string]*pb.Document // Full document name -> document
+	locks  map[string][]byte       // Full document name -> transaction holding it
+	nextTx int
+	clock  time.Time // Last update time handed out, strictly increasing
+	// commits counts successful commits, so tests can tell how many writes a call made
+	commits int
+	// failCommit, when set, fails any commit whose writes it returns an error for
+	failCommit func(writes []*pb.Write) error
+	// afterCommit, when set, runs after each successful commit before the client hears of it
+	afterCommit func(writes []*pb.Write)
+}
+
+// newFakeFirestoreClient starts a fakeFirestore and returns a storage client connected to it.
+// Environment variables read by NewClient must be set before calling it.
+func newFakeFirestoreClient(t *testing.T) (*Client, *fakeFirestore) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	fake := &fakeFirestore{docs: make(map[string]*pb.Document), locks: make(map[string][]byte), clock: time.Now()}
+	fake.unlock = sync.NewCond(&fake.mu)
+	server := grpc.NewServer()
+	pb.RegisterFirestoreServer(server, fake)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	t.Setenv("FIRESTORE_EMULATOR_HOST", listener.Addr().String())
+	client, err := NewClient(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, fake
+}
+
+// docName returns the full name of a document path such as "runs/run-1"
+func (f *fakeFirestore) docName(path string) string {
+	return "projects/test-project/databases/(default)/documents/" + path
+}
+
+// fields returns a copy of the stored fields of path, nil when it does not exist
+func (f *fakeFirestore) fields(path string) map[string]*pb.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.docs[f.docName(path)]
+	if !ok {
+		return nil
+	}
+	return proto.Clone(doc).(*pb.Document).Fields
+}
+
+// count returns the number of documents directly under the collection at path
+func (f *fakeFirestore) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := f.docName(path) + "/"
+	n := 0
+	for name := range f.docs {
+		if id, ok := strings.CutPrefix(name, prefix); ok && !strings.Contains(id, "/") {
+			n++
+		}
+	}
+	return n
+}
+
+// updateTime returns when path was last written, zero when it does not exist
+func (f *fakeFirestore) updateTime(path string) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.docs[f.docName(path)]
+	if !ok {
+		return time.Time{}
+	}
+	return doc.UpdateTime.AsTime()
+}
+
+// createTimes returns when each document directly under the collection at path was created
+func (f *fakeFirestore) createTimes(path string) []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := f.docName(path) + "/"
+	var times []time.Time
+	for name, doc := range f.docs {
+		if id, ok := strings.CutPrefix(name, prefix); ok && !strings.Contains(id, "/") {
+			times = append(times, doc.CreateTime.AsTime())
+		}
+	}
+	return times
+}
+
+// tick returns a new update time, later than every previous one
+func (f *fakeFirestore) tick() *timestamppb.Timestamp {
+	f.clock = f.clock.Add(time.Microsecond)
+	return timestamppb.New(f.clock)
+}
+
+// lock takes the lock on name for tx, waiting while another transaction holds it
+func (f *fakeFirestore) lock(name string, tx []byte) {
+	for held, ok := f.locks[name]; ok && !bytes.Equal(held, tx); held, ok = f.locks[name] {
+		f.unlock.Wait()
+	}
+	if tx != nil {
+		f.locks[name] = tx
+	}
+}
+
+// release drops every lock held by tx
+func (f *fakeFirestore) release(tx []byte) {
+	for name, held := range f.locks {
+		if bytes.Equal(held, tx) {
+			delete(f.locks, name)
+		}
+	}
+	f.unlock.Broadcast()
+}
+
+func (f *fakeFirestore) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextTx++
+	return &pb.BeginTransactionResponse{Transaction: []byte(strconv.Itoa(f.nextTx))}, nil
+}
+
+func (f *fakeFirestore) Rollback(ctx context.Context, req *pb.RollbackRequest) (*emptypb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.release(req.Transaction)
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeFirestore) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	f.mu.Lock()
+	var responses []*pb.BatchGetDocumentsResponse
+	for _, name := range req.Documents {
+		if tx := req.GetTransaction(); tx != nil {
+			f.lock(name, tx)
+		}
+		response := &pb.BatchGetDocumentsResponse{ReadTime: timestamppb.New(f.clock)}
+		if doc, ok := f.docs[name]; ok {
+			response.Result = &pb.BatchGetDocumentsResponse_Found{Found: proto.Clone(doc).(*pb.Document)}
+		} else {
+			response.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		responses = append(responses, response)
+	}
+	f.mu.Unlock()
+
+	for _, response := range responses {
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	response, err := f.commit(req)
+	if err == nil && f.afterCommit != nil {
+		f.afterCommit(req.Writes)
+	}
+	return response, err
+}
+
+func (f *fakeFirestore) commit(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// A transaction's locks are released whether or not its commit succeeds
+	if req.Transaction != nil {
+		defer f.release(req.Transaction)
+	}
+	for _, write := range req.Writes {
+		f.lock(writeName(write), req.Transaction)
+	}
+	if f.failCommit != nil {
+		if err := f.failCommit(req.Writes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every write is checked before any is applied, so a commit is all or nothing
+	docs := make(map[string]*pb.Document)
+	current := func(name string) *pb.Document {
+		if doc, ok := docs[name]; ok {
+			return doc
+		}
+		return f.docs[name]
+	}
+	commitTime := f.tick()
+	for _, write := range req.Writes {
+		name := writeName(write)
+		existing := current(name)
+		if err := checkPrecondition(name, existing, write.CurrentDocument); err != nil {
+			return nil, err
+		}
+		if write.GetDelete() != "" {
+			docs[name] = nil
+			continue
+		}
+		if err := checkDocumentSize(write.GetUpdate()); err != nil {
+			return nil, err
+		}
+		docs[name] = applyUpdate(existing, write, commitTime)
+	}
+
+	results := make([]*pb.WriteResult, len(req.Writes))
+	for i := range results {
+		results[i] = &pb.WriteResult{UpdateTime: commitTime}
+	}
+	for name, doc := range docs {
+		if doc == nil {
+			delete(f.docs, name)
+		} else {
+			f.docs[name] = doc
+		}
+	}
+	f.commits++
+	return &pb.CommitResponse{WriteResults: results, CommitTime: commitTime}, nil
+}
+
+// BatchWrite applies each write on its own, as the BulkWriter expects, with a status per write
+func (f *fakeFirestore) BatchWrite(ctx context.Context, req *pb.BatchWriteRequest) (*pb.BatchWriteResponse, error) {
+	response := &pb.BatchWriteResponse{}
+	for _, write := range req.Writes {
+		result := &pb.WriteResult{}
+		committed, err := f.commit(&pb.CommitRequest{Writes: []*pb.Write{write}})
+		if err == nil {
+			result = committed.WriteResults[0]
+		}
+		response.WriteResults = append(response.WriteResults, result)
+		response.Status = append(response.Status, status.Convert(err).Proto())
+	}
+	return response, nil
+}
+
+// writeName returns the document a write applies to
+func writeName(write *pb.Write) string {
+	if name := write.GetDelete(); name != "" {
+		return name
+	}
+	return write.GetUpdate().GetName()
+}
+
+// checkPrecondition enforces a write's exists or update_time precondition
+func checkPrecondition(name string, existing *pb.Document, precondition *pb.Precondition) error {
+	switch {
+	case precondition == nil:
+		return nil
+	case precondition.GetUpdateTime() != nil:
+		if existing == nil || !proto.Equal(existing.UpdateTime, precondition.GetUpdateTime()) {
+			return status.Errorf(codes.FailedPrecondition, "%s was updated since it was read", name)
+		}
+	case precondition.GetExists() && existing == nil:
+		return status.Errorf(codes.NotFound, "no document to update: %s", name)
+	case !precondition.GetExists() && existing != nil:
+		return status.Errorf(codes.AlreadyExists, "document already exists: %s", name)
+	}
+	return nil
+}
+
+// maxDocumentBytes is Firestore's limit on the size of a single document
+const maxDocumentBytes = 1 << 20
+
+// checkDocumentSize rejects writes over maxDocumentBytes, approximated by the encoded size
+func checkDocumentSize(doc *pb.Document) error {
+	if size := proto.Size(doc); size > maxDocumentBytes {
+		return status.Errorf(codes.InvalidArgument, "document %s is %d bytes, over the %d byte limit", doc.Name, size, maxDocumentBytes)
+	}
+	return nil
+}
+
+// applyUpdate returns existing with write applied: a replacement without an update mask,
+// otherwise only the masked fields, where a masked field missing from the write is deleted
+func applyUpdate(existing *pb.Document, write *pb.Write, commitTime *timestamppb.Timestamp) *pb.Document {
+	update := write.GetUpdate()
+	doc := &pb.Document{Name: update.Name, Fields: make(map[string]*pb.Value), CreateTime: commitTime, UpdateTime: commitTime}
+	if existing != nil {
+		doc.CreateTime = existing.CreateTime
+	}
+	if write.UpdateMask == nil {
+		for key, value := range update.Fields {
+			doc.Fields[key] = proto.Clone(value).(*pb.Value)
+		}
+	} else {
+		if existing != nil {
+			for key, value := range existing.Fields {
+				doc.Fields[key] = proto.Clone(value).(*pb.Value)
+			}
+		}
+		for _, path := range write.UpdateMask.FieldPaths {
+			segments := splitFieldPath(path)
+			if value, ok := lookupField(update.Fields, segments); ok {
+				setField(doc.Fields, segments, proto.Clone(value).(*pb.Value))
+			} else {
+				deleteField(doc.Fields, segments)
+			}
+		}
+	}
+	for _, transform := range write.UpdateTransforms {
+		if transform.GetSetToServerValue() == pb.DocumentTransform_FieldTransform_REQUEST_TIME {
+			setField(doc.Fields, splitFieldPath(transform.FieldPath), &pb.Value{ValueType: &pb.Value_TimestampValue{TimestampValue: commitTime}})
+		}
+	}
+	return doc
+}
+
+// splitFieldPath splits a dotted field path, unquoting backtick-quoted segments
+func splitFieldPath(path string) []string {
+	var segments []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '`':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case c == '.' && !quoted:
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(segments, current.String())
+}
+
+func lookupField(fields map[string]*pb.Value, segments []string) (*pb.Value, bool) {
+	value, ok := fields[segments[0]]
+	if !ok || len(segments) == 1 {
+		return value, ok
+	}
+	if value.GetMapValue() == nil {
+		return nil, false
+	}
+	return lookupField(value.GetMapValue().Fields, segments[1:])
+}
+
+func setField(fields map[string]*pb.Value, segments []string, value *pb.Value) {
+	if len(segments) == 1 {
+		fields[segments[0]] = value
+		return
+	}
+	parent := fields[segments[0]]
+	if parent.GetMapValue() == nil {
+		parent = &pb.Value{ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{}}}
+		fields[segments[0]] = parent
+	}
+	if parent.GetMapValue().Fields == nil {
+		parent.GetMapValue().Fields = make(map[string]*pb.Value)
+	}
+	setField(parent.GetMapValue().Fields, segments[1:], value)
+}
+
+func deleteField(fields map[string]*pb.Value, segments []string) {
+	if len(segments) == 1 {
+		delete(fields, segments[0])
+		return
+	}
+	if parent := fields[segments[0]]; parent.GetMapValue() != nil {
+		deleteField(parent.GetMapValue().Fields, segments[1:])
+	}
+}
+
+func (f *fakeFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	f.mu.Lock()
+	docs, err := f.query(req.Parent, req.GetStructuredQuery())
+	readTime := timestamppb.New(f.clock)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return stream.Send(&pb.RunQueryResponse{ReadTime: readTime})
+	}
+	for _, doc := range docs {
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: readTime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirestore) RunAggregationQuery(req *pb.RunAggregationQueryRequest, stream pb.Firestore_RunAggregationQueryServer) error {
+	aggregation := req.GetStructuredAggregationQuery()
+	f.mu.Lock()
+	docs, err := f.query(req.Parent, aggregation.GetStructuredQuery())
+	readTime := timestamppb.New(f.clock)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fields := make(map[string]*pb.Value)
+	for _, aggregate := range aggregation.Aggregations {
+		if aggregate.GetCount() == nil {
+			return status.Errorf(codes.Unimplemented, "only count aggregations are supported")
+		}
+		fields[aggregate.Alias] = &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: int64(len(docs))}}
+	}
+	return stream.Send(&pb.RunAggregationQueryResponse{Result: &pb.AggregationResult{AggregateFields: fields}, ReadTime: readTime})
+}
+
+// query evaluates a structured query over the documents of a collection under parent
+func (f *fakeFirestore) query(parent string, query *pb.StructuredQuery) ([]*pb.Document, error) {
+	if len(query.From) != 1 || query.From[0].AllDescendants {
+		return nil, status.Errorf(codes.Unimplemented, "only single collection queries are supported")
+	}
+	prefix := parent + "/" + query.From[0].CollectionId + "/"
+
+	orders := append([]*pb.StructuredQuery_Order(nil), query.OrderBy...)
+	direction := pb.StructuredQuery_ASCENDING
+	if len(orders) > 0 {
+		direction = orders[len(orders)-1].Direction
+	}
+	if len(orders) == 0 || orders[len(orders)-1].Field.FieldPath != "__name__" {
+		orders = append(orders, &pb.StructuredQuery_Order{Field: &pb.StructuredQuery_FieldReference{FieldPath: "__name__"}, Direction: direction})
+	}
+
+	var docs []*pb.Document
+	for name, doc := range f.docs {
+		id, ok := strings.CutPrefix(name, prefix)
+		if !ok || strings.Contains(id, "/") || !matchesFilter(doc, query.Where) {
+			continue
+		}
+		// Like Firestore, documents without a field the query orders by are left out
+		if !hasOrderFields(doc, orders) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return compareOrder(docs[i], docs[j], orders) < 0 })
+
+	if query.StartAt != nil {
+		docs = filterCursor(docs, orders, query.StartAt, true)
+	}
+	if query.EndAt != nil {
+		docs = filterCursor(docs, orders, query.EndAt, false)
+	}
+	if offset := int(query.Offset); offset > 0 {
+		docs = docs[min(offset, len(docs)):]
+	}
+	if query.Limit != nil && int(query.Limit.Value) < len(docs) {
+		docs = docs[:query.Limit.Value]
+	}
+
+	results := make([]*pb.Document, len(docs))
+	for i, doc := range docs {
+		results[i] = project(doc, query.Select)
+	}
+	return results, nil
+}
+
+// project returns a copy of doc with only the selected fields
+func project(doc *pb.Document, selection *pb.StructuredQuery_Projection) *pb.Document {
+	copied := proto.Clone(doc).(*pb.Document)
+	if selection == nil || len(selection.Fields) == 0 {
+		return copied
+	}
+	copied.Fields = make(map[string]*pb.Value)
+	for _, field := range selection.Fields {
+		if field.FieldPath == "__name__" {
+			continue
+		}
+		segments := splitFieldPath(field.FieldPath)
+		if value, ok := lookupField(doc.Fields, segments); ok {
+			setField(copied.Fields, segments, proto.Clone(value).(*pb.Value))
+		}
+	}
+	return copied
+}
+
+// fieldValue returns a document's value at path, with "__name__" as its reference
+func fieldValue(doc *pb.Document, path string) (*pb.Value, bool) {
+	if path == "__name__" {
+		return &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: doc.Name}}, true
+	}
+	return lookupField(doc.Fields, splitFieldPath(path))
+}
+
+func hasOrderFields(doc *pb.Document, orders []*pb.StructuredQuery_Order) bool {
+	for _, order := range orders {
+		if _, ok := fieldValue(doc, order.Field.FieldPath); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareOrder(a, b *pb.Document, orders []*pb.StructuredQuery_Order) int {
+	for _, order := range orders {
+		x, _ := fieldValue(a, order.Field.FieldPath)
+		y, _ := fieldValue(b, order.Field.FieldPath)
+		c := compareValues(x, y)
+		if order.Direction == pb.StructuredQuery_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// filterCursor keeps the documents at or after a start cursor, or at or before an end cursor
+func filterCursor(docs []*pb.Document, orders []*pb.StructuredQuery_Order, cursor *pb.Cursor, start bool) []*pb.Document {
+	var kept []*pb.Document
+	for _, doc := range docs {
+		c := 0
+		for i, value := range cursor.Values {
+			x, _ := fieldValue(doc, orders[i].Field.FieldPath)
+			c = compareValues(x, value)
+			if orders[i].Direction == pb.StructuredQuery_DESCENDING {
+				c = -c
+			}
+			if c != 0 {
+				break
+			}
+		}
+		// Before positions the cursor before the matching documents
+		var keep bool
+		switch {
+		case start && cursor.Before:
+			keep = c >= 0
+		case start:
+			keep = c > 0
+		case cursor.Before:
+			keep = c < 0
+		default:
+			keep = c <= 0
+		}
+		if keep {
+			kept = append(kept, doc)
+		}
+	}
+	return kept
+}
+
+func matchesFilter(doc *pb.Document, filter *pb.StructuredQuery_Filter) bool {
+	switch {
+	case filter == nil:
+		return true
+	case filter.GetCompositeFilter() != nil:
+		composite := filter.GetCompositeFilter()
+		for _, sub := range composite.Filters {
+			matched := matchesFilter(doc, sub)
+			if composite.Op == pb.StructuredQuery_CompositeFilter_OR && matched {
+				return true
+			}
+			if composite.Op != pb.StructuredQuery_CompositeFilter_OR && !matched {
+				return false
+			}
+		}
+		return composite.Op != pb.StructuredQuery_CompositeFilter_OR
+	case filter.GetUnaryFilter() != nil:
+		unary := filter.GetUnaryFilter()
+		value, ok := fieldValue(doc, unary.GetField().FieldPath)
+		if !ok {
+			return false
+		}
+		isNull := value.GetValueType() == nil || isNullValue(value)
+		isNaN := math.IsNaN(value.GetDoubleValue())
+		switch unary.Op {
+		case pb.StructuredQuery_UnaryFilter_IS_NULL:
+			return isNull
+		case pb.StructuredQuery_UnaryFilter_IS_NOT_NULL:
+			return !isNull
+		case pb.StructuredQuery_UnaryFilter_IS_NAN:
+			return isNaN
+		default:
+			return !isNaN
+		}
+	default:
+		field := filter.GetFieldFilter()
+		// A document without the field never matches, not even != filters
+		value, ok := fieldValue(doc, field.Field.FieldPath)
+		if !ok {
+			return false
+		}
+		want := field.Value
+		switch field.Op {
+		case pb.StructuredQuery_FieldFilter_EQUAL:
+			return compareValues(value, want) == 0
+		case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+			return compareValues(value, want) != 0
+		case pb.StructuredQuery_FieldFilter_IN, pb.StructuredQuery_FieldFilter_NOT_IN:
+			in := false
+			for _, candidate := range want.GetArrayValue().GetValues() {
+				in = in || compareValues(value, candidate) == 0
+			}
+			return in == (field.Op == pb.StructuredQuery_FieldFilter_IN)
+		case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS:
+			for _, element := range value.GetArrayValue().GetValues() {
+				if compareValues(element, want) == 0 {
+					return true
+				}
+			}
+			return false
+		}
+		// Range filters only match values of the same type
+		if typeOrder(value) != typeOrder(want) {
+			return false
+		}
+		c := compareValues(value, want)
+		switch field.Op {
+		case pb.StructuredQuery_FieldFilter_LESS_THAN:
+			return c < 0
+		case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+			return c <= 0
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+			return c > 0
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+			return c >= 0
+		}
+		panic(fmt.Sprintf("unsupported filter operator %v", field.Op))
+	}
+}
+
+func isNullValue(value *pb.Value) bool {
+	_, ok := value.GetValueType().(*pb.Value_NullValue)
+	return ok
+}
+
+// typeOrder ranks value types in Firestore's cross-type ordering
+func typeOrder(value *pb.Value) int {
+	switch value.GetValueType().(type) {
+	case *pb.Value_NullValue, nil:
+		return 0
+	case *pb.Value_BooleanValue:
+		return 1
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return 2
+	case *pb.Value_TimestampValue:
+		return 3
+	case *pb.Value_StringValue:
+		return 4
+	case *pb.Value_BytesValue:
+		return 5
+	case *pb.Value_ReferenceValue:
+		return 6
+	case *pb.Value_GeoPointValue:
+		return 7
+	case *pb.Value_ArrayValue:
+		return 8
+	default:
+		return 9
+	}
+}
+
+// compareValues orders two values like Firestore, comparing numbers across int and double
+func compareValues(a, b *pb.Value) int {
+	if ta, tb := typeOrder(a), typeOrder(b); ta != tb {
+		return ta - tb
+	}
+	switch a.GetValueType().(type) {
+	case *pb.Value_BooleanValue:
+		return compareBools(a.GetBooleanValue(), b.GetBooleanValue())
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return compareNumbers(a, b)
+	case *pb.Value_TimestampValue:
+		return a.GetTimestampValue().AsTime().Compare(b.GetTimestampValue().AsTime())
+	case *pb.Value_StringValue:
+		return strings.Compare(a.GetStringValue(), b.GetStringValue())
+	case *pb.Value_BytesValue:
+		return bytes.Compare(a.GetBytesValue(), b.GetBytesValue())
+	case *pb.Value_ReferenceValue:
+		return strings.Compare(a.GetReferenceValue(), b.GetReferenceValue())
+	case *pb.Value_ArrayValue:
+		x, y := a.GetArrayValue().GetValues(), b.GetArrayValue().GetValues()
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	case *pb.Value_MapValue:
+		if proto.Equal(a, b) {
+			return 0
+		}
+		return strings.Compare(a.String(), b.String())
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func compareNumbers(a, b *pb.Value) int {
+	_, aInt := a.GetValueType().(*pb.Value_IntegerValue)
+	_, bInt := b.GetValueType().(*pb.Value_IntegerValue)
+	if aInt && bInt {
+		x, y := a.GetIntegerValue(), b.GetIntegerValue()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	number := func(v *pb.Value, isInt bool) float64 {
+		if isInt {
+			return float64(v.GetIntegerValue())
+		}
+		return v.GetDoubleValue()
+	}
+	x, y := number(a, aInt), number(b, bInt)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
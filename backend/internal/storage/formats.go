@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Ingest payload formats selectable with the X-Data-Format header
+const (
+	DataFormatPipe6  = "v1-pipe6" // "HH:MM:SS | pid | name | heap_used | heap_cap | rss"
+	DataFormatPipe7  = "v1-pipe7" // v1-pipe6 followed by "| gc_time"
+	DataFormatCSV    = "csv"      // "elapsed_seconds,pid,name,heap_used_mb,heap_cap_mb,rss_mb[,gc_ms]"
+	DataFormatNDJSON = "ndjson"   // One ndjsonSample object per line
+	// DataFormatMonotonicNS is the pipe layout with nanoseconds since the run started in
+	// place of "HH:MM:SS", for agents that only have a monotonic clock
+	DataFormatMonotonicNS = "monotonic-ns"
+)
+
+// ErrUnsupportedFormat is returned by ParseDataFormat for an unknown format name
+var ErrUnsupportedFormat = errors.New("unsupported data format")
+
+// ndjsonSample is a single line of the ndjson ingest format
+type ndjsonSample struct {
+	ElapsedTime int                `json:"elapsed_time"`
+	PID         string             `json:"pid"`
+	Name        string             `json:"name"`
+	HeapUsed    int                `json:"heap_used"`
+	HeapCap     int                `json:"heap_cap"`
+	RSS         *int               `json:"rss"`
+	GCTime      *int               `json:"gc_time"`
+	Extra       map[string]float64 `json:"extra"`
+	Phase       string             `json:"phase"`
+}
+
+// ParseDataFormat parses data using an explicitly selected format.
+// An empty format falls back to ParseData's detection by field count, accepting the
+// field counts in config. Explicit pipe formats fix the count themselves.
+func ParseDataFormat(format string, data string, startTime time.Time, config ParseConfig) ([]models.Sample, error) {
+	switch format {
+	case "":
+		return ParseDataFields(data, startTime, config)
+	case DataFormatPipe6:
+		return parsePipeFormat(data, startTime, 6, config)
+	case DataFormatPipe7:
+		return parsePipeFormat(data, startTime, 7, config)
+	case DataFormatCSV:
+		return parseCSVFormat(data, startTime)
+	case DataFormatNDJSON:
+		return parseNDJSONFormat(data, startTime)
+	case DataFormatMonotonicNS:
+		return parseMonotonicFormat(data, startTime, config)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+}
+
+// parsePipeFormat requires every line to have exactly fields pipe-separated parts
+// (plus an optional trailing extras segment) before delegating to ParseDataFields
+func parsePipeFormat(data string, startTime time.Time, fields int, config ParseConfig) ([]models.Sample, error) {
+	for i, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || config.isComment(line) {
+			continue
+		}
+		parts := strings.Split(line, "|")
+		if len(parts) > fields && strings.Contains(parts[len(parts)-1], "=") {
+			parts = parts[:len(parts)-1]
+		}
+		if len(parts) != fields {
+			return nil, fmt.Errorf("line %d: expected %d fields, got %d", i+1, fields, len(parts))
+		}
+	}
+	return ParseDataFields(data, startTime, ParseConfig{Fields: DefaultFieldRange, CommentPrefix: config.CommentPrefix})
+}
+
+// parseMonotonicFormat parses pipe lines whose first field is nanoseconds since startTime.
+// The rest of the line is parsed like ParseData, then the timestamp is set to startTime plus
+// the exact duration, where ElapsedTime keeps whole seconds.
+func parseMonotonicFormat(data string, startTime time.Time, config ParseConfig) ([]models.Sample, error) {
+	var samples []models.Sample
+	for i, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || config.isComment(line) {
+			continue
+		}
+		elapsedField, rest, _ := strings.Cut(line, "|")
+		elapsed, err := strconv.ParseInt(strings.TrimSpace(elapsedField), 10, 64)
+		if err != nil || elapsed < 0 {
+			return nil, fmt.Errorf("line %d: invalid monotonic nanoseconds %q", i+1, strings.TrimSpace(elapsedField))
+		}
+		duration := time.Duration(elapsed)
+
+		seconds := int(duration / time.Second)
+		clock := fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+		sample, err := parseDataLine(clock+" |"+rest, startTime, config.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		sample.Timestamp = ToMillis(startTime.Add(duration))
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// parseCSVFormat parses comma-separated lines with numeric elapsed seconds and MB values.
+// A leading header row starting with "elapsed" is skipped.
+func parseCSVFormat(data string, startTime time.Time) ([]models.Sample, error) {
+	var samples []models.Sample
+	for i, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (i == 0 && strings.HasPrefix(line, "elapsed")) {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 && len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 6 or 7 fields, got %d", i+1, len(fields))
+		}
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+
+		numbers := make([]int, 0, 5)
+		for _, index := range []int{0, 3, 4, 5, 6} {
+			if index >= len(fields) {
+				break
+			}
+			value, err := strconv.ParseFloat(fields[index], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: field %d: %w", i+1, index+1, err)
+			}
+			numbers = append(numbers, int(value))
+		}
+
+		sample := models.Sample{
+			Timestamp:   ToMillis(startTime.Add(time.Duration(numbers[0]) * time.Second)),
+			ElapsedTime: numbers[0],
+			PID:         fields[1],
+			Name:        fields[2],
+			HeapUsed:    numbers[1],
+			HeapCap:     numbers[2],
+			RSS:         numbers[3],
+		}
+		if len(numbers) == 5 {
+			sample.GCTime = numbers[4]
+		} else {
+			sample.GCTimeMissing = true
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// parseNDJSONFormat parses one JSON sample object per line
+func parseNDJSONFormat(data string, startTime time.Time) ([]models.Sample, error) {
+	var samples []models.Sample
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var entry ndjsonSample
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.PID == "" {
+			return nil, fmt.Errorf("line %d: missing pid", line)
+		}
+
+		sample := models.Sample{
+			Timestamp:     ToMillis(startTime.Add(time.Duration(entry.ElapsedTime) * time.Second)),
+			ElapsedTime:   entry.ElapsedTime,
+			PID:           entry.PID,
+			Name:          entry.Name,
+			HeapUsed:      entry.HeapUsed,
+			HeapCap:       entry.HeapCap,
+			RSSMissing:    entry.RSS == nil,
+			GCTimeMissing: entry.GCTime == nil,
+			Extra:         entry.Extra,
+			Phase:         entry.Phase,
+		}
+		if entry.RSS != nil {
+			sample.RSS = *entry.RSS
+		}
+		if entry.GCTime != nil {
+			sample.GCTime = *entry.GCTime
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
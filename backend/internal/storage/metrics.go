@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// RunDurationBuckets cover builds from a few seconds up to four hours
+var RunDurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 14400}
+
+// RunDurationSeconds is the distribution of finished run durations (FinishedAt - StartTime)
+var RunDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "build_watcher_run_duration_seconds",
+	Help:    "Duration of finished runs from start to finish, in seconds.",
+	Buckets: RunDurationBuckets,
+})
+
+// PermissionDeniedErrors counts storage calls Firestore rejected for missing permissions,
+// which points at a misconfigured service account rather than an outage
+var PermissionDeniedErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "build_watcher_firestore_permission_denied_total",
+	Help: "Firestore calls rejected with PERMISSION_DENIED.",
+})
+
+// ImplausibleSamples counts data lines skipped for exceeding INGEST_MAX_SAMPLE_MB
+var ImplausibleSamples = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "build_watcher_implausible_samples_total",
+	Help: "Ingested samples skipped for heap or RSS values above INGEST_MAX_SAMPLE_MB.",
+})
+
+func init() {
+	prometheus.MustRegister(RunDurationSeconds, PermissionDeniedErrors, ImplausibleSamples)
+}
+
+// IsPermissionDenied reports whether err is a Firestore permission-denied error
+func IsPermissionDenied(err error) bool {
+	return err != nil && status.Code(err) == codes.PermissionDenied
+}
+
+// notePermissionDenied logs and counts permission-denied errors so IAM misconfiguration
+// stands out from ordinary failures
+func notePermissionDenied(err error) {
+	if !IsPermissionDenied(err) {
+		return
+	}
+	PermissionDeniedErrors.Inc()
+	log.Printf("🔒 Firestore permission denied, check the service account IAM roles for this project: %v", err)
+}
+
+// observeRunDuration records the duration of a finished run. Runs without a start time,
+// or that finished before they started, are skipped.
+func observeRunDuration(observer prometheus.Observer, runDoc *models.RunDoc) {
+	if runDoc.StartTime.IsZero() || !runDoc.FinishedAt.After(runDoc.StartTime) {
+		return
+	}
+	observer.Observe(runDoc.FinishedAt.Sub(runDoc.StartTime).Seconds())
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestObserveRunDuration(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_run_duration_seconds",
+		Buckets: RunDurationBuckets,
+	})
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	observeRunDuration(histogram, &models.RunDoc{StartTime: start, FinishedAt: start.Add(90 * time.Second)})
+	// No start time, nothing to observe
+	observeRunDuration(histogram, &models.RunDoc{FinishedAt: start})
+
+	var metric dto.Metric
+	if err := histogram.Write(&metric); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	got := metric.GetHistogram()
+	if got.GetSampleCount() != 1 {
+		t.Fatalf("expected 1 observation, got %d", got.GetSampleCount())
+	}
+	if got.GetSampleSum() != 90 {
+		t.Errorf("expected sum 90, got %v", got.GetSampleSum())
+	}
+	for _, bucket := range got.GetBucket() {
+		want := uint64(0)
+		if bucket.GetUpperBound() >= 90 {
+			want = 1
+		}
+		if bucket.GetCumulativeCount() != want {
+			t.Errorf("bucket <= %v: expected %d, got %d", bucket.GetUpperBound(), want, bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestPermissionDeniedIsCounted(t *testing.T) {
+	read := func() float64 {
+		var metric dto.Metric
+		if err := PermissionDeniedErrors.Write(&metric); err != nil {
+			t.Fatalf("failed to read counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := read()
+
+	denied := fmt.Errorf("failed to get run: %w", status.Error(codes.PermissionDenied, "missing datastore.entities.get"))
+	if !IsPermissionDenied(denied) {
+		t.Fatal("Expected a wrapped PERMISSION_DENIED error to be detected")
+	}
+	var breaker *circuitBreaker
+	breaker.record(denied)
+	breaker.record(status.Error(codes.Unavailable, "unavailable"))
+	breaker.record(nil)
+
+	if got := read() - before; got != 1 {
+		t.Errorf("Expected 1 permission-denied error to be counted, got %v", got)
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"log"
+	"os"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Policies for a PID that reports a different name mid-run, usually because the OS
+// recycled it for another process. Selected with PID_NAME_CONFLICT_POLICY.
+const (
+	// PIDNamePolicyLatest keeps a single process per PID, its latest name wins
+	PIDNamePolicyLatest = "latest"
+	// PIDNamePolicySplit records the new process as "pid~name" so the two do not merge
+	PIDNamePolicySplit = "split"
+)
+
+// SplitPIDSeparator joins a recycled PID and the new process's name under PIDNamePolicySplit
+const SplitPIDSeparator = "~"
+
+// getPIDNamePolicy reads PID_NAME_CONFLICT_POLICY, defaulting to PIDNamePolicyLatest
+func getPIDNamePolicy() string {
+	switch value := os.Getenv("PID_NAME_CONFLICT_POLICY"); value {
+	case "", PIDNamePolicyLatest:
+		return PIDNamePolicyLatest
+	case PIDNamePolicySplit:
+		return PIDNamePolicySplit
+	default:
+		log.Printf("⚠️  WARNING: invalid PID_NAME_CONFLICT_POLICY %q, using %s", value, PIDNamePolicyLatest)
+		return PIDNamePolicyLatest
+	}
+}
+
+// resolvePIDName compares the name a process reports with the name known for its PID.
+// It returns the PID to record the process under and whether the names conflict.
+func resolvePIDName(pid, name, known, policy string) (string, bool) {
+	if name == "" || known == "" || name == known {
+		return pid, false
+	}
+	if policy == PIDNamePolicySplit {
+		return pid + SplitPIDSeparator + name, true
+	}
+	return pid, true
+}
+
+// ResolvePIDNames applies policy to samples whose name differs from the one recorded for
+// their process in names, updating names as it goes. It returns the samples, copied when
+// any was moved to a split PID, and the process keys that reported a new name.
+func ResolvePIDNames(names map[string]string, samples []models.Sample, policy string) ([]models.Sample, []string) {
+	var conflicts []string
+	seen := make(map[string]bool)
+	copied := false
+	for i, sample := range samples {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		pid, conflict := resolvePIDName(sample.PID, sample.Name, names[key], policy)
+		if conflict && !seen[key] {
+			seen[key] = true
+			conflicts = append(conflicts, key)
+		}
+		if pid != sample.PID {
+			if !copied {
+				samples = append([]models.Sample(nil), samples...)
+				copied = true
+			}
+			samples[i].PID = pid
+			key = models.ProcessKey(sample.Machine, pid)
+		}
+		if sample.Name != "" && (names[key] == "" || policy == PIDNamePolicyLatest) {
+			names[key] = sample.Name
+		}
+	}
+	return samples, conflicts
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// recycledPIDBatches is PID 42 reported by a Gradle worker, then recycled by the OS
+// for a Kotlin daemon
+var recycledPIDBatches = [][]models.Sample{
+	{{PID: "42", Name: "GradleWorkerMain", HeapUsed: 100}, {PID: "7", Name: "GradleDaemon", HeapUsed: 500}},
+	{{PID: "42", Name: "KotlinCompileDaemon", HeapUsed: 300}},
+	{{PID: "42", Name: "KotlinCompileDaemon", HeapUsed: 320}},
+}
+
+func TestResolvePIDNames_SplitPolicy(t *testing.T) {
+	names := make(map[string]string)
+	var pids []string
+	var conflicts []string
+	for _, batch := range recycledPIDBatches {
+		samples, batchConflicts := ResolvePIDNames(names, batch, PIDNamePolicySplit)
+		conflicts = append(conflicts, batchConflicts...)
+		for _, sample := range samples {
+			pids = append(pids, sample.PID)
+		}
+	}
+
+	if expected := []string{"42", "7", "42~KotlinCompileDaemon", "42~KotlinCompileDaemon"}; !reflect.DeepEqual(pids, expected) {
+		t.Errorf("Expected the recycled PID split into a new process, got %v", pids)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"42", "42"}) {
+		t.Errorf("Expected the conflict reported for each batch, got %v", conflicts)
+	}
+	if names["42"] != "GradleWorkerMain" || names["42~KotlinCompileDaemon"] != "KotlinCompileDaemon" {
+		t.Errorf("Expected each logical process to keep its name, got %v", names)
+	}
+	if recycledPIDBatches[1][0].PID != "42" {
+		t.Errorf("Expected the caller's samples to be left untouched, got PID %s", recycledPIDBatches[1][0].PID)
+	}
+}
+
+func TestResolvePIDNames_LatestPolicy(t *testing.T) {
+	names := make(map[string]string)
+	var pids []string
+	var conflicts []string
+	for _, batch := range recycledPIDBatches {
+		samples, batchConflicts := ResolvePIDNames(names, batch, PIDNamePolicyLatest)
+		conflicts = append(conflicts, batchConflicts...)
+		for _, sample := range samples {
+			pids = append(pids, sample.PID)
+		}
+	}
+
+	if expected := []string{"42", "7", "42", "42"}; !reflect.DeepEqual(pids, expected) {
+		t.Errorf("Expected PIDs unchanged, got %v", pids)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"42"}) {
+		t.Errorf("Expected a single conflict once the latest name is recorded, got %v", conflicts)
+	}
+	if names["42"] != "KotlinCompileDaemon" {
+		t.Errorf("Expected the latest name kept, got %q", names["42"])
+	}
+}
+
+func TestGetPIDNamePolicy(t *testing.T) {
+	for value, expected := range map[string]string{"": PIDNamePolicyLatest, "split": PIDNamePolicySplit, "bogus": PIDNamePolicyLatest} {
+		t.Setenv("PID_NAME_CONFLICT_POLICY", value)
+		if policy := getPIDNamePolicy(); policy != expected {
+			t.Errorf("PID_NAME_CONFLICT_POLICY=%q: expected %s, got %s", value, expected, policy)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// CurrentSchemaVersion is the RunDoc layout written by this version of the service.
+//
+//	0: written before runs were versioned; finished runs may lack a finish status
+//	1: samples may be stored as a gzipped blob (COMPRESS_SAMPLES_THRESHOLD) or in the
+//	   samples subcollection, and every finished run records its finish status
+//	2: sample_count is kept up to date so the runs listing can sort by it
+const CurrentSchemaVersion = 2
+
+// MigrateRunDoc upgrades a run read from Firestore to the current layout in memory,
+// choosing the decode path by its stored SchemaVersion. SchemaVersion itself is left as
+// stored; writers that save the whole document stamp CurrentSchemaVersion. Runs written
+// by a newer version of the service are rejected rather than misread.
+func MigrateRunDoc(runDoc *models.RunDoc) error {
+	switch runDoc.SchemaVersion {
+	case 0:
+		// Runs finished before finish statuses existed were all finished by their agent
+		// or the stale sweep; without a record, treat them as completed
+		if runDoc.Finished && runDoc.FinishStatus == "" {
+			runDoc.FinishStatus = FinishStatusCompleted
+		}
+		// Compression predates versioning, so version 0 runs may also be packed
+		fallthrough
+	case 1:
+		if err := unpackSamples(runDoc); err != nil {
+			return err
+		}
+		countInlineSamples(runDoc)
+		return nil
+	case 2:
+		return unpackSamples(runDoc)
+	default:
+		return fmt.Errorf("run %s has schema version %d, newer than the supported %d", runDoc.RunID, runDoc.SchemaVersion, CurrentSchemaVersion)
+	}
+}
+
+// countInlineSamples fills in the sample count of runs written before version 2. Samples
+// in the subcollection are not counted, so older subcollection runs count only the
+// samples ingested after the upgrade.
+func countInlineSamples(runDoc *models.RunDoc) {
+	if runDoc.SampleCount == 0 {
+		runDoc.SampleCount = len(runDoc.Samples)
+	}
+}
+
+// BackfillLegacyRuns stores the fields that server-side filters and orderings rely on but
+// runs written by older versions may lack: finished = false, since runs only carried
+// finished once it was true, within a RUN_ID_PREFIX namespace the namespace field, and
+// sample_count, counted from the inline samples and the samples subcollection. Firestore
+// never matches or orders by a missing field, so until the backfill has run the stale
+// sweep, the admin summary, namespaced queries and listings sorted by sample count skip
+// those runs. It scans the runs collection once and writes with a BulkWriter, so it is
+// meant to run at startup, off the request path. A run that changed since the scan stores
+// the fields itself, so its failed conditional write is not retried.
+func (c *Client) BackfillLegacyRuns(ctx context.Context) error {
+	iter := c.firestore.Collection("runs").Select("finished", "namespace", "sample_count").Documents(ctx)
+	defer iter.Stop()
+
+	writer := c.firestore.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			writer.End()
+			return err
+		}
+		if _, ok := c.runIDOf(doc.Ref); !ok {
+			continue
+		}
+
+		var updates []firestore.Update
+		data := doc.Data()
+		if _, ok := data["finished"]; !ok {
+			updates = append(updates, firestore.Update{Path: "finished", Value: false})
+		}
+		if _, ok := data["namespace"]; !ok && c.runIDPrefix != "" {
+			updates = append(updates, firestore.Update{Path: "namespace", Value: c.runIDPrefix})
+		}
+		if _, ok := data["sample_count"]; !ok {
+			// Only legacy runs are read in full, to count their samples
+			count, err := c.countLegacySamples(ctx, doc.Ref)
+			if err != nil {
+				log.Printf("⚠️  WARNING: could not count samples of legacy run %s: %v", doc.Ref.ID, err)
+			} else {
+				updates = append(updates, firestore.Update{Path: "sample_count", Value: count})
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		job, err := writer.Update(doc.Ref, updates, firestore.LastUpdateTime(doc.UpdateTime))
+		if err != nil {
+			writer.End()
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	writer.End()
+
+	backfilled := 0
+	for _, job := range jobs {
+		if _, err := job.Results(); err == nil {
+			backfilled++
+		}
+	}
+	log.Printf("🔧 Backfilled finished, namespace and sample_count fields on %d of %d legacy runs", backfilled, len(jobs))
+	return nil
+}
+
+// countLegacySamples counts the samples of a run written before sample_count was stored,
+// inline or packed in the document and in the samples subcollection
+func (c *Client) countLegacySamples(ctx context.Context, ref *firestore.DocumentRef) (int, error) {
+	snapshot, err := ref.Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	status, err := c.runStatusOf(ctx, snapshot)
+	if err != nil {
+		return 0, err
+	}
+	return status.SampleCount, nil
+}
+
+// runsQuery returns the query over this deployment's runs. Within a RUN_ID_PREFIX namespace
+// it filters on the namespace field server-side, so limits count this deployment's runs
+// only.
+func (c *Client) runsQuery() firestore.Query {
+	query := c.firestore.Collection("runs").Query
+	if c.runIDPrefix != "" {
+		query = query.Where("namespace", "==", c.runIDPrefix)
+	}
+	return query
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestMigrateRunDoc_VersionZero(t *testing.T) {
+	runDoc := &models.RunDoc{
+		RunID:    "run-v0",
+		Finished: true,
+		Samples:  []models.Sample{{PID: "1", Timestamp: 1000, HeapUsed: 100}},
+	}
+
+	if err := MigrateRunDoc(runDoc); err != nil {
+		t.Fatalf("MigrateRunDoc failed: %v", err)
+	}
+	if runDoc.FinishStatus != FinishStatusCompleted {
+		t.Errorf("Expected a finished v0 run to migrate to %q, got %q", FinishStatusCompleted, runDoc.FinishStatus)
+	}
+	if len(runDoc.Samples) != 1 {
+		t.Errorf("Expected inline samples to be kept, got %d", len(runDoc.Samples))
+	}
+	if runDoc.SchemaVersion != 0 {
+		t.Errorf("Expected the stored version to be left as read, got %d", runDoc.SchemaVersion)
+	}
+}
+
+func TestMigrateRunDoc_CurrentVersion(t *testing.T) {
+	samples := []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 100},
+		{PID: "1", Timestamp: 2000, HeapUsed: 200},
+	}
+	runDoc := &models.RunDoc{RunID: "run-v1", Samples: samples, SchemaVersion: CurrentSchemaVersion}
+	if err := packSamples(runDoc, 1); err != nil {
+		t.Fatalf("packSamples failed: %v", err)
+	}
+
+	if err := MigrateRunDoc(runDoc); err != nil {
+		t.Fatalf("MigrateRunDoc failed: %v", err)
+	}
+	if len(runDoc.Samples) != 2 || runDoc.SamplesGzip != nil {
+		t.Errorf("Expected the packed samples to be decoded, got %d samples", len(runDoc.Samples))
+	}
+	if runDoc.FinishStatus != "" {
+		t.Errorf("Expected an unfinished run to keep an empty finish status, got %q", runDoc.FinishStatus)
+	}
+
+	future := &models.RunDoc{RunID: "run-future", SchemaVersion: CurrentSchemaVersion + 1}
+	if err := MigrateRunDoc(future); err == nil {
+		t.Error("Expected a newer schema version to be rejected")
+	}
+}
+
+func TestMigrateRunDoc_CountsSamplesBeforeVersionTwo(t *testing.T) {
+	runDoc := &models.RunDoc{
+		RunID:         "run-v1",
+		Samples:       []models.Sample{{PID: "1"}, {PID: "1"}, {PID: "2"}},
+		SchemaVersion: 1,
+	}
+
+	if err := MigrateRunDoc(runDoc); err != nil {
+		t.Fatalf("MigrateRunDoc failed: %v", err)
+	}
+	if runDoc.SampleCount != 3 {
+		t.Errorf("Expected the sample count to be filled in from inline samples, got %d", runDoc.SampleCount)
+	}
+}
+
+func TestMarkRunAsFinished_MigratesLegacyRun(t *testing.T) {
+	t.Setenv("COMPRESS_SAMPLES_THRESHOLD", "1")
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Written compressed before versioning and before sample counts were kept
+	legacy := models.RunDoc{RunID: "run-v0", Samples: []models.Sample{{PID: "1", Timestamp: 1000}, {PID: "1", Timestamp: 2000}}}
+	if err := packSamples(&legacy, 1); err != nil {
+		t.Fatalf("packSamples failed: %v", err)
+	}
+	if _, err := client.runRef("run-v0").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+
+	if err := client.MarkRunAsFinished(ctx, "run-v0"); err != nil {
+		t.Fatalf("MarkRunAsFinished failed: %v", err)
+	}
+	stored := fake.fields("runs/run-v0")
+	if stored["schema_version"].GetIntegerValue() != CurrentSchemaVersion || stored["sample_count"].GetIntegerValue() != 2 {
+		t.Errorf("Expected the run stamped with version %d and 2 samples, got %v and %v", CurrentSchemaVersion, stored["schema_version"], stored["sample_count"])
+	}
+	if len(stored["samples_gzip"].GetBytesValue()) == 0 || len(stored["samples"].GetArrayValue().GetValues()) != 0 {
+		t.Errorf("Expected the samples kept compressed, got %v", stored["samples"])
+	}
+	runDoc, err := client.GetRun(ctx, "run-v0")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	if !runDoc.Finished || len(runDoc.Samples) != 2 {
+		t.Errorf("Expected a finished run with 2 samples, got finished=%v with %d samples", runDoc.Finished, len(runDoc.Samples))
+	}
+}
+
+func TestSweeps_SkipRunsFromNewerSchema(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	stale := time.Now().Add(-2 * time.Hour)
+
+	future := models.RunDoc{RunID: "run-future", Finished: false, UpdatedAt: stale, UpdatedAtTimestamp: ToMillis(stale), SchemaVersion: CurrentSchemaVersion + 1}
+	if _, err := client.runRef("run-future").Set(ctx, future); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+
+	staleRuns, err := client.FindStaleRuns(time.Hour)
+	if err != nil {
+		t.Fatalf("FindStaleRuns failed: %v", err)
+	}
+	if len(staleRuns) != 0 {
+		t.Errorf("Expected a run from a newer schema not to be swept, got %+v", staleRuns)
+	}
+	if err := client.MarkRunAsFinished(ctx, "run-future"); err == nil {
+		t.Error("Expected finishing a run from a newer schema to fail rather than overwrite it")
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"log"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// PeakHeapUsed returns the higher of peak and the heap used (MB) of any of samples, used to
+// maintain a run's peak_heap_used_mb as samples arrive
+func PeakHeapUsed(peak int, samples []models.Sample) int {
+	for _, sample := range samples {
+		if sample.HeapUsed > peak {
+			peak = sample.HeapUsed
+		}
+	}
+	return peak
+}
+
+// LatestHeap updates latest, keyed by process key, with the newest heap reading of each
+// process among samples. A nil latest starts a new map.
+func LatestHeap(latest map[string]models.HeapReading, samples []models.Sample) map[string]models.HeapReading {
+	for _, sample := range samples {
+		if latest == nil {
+			latest = make(map[string]models.HeapReading)
+		}
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if previous, ok := latest[key]; !ok || sample.Timestamp >= previous.Timestamp {
+			latest[key] = models.HeapReading{Timestamp: sample.Timestamp, HeapUsedMB: sample.HeapUsed}
+		}
+	}
+	return latest
+}
+
+// CurrentHeapUsed returns the highest heap used among each process's newest reading
+func CurrentHeapUsed(latest map[string]models.HeapReading) int {
+	current := 0
+	for _, reading := range latest {
+		if reading.HeapUsedMB > current {
+			current = reading.HeapUsedMB
+		}
+	}
+	return current
+}
+
+// SearchRunsByPeakHeap returns summaries of up to limit runs whose peak heap reached
+// minPeakMB, highest peak first. It queries the maintained peak_heap_used_mb field, covered
+// by Firestore's automatic single-field index, so runs last written before the field was
+// kept are not found.
+func (c *Client) SearchRunsByPeakHeap(ctx context.Context, minPeakMB int, limit int) ([]models.RunSummary, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	summaries, err := c.searchRunsByPeakHeap(ctx, minPeakMB, limit)
+	c.breaker.record(err)
+	return summaries, err
+}
+
+// searchRunsByPeakHeap is the SearchRunsByPeakHeap implementation, called through the circuit breaker
+func (c *Client) searchRunsByPeakHeap(ctx context.Context, minPeakMB int, limit int) ([]models.RunSummary, error) {
+	iter := c.runsQuery().
+		Select("run_id", "provider", "start_time", "updated_at", "finished", "updated_at_timestamp", "sample_count", "retain_forever", "peak_heap_used_mb").
+		Where("peak_heap_used_mb", ">=", minPeakMB).
+		OrderBy("peak_heap_used_mb", firestore.Desc).
+		Limit(limit).
+		Documents(ctx)
+	defer iter.Stop()
+
+	summaries := []models.RunSummary{}
+	for len(summaries) < limit {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		runID, ok := c.runIDOf(doc.Ref)
+		if !ok {
+			continue
+		}
+
+		var summary models.RunSummary
+		if err := doc.DataTo(&summary); err != nil {
+			log.Printf("❌ Error parsing run summary %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		summary.RunID = runID
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
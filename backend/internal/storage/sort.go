@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Fields the runs listing can be sorted by with ?sort=
+const (
+	RunSortUpdated = "updated"
+	RunSortStarted = "started"
+	RunSortSamples = "samples"
+)
+
+// ErrInvalidSort is returned for a ?sort= value ParseRunSort does not accept
+var ErrInvalidSort = errors.New("invalid sort")
+
+// RunSort orders the runs listing by one field, the run ID breaking ties
+type RunSort struct {
+	Field     string
+	Ascending bool
+}
+
+// DefaultRunSort lists the most recently updated runs first
+var DefaultRunSort = RunSort{Field: RunSortUpdated}
+
+// ParseRunSort reads a ?sort= value of the form field or field:direction, where field is
+// updated, started or samples and direction is asc or desc (the default)
+func ParseRunSort(value string) (RunSort, error) {
+	if value == "" {
+		return DefaultRunSort, nil
+	}
+	field, direction, hasDirection := strings.Cut(value, ":")
+	if hasDirection && direction == "" {
+		return RunSort{}, fmt.Errorf("%w %q, expected a direction after the colon", ErrInvalidSort, value)
+	}
+	switch field {
+	case RunSortUpdated, RunSortStarted, RunSortSamples:
+	default:
+		return RunSort{}, fmt.Errorf("%w %q, expected updated, started or samples", ErrInvalidSort, field)
+	}
+	switch direction {
+	case "", "desc":
+		return RunSort{Field: field}, nil
+	case "asc":
+		return RunSort{Field: field, Ascending: true}, nil
+	default:
+		return RunSort{}, fmt.Errorf("%w direction %q, expected asc or desc", ErrInvalidSort, direction)
+	}
+}
+
+// firestoreField is the indexed run document field backing the sort
+func (s RunSort) firestoreField() string {
+	switch s.Field {
+	case RunSortStarted:
+		return "start_time"
+	case RunSortSamples:
+		return "sample_count"
+	default:
+		return "updated_at_timestamp"
+	}
+}
+
+// direction is the Firestore direction of the sort
+func (s RunSort) direction() firestore.Direction {
+	if s.Ascending {
+		return firestore.Asc
+	}
+	return firestore.Desc
+}
+
+// Key is the sort value of summary stored in the listing cursor. Start times are kept
+// in microseconds, the precision of Firestore timestamps.
+func (s RunSort) Key(summary models.RunSummary) int64 {
+	switch s.Field {
+	case RunSortStarted:
+		return summary.StartTime.UnixMicro()
+	case RunSortSamples:
+		return int64(summary.SampleCount)
+	default:
+		return summary.UpdatedAtTimestamp
+	}
+}
+
+// startAfter converts a cursor key back to the value Firestore compares the field with
+func (s RunSort) startAfter(key int64) any {
+	if s.Field == RunSortStarted {
+		return time.UnixMicro(key).UTC()
+	}
+	return key
+}
+
+// compare orders two listing positions in the sort's direction
+func (s RunSort) compare(aKey int64, aRunID string, bKey int64, bRunID string) int {
+	c := cmp.Or(cmp.Compare(aKey, bKey), cmp.Compare(aRunID, bRunID))
+	if s.Ascending {
+		return c
+	}
+	return -c
+}
+
+// Less reports whether a is listed before b, matching the Firestore query order
+func (s RunSort) Less(a, b models.RunSummary) bool {
+	return s.compare(s.Key(a), a.RunID, s.Key(b), b.RunID) < 0
+}
+
+// After reports whether summary is listed after the cursor position (key, runID)
+func (s RunSort) After(summary models.RunSummary, key int64, runID string) bool {
+	return s.compare(s.Key(summary), summary.RunID, key, runID) > 0
+}
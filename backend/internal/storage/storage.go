@@ -2,21 +2,188 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
 	"github.com/cdsap/build-process-watcher/backend/internal/models"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// ErrInvalidCursor is returned by ListRuns for a malformed pagination cursor
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrRunPaused is returned by StoreSamples when an admin has paused ingestion for the run
+var ErrRunPaused = errors.New("run is paused")
+
+// ErrRunArchived is returned by writes to a run an admin has archived
+var ErrRunArchived = errors.New("run is archived")
+
+// ErrRunFinished is returned by StoreSamples for a finished run that may not resume,
+// only enforced when STALE_RESUME_WINDOW is set
+var ErrRunFinished = errors.New("run is finished")
+
+// ErrSamplesAfterEnd is returned by StoreSamples for samples stamped after the run's
+// EndTime, only enforced when REJECT_AFTER_END_TIME is set
+var ErrSamplesAfterEnd = errors.New("samples are after the run's end time")
+
+// ErrRunNotFinished is returned by SetRunArchived for a run that is still running
+var ErrRunNotFinished = errors.New("run is not finished")
+
+// ErrRunExists is returned by CreateRun for a run ID that is already stored
+var ErrRunExists = errors.New("run already exists")
+
+// ErrRunChanged is returned by DeleteStaleRun for a run that is no longer stale and empty
+var ErrRunChanged = errors.New("run changed since it was found stale")
+
 // Client wraps Firestore operations
 type Client struct {
-	firestore *firestore.Client
-	ctx       context.Context
+	firestore         *firestore.Client
+	ctx               context.Context
+	ingestHistorySize int   // Max ingest events kept per run, 0 disables the history
+	staleScanLimit    int   // Max runs read per stale sweep, 0 means unlimited
+	retainBackfill    bool  // Exempt backfilled runs from retention and TTL
+	minSampleInterval int64 // Milliseconds a PID must wait between stored samples, 0 stores every sample
+	clampTimestamps   bool  // Clamp sample timestamps into [StartTime, now] instead of storing them raw
+	// staleResumeWindow is how long after the stale sweep finished a run an ingest may
+	// reopen it. Other finished runs then reject samples; 0 keeps accepting them unchanged.
+	staleResumeWindow time.Duration
+	endTimeLimit      EndTimeLimit     // Rejects late samples for runs with an EndTime, off by default
+	finishRace        FinishRacePolicy // FINISH_RACE_POLICY, whether samples racing a finish are stored
+	compressThreshold int              // Inline samples above this count are stored gzipped, 0 never compresses
+	maxProcesses      int              // Max process info entries kept per run, 0 keeps every process
+	pidNamePolicy     string           // PID_NAME_CONFLICT_POLICY, how a PID reporting a new name is handled
+	compactWeights    CompactionWeights
+	autoCompact       AutoCompaction // Compacts inline samples in StoreSamples, no extra reads or writes
+	// runIDPrefix namespaces this deployment's documents within shared collections. It is
+	// added to every run ID on the way in and stripped from document IDs on the way out,
+	// and stored in each run's namespace field for queries to filter on.
+	runIDPrefix string
+	// samplesSubcollection stores samples as documents under runs/{runId}/samples
+	// instead of inline in the run document, so tails are a limited query
+	samplesSubcollection bool
+	// archiveBucket is the Cloud Storage bucket runs are exported to before retention
+	// deletes them, empty disables the export
+	archiveBucket string
+	uploader      ObjectUploader
+	finishWebhook *finishWebhook // Notified when a run is marked finished, nil when FINISH_WEBHOOK_URL is unset
+	breaker       *circuitBreaker
+}
+
+// samplesCollection is the per-run subcollection used when SAMPLES_SUBCOLLECTION is enabled
+const samplesCollection = "samples"
+
+// maxBatchWrites is the Firestore limit on writes in a single batch
+const maxBatchWrites = 500
+
+type ingestSourceKey struct{}
+
+// WithIngestSource attaches the remote address of an ingest request to ctx
+// so StoreSamples can record it in the run's ingest history
+func WithIngestSource(ctx context.Context, remoteAddr string) context.Context {
+	return context.WithValue(ctx, ingestSourceKey{}, remoteAddr)
+}
+
+func ingestSource(ctx context.Context) string {
+	source, _ := ctx.Value(ingestSourceKey{}).(string)
+	return source
+}
+
+type verboseLogsKey struct{}
+
+// WithVerboseLogs records on ctx whether StoreSamples and StoreProcessInfo log their
+// progress, so ingest requests left out by INGEST_LOG_SAMPLE_RATE stay quiet in storage too.
+// Warnings and errors are always logged.
+func WithVerboseLogs(ctx context.Context, verbose bool) context.Context {
+	return context.WithValue(ctx, verboseLogsKey{}, verbose)
+}
+
+// ingestLogf logs a progress message unless ctx was marked quiet with WithVerboseLogs
+func ingestLogf(ctx context.Context, format string, args ...any) {
+	if verbose, ok := ctx.Value(verboseLogsKey{}).(bool); ok && !verbose {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// getEnvBool reports whether the environment variable is set to a true value
+func getEnvBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+// getEnvInt reads a non-negative integer from the environment, falling back to def
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("⚠️  WARNING: invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// getStaleResumeWindow reads STALE_RESUME_WINDOW (e.g. "30m"), 0 when unset or invalid
+func getStaleResumeWindow() time.Duration {
+	value := os.Getenv("STALE_RESUME_WINDOW")
+	if value == "" {
+		return 0
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		log.Printf("⚠️  WARNING: invalid STALE_RESUME_WINDOW %q, stale runs will not resume", value)
+		return 0
+	}
+	return window
+}
+
+// EndTimeLimit rejects samples stamped more than Slack after a run's EndTime
+type EndTimeLimit struct {
+	Enabled bool
+	Slack   time.Duration
+}
+
+// getEndTimeLimit reads REJECT_AFTER_END_TIME and END_TIME_SLACK (e.g. "30s", default 0)
+func getEndTimeLimit() EndTimeLimit {
+	limit := EndTimeLimit{Enabled: getEnvBool("REJECT_AFTER_END_TIME")}
+	if value := os.Getenv("END_TIME_SLACK"); value != "" {
+		slack, err := time.ParseDuration(value)
+		if err != nil || slack < 0 {
+			log.Printf("⚠️  WARNING: invalid END_TIME_SLACK %q, using 0", value)
+		} else {
+			limit.Slack = slack
+		}
+	}
+	return limit
+}
+
+// Check returns ErrSamplesAfterEnd if any sample is stamped after endTime plus the slack.
+// Runs without an EndTime accept every sample.
+func (l EndTimeLimit) Check(samples []models.Sample, endTime time.Time) error {
+	if !l.Enabled || endTime.IsZero() {
+		return nil
+	}
+	limit := ToMillis(endTime.Add(l.Slack))
+	for _, sample := range samples {
+		if sample.Timestamp > limit {
+			return fmt.Errorf("%w: sample of PID %s at %d is %dms late", ErrSamplesAfterEnd, sample.PID, sample.Timestamp, sample.Timestamp-limit)
+		}
+	}
+	return nil
 }
 
 // NewClient creates a new storage client
@@ -28,20 +195,83 @@ func NewClient(ctx context.Context, projectID string) (*Client, error) {
 
 	log.Printf("✅ Connected to Firestore project: %s", projectID)
 	return &Client{
-		firestore: client,
-		ctx:       ctx,
+		firestore:            client,
+		ctx:                  ctx,
+		ingestHistorySize:    getEnvInt("INGEST_HISTORY_SIZE", 0),
+		staleScanLimit:       getEnvInt("STALE_SCAN_LIMIT", 0),
+		retainBackfill:       getEnvBool("BACKFILL_SKIP_RETENTION"),
+		minSampleInterval:    int64(getEnvInt("MIN_SAMPLE_INTERVAL_MS", 0)),
+		clampTimestamps:      getEnvBool("CLAMP_SAMPLE_TIMESTAMPS"),
+		staleResumeWindow:    getStaleResumeWindow(),
+		endTimeLimit:         getEndTimeLimit(),
+		finishRace:           getFinishRacePolicy(),
+		compressThreshold:    getEnvInt("COMPRESS_SAMPLES_THRESHOLD", 0),
+		maxProcesses:         getEnvInt("MAX_PROCESSES_PER_RUN", 0),
+		pidNamePolicy:        getPIDNamePolicy(),
+		compactWeights:       getCompactionWeights(),
+		autoCompact:          getAutoCompaction(),
+		runIDPrefix:          os.Getenv("RUN_ID_PREFIX"),
+		samplesSubcollection: getEnvBool("SAMPLES_SUBCOLLECTION"),
+		archiveBucket:        os.Getenv("ARCHIVE_BUCKET"),
+		uploader:             &gcsUploader{},
+		finishWebhook:        newFinishWebhook(os.Getenv("FINISH_WEBHOOK_URL")),
+		breaker:              newCircuitBreakerFromEnv(),
 	}, nil
 }
 
+// runRef returns the run document of runID within the RUN_ID_PREFIX namespace
+func (c *Client) runRef(runID string) *firestore.DocumentRef {
+	return c.firestore.Collection("runs").Doc(c.runIDPrefix + runID)
+}
+
+// processRef returns the process document of runID within the RUN_ID_PREFIX namespace
+func (c *Client) processRef(runID string) *firestore.DocumentRef {
+	return c.firestore.Collection("processes").Doc(c.runIDPrefix + runID)
+}
+
+// runIDOf returns the client-facing run ID of a run document, and false when the
+// document belongs to another RUN_ID_PREFIX namespace
+func (c *Client) runIDOf(ref *firestore.DocumentRef) (string, bool) {
+	return strings.CutPrefix(ref.ID, c.runIDPrefix)
+}
+
 // Close closes the Firestore client
 func (c *Client) Close() error {
 	return c.firestore.Close()
 }
 
 // GetRun retrieves a run document by ID
-func (c *Client) GetRun(runID string) (*models.RunDoc, error) {
-	doc := c.firestore.Collection("runs").Doc(runID)
-	snapshot, err := doc.Get(c.ctx)
+func (c *Client) GetRun(ctx context.Context, runID string) (*models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	result, err := c.getRun(ctx, runID)
+	c.breaker.record(err)
+	return result, err
+}
+
+// getRun is the GetRun implementation, called through the circuit breaker
+func (c *Client) getRun(ctx context.Context, runID string) (*models.RunDoc, error) {
+	return c.readRun(ctx, runID, c.runRef(runID).Collection(samplesCollection).Query)
+}
+
+// GetRunSince is GetRun for incremental fetches: subcollection samples are read only when
+// newer than sinceTS, so polling a long run does not read it whole each time. Inline
+// samples come with the run document and are returned unfiltered.
+func (c *Client) GetRunSince(ctx context.Context, runID string, sinceTS int64) (*models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	samples := c.runRef(runID).Collection(samplesCollection).Where("timestamp", ">", sinceTS)
+	result, err := c.readRun(ctx, runID, samples)
+	c.breaker.record(err)
+	return result, err
+}
+
+// readRun reads and migrates a run, with the subcollection samples matched by samples
+func (c *Client) readRun(ctx context.Context, runID string, samples firestore.Query) (*models.RunDoc, error) {
+	doc := c.runRef(runID)
+	snapshot, err := doc.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -54,126 +284,1166 @@ func (c *Client) GetRun(runID string) (*models.RunDoc, error) {
 	if err := snapshot.DataTo(&runDoc); err != nil {
 		return nil, err
 	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return nil, err
+	}
+
+	if c.samplesSubcollection {
+		// Inline samples written before the subcollection was enabled come first
+		stored, err := readSamples(samples.OrderBy("timestamp", firestore.Asc).Documents(ctx))
+		if err != nil {
+			return nil, err
+		}
+		runDoc.Samples = append(runDoc.Samples, stored...)
+	}
 
 	return &runDoc, nil
 }
 
-// StoreSamples stores samples for a run
-func (c *Client) StoreSamples(runID string, samples []models.Sample) error {
-	log.Printf("🔄 Storing %d samples for run ID: %s", len(samples), runID)
+// GetRunHeap reads only a run's maintained peak_heap_used_mb and latest_heap fields, so
+// callers after the heap figures never load its samples. Both are empty for runs not
+// written since the fields were maintained.
+func (c *Client) GetRunHeap(ctx context.Context, runID string) (*models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	result, err := c.getRunHeap(ctx, runID)
+	c.breaker.record(err)
+	return result, err
+}
+
+// getRunHeap is the GetRunHeap implementation, called through the circuit breaker
+func (c *Client) getRunHeap(ctx context.Context, runID string) (*models.RunDoc, error) {
+	return c.projectRun(ctx, runID, "peak_heap_used_mb", "latest_heap")
+}
+
+// GetRunMeta reads only a run's start_time and provider, for the ingest path, which needs
+// the run's timeline but never its samples
+func (c *Client) GetRunMeta(ctx context.Context, runID string) (*models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	result, err := c.projectRun(ctx, runID, "start_time", "provider")
+	c.breaker.record(err)
+	return result, err
+}
 
-	doc := c.firestore.Collection("runs").Doc(runID)
+// projectRun reads only fields of a run document, never its samples subcollection
+func (c *Client) projectRun(ctx context.Context, runID string, fields ...string) (*models.RunDoc, error) {
+	ref := c.runRef(runID)
+	iter := c.firestore.Collection("runs").
+		Where(firestore.DocumentID, "==", ref).
+		Select(fields...).
+		Documents(ctx)
+	defer iter.Stop()
+
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runDoc models.RunDoc
+	if err := doc.DataTo(&runDoc); err != nil {
+		return nil, err
+	}
+	runDoc.RunID = runID
+	return &runDoc, nil
+}
 
-	// Get existing document or create new one
-	snapshot, err := doc.Get(c.ctx)
-	if err != nil && !strings.Contains(err.Error(), "not found") {
-		log.Printf("❌ Error getting document: %v", err)
+// EachSample calls fn with each sample of a run in stored order, stopping at the first error.
+// With the samples subcollection enabled, sample documents are read one at a time rather
+// than loaded into memory first.
+func (c *Client) EachSample(ctx context.Context, runID string, fn func(models.Sample) error) error {
+	if err := c.breaker.allow(); err != nil {
 		return err
 	}
+	var fnErr error
+	err := c.eachSample(ctx, runID, func(sample models.Sample) error {
+		fnErr = fn(sample)
+		return fnErr
+	})
+	// A consumer that stopped reading says nothing about Firestore
+	if fnErr != nil {
+		c.breaker.record(nil)
+	} else {
+		c.breaker.record(err)
+	}
+	return err
+}
 
+// eachSample is the EachSample implementation, called through the circuit breaker
+func (c *Client) eachSample(ctx context.Context, runID string, fn func(models.Sample) error) error {
+	if !c.samplesSubcollection {
+		runDoc, err := c.getRun(ctx, runID)
+		if err != nil {
+			return err
+		}
+		for _, sample := range runDoc.Samples {
+			if err := fn(sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	doc := c.runRef(runID)
+	snapshot, err := doc.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if !snapshot.Exists() {
+		return fmt.Errorf("run %s not found", runID)
+	}
 	var runDoc models.RunDoc
-	if snapshot != nil && snapshot.Exists() {
-		if err := snapshot.DataTo(&runDoc); err != nil {
-			log.Printf("❌ Error parsing document data: %v", err)
+	if err := snapshot.DataTo(&runDoc); err != nil {
+		return err
+	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return err
+	}
+
+	// Inline samples written before the subcollection was enabled come first
+	for _, sample := range runDoc.Samples {
+		if err := fn(sample); err != nil {
 			return err
 		}
-		log.Printf("📄 Found existing document with %d samples", len(runDoc.Samples))
-	} else {
-		now := time.Now()
-		runDoc = models.RunDoc{
-			ID:                 runID,
-			RunID:              runID,
-			StartTime:          now,
-			CreatedAt:          now,
-			UpdatedAt:          now,
-			UpdatedAtTimestamp: ToMillis(now), // Set timestamp on creation
-		}
-		log.Printf("📄 Creating new document for run ID: %s", runID)
-	}
-
-	// Append new samples
-	runDoc.Samples = append(runDoc.Samples, samples...)
-	now := time.Now()
-	runDoc.UpdatedAt = now
-	runDoc.UpdatedAtTimestamp = ToMillis(now) // Store Unix millis for timezone-independent queries
-	log.Printf("📊 Document now has %d samples total", len(runDoc.Samples))
-
-	// Save back to Firestore
-	_, err = doc.Set(c.ctx, runDoc)
+	}
+	iter := doc.Collection(samplesCollection).OrderBy("timestamp", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		sampleDoc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var sample models.Sample
+		if err := sampleDoc.DataTo(&sample); err != nil {
+			log.Printf("❌ Error parsing sample document %s: %v", sampleDoc.Ref.ID, err)
+			continue
+		}
+		if err := fn(sample); err != nil {
+			return err
+		}
+	}
+}
+
+// TailSamples returns the newest n samples of a run, oldest first. With the samples
+// subcollection enabled this is a limited descending query rather than a full read.
+func (c *Client) TailSamples(ctx context.Context, runID string, n int) ([]models.Sample, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	result, err := c.tailSamples(ctx, runID, n)
+	c.breaker.record(err)
+	return result, err
+}
+
+// tailSamples is the TailSamples implementation, called through the circuit breaker
+func (c *Client) tailSamples(ctx context.Context, runID string, n int) ([]models.Sample, error) {
+	if !c.samplesSubcollection {
+		runDoc, err := c.getRun(ctx, runID)
+		if err != nil {
+			return nil, err
+		}
+		return TailOf(runDoc.Samples, n), nil
+	}
+
+	snapshot, err := c.runRef(runID).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.Exists() {
+		return nil, fmt.Errorf("run %s not found", runID)
+	}
+	var runDoc models.RunDoc
+	if err := snapshot.DataTo(&runDoc); err != nil {
+		return nil, err
+	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return nil, err
+	}
+
+	samples, err := readSamples(c.tailQuery(runID, n).Documents(ctx))
+	if err != nil {
+		return nil, err
+	}
+	// Inline samples written before the subcollection was enabled are older than any in it
+	return TailOf(append(runDoc.Samples, ReverseSamples(samples)...), n), nil
+}
+
+// tailQuery selects the newest n samples of a run, newest first
+func (c *Client) tailQuery(runID string, n int) firestore.Query {
+	return c.runRef(runID).Collection(samplesCollection).
+		OrderBy("timestamp", firestore.Desc).
+		Limit(n)
+}
+
+// readSamples drains a samples subcollection iterator
+func readSamples(iter *firestore.DocumentIterator) ([]models.Sample, error) {
+	defer iter.Stop()
+
+	var samples []models.Sample
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sample models.Sample
+		if err := doc.DataTo(&sample); err != nil {
+			log.Printf("❌ Error parsing sample document %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// writeSamples stores samples as documents in a run's samples subcollection, in batches
+func (c *Client) writeSamples(ctx context.Context, runID string, samples []models.Sample) error {
+	collection := c.runRef(runID).Collection(samplesCollection)
+	for start := 0; start < len(samples); start += maxBatchWrites {
+		end := start + maxBatchWrites
+		if end > len(samples) {
+			end = len(samples)
+		}
+		batch := c.firestore.Batch()
+		for _, sample := range samples[start:end] {
+			sample.RunID = runID
+			batch.Create(collection.NewDoc(), sample)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSamples deletes a run's samples subcollection in batches
+func (c *Client) deleteSamples(ctx context.Context, runRef *firestore.DocumentRef) error {
+	collection := runRef.Collection(samplesCollection)
+	for {
+		refs, err := collection.Limit(maxBatchWrites).Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(refs) == 0 {
+			return nil
+		}
+		batch := c.firestore.Batch()
+		for _, doc := range refs {
+			batch.Delete(doc.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// TailOf returns the last n samples, or all of them when there are fewer
+func TailOf(samples []models.Sample, n int) []models.Sample {
+	if n <= 0 || n >= len(samples) {
+		return samples
+	}
+	return samples[len(samples)-n:]
+}
+
+// ReverseSamples reverses samples in place and returns them
+func ReverseSamples(samples []models.Sample) []models.Sample {
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+	return samples
+}
+
+// newRunDoc returns the document of a run created at now, before any sample is stored
+func newRunDoc(runID string, now time.Time) models.RunDoc {
+	return models.RunDoc{
+		ID:                 runID,
+		RunID:              runID,
+		StartTime:          now,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		UpdatedAtTimestamp: ToMillis(now), // Set timestamp on creation
+		SchemaVersion:      CurrentSchemaVersion,
+	}
+}
+
+// CreateRun creates an empty run, failing with ErrRunExists when runID is already stored.
+// The create is a single conditional write, so of several concurrent callers exactly one
+// succeeds.
+func (c *Client) CreateRun(ctx context.Context, runID string) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	runDoc := newRunDoc(runID, clock.Now())
+	runDoc.Namespace = c.runIDPrefix
+	_, err := c.runRef(runID).Create(ctx, runDoc)
+	if status.Code(err) == codes.AlreadyExists {
+		err = ErrRunExists
+	}
+	c.breaker.record(err)
+	return err
+}
+
+// StoreSamples stores samples for a run, shifting those of processes with a start offset
+// onto the run's timeline
+func (c *Client) StoreSamples(ctx context.Context, runID string, samples []models.Sample) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.storeSamples(ctx, runID, samples)
+	c.breaker.record(err)
+	return err
+}
+
+// storeSamples is the StoreSamples implementation, called through the circuit breaker
+func (c *Client) storeSamples(ctx context.Context, runID string, incoming []models.Sample) error {
+	// In subcollection mode every sample is a write of the transaction next to the run
+	// document, so larger batches are stored in chunks within the write limit
+	if chunk := maxBatchWrites - 1; c.samplesSubcollection && len(incoming) > chunk {
+		for start := 0; start < len(incoming); start += chunk {
+			if err := c.storeSamples(ctx, runID, incoming[start:min(start+chunk, len(incoming))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ingestLogf(ctx, "🔄 Storing %d samples for run ID: %s", len(incoming), runID)
+
+	doc := c.runRef(runID)
+
+	// Agents on several machines may ingest into the same run at once. The run document is
+	// updated in a transaction, which Firestore retries on contention, so concurrent batches
+	// merge instead of the last writer dropping the others.
+	var samples []models.Sample
+	err := c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Get existing document or create new one, with the processes document in the same read
+		snapshots, err := tx.GetAll([]*firestore.DocumentRef{doc, c.processRef(runID)})
+		if err != nil {
+			log.Printf("❌ Error getting document: %v", err)
+			return err
+		}
+		snapshot := snapshots[0]
+
+		// Align processes whose agent uses its own elapsed-time origin
+		samples = incoming
+		if processSnapshot := snapshots[1]; processSnapshot.Exists() {
+			var processDoc models.ProcessDoc
+			if err := processSnapshot.DataTo(&processDoc); err != nil {
+				log.Printf("⚠️  WARNING: invalid process info for run ID: %s, ignoring start offsets: %v", runID, err)
+			} else {
+				samples = ApplyStartOffsets(samples, StartOffsets(processDoc.ProcessInfo))
+			}
+		}
+
+		var runDoc models.RunDoc
+		if snapshot != nil && snapshot.Exists() {
+			if err := snapshot.DataTo(&runDoc); err != nil {
+				log.Printf("❌ Error parsing document data: %v", err)
+				return err
+			}
+			if err := MigrateRunDoc(&runDoc); err != nil {
+				return err
+			}
+			ingestLogf(ctx, "📄 Found existing document with %d samples", len(runDoc.Samples))
+			if runDoc.Archived {
+				log.Printf("🗄️ Rejecting %d samples for archived run ID: %s", len(samples), runID)
+				return ErrRunArchived
+			}
+			if runDoc.Paused {
+				log.Printf("⏸️  Rejecting %d samples for paused run ID: %s", len(samples), runID)
+				return ErrRunPaused
+			}
+			resumed, err := ResumeForIngest(&runDoc, clock.Now(), c.staleResumeWindow, c.finishRace)
+			if err != nil {
+				log.Printf("🏁 Rejecting %d samples for finished run ID: %s", len(samples), runID)
+				return err
+			}
+			if resumed {
+				log.Printf("♻️ Resurrecting run ID: %s, finished but still sending samples", runID)
+			}
+			if err := c.endTimeLimit.Check(samples, runDoc.EndTime); err != nil {
+				log.Printf("🏁 Rejecting %d samples for run ID: %s: %v", len(samples), runID, err)
+				return err
+			}
+			// A new run takes its StartTime from this batch, so only existing runs are clamped
+			if c.clampTimestamps {
+				var clamped int
+				samples, clamped = ClampTimestamps(samples, runDoc.StartTime, clock.Now())
+				if clamped > 0 {
+					log.Printf("⚠️  Clamped %d sample timestamps into the window of run ID: %s", clamped, runID)
+				}
+			}
+		} else {
+			runDoc = newRunDoc(runID, clock.Now())
+			ingestLogf(ctx, "📄 Creating new document for run ID: %s", runID)
+		}
+
+		if runDoc.ProcessNames == nil {
+			runDoc.ProcessNames = make(map[string]string)
+		}
+		var conflicts []string
+		if samples, conflicts = ResolvePIDNames(runDoc.ProcessNames, samples, c.pidNamePolicy); len(conflicts) > 0 {
+			log.Printf("⚠️  Run ID: %s has PIDs reporting a new name (%s policy): %s", runID, c.pidNamePolicy, strings.Join(conflicts, ", "))
+		}
+
+		if c.minSampleInterval > 0 {
+			previous := runDoc.Samples
+			if c.samplesSubcollection {
+				// Only recent samples can fall within the interval, so the tail is enough. It is
+				// read in the transaction, so a concurrent batch cannot slip in unthrottled.
+				previous, err = readSamples(tx.Documents(c.tailQuery(runID, maxBatchWrites)))
+				if err != nil {
+					return err
+				}
+			}
+			kept := ThrottleSamples(previous, samples, c.minSampleInterval)
+			if dropped := len(samples) - len(kept); dropped > 0 {
+				log.Printf("⏱️ Dropped %d samples arriving within %dms of the previous sample of their PID for run ID: %s", dropped, c.minSampleInterval, runID)
+			}
+			samples = kept
+		}
+
+		// Append new samples; activity clears any stale suspicion
+		if !c.samplesSubcollection {
+			runDoc.Samples = append(runDoc.Samples, samples...)
+			// Compacting here keeps the document bounded within the same write
+			var compacted bool
+			before := len(runDoc.Samples)
+			if runDoc.Samples, compacted = c.autoCompact.apply(runDoc.Samples, c.compactWeights); compacted {
+				log.Printf("🗜️ Auto-compacted run ID: %s from %d to %d samples", runID, before, len(runDoc.Samples))
+			}
+			runDoc.SampleCount = len(runDoc.Samples)
+		} else {
+			// The samples are written to the subcollection below, in this transaction
+			runDoc.SampleCount += len(samples)
+		}
+		runDoc.PeakHeapUsedMB = PeakHeapUsed(runDoc.PeakHeapUsedMB, samples)
+		runDoc.LatestHeap = LatestHeap(runDoc.LatestHeap, samples)
+		runDoc.SuspectedStaleAt = time.Time{}
+		now := clock.Now()
+		if c.ingestHistorySize > 0 {
+			runDoc.IngestHistory = AppendIngestEvent(runDoc.IngestHistory, models.IngestEvent{
+				Timestamp:   now,
+				SampleCount: len(samples),
+				RemoteAddr:  ingestSource(ctx),
+			}, c.ingestHistorySize)
+		}
+		runDoc.UpdatedAt = now
+		runDoc.UpdatedAtTimestamp = ToMillis(now) // Store Unix millis for timezone-independent queries
+		ingestLogf(ctx, "📊 Document now has %d samples total", len(runDoc.Samples))
+		runDoc.SchemaVersion = CurrentSchemaVersion
+		if err := packSamples(&runDoc, c.compressThreshold); err != nil {
+			return err
+		}
+
+		runDoc.Namespace = c.runIDPrefix
+
+		// Save back to Firestore
+		if err := tx.Set(doc, runDoc); err != nil {
+			log.Printf("❌ Error saving document to Firestore: %v", err)
+			return err
+		}
+		// Committing the samples with the run document means a finish racing this ingest
+		// either sees them or makes the transaction retry and hit the finish policy
+		if c.samplesSubcollection {
+			collection := doc.Collection(samplesCollection)
+			for _, sample := range samples {
+				sample.RunID = runID
+				if err := tx.Create(collection.NewDoc(), sample); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ingestLogf(ctx, "✅ Successfully stored %d samples for run ID: %s", len(samples), runID)
+	return nil
+}
+
+// ResumeFinishedRun decides whether a finished run accepts new samples. A run the stale
+// sweep finished less than window ago is reopened in place and reported as resumed; any
+// other finished run fails with ErrRunFinished. A window of 0 leaves runDoc untouched.
+func ResumeFinishedRun(runDoc *models.RunDoc, now time.Time, window time.Duration) (bool, error) {
+	if !runDoc.Finished || window <= 0 {
+		return false, nil
+	}
+	if runDoc.FinishStatus != FinishStatusStale || now.Sub(runDoc.FinishedAt) > window {
+		return false, ErrRunFinished
+	}
+	reopenRun(runDoc)
+	return true, nil
+}
+
+// reopenRun clears the finish of runDoc, including its TTL, so it keeps taking samples
+func reopenRun(runDoc *models.RunDoc) {
+	runDoc.Finished = false
+	runDoc.FinishedAt = time.Time{}
+	runDoc.ExpireAt = time.Time{}
+	runDoc.FinishStatus = ""
+}
+
+// ClampTimestamps returns samples with each Timestamp moved into [start, now] and
+// the number of samples that had to be moved. The input slice is not modified.
+func ClampTimestamps(samples []models.Sample, start, now time.Time) ([]models.Sample, int) {
+	lower, upper := ToMillis(start), ToMillis(now)
+	clamped := 0
+	result := make([]models.Sample, len(samples))
+	for i, sample := range samples {
+		switch {
+		case sample.Timestamp < lower:
+			sample.Timestamp = lower
+			clamped++
+		case sample.Timestamp > upper:
+			sample.Timestamp = upper
+			clamped++
+		}
+		result[i] = sample
+	}
+	return result, clamped
+}
+
+// ThrottleSamples drops incoming samples whose timestamp is within minInterval milliseconds
+// of the previous sample of the same PID, whether already stored or earlier in incoming
+func ThrottleSamples(previous []models.Sample, incoming []models.Sample, minInterval int64) []models.Sample {
+	last := make(map[string]int64)
+	for _, sample := range previous {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if ts, ok := last[key]; !ok || sample.Timestamp > ts {
+			last[key] = sample.Timestamp
+		}
+	}
+
+	kept := make([]models.Sample, 0, len(incoming))
+	for _, sample := range incoming {
+		key := models.ProcessKey(sample.Machine, sample.PID)
+		if ts, ok := last[key]; ok {
+			delta := sample.Timestamp - ts
+			if delta < 0 {
+				delta = -delta
+			}
+			if delta < minInterval {
+				continue
+			}
+		}
+		last[key] = sample.Timestamp
+		kept = append(kept, sample)
+	}
+	return kept
+}
+
+// StoreBackfill creates a historical run from samples in a single write, already finished
+// so the stale sweep never picks it up. It fails if the run already exists.
+func (c *Client) StoreBackfill(ctx context.Context, runID string, startTime time.Time, samples []models.Sample) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	runDoc := NewBackfillRun(runID, startTime, samples, clock.Now(), c.retainBackfill)
+	runDoc.Namespace = c.runIDPrefix
+	err := c.storeBackfill(ctx, runDoc)
+	c.breaker.record(err)
+	if err == nil {
+		log.Printf("✅ Backfilled run %s with %d samples (started %v)", runID, len(samples), startTime)
+	}
+	return err
+}
+
+// storeBackfill is the StoreBackfill implementation, called through the circuit breaker.
+// With the samples subcollection enabled the samples are written there once the run
+// document is created, so a run that already exists is never touched.
+func (c *Client) storeBackfill(ctx context.Context, runDoc models.RunDoc) error {
+	var samples []models.Sample
+	if c.samplesSubcollection {
+		samples, runDoc.Samples = runDoc.Samples, nil
+	}
+	if err := packSamples(&runDoc, c.compressThreshold); err != nil {
+		return err
+	}
+	if _, err := c.runRef(runDoc.RunID).Create(ctx, runDoc); err != nil {
+		return err
+	}
+	return c.writeSamples(ctx, runDoc.RunID, samples)
+}
+
+// NewBackfillRun builds the document for a backfilled run. The run keeps its original
+// start time but finishes at import time, so retention counts from the import.
+// With retain set, no TTL is applied.
+func NewBackfillRun(runID string, startTime time.Time, samples []models.Sample, now time.Time, retain bool) models.RunDoc {
+	runDoc := models.RunDoc{
+		ID:                 runID,
+		RunID:              runID,
+		StartTime:          startTime,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		UpdatedAtTimestamp: ToMillis(now),
+		Samples:            samples,
+		Finished:           true,
+		FinishedAt:         now,
+		FinishStatus:       FinishStatusCompleted,
+		Backfill:           true,
+		SampleCount:        len(samples),
+		PeakHeapUsedMB:     PeakHeapUsed(0, samples),
+		LatestHeap:         LatestHeap(nil, samples),
+		SchemaVersion:      CurrentSchemaVersion,
+	}
+	if !retain {
+		runDoc.ExpireAt = now.Add(3 * time.Hour)
+	}
+	return runDoc
+}
+
+// SetMachine records the agent's machine on each sample, leaving samples unchanged when machine is empty
+func SetMachine(samples []models.Sample, machine string) []models.Sample {
+	if machine == "" {
+		return samples
+	}
+	for i := range samples {
+		samples[i].Machine = machine
+	}
+	return samples
+}
+
+// Length caps, in characters, on the presentation hints of ProcessInfo
+const (
+	MaxProcessColorLength       = 32
+	MaxProcessDisplayNameLength = 64
+)
+
+// CapDisplayHints truncates the color and display name of processInfo to their caps
+func CapDisplayHints(processInfo models.ProcessInfo) models.ProcessInfo {
+	processInfo.Color = truncateRunes(strings.TrimSpace(processInfo.Color), MaxProcessColorLength)
+	processInfo.DisplayName = truncateRunes(strings.TrimSpace(processInfo.DisplayName), MaxProcessDisplayNameLength)
+	return processInfo
+}
+
+// truncateRunes cuts s to at most n characters without splitting a multi-byte character
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// SetRunPaused pauses or resumes ingestion for an existing run
+func (c *Client) SetRunPaused(ctx context.Context, runID string, paused bool) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.ensureWritable(ctx, runID)
+	if err == nil {
+		_, err = c.runRef(runID).Update(ctx, []firestore.Update{
+			{Path: "paused", Value: paused},
+		})
+	}
+	c.breaker.record(err)
+	return err
+}
+
+// SetRunArchived marks a finished run as archived, after which every write to it
+// fails with ErrRunArchived. Runs that are still running fail with ErrRunNotFinished.
+func (c *Client) SetRunArchived(ctx context.Context, runID string) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.setRunArchived(ctx, runID)
+	c.breaker.record(err)
+	return err
+}
+
+// setRunArchived is the SetRunArchived implementation, called through the circuit breaker
+func (c *Client) setRunArchived(ctx context.Context, runID string) error {
+	doc := c.runRef(runID)
+	snapshot, err := doc.Get(ctx)
+	if err != nil {
+		return err
+	}
+	var runDoc models.RunDoc
+	if err := snapshot.DataTo(&runDoc); err != nil {
+		return err
+	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return err
+	}
+	if !runDoc.Finished {
+		return ErrRunNotFinished
+	}
+
+	// The precondition fails if the run changed since it was read
+	_, err = doc.Update(ctx, []firestore.Update{
+		{Path: "archived", Value: true},
+	}, firestore.LastUpdateTime(snapshot.UpdateTime))
+	return err
+}
+
+// ensureWritable returns ErrRunArchived when runID is archived. A missing run is
+// writable, the write itself reports it if it needs the run to exist.
+func (c *Client) ensureWritable(ctx context.Context, runID string) error {
+	snapshot, err := c.runRef(runID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return checkWritable(snapshot)
+}
+
+// checkWritable is the ensureWritable check on a run already read, e.g. in a transaction
+func checkWritable(snapshot *firestore.DocumentSnapshot) error {
+	if !snapshot.Exists() {
+		return nil
+	}
+	var runDoc models.RunDoc
+	if err := snapshot.DataTo(&runDoc); err != nil {
+		return err
+	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return err
+	}
+	if runDoc.Archived {
+		return ErrRunArchived
+	}
+	return nil
+}
+
+// SetRunProvider records the CI provider on an existing run
+func (c *Client) SetRunProvider(ctx context.Context, runID string, provider string) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.setRunProvider(ctx, runID, provider)
+	c.breaker.record(err)
+	return err
+}
+
+// setRunProvider is the SetRunProvider implementation, called through the circuit breaker
+func (c *Client) setRunProvider(ctx context.Context, runID string, provider string) error {
+	if err := c.ensureWritable(ctx, runID); err != nil {
+		return err
+	}
+	_, err := c.runRef(runID).Update(ctx, []firestore.Update{
+		{Path: "provider", Value: provider},
+	})
+	return err
+}
+
+// RunStatsInWindow returns the most recently updated runs within [from, to), at most
+// limit of them, with only the fields GET /stats/aggregate uses read: finished,
+// finish_status, peak_heap_used_mb and sample_count. The range is on updated_at_timestamp,
+// which Firestore indexes automatically.
+func (c *Client) RunStatsInWindow(ctx context.Context, from, to time.Time, limit int) ([]models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	runs, err := c.projectRunsInWindow(ctx, from, to, limit, "run_id", "finished", "finish_status", "peak_heap_used_mb", "sample_count")
+	c.breaker.record(err)
+	return runs, err
+}
+
+// RunTagsInWindow returns the runs last updated within [from, to) with only their run ID
+// and tags read, for GET /labels
+func (c *Client) RunTagsInWindow(ctx context.Context, from, to time.Time) ([]models.RunDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	runs, err := c.projectRunsInWindow(ctx, from, to, 0, "run_id", "tags")
+	c.breaker.record(err)
+	return runs, err
+}
+
+// projectRunsInWindow reads the runs last updated within [from, to), newest first, with
+// only fields read. limit caps the runs read, 0 reads them all. Samples are never read.
+func (c *Client) projectRunsInWindow(ctx context.Context, from, to time.Time, limit int, fields ...string) ([]models.RunDoc, error) {
+	query := c.runsQuery().
+		Select(fields...).
+		Where("updated_at_timestamp", ">=", ToMillis(from)).
+		Where("updated_at_timestamp", "<", ToMillis(to)).
+		OrderBy("updated_at_timestamp", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var runs []models.RunDoc
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		runID, ok := c.runIDOf(doc.Ref)
+		if !ok {
+			continue
+		}
+
+		var runDoc models.RunDoc
+		if err := doc.DataTo(&runDoc); err != nil {
+			log.Printf("❌ Error parsing run document %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		runDoc.RunID = runID
+		runs = append(runs, runDoc)
+	}
+	return runs, nil
+}
+
+// GetRunStatuses returns the status of each existing run in runIDs, keyed by run ID.
+// Missing runs are left out of both maps. Runs that could not be read are reported in
+// the second map instead of failing the whole call, so one bad document or failed read
+// does not hide the statuses of the others.
+func (c *Client) GetRunStatuses(ctx context.Context, runIDs []string) (map[string]models.RunStatus, map[string]error, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	statuses, errs, err := c.getRunStatuses(ctx, runIDs)
+	breakerErr := err
+	if breakerErr == nil && len(statuses) == 0 {
+		// Per-run failures only count against the breaker when no run could be read
+		breakerErr = firstError(errs)
+	}
+	c.breaker.record(breakerErr)
+	return statuses, errs, err
+}
+
+// getRunStatuses is the GetRunStatuses implementation, called through the circuit breaker
+func (c *Client) getRunStatuses(ctx context.Context, runIDs []string) (map[string]models.RunStatus, map[string]error, error) {
+	refs := make([]*firestore.DocumentRef, 0, len(runIDs))
+	for _, runID := range runIDs {
+		refs = append(refs, c.runRef(runID))
+	}
+
+	statuses := make(map[string]models.RunStatus, len(refs))
+	errs := make(map[string]error)
+
+	snapshots, err := c.firestore.GetAll(ctx, refs)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		// The batched read fails as a whole, so fall back to reading each run on its own
+		log.Printf("⚠️  Batched status read failed, reading %d runs individually: %v", len(refs), err)
+		snapshots = make([]*firestore.DocumentSnapshot, 0, len(refs))
+		for _, ref := range refs {
+			snapshot, err := ref.Get(ctx)
+			if err != nil && status.Code(err) != codes.NotFound {
+				runID, _ := c.runIDOf(ref)
+				errs[runID] = err
+				continue
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot == nil || !snapshot.Exists() {
+			continue
+		}
+		runID, _ := c.runIDOf(snapshot.Ref)
+		runStatus, err := c.runStatusOf(ctx, snapshot)
+		if err != nil {
+			errs[runID] = err
+			continue
+		}
+		statuses[runID] = runStatus
+	}
+	return statuses, errs, nil
+}
+
+// runStatusOf decodes the status of a single run snapshot
+func (c *Client) runStatusOf(ctx context.Context, snapshot *firestore.DocumentSnapshot) (models.RunStatus, error) {
+	var runDoc models.RunDoc
+	if err := snapshot.DataTo(&runDoc); err != nil {
+		return models.RunStatus{}, err
+	}
+	if err := MigrateRunDoc(&runDoc); err != nil {
+		return models.RunStatus{}, err
+	}
+
+	sampleCount := len(runDoc.Samples)
+	if c.samplesSubcollection {
+		n, err := c.countSamples(ctx, snapshot.Ref)
+		if err != nil {
+			return models.RunStatus{}, err
+		}
+		sampleCount += n
+	}
+
+	return models.RunStatus{
+		Finished:    runDoc.Finished,
+		UpdatedAt:   runDoc.UpdatedAt,
+		SampleCount: sampleCount,
+	}, nil
+}
+
+// firstError returns any one of errs, or nil when it is empty
+func firstError(errs map[string]error) error {
+	for _, err := range errs {
+		return err
+	}
+	return nil
+}
+
+// countSamples counts the documents in a run's samples subcollection without reading them
+func (c *Client) countSamples(ctx context.Context, ref *firestore.DocumentRef) (int, error) {
+	result, err := ref.Collection(samplesCollection).NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := result["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("unexpected count result for run %s", ref.ID)
+	}
+	return int(count.GetIntegerValue()), nil
+}
+
+// ListRuns returns a page of run summaries in the given order, optionally filtered by
+// provider, and the cursor for the next page ("" on the last page). A cursor is only
+// valid with the sort it was returned for.
+func (c *Client) ListRuns(ctx context.Context, provider string, sort RunSort, limit int, cursor string) ([]models.RunSummary, string, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, "", err
+	}
+	summaries, next, err := c.listRuns(ctx, provider, sort, limit, cursor)
+	c.breaker.record(err)
+	return summaries, next, err
+}
+
+// listRuns is the ListRuns implementation, called through the circuit breaker
+func (c *Client) listRuns(ctx context.Context, provider string, sort RunSort, limit int, cursor string) ([]models.RunSummary, string, error) {
+	query := c.runsQuery().Select("run_id", "provider", "start_time", "updated_at", "finished", "updated_at_timestamp", "sample_count", "retain_forever", "peak_heap_used_mb")
+	if provider != "" {
+		query = query.Where("provider", "==", provider)
+	}
+	// The document ID breaks ties between runs with the same sort value. Each field
+	// combined with the provider filter needs its composite index in firestore.indexes.json.
+	query = query.OrderBy(sort.firestoreField(), sort.direction()).OrderBy(firestore.DocumentID, sort.direction())
+	if cursor != "" {
+		key, runID, err := DecodeRunCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.StartAfter(sort.startAfter(key), c.runIDPrefix+runID)
+	}
+	// Read one extra run to know whether another page follows
+	iter := query.Limit(limit + 1).Documents(ctx)
+	defer iter.Stop()
+
+	summaries := []models.RunSummary{}
+	for len(summaries) < limit+1 {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		runID, ok := c.runIDOf(doc.Ref)
+		if !ok {
+			continue
+		}
+
+		var summary models.RunSummary
+		if err := doc.DataTo(&summary); err != nil {
+			log.Printf("❌ Error parsing run summary %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		summary.RunID = runID
+		summaries = append(summaries, summary)
+	}
+
+	summaries, next := PageRuns(summaries, sort, limit)
+	return summaries, next, nil
+}
+
+// PageRuns trims summaries read with one extra entry down to limit and returns the
+// cursor for the next page, or "" when there are no further runs
+func PageRuns(summaries []models.RunSummary, sort RunSort, limit int) ([]models.RunSummary, string) {
+	if len(summaries) <= limit {
+		return summaries, ""
+	}
+	summaries = summaries[:limit]
+	return summaries, EncodeRunCursor(sort, summaries[len(summaries)-1])
+}
+
+// EncodeRunCursor builds the opaque listing cursor positioned after summary in sort order
+func EncodeRunCursor(sort RunSort, summary models.RunSummary) string {
+	raw := strconv.FormatInt(sort.Key(summary), 10) + ":" + summary.RunID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeRunCursor parses a cursor built by EncodeRunCursor into its sort key and run ID
+func DecodeRunCursor(cursor string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	timestampPart, runID, ok := strings.Cut(string(raw), ":")
+	if !ok || runID == "" {
+		return 0, "", fmt.Errorf("%w: malformed", ErrInvalidCursor)
+	}
+	timestamp, err := strconv.ParseInt(timestampPart, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return timestamp, runID, nil
+}
+
+// StoreProcessInfo stores or updates process information (VM flags) for a process in the processes collection
+func (c *Client) StoreProcessInfo(ctx context.Context, runID string, processInfo models.ProcessInfo) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.storeProcessInfo(ctx, runID, processInfo)
+	c.breaker.record(err)
+	return err
+}
+
+// storeProcessInfo is the StoreProcessInfo implementation, called through the circuit breaker
+func (c *Client) storeProcessInfo(ctx context.Context, runID string, processInfo models.ProcessInfo) error {
+	ingestLogf(ctx, "🔄 Storing process info for PID: %s (Name: %s) in run ID: %s", processInfo.PID, processInfo.Name, runID)
+
+	doc := c.processRef(runID)
+
+	// PIDs are only unique per machine, and agents on several machines may write at once
+	reported := processInfo
+	err := c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		processInfo = reported
+		// Get existing document or create new one, reading the run in the same call so an
+		// archive cannot land between the check and the write
+		snapshots, err := tx.GetAll([]*firestore.DocumentRef{c.runRef(runID), doc})
+		if err != nil {
+			return fmt.Errorf("failed to get process document: %w", err)
+		}
+		if err := checkWritable(snapshots[0]); err != nil {
+			return err
+		}
+		snapshot := snapshots[1]
+
+		var processDoc models.ProcessDoc
+		if snapshot != nil && snapshot.Exists() {
+			if err := snapshot.DataTo(&processDoc); err != nil {
+				log.Printf("❌ Error parsing process document data: %v", err)
+				return fmt.Errorf("failed to parse document data: %w", err)
+			}
+			ingestLogf(ctx, "📄 Found existing process document for run ID: %s", runID)
+		} else {
+			now := clock.Now()
+			processDoc = models.ProcessDoc{
+				RunID:              runID,
+				ProcessInfo:        make(map[string]models.ProcessInfo),
+				CreatedAt:          now,
+				UpdatedAt:          now,
+				UpdatedAtTimestamp: ToMillis(now),
+			}
+			ingestLogf(ctx, "📄 Creating new process document for run ID: %s", runID)
+		}
+
+		// Initialize ProcessInfo map if nil
+		if processDoc.ProcessInfo == nil {
+			processDoc.ProcessInfo = make(map[string]models.ProcessInfo)
+		}
+
+		// A recycled PID reporting another name is renamed or split off per PID_NAME_CONFLICT_POLICY
+		key := models.ProcessKey(processInfo.Machine, processInfo.PID)
+		if existing, ok := processDoc.ProcessInfo[key]; ok {
+			var conflict bool
+			if processInfo.PID, conflict = resolvePIDName(processInfo.PID, processInfo.Name, existing.Name, c.pidNamePolicy); conflict {
+				log.Printf("⚠️  PID %s of run ID: %s changed name from %q to %q (%s policy)", key, runID, existing.Name, processInfo.Name, c.pidNamePolicy)
+				key = models.ProcessKey(processInfo.Machine, processInfo.PID)
+			}
+		}
+
+		now := clock.Now()
+		processInfo.LastSeen = now
+
+		// Store or update process info (only if not already exists, or update if exists)
+		if _, exists := processDoc.ProcessInfo[key]; exists {
+			ingestLogf(ctx, "📝 Updating existing process info for PID: %s", key)
+			// Replace with new process info
+			processDoc.ProcessInfo[key] = processInfo
+		} else {
+			ingestLogf(ctx, "➕ Adding new process info for PID: %s", key)
+			processDoc.ProcessInfo[key] = processInfo
+		}
+
+		if evicted := EvictProcesses(processDoc.ProcessInfo, c.maxProcesses); len(evicted) > 0 {
+			log.Printf("⚠️  Run ID: %s exceeds %d processes, evicted the least recently seen: %s", runID, c.maxProcesses, strings.Join(evicted, ", "))
+		}
+
+		processDoc.UpdatedAt = now
+		processDoc.UpdatedAtTimestamp = ToMillis(now)
+
+		// Save back to Firestore
+		if err := tx.Set(doc, processDoc); err != nil {
+			log.Printf("❌ Error saving process info to Firestore: %v", err)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("❌ Error saving document to Firestore: %v", err)
 		return err
 	}
 
-	log.Printf("✅ Successfully stored %d samples for run ID: %s", len(samples), runID)
+	ingestLogf(ctx, "✅ Successfully stored process info for PID: %s in run ID: %s", processInfo.PID, runID)
 	return nil
 }
 
-// StoreProcessInfo stores or updates process information (VM flags) for a process in the processes collection
-func (c *Client) StoreProcessInfo(runID string, processInfo models.ProcessInfo) error {
-	log.Printf("🔄 Storing process info for PID: %s (Name: %s) in run ID: %s", processInfo.PID, processInfo.Name, runID)
-
-	doc := c.firestore.Collection("processes").Doc(runID)
-
-	// Get existing document or create new one
-	snapshot, err := doc.Get(c.ctx)
-	if err != nil && !strings.Contains(err.Error(), "not found") {
-		return fmt.Errorf("failed to get process document: %w", err)
-	}
-
-	var processDoc models.ProcessDoc
-	if snapshot != nil && snapshot.Exists() {
-		if err := snapshot.DataTo(&processDoc); err != nil {
-			log.Printf("❌ Error parsing process document data: %v", err)
-			return fmt.Errorf("failed to parse document data: %w", err)
-		}
-		log.Printf("📄 Found existing process document for run ID: %s", runID)
-	} else {
-		now := time.Now()
-		processDoc = models.ProcessDoc{
-			RunID:              runID,
-			ProcessInfo:        make(map[string]models.ProcessInfo),
-			CreatedAt:          now,
-			UpdatedAt:          now,
-			UpdatedAtTimestamp: ToMillis(now),
-		}
-		log.Printf("📄 Creating new process document for run ID: %s", runID)
+// EvictProcesses removes the least recently seen entries of processInfo until at most max
+// remain, returning the evicted keys oldest first. A max of 0 keeps every entry.
+func EvictProcesses(processInfo map[string]models.ProcessInfo, max int) []string {
+	if max <= 0 || len(processInfo) <= max {
+		return nil
 	}
-
-	// Initialize ProcessInfo map if nil
-	if processDoc.ProcessInfo == nil {
-		processDoc.ProcessInfo = make(map[string]models.ProcessInfo)
+	keys := make([]string, 0, len(processInfo))
+	for key := range processInfo {
+		keys = append(keys, key)
 	}
-
-	// Store or update process info (only if not already exists, or update if exists)
-	if _, exists := processDoc.ProcessInfo[processInfo.PID]; exists {
-		log.Printf("📝 Updating existing process info for PID: %s", processInfo.PID)
-		// Replace with new process info
-		processDoc.ProcessInfo[processInfo.PID] = processInfo
-	} else {
-		log.Printf("➕ Adding new process info for PID: %s", processInfo.PID)
-		processDoc.ProcessInfo[processInfo.PID] = processInfo
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := processInfo[keys[i]].LastSeen, processInfo[keys[j]].LastSeen
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return keys[i] < keys[j]
+	})
+	evicted := keys[:len(keys)-max]
+	for _, key := range evicted {
+		delete(processInfo, key)
 	}
+	return evicted
+}
 
-	now := time.Now()
-	processDoc.UpdatedAt = now
-	processDoc.UpdatedAtTimestamp = ToMillis(now)
-
-	// Save back to Firestore
-	_, err = doc.Set(c.ctx, processDoc)
-	if err != nil {
-		log.Printf("❌ Error saving process info to Firestore: %v", err)
-		return err
+// GetProcesses retrieves process information for a run from the processes collection
+func (c *Client) GetProcesses(ctx context.Context, runID string) (*models.ProcessDoc, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
 	}
-
-	log.Printf("✅ Successfully stored process info for PID: %s in run ID: %s", processInfo.PID, runID)
-	return nil
+	result, err := c.getProcesses(ctx, runID)
+	c.breaker.record(err)
+	return result, err
 }
 
-// GetProcesses retrieves process information for a run from the processes collection
-func (c *Client) GetProcesses(runID string) (*models.ProcessDoc, error) {
-	doc := c.firestore.Collection("processes").Doc(runID)
-	snapshot, err := doc.Get(c.ctx)
+// getProcesses is the GetProcesses implementation, called through the circuit breaker
+func (c *Client) getProcesses(ctx context.Context, runID string) (*models.ProcessDoc, error) {
+	doc := c.processRef(runID)
+	snapshot, err := doc.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -194,52 +1464,111 @@ func (c *Client) GetProcesses(runID string) (*models.ProcessDoc, error) {
 	return &processDoc, nil
 }
 
-// MarkRunAsFinished marks a run as finished
-func (c *Client) MarkRunAsFinished(runID string) error {
-	doc := c.firestore.Collection("runs").Doc(runID)
-	snapshot, err := doc.Get(c.ctx)
-	if err != nil {
+// MarkRunAsFinished marks a run as finished. When FINISH_WEBHOOK_URL is set a
+// FinishNotification is sent in the background, with the status from WithFinishStatus.
+func (c *Client) MarkRunAsFinished(ctx context.Context, runID string) error {
+	if err := c.breaker.allow(); err != nil {
 		return err
 	}
+	err := c.markRunAsFinished(ctx, runID)
+	c.breaker.record(err)
+	return err
+}
 
-	if !snapshot.Exists() {
-		return fmt.Errorf("run %s not found", runID)
-	}
-
+// markRunAsFinished is the MarkRunAsFinished implementation, called through the circuit breaker
+func (c *Client) markRunAsFinished(ctx context.Context, runID string) error {
+	doc := c.runRef(runID)
 	var runDoc models.RunDoc
-	if err := snapshot.DataTo(&runDoc); err != nil {
+	alreadyFinished := false
+	// In a transaction, so samples ingested concurrently are neither overwritten by the
+	// finish nor stored after it without the finish race policy seeing them
+	err := c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			return err
+		}
+
+		if !snapshot.Exists() {
+			return fmt.Errorf("run %s not found", runID)
+		}
+
+		runDoc = models.RunDoc{}
+		if err := snapshot.DataTo(&runDoc); err != nil {
+			return err
+		}
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			return err
+		}
+
+		// If already finished, nothing to do
+		if alreadyFinished = runDoc.Finished; alreadyFinished {
+			return nil
+		}
+
+		// Mark as finished
+		now := clock.Now()
+		runDoc.Finished = true
+		runDoc.FinishedAt = now
+		runDoc.UpdatedAt = now
+		runDoc.UpdatedAtTimestamp = ToMillis(now) // Store Unix millis for timezone-independent queries
+		// Set expire_at to 3 hours from finish time for Firestore TTL, unless the run is retained
+		if !runDoc.RetainForever {
+			runDoc.ExpireAt = now.Add(3 * time.Hour)
+		}
+		runDoc.FinishStatus = finishStatus(ctx)
+		runDoc.Namespace = c.runIDPrefix
+		runDoc.SchemaVersion = CurrentSchemaVersion
+		if err := packSamples(&runDoc, c.compressThreshold); err != nil {
+			return err
+		}
+
+		// Update in Firestore
+		return tx.Set(doc, runDoc)
+	})
+	if err != nil {
 		return err
 	}
-
-	// If already finished, nothing to do
-	if runDoc.Finished {
+	if alreadyFinished {
 		log.Printf("Run %s is already finished", runID)
 		return nil
 	}
+	observeRunDuration(RunDurationSeconds, &runDoc)
 
-	// Mark as finished
-	now := time.Now()
-	runDoc.Finished = true
-	runDoc.FinishedAt = now
-	runDoc.UpdatedAt = now
-	runDoc.UpdatedAtTimestamp = ToMillis(now) // Store Unix millis for timezone-independent queries
-	// Set expire_at to 3 hours from finish time for Firestore TTL
-	runDoc.ExpireAt = now.Add(3 * time.Hour)
-
-	// Update in Firestore
-	_, err = doc.Set(c.ctx, runDoc)
-	if err != nil {
-		return err
+	if c.finishWebhook != nil {
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			log.Printf("Warning: Failed to read samples of run %s for the finish webhook: %v", runID, err)
+		}
+		if c.samplesSubcollection {
+			samples, err := readSamples(doc.Collection(samplesCollection).Documents(ctx))
+			if err != nil {
+				log.Printf("Warning: Failed to read samples of run %s for the finish webhook: %v", runID, err)
+			}
+			runDoc.Samples = append(runDoc.Samples, samples...)
+		}
+		c.finishWebhook.notify(NewFinishNotification(&runDoc, finishStatus(ctx)))
 	}
 
 	return nil
 }
 
-// FindStaleRuns finds runs that haven't been updated within the timeout period
-func (c *Client) FindStaleRuns(timeout time.Duration) ([]string, error) {
-	iter := c.firestore.Collection("runs").Documents(c.ctx)
+// FindStaleRuns finds runs that haven't been updated within the timeout period.
+// The returned documents have RunID set to the Firestore document ID, without RUN_ID_PREFIX.
+// Filtering happens server-side on finished == false and updated_at_timestamp < cutoff,
+// which requires the composite index in firestore.indexes.json. Legacy runs without a
+// finished field are matched once BackfillLegacyRuns has run at startup.
+func (c *Client) FindStaleRuns(timeout time.Duration) ([]models.RunDoc, error) {
+	query := c.runsQuery()
+	cutoff := cutoffBefore(timeout)
+
+	query = query.
+		Where("finished", "==", false).
+		Where("updated_at_timestamp", "<", ToMillis(cutoff))
+	if c.staleScanLimit > 0 {
+		query = query.Limit(c.staleScanLimit)
+	}
+	iter := query.Documents(c.ctx)
 
-	var staleRuns []string
+	var staleRuns []models.RunDoc
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
@@ -249,47 +1578,170 @@ func (c *Client) FindStaleRuns(timeout time.Duration) ([]string, error) {
 			return nil, err
 		}
 
+		runID, ok := c.runIDOf(doc.Ref)
+		if !ok {
+			continue
+		}
+
 		var runDoc models.RunDoc
 		if err := doc.DataTo(&runDoc); err != nil {
 			log.Printf("❌ Error parsing run document %s: %v", doc.Ref.ID, err)
 			continue
 		}
-
-		// Skip if already finished
-		if runDoc.Finished {
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			log.Printf("❌ Error migrating run document %s: %v", doc.Ref.ID, err)
 			continue
 		}
 
-		// Check if this run is stale
-		timeSinceLastUpdate := time.Since(runDoc.UpdatedAt)
-		if timeSinceLastUpdate > timeout {
-			staleRuns = append(staleRuns, doc.Ref.ID)
+		// Re-check client-side in case a run was updated after the query snapshot
+		if IsStaleRun(&runDoc, cutoff) {
+			runDoc.RunID = runID
+			staleRuns = append(staleRuns, runDoc)
 		}
 	}
 
 	return staleRuns, nil
 }
 
+// MarkRunSuspectedStale flags a run as suspected stale without touching updated_at,
+// so it keeps matching the stale query until it either ingests again or is finished
+func (c *Client) MarkRunSuspectedStale(ctx context.Context, runID string) error {
+	_, err := c.runRef(runID).Update(ctx, []firestore.Update{
+		{Path: "suspected_stale_at", Value: clock.Now()},
+	})
+	return err
+}
+
+// IsStaleRun reports whether an unfinished run was last updated before cutoff
+func IsStaleRun(runDoc *models.RunDoc, cutoff time.Time) bool {
+	return !runDoc.Finished && runDoc.UpdatedAt.Before(cutoff)
+}
+
+// IsEmptyRun reports whether a run has no samples stored, inline, packed or in the
+// samples subcollection
+func IsEmptyRun(runDoc *models.RunDoc) bool {
+	return runDoc.SampleCount == 0 && len(runDoc.Samples) == 0 && len(runDoc.SamplesGzip) == 0
+}
+
+// cutoffBefore returns the time age ago, the boundary of the stale and retention queries
+func cutoffBefore(age time.Duration) time.Time {
+	return clock.Now().Add(-age)
+}
+
+// runExpired reports whether DeleteOldRuns should delete runDoc: its RetentionStart is
+// before cutoff and it is not RetainedForever.
+func runExpired(runDoc *models.RunDoc, cutoff time.Time, retainBackfill bool) bool {
+	return !RetainedForever(runDoc, retainBackfill) && RetentionStart(runDoc).Before(cutoff)
+}
+
+// RetainedForever reports whether DeleteOldRuns never deletes runDoc: it is flagged
+// retain_forever, or is a backfilled run with retainBackfill (BACKFILL_SKIP_RETENTION)
+func RetainedForever(runDoc *models.RunDoc, retainBackfill bool) bool {
+	return runDoc.RetainForever || (runDoc.Backfill && retainBackfill)
+}
+
+// RetentionStart returns when the retention period of runDoc starts: when it finished, or
+// was created when it never finished, unless it was imported later
+func RetentionStart(runDoc *models.RunDoc) time.Time {
+	compareTime := runDoc.FinishedAt
+	if compareTime.IsZero() {
+		compareTime = runDoc.CreatedAt
+	}
+	// Runs restored from an archive are kept for the retention period after the import
+	if runDoc.ImportedAt.After(compareTime) {
+		compareTime = runDoc.ImportedAt
+	}
+	return compareTime
+}
+
+// SetRunRetainForever flags or unflags a run as exempt from retention. Flagging also
+// clears the run's TTL; unflagged runs are left to DeleteOldRuns. Archived runs can be
+// flagged too, the flag does not change their samples.
+func (c *Client) SetRunRetainForever(ctx context.Context, runID string, retain bool) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	updates := []firestore.Update{{Path: "retain_forever", Value: retain}}
+	if retain {
+		updates = append(updates, firestore.Update{Path: "expire_at", Value: firestore.Delete})
+	}
+	_, err := c.runRef(runID).Update(ctx, updates)
+	c.breaker.record(err)
+	return err
+}
+
+// DeleteStaleRun deletes a run the stale sweep found stale and empty at timeout. The run is
+// re-read in a transaction and only deleted when it is still unfinished, stale and without
+// samples, so an ingest or a retain_forever flag landing after the sweep's query keeps it;
+// such a run fails with ErrRunChanged.
+func (c *Client) DeleteStaleRun(ctx context.Context, runID string, timeout time.Duration) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.deleteStaleRun(ctx, runID, timeout)
+	c.breaker.record(err)
+	return err
+}
+
+// deleteStaleRun is the DeleteStaleRun implementation, called through the circuit breaker
+func (c *Client) deleteStaleRun(ctx context.Context, runID string, timeout time.Duration) error {
+	doc := c.runRef(runID)
+	return c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			return err
+		}
+		var runDoc models.RunDoc
+		if err := snapshot.DataTo(&runDoc); err != nil {
+			return err
+		}
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			return err
+		}
+		if !IsStaleRun(&runDoc, cutoffBefore(timeout)) || !IsEmptyRun(&runDoc) || runDoc.RetainForever {
+			return ErrRunChanged
+		}
+		// Subcollection runs written before sample counts were kept may count 0 with samples
+		if c.samplesSubcollection {
+			samples, err := tx.Documents(doc.Collection(samplesCollection).Limit(1)).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(samples) > 0 {
+				return ErrRunChanged
+			}
+		}
+		return tx.Delete(doc)
+	})
+}
+
 // DeleteOldRuns deletes runs older than the retention period
 // Uses finished_at if available, otherwise uses created_at + retention period
+// When ARCHIVE_BUCKET is set each run is exported there first and runs that fail to export
+// are kept. Runs removed by the Firestore TTL policy on expire_at are not exported.
+// Runs flagged retain_forever are skipped regardless of age.
 func (c *Client) DeleteOldRuns(retentionPeriod time.Duration) ([]string, error) {
-	cutoffTime := time.Now().Add(-retentionPeriod)
+	cutoffTime := cutoffBefore(retentionPeriod)
 	cutoffTimestamp := ToMillis(cutoffTime)
 
 	log.Printf("🗑️ Deleting data older than: %v (timestamp: %d)", cutoffTime, cutoffTimestamp)
 
 	// Get all runs - we need to check each one individually because we need to check
 	// finished_at if available, otherwise created_at
-	iter := c.firestore.Collection("runs").Documents(c.ctx)
+	iter := c.runsQuery().Documents(c.ctx)
 
-	var deletedRuns []string
+	var expired []*firestore.DocumentRef
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return deletedRuns, err
+			return nil, err
+		}
+
+		if _, ok := c.runIDOf(doc.Ref); !ok {
+			continue
 		}
 
 		var runDoc models.RunDoc
@@ -297,159 +1749,466 @@ func (c *Client) DeleteOldRuns(retentionPeriod time.Duration) ([]string, error)
 			log.Printf("❌ Error parsing run document %s: %v", doc.Ref.ID, err)
 			continue
 		}
-
-		// Determine the timestamp to use for comparison
-		var compareTime time.Time
-		if !runDoc.FinishedAt.IsZero() {
-			// Use finished_at if the run is finished
-			compareTime = runDoc.FinishedAt
-		} else {
-			// Use created_at if the run never finished
-			compareTime = runDoc.CreatedAt
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			log.Printf("❌ Error migrating run document %s: %v", doc.Ref.ID, err)
+			continue
 		}
 
 		// Check if this run should be deleted (older than retention period)
-		if compareTime.Before(cutoffTime) {
-			// Delete the document
-			_, err = doc.Ref.Delete(c.ctx)
-			if err != nil {
-				log.Printf("❌ Error deleting old run %s: %v", doc.Ref.ID, err)
-				continue
-			}
+		if runExpired(&runDoc, cutoffTime, c.retainBackfill) {
+			expired = append(expired, doc.Ref)
+			log.Printf("🗑️ Deleting old run: %s (created: %v, finished: %v)", doc.Ref.ID, runDoc.CreatedAt, runDoc.FinishedAt)
+		}
+	}
+
+	refs := make(map[string]*firestore.DocumentRef, len(expired))
+	runIDs := make([]string, 0, len(expired))
+	for _, ref := range expired {
+		runID, _ := c.runIDOf(ref)
+		refs[runID] = ref
+		runIDs = append(runIDs, runID)
+	}
+	return exportThenDelete(runIDs, c.archiveBucket, c.ExportRunToGCS, func(runIDs []string) ([]string, error) {
+		toDelete := make([]*firestore.DocumentRef, 0, len(runIDs))
+		for _, runID := range runIDs {
+			toDelete = append(toDelete, refs[runID])
+		}
+		return c.deleteRuns(c.ctx, toDelete)
+	})
+}
+
+// DeleteFinishedRuns deletes finished runs whose finished_at is older than olderThan,
+// regardless of retention but sparing runs flagged retain_forever, and returns the deleted
+// run IDs. The query requires the
+// (finished, finished_at) composite index in firestore.indexes.json.
+func (c *Client) DeleteFinishedRuns(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	cutoff := cutoffBefore(olderThan)
+	iter := c.runsQuery().
+		Where("finished", "==", true).
+		Where("finished_at", "<", cutoff).
+		Documents(ctx)
+
+	var refs []*firestore.DocumentRef
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := c.runIDOf(doc.Ref); !ok {
+			continue
+		}
 
-			deletedRuns = append(deletedRuns, doc.Ref.ID)
-			log.Printf("🗑️ Deleted old run: %s (created: %v, finished: %v)", doc.Ref.ID, runDoc.CreatedAt, runDoc.FinishedAt)
+		var runDoc models.RunDoc
+		if err := doc.DataTo(&runDoc); err != nil {
+			log.Printf("❌ Error parsing run document %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if err := MigrateRunDoc(&runDoc); err != nil {
+			log.Printf("❌ Error migrating run document %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if IsPurgeableFinishedRun(&runDoc, cutoff) {
+			refs = append(refs, doc.Ref)
 		}
 	}
 
+	log.Printf("🗑️ Purging %d finished runs older than %v", len(refs), olderThan)
+	return c.deleteRuns(ctx, refs)
+}
+
+// IsPurgeableFinishedRun reports whether a run finished before cutoff. Runs flagged
+// retain_forever are never purged.
+func IsPurgeableFinishedRun(runDoc *models.RunDoc, cutoff time.Time) bool {
+	return runDoc.Finished && !runDoc.RetainForever && !runDoc.FinishedAt.IsZero() && runDoc.FinishedAt.Before(cutoff)
+}
+
+// deleteRuns deletes run documents in batches and returns the IDs that were deleted.
+// Samples subcollections are removed first, since Firestore keeps them after their parent is deleted.
+func (c *Client) deleteRuns(ctx context.Context, refs []*firestore.DocumentRef) ([]string, error) {
+	var deletedRuns []string
+	for start := 0; start < len(refs); start += maxBatchWrites {
+		end := start + maxBatchWrites
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		batch := c.firestore.Batch()
+		var batchIDs []string
+		for _, ref := range refs[start:end] {
+			if c.samplesSubcollection {
+				if err := c.deleteSamples(ctx, ref); err != nil {
+					log.Printf("❌ Error deleting samples of run %s: %v", ref.ID, err)
+					continue
+				}
+			}
+			batch.Delete(ref)
+			runID, _ := c.runIDOf(ref)
+			batchIDs = append(batchIDs, runID)
+		}
+		if len(batchIDs) == 0 {
+			continue
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return deletedRuns, err
+		}
+		deletedRuns = append(deletedRuns, batchIDs...)
+	}
 	return deletedRuns, nil
 }
 
-// ParseData parses the monitoring data string into samples
+// AppendIngestEvent appends event to history, dropping the oldest entries so at most max remain
+func AppendIngestEvent(history []models.IngestEvent, event models.IngestEvent, max int) []models.IngestEvent {
+	history = append(history, event)
+	if len(history) > max {
+		history = append([]models.IngestEvent(nil), history[len(history)-max:]...)
+	}
+	return history
+}
+
+// ParseDataChunk parses one chunk of a streamed payload. Text after the last newline may
+// be a line cut off mid-way, so it is returned unparsed as remainder for the caller to
+// prepend to the next chunk. A chunk without any newline is returned whole as remainder.
+func ParseDataChunk(data string, startTime time.Time) ([]models.Sample, string, error) {
+	end := strings.LastIndex(data, "\n")
+	if end < 0 {
+		return nil, data, nil
+	}
+	samples, err := ParseData(data[:end+1], startTime)
+	if err != nil {
+		return nil, "", err
+	}
+	return samples, data[end+1:], nil
+}
+
+// FieldRange bounds how many pipe-separated fields a data line may have, not counting a
+// trailing extras segment. The parser understands 5 (no RSS), 6 and 7 (with GC time).
+type FieldRange struct {
+	Min int
+	Max int
+}
+
+// DefaultFieldRange accepts every line layout the parser understands
+var DefaultFieldRange = FieldRange{Min: 5, Max: 7}
+
+// Valid reports whether the range is non-empty and within DefaultFieldRange
+func (r FieldRange) Valid() bool {
+	return DefaultFieldRange.Min <= r.Min && r.Min <= r.Max && r.Max <= DefaultFieldRange.Max
+}
+
+// DefaultCommentPrefix starts data lines that are skipped without being reported as
+// malformed, change it with INGEST_COMMENT_PREFIX
+const DefaultCommentPrefix = "#"
+
+// ParseConfig configures how text ingest payloads are parsed
+type ParseConfig struct {
+	Fields        FieldRange // Accepted field counts when the layout is detected by field count
+	CommentPrefix string     // Lines starting with it are skipped, DefaultCommentPrefix when empty
+}
+
+// DefaultParseConfig accepts every line layout and skips "#" comments
+var DefaultParseConfig = ParseConfig{Fields: DefaultFieldRange, CommentPrefix: DefaultCommentPrefix}
+
+// isComment reports whether a trimmed data line is a comment
+func (c ParseConfig) isComment(line string) bool {
+	prefix := c.CommentPrefix
+	if prefix == "" {
+		prefix = DefaultCommentPrefix
+	}
+	return strings.HasPrefix(line, prefix)
+}
+
+// ErrImplausibleSample is returned for a sample whose heap or RSS exceeds the ingest ceiling
+var ErrImplausibleSample = errors.New("implausible sample value")
+
+// checkSampleCeiling returns ErrImplausibleSample when the sample's HeapUsed, HeapCap or RSS
+// exceeds ceilingMB, 0 disables the check
+func checkSampleCeiling(sample models.Sample, ceilingMB int) error {
+	if ceilingMB <= 0 {
+		return nil
+	}
+	for _, value := range []struct {
+		name string
+		mb   int
+	}{{"heap used", sample.HeapUsed}, {"heap capacity", sample.HeapCap}, {"RSS", sample.RSS}} {
+		if value.mb > ceilingMB {
+			return fmt.Errorf("%w: %s %dMB exceeds %dMB", ErrImplausibleSample, value.name, value.mb, ceilingMB)
+		}
+	}
+	return nil
+}
+
+// DropImplausibleSamples removes the samples whose HeapUsed, HeapCap or RSS exceeds
+// ceilingMB, counting them in ImplausibleSamples. Agents that overflowed a counter have
+// reported heaps in the millions of MB. It applies to samples of any ingest format; 0
+// keeps every sample.
+func DropImplausibleSamples(samples []models.Sample, ceilingMB int) []models.Sample {
+	if ceilingMB <= 0 {
+		return samples
+	}
+	kept := samples[:0:0]
+	for _, sample := range samples {
+		if checkSampleCeiling(sample, ceilingMB) == nil {
+			kept = append(kept, sample)
+		}
+	}
+	if implausible := len(samples) - len(kept); implausible > 0 {
+		ImplausibleSamples.Add(float64(implausible))
+		log.Printf("⚠️  Skipped %d implausible samples above %dMB", implausible, ceilingMB)
+	}
+	return kept
+}
+
+// ParseData parses the monitoring data string into samples.
+// Blank lines and lines starting with the comment prefix ("#" by default) are skipped.
+// Payloads are expected to hold complete lines: a partial final line is skipped like any
+// malformed line rather than carried over, streamed input should use ParseDataChunk.
 func ParseData(data string, startTime time.Time) ([]models.Sample, error) {
+	return ParseDataFields(data, startTime, DefaultParseConfig)
+}
+
+// ParseDataFields parses like ParseData, skipping comments with config's prefix and lines
+// whose field count is outside config's range
+func ParseDataFields(data string, startTime time.Time, config ParseConfig) ([]models.Sample, error) {
 	var samples []models.Sample
 	lines := strings.Split(strings.TrimSpace(data), "\n")
 
-	log.Printf("=== PARSING DATA ===")
-	log.Printf("Raw data: %q", data)
-	log.Printf("Split into %d lines", len(lines))
-
 	for i, line := range lines {
 		line = strings.TrimSpace(line)
-		log.Printf("Processing line %d: %q", i, line)
 		if line == "" {
-			log.Printf("Skipping empty line %d", i)
 			continue
 		}
-
-		parts := strings.Split(line, "|")
-		log.Printf("Split into %d parts: %v", len(parts), parts)
-		if len(parts) != 6 && len(parts) != 7 {
-			log.Printf("Skipping line %d: expected 6 or 7 parts, got %d", i, len(parts))
+		if config.isComment(line) {
 			continue
 		}
 
-		// Trim whitespace from all parts
-		for i := range parts {
-			parts[i] = strings.TrimSpace(parts[i])
+		sample, err := parseDataLine(line, startTime, config.Fields)
+		if err != nil {
+			log.Printf("Skipping line %d: %v", i, err)
+			continue
 		}
 
-		// Parse elapsed time from "HH:MM:SS" format
-		log.Printf("Parsing time: %q", parts[0])
-		timeParts := strings.Split(parts[0], ":")
-		if len(timeParts) != 3 {
-			log.Printf("Skipping: invalid time format, got %d parts", len(timeParts))
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// ValidateData parses data like ParseData but reports every skipped non-empty line
+// instead of dropping it silently, including samples DropImplausibleSamples would drop
+func ValidateData(data string, startTime time.Time, config ParseConfig, ceilingMB int) ([]models.Sample, []models.LineError) {
+	var samples []models.Sample
+	var lineErrors []models.LineError
+	for i, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || config.isComment(line) {
 			continue
 		}
-		hours, err1 := strconv.Atoi(timeParts[0])
-		minutes, err2 := strconv.Atoi(timeParts[1])
-		seconds, err3 := strconv.Atoi(timeParts[2])
-		if err1 != nil || err2 != nil || err3 != nil {
-			log.Printf("Skipping: time parsing failed: %v, %v, %v", err1, err2, err3)
-			continue
+		sample, err := parseDataLine(line, startTime, config.Fields)
+		if err == nil {
+			err = checkSampleCeiling(sample, ceilingMB)
 		}
-		elapsedTime := hours*3600 + minutes*60 + seconds
-		log.Printf("Parsed elapsed time: %d seconds", elapsedTime)
-
-		// Parse heap used (remove "MB" suffix and convert float to int)
-		heapUsedStr := strings.TrimSuffix(strings.TrimSuffix(parts[3], "MB"), "MB")
-		heapUsedFloat, err := strconv.ParseFloat(heapUsedStr, 64)
 		if err != nil {
-			log.Printf("Skipping: heap used parsing failed: %v", err)
+			lineErrors = append(lineErrors, models.LineError{Line: i + 1, Error: err.Error()})
 			continue
 		}
-		heapUsed := int(heapUsedFloat)
+		samples = append(samples, sample)
+	}
+	return samples, lineErrors
+}
 
-		// Parse heap capacity (remove "MB" suffix and convert float to int)
-		heapCapStr := strings.TrimSuffix(strings.TrimSuffix(parts[4], "MB"), "MB")
-		heapCapFloat, err := strconv.ParseFloat(heapCapStr, 64)
-		if err != nil {
-			log.Printf("Skipping: heap capacity parsing failed: %v", err)
-			continue
-		}
-		heapCap := int(heapCapFloat)
+// parseDataLine parses a single non-empty "HH:MM:SS|pid|name|heapUsed|heapCap[|rss[|gcTime]][|extras]" line
+func parseDataLine(line string, startTime time.Time, fields FieldRange) (models.Sample, error) {
+	parts := strings.Split(line, "|")
+
+	// Extended lines carry custom metrics as a trailing "key=value;key=value" part,
+	// which may also hold the build phase as "phase=compiling"
+	var extra map[string]float64
+	var phase string
+	if len(parts) > 5 && strings.Contains(parts[len(parts)-1], "=") {
+		var metrics string
+		phase, metrics = SplitPhase(parts[len(parts)-1])
+		extra = ParseExtraMetrics(metrics)
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < fields.Min || len(parts) > fields.Max {
+		return models.Sample{}, fmt.Errorf("expected %d to %d parts, got %d", fields.Min, fields.Max, len(parts))
+	}
+
+	// Trim whitespace from all parts
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	// Parse elapsed time from "HH:MM:SS" format
+	timeParts := strings.Split(parts[0], ":")
+	if len(timeParts) != 3 {
+		return models.Sample{}, fmt.Errorf("invalid time format %q", parts[0])
+	}
+	hours, err1 := strconv.Atoi(timeParts[0])
+	minutes, err2 := strconv.Atoi(timeParts[1])
+	seconds, err3 := strconv.Atoi(timeParts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return models.Sample{}, fmt.Errorf("invalid time %q", parts[0])
+	}
+	elapsedTime := hours*3600 + minutes*60 + seconds
+
+	// Parse heap used (remove "MB" suffix and convert float to int)
+	heapUsedStr := strings.TrimSuffix(strings.TrimSuffix(parts[3], "MB"), "MB")
+	heapUsedFloat, err := strconv.ParseFloat(heapUsedStr, 64)
+	if err != nil {
+		return models.Sample{}, fmt.Errorf("heap used parsing failed: %v", err)
+	}
+	heapUsed := int(heapUsedFloat)
 
-		// Parse RSS (remove "MB" suffix and convert float to int)
+	// Parse heap capacity (remove "MB" suffix and convert float to int)
+	heapCapStr := strings.TrimSuffix(strings.TrimSuffix(parts[4], "MB"), "MB")
+	heapCapFloat, err := strconv.ParseFloat(heapCapStr, 64)
+	if err != nil {
+		return models.Sample{}, fmt.Errorf("heap capacity parsing failed: %v", err)
+	}
+	heapCap := int(heapCapFloat)
+
+	// Parse RSS (remove "MB" suffix and convert float to int)
+	// Lightweight agents send 5 parts and omit RSS entirely
+	var rss int
+	rssMissing := len(parts) == 5
+	if !rssMissing {
 		rssStr := strings.TrimSuffix(strings.TrimSuffix(parts[5], "MB"), "MB")
 		rssFloat, err := strconv.ParseFloat(rssStr, 64)
 		if err != nil {
-			log.Printf("Skipping: RSS parsing failed: %v", err)
-			continue
+			return models.Sample{}, fmt.Errorf("RSS parsing failed: %v", err)
 		}
-		rss := int(rssFloat)
-
-		// Parse GC time if present (7th part)
-		// Format can be either "0.234s" (seconds) or legacy "234ms" (milliseconds)
-		var gcTime int
-		if len(parts) == 7 {
-			gcTimeStr := parts[6]
-			isSeconds := strings.HasSuffix(gcTimeStr, "s")
-			isMilliseconds := strings.HasSuffix(gcTimeStr, "ms")
-
-			// Remove suffix (either "s" or "ms")
-			if isSeconds {
-				gcTimeStr = strings.TrimSuffix(gcTimeStr, "s")
-			} else if isMilliseconds {
-				gcTimeStr = strings.TrimSuffix(gcTimeStr, "ms")
-			}
+		rss = int(rssFloat)
+	}
 
-			if gcTimeStr != "N/A" && gcTimeStr != "" {
-				gcTimeFloat, err := strconv.ParseFloat(gcTimeStr, 64)
-				if err != nil {
-					log.Printf("Warning: GC time parsing failed: %v, using 0", err)
-					gcTime = 0
+	// Parse GC time if present (7th part), lines without it did not report GC at all
+	// Format can be either "0.234s" (seconds) or legacy "234ms" (milliseconds)
+	var gcTime int
+	gcTimeMissing := len(parts) < 7
+	if !gcTimeMissing {
+		gcTimeStr := parts[6]
+		isSeconds := strings.HasSuffix(gcTimeStr, "s")
+		isMilliseconds := strings.HasSuffix(gcTimeStr, "ms")
+
+		// Remove suffix (either "s" or "ms")
+		if isSeconds {
+			gcTimeStr = strings.TrimSuffix(gcTimeStr, "s")
+		} else if isMilliseconds {
+			gcTimeStr = strings.TrimSuffix(gcTimeStr, "ms")
+		}
+
+		// "N/A" or an empty field means GC data was unavailable, not that no GC happened
+		gcTimeMissing = gcTimeStr == "N/A" || gcTimeStr == ""
+		if !gcTimeMissing {
+			gcTimeFloat, err := strconv.ParseFloat(gcTimeStr, 64)
+			if err != nil {
+				log.Printf("Warning: GC time parsing failed: %v, using 0", err)
+				gcTime = 0
+			} else {
+				// If original format had "s" suffix, convert seconds to milliseconds
+				// If original format had "ms" suffix, it's already in milliseconds
+				if isSeconds {
+					gcTime = int(gcTimeFloat * 1000) // Convert seconds to milliseconds
 				} else {
-					// If original format had "s" suffix, convert seconds to milliseconds
-					// If original format had "ms" suffix, it's already in milliseconds
-					if isSeconds {
-						gcTime = int(gcTimeFloat * 1000) // Convert seconds to milliseconds
-					} else {
-						gcTime = int(gcTimeFloat) // Already in milliseconds
-					}
+					gcTime = int(gcTimeFloat) // Already in milliseconds
 				}
 			}
 		}
+	}
+
+	// Calculate consistent timestamp using startTime + elapsedTime
+	// This ensures all samples in the same monitoring cycle have the same timestamp
+	timestamp := startTime.Add(time.Duration(elapsedTime) * time.Second)
+
+	sample := models.Sample{
+		Timestamp:     ToMillis(timestamp),
+		ElapsedTime:   elapsedTime,
+		PID:           parts[1],
+		Name:          parts[2],
+		HeapUsed:      heapUsed,
+		HeapCap:       heapCap,
+		RSS:           rss,
+		RSSMissing:    rssMissing,
+		GCTime:        gcTime,
+		GCTimeMissing: gcTimeMissing,
+		Extra:         extra,
+		Phase:         phase,
+	}
 
-		// Calculate consistent timestamp using startTime + elapsedTime
-		// This ensures all samples in the same monitoring cycle have the same timestamp
-		timestamp := startTime.Add(time.Duration(elapsedTime) * time.Second)
+	return sample, nil
+}
 
-		sample := models.Sample{
-			Timestamp:   ToMillis(timestamp),
-			ElapsedTime: elapsedTime,
-			PID:         parts[1],
-			Name:        parts[2],
-			HeapUsed:    heapUsed,
-			HeapCap:     heapCap,
-			RSS:         rss,
-			GCTime:      gcTime,
+// ApplyStartOffsets shifts the timestamps of each PID's samples by its start offset in
+// seconds, for runs where several agents report elapsed times from different origins.
+// The shifted samples are a copy, so a retried transaction does not shift them twice.
+func ApplyStartOffsets(samples []models.Sample, offsets map[string]int) []models.Sample {
+	if len(offsets) == 0 {
+		return samples
+	}
+	samples = append([]models.Sample(nil), samples...)
+	for i := range samples {
+		if offset := offsets[models.ProcessKey(samples[i].Machine, samples[i].PID)]; offset != 0 {
+			samples[i].Timestamp += int64(offset) * 1000
 		}
+	}
+	return samples
+}
 
-		log.Printf("Created sample: %+v", sample)
-		samples = append(samples, sample)
+// StartOffsets collects the non-zero start offsets of a run's processes by process key
+func StartOffsets(processInfo map[string]models.ProcessInfo) map[string]int {
+	offsets := make(map[string]int)
+	for pid, info := range processInfo {
+		if info.StartOffsetSeconds != 0 {
+			offsets[pid] = info.StartOffsetSeconds
+		}
+	}
+	return offsets
+}
+
+// SplitPhase removes the "phase=<label>" pair from a "key=value;key=value" segment,
+// returning the phase label and the remaining pairs
+func SplitPhase(segment string) (string, string) {
+	var phase string
+	var rest []string
+	for _, pair := range strings.Split(segment, ";") {
+		if key, value, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(key) == "phase" {
+			phase = strings.TrimSpace(value)
+			continue
+		}
+		rest = append(rest, pair)
 	}
+	return phase, strings.Join(rest, ";")
+}
 
-	return samples, nil
+// ParseExtraMetrics parses a "key=value;key=value" segment into custom metrics,
+// skipping pairs that are malformed or have non-numeric values
+func ParseExtraMetrics(segment string) map[string]float64 {
+	extra := make(map[string]float64)
+	for _, pair := range strings.Split(segment, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			log.Printf("Warning: skipping malformed extra metric %q", pair)
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			log.Printf("Warning: skipping extra metric %q: %v", key, err)
+			continue
+		}
+		extra[key] = number
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	return extra
 }
 
 // ToMillis converts a time.Time to Unix milliseconds
@@ -0,0 +1,1682 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseData_FivePartLineMarksRSSMissing(t *testing.T) {
+	startTime := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	data := "00:00:05 | 12345 | GradleDaemon | 100MB | 200MB"
+
+	samples, err := ParseData(data, startTime)
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("Expected 1 sample, got %d", len(samples))
+	}
+
+	sample := samples[0]
+	if !sample.RSSMissing {
+		t.Error("Expected RSSMissing to be true for a 5-part line")
+	}
+	if sample.RSS != 0 {
+		t.Errorf("Expected RSS 0 when missing, got %d", sample.RSS)
+	}
+	if sample.HeapUsed != 100 || sample.HeapCap != 200 {
+		t.Errorf("Unexpected heap values: used=%d cap=%d", sample.HeapUsed, sample.HeapCap)
+	}
+	if sample.Timestamp != ToMillis(startTime.Add(5*time.Second)) {
+		t.Errorf("Unexpected timestamp: %d", sample.Timestamp)
+	}
+}
+
+func TestParseData_SixAndSevenPartLines(t *testing.T) {
+	startTime := time.Now()
+	data := "00:00:01 | 12345 | GradleDaemon | 100MB | 200MB | 300MB\n" +
+		"00:00:02 | 12345 | GradleDaemon | 110MB | 200MB | 310MB | 0.250s"
+
+	samples, err := ParseData(data, startTime)
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(samples))
+	}
+
+	for _, sample := range samples {
+		if sample.RSSMissing {
+			t.Errorf("RSSMissing should be false when RSS is reported: %+v", sample)
+		}
+	}
+	if samples[0].RSS != 300 || samples[1].RSS != 310 {
+		t.Errorf("Unexpected RSS values: %d, %d", samples[0].RSS, samples[1].RSS)
+	}
+	if samples[1].GCTime != 250 {
+		t.Errorf("Expected GC time 250ms, got %d", samples[1].GCTime)
+	}
+}
+
+func TestParseData_GCTimeMissing(t *testing.T) {
+	data := "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | N/A\n" +
+		"00:00:02 | 1 | GradleDaemon | 100MB | 200MB | 300MB | \n" +
+		"00:00:03 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 0ms\n" +
+		"00:00:04 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 0.120s\n" +
+		"00:00:05 | 1 | GradleDaemon | 100MB | 200MB | 300MB"
+
+	samples, err := ParseData(data, time.Now())
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(samples))
+	}
+
+	tests := []struct {
+		name    string
+		gcTime  int
+		missing bool
+	}{
+		{"N/A", 0, true},
+		{"empty", 0, true},
+		{"zero", 0, false},
+		{"numeric", 120, false},
+		{"omitted", 0, true},
+	}
+	for i, tt := range tests {
+		if samples[i].GCTime != tt.gcTime || samples[i].GCTimeMissing != tt.missing {
+			t.Errorf("%s: expected gc=%d missing=%v, got gc=%d missing=%v", tt.name, tt.gcTime, tt.missing, samples[i].GCTime, samples[i].GCTimeMissing)
+		}
+	}
+
+	// The binary format keeps the distinction
+	encoded, err := EncodeSamplesBinary(samples)
+	if err != nil {
+		t.Fatalf("EncodeSamplesBinary failed: %v", err)
+	}
+	decoded, err := DecodeSamplesBinary(encoded, time.Now())
+	if err != nil {
+		t.Fatalf("DecodeSamplesBinary failed: %v", err)
+	}
+	if !decoded[0].GCTimeMissing || decoded[2].GCTimeMissing {
+		t.Errorf("Expected GCTimeMissing to round-trip through the binary format, got %v and %v", decoded[0].GCTimeMissing, decoded[2].GCTimeMissing)
+	}
+
+	// CSV and NDJSON report an omitted GC time the same way
+	csvSamples, err := ParseDataFormat(DataFormatCSV, "1,42,GradleDaemon,100,200,300\n2,42,GradleDaemon,100,200,300,0", time.Now(), ParseConfig{})
+	if err != nil {
+		t.Fatalf("ParseDataFormat csv failed: %v", err)
+	}
+	if !csvSamples[0].GCTimeMissing || csvSamples[1].GCTimeMissing {
+		t.Errorf("Expected csv GCTimeMissing true then false, got %v and %v", csvSamples[0].GCTimeMissing, csvSamples[1].GCTimeMissing)
+	}
+	ndjsonSamples, err := ParseDataFormat(DataFormatNDJSON, `{"elapsed_time":1,"pid":"42","heap_used":100}`+"\n"+`{"elapsed_time":2,"pid":"42","gc_time":0}`, time.Now(), ParseConfig{})
+	if err != nil {
+		t.Fatalf("ParseDataFormat ndjson failed: %v", err)
+	}
+	if !ndjsonSamples[0].GCTimeMissing || ndjsonSamples[1].GCTimeMissing {
+		t.Errorf("Expected ndjson GCTimeMissing true then false, got %v and %v", ndjsonSamples[0].GCTimeMissing, ndjsonSamples[1].GCTimeMissing)
+	}
+}
+
+func TestParseData_RejectsTooFewParts(t *testing.T) {
+	samples, err := ParseData("00:00:01 | 12345 | GradleDaemon | 100MB", time.Now())
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("Expected 4-part line to be skipped, got %d samples", len(samples))
+	}
+}
+
+func TestParseData_SkipsCommentLines(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	data := "# agent v2.1, sampling every 5s\n" +
+		"00:00:05 | 1 | GradleDaemon | 100MB | 200MB | 300MB\n" +
+		"\n" +
+		"   # interval boundary\n" +
+		"00:00:10 | 1 | GradleDaemon | 120MB | 200MB | 310MB\n"
+
+	samples, err := ParseData(data, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 2 || samples[0].HeapUsed != 100 || samples[1].HeapUsed != 120 {
+		t.Fatalf("Expected both data lines parsed, got %+v", samples)
+	}
+	if strings.Contains(logs.String(), "Skipping line") {
+		t.Errorf("Expected comment lines skipped without a parse error, got logs:\n%s", logs.String())
+	}
+	if _, lineErrors := ValidateData(data, time.Unix(0, 0), DefaultParseConfig, 0); len(lineErrors) != 0 {
+		t.Errorf("Expected comment lines not reported by validation, got %+v", lineErrors)
+	}
+
+	custom := ParseConfig{Fields: DefaultFieldRange, CommentPrefix: "//"}
+	if _, lineErrors := ValidateData(data+"// custom comment\n", time.Unix(0, 0), custom, 0); len(lineErrors) != 2 {
+		t.Errorf("Expected only the custom prefix skipped, got %+v", lineErrors)
+	}
+}
+
+func TestDropImplausibleSamples_AnyFormat(t *testing.T) {
+	data := "00:00:05 | 1 | GradleDaemon | 512MB | 1024MB | 1300MB\n" +
+		"00:00:10 | 1 | GradleDaemon | 4294967MB | 1024MB | 1300MB\n" +
+		"00:00:15 | 1 | GradleDaemon | 530MB | 1024MB | 1310MB\n"
+	samples, err := ParseData(data, time.Unix(0, 0))
+	if err != nil || len(samples) != 3 {
+		t.Fatalf("Expected every sample parsed, got %d: %v", len(samples), err)
+	}
+	if kept := DropImplausibleSamples(samples, 0); len(kept) != 3 {
+		t.Fatalf("Expected every sample kept without a ceiling, got %d", len(kept))
+	}
+
+	read := func() float64 {
+		var metric dto.Metric
+		if err := ImplausibleSamples.Write(&metric); err != nil {
+			t.Fatalf("failed to read counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := read()
+	kept := DropImplausibleSamples(samples, 65536)
+	if len(kept) != 2 || kept[0].HeapUsed != 512 || kept[1].HeapUsed != 530 {
+		t.Errorf("Expected the implausible sample dropped, got %+v", kept)
+	}
+	if len(samples) != 3 {
+		t.Errorf("Expected the input left intact, got %d samples", len(samples))
+	}
+	if counted := read() - before; counted != 1 {
+		t.Errorf("Expected 1 implausible sample counted, got %v", counted)
+	}
+
+	// Formats without pipe lines are held to the same ceiling
+	csv, err := ParseDataFormat(DataFormatCSV, "5,1,GradleDaemon,512,1024,1300\n10,1,GradleDaemon,4294967,1024,1300", time.Unix(0, 0), DefaultParseConfig)
+	if err != nil {
+		t.Fatalf("ParseDataFormat failed: %v", err)
+	}
+	if kept := DropImplausibleSamples(csv, 65536); len(kept) != 1 {
+		t.Errorf("Expected the implausible CSV sample dropped, got %+v", kept)
+	}
+
+	if _, lineErrors := ValidateData(data, time.Unix(0, 0), DefaultParseConfig, 65536); len(lineErrors) != 1 || lineErrors[0].Line != 2 {
+		t.Errorf("Expected validation to report line 2, got %+v", lineErrors)
+	}
+}
+
+func TestParseDataFields_RangeBoundaries(t *testing.T) {
+	lines := map[int]string{
+		5: "00:00:01 | 1 | GradleDaemon | 100MB | 200MB",
+		6: "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB",
+		7: "00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB | 0.5s",
+	}
+	tests := []struct {
+		fields   FieldRange
+		accepted []int
+	}{
+		{DefaultFieldRange, []int{5, 6, 7}},
+		{FieldRange{Min: 6, Max: 7}, []int{6, 7}},
+		{FieldRange{Min: 6, Max: 6}, []int{6}},
+		{FieldRange{Min: 5, Max: 6}, []int{5, 6}},
+	}
+	for _, tt := range tests {
+		var accepted []int
+		for _, n := range []int{5, 6, 7} {
+			samples, err := ParseDataFields(lines[n], time.Now(), ParseConfig{Fields: tt.fields})
+			if err != nil {
+				t.Fatalf("ParseDataFields failed: %v", err)
+			}
+			if len(samples) == 1 {
+				accepted = append(accepted, n)
+			}
+		}
+		if !reflect.DeepEqual(accepted, tt.accepted) {
+			t.Errorf("Range %d-%d: expected %v-field lines accepted, got %v", tt.fields.Min, tt.fields.Max, tt.accepted, accepted)
+		}
+	}
+
+	// The extras segment does not count as a field
+	samples, _ := ParseDataFields(lines[6]+" | phase=compiling", time.Now(), ParseConfig{Fields: FieldRange{Min: 6, Max: 6}})
+	if len(samples) != 1 || samples[0].Phase != "compiling" {
+		t.Errorf("Expected a 6-field line with extras accepted, got %+v", samples)
+	}
+
+	for _, fields := range []FieldRange{{Min: 4, Max: 7}, {Min: 7, Max: 6}, {Min: 6, Max: 8}} {
+		if fields.Valid() {
+			t.Errorf("Expected range %d-%d to be invalid", fields.Min, fields.Max)
+		}
+	}
+}
+
+// newUnreachableClient returns a client pointed at an emulator address nothing listens on,
+// so any call that is not aborted by its context would block on retries
+func newUnreachableClient(t *testing.T) *Client {
+	t.Helper()
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "127.0.0.1:1")
+
+	client, err := NewClient(context.Background(), "test-project")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRunIDPrefixNamespacesDocuments(t *testing.T) {
+	t.Setenv("RUN_ID_PREFIX", "team-a-")
+	client := newUnreachableClient(t)
+
+	if id := client.runRef("run1").ID; id != "team-a-run1" {
+		t.Errorf("Expected run document team-a-run1, got %s", id)
+	}
+	if id := client.processRef("run1").ID; id != "team-a-run1" {
+		t.Errorf("Expected process document team-a-run1, got %s", id)
+	}
+
+	runID, ok := client.runIDOf(client.firestore.Collection("runs").Doc("team-a-run1"))
+	if !ok || runID != "run1" {
+		t.Errorf("Expected run1 in namespace, got %q (ok=%v)", runID, ok)
+	}
+	if _, ok := client.runIDOf(client.firestore.Collection("runs").Doc("team-b-run1")); ok {
+		t.Error("Expected another team's run to be outside the namespace")
+	}
+}
+
+func TestNoRunIDPrefixKeepsDocumentIDs(t *testing.T) {
+	client := newUnreachableClient(t)
+
+	if id := client.runRef("run1").ID; id != "run1" {
+		t.Errorf("Expected run document run1, got %s", id)
+	}
+	runID, ok := client.runIDOf(client.firestore.Collection("runs").Doc("team-b-run1"))
+	if !ok || runID != "team-b-run1" {
+		t.Errorf("Expected every run in namespace without a prefix, got %q (ok=%v)", runID, ok)
+	}
+}
+
+func TestCancelledContextAbortsStorageCalls(t *testing.T) {
+	client := newUnreachableClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := map[string]func() error{
+		"GetRun": func() error {
+			_, err := client.GetRun(ctx, "run-1")
+			return err
+		},
+		"StoreSamples": func() error {
+			return client.StoreSamples(ctx, "run-1", []models.Sample{{PID: "1"}})
+		},
+		"MarkRunAsFinished": func() error {
+			return client.MarkRunAsFinished(ctx, "run-1")
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			err := call()
+			if err == nil {
+				t.Fatal("Expected error for cancelled context")
+			}
+			if status.Code(err) != codes.Canceled {
+				t.Errorf("Expected Canceled error, got: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Cancelled call took too long: %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestAppendIngestEvent_RecordsAndWraps(t *testing.T) {
+	var history []models.IngestEvent
+	base := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		history = AppendIngestEvent(history, models.IngestEvent{
+			Timestamp:   base.Add(time.Duration(i) * time.Second),
+			SampleCount: i + 1,
+			RemoteAddr:  "10.0.0.1:1234",
+		}, 3)
+	}
+
+	if len(history) != 3 {
+		t.Fatalf("Expected ring capped at 3 events, got %d", len(history))
+	}
+	// Oldest two events should have been dropped, newest kept in order
+	for i, event := range history {
+		if event.SampleCount != i+3 {
+			t.Errorf("Event %d: expected sample count %d, got %d", i, i+3, event.SampleCount)
+		}
+	}
+}
+
+func TestIngestSourceFromContext(t *testing.T) {
+	if source := ingestSource(context.Background()); source != "" {
+		t.Errorf("Expected empty source without value, got %q", source)
+	}
+
+	ctx := WithIngestSource(context.Background(), "10.0.0.1:1234")
+	if source := ingestSource(ctx); source != "10.0.0.1:1234" {
+		t.Errorf("Expected source 10.0.0.1:1234, got %q", source)
+	}
+}
+
+func TestIsStaleRun_OnlyUnfinishedAndStale(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-5 * time.Minute)
+
+	tests := []struct {
+		name  string
+		run   models.RunDoc
+		stale bool
+	}{
+		{"unfinished and stale", models.RunDoc{UpdatedAt: now.Add(-10 * time.Minute)}, true},
+		{"unfinished and recent", models.RunDoc{UpdatedAt: now.Add(-1 * time.Minute)}, false},
+		{"finished and stale", models.RunDoc{UpdatedAt: now.Add(-10 * time.Minute), Finished: true}, false},
+		{"finished and recent", models.RunDoc{UpdatedAt: now, Finished: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsStaleRun(&tt.run, cutoff); got != tt.stale {
+				t.Errorf("IsStaleRun() = %v, want %v", got, tt.stale)
+			}
+		})
+	}
+}
+
+func TestParseData_ExtraMetricsRoundTrip(t *testing.T) {
+	data := "00:00:01 | 12345 | GradleDaemon | 100MB | 200MB | 300MB | 0.1s | metaspace=85.5;code_cache=12\n" +
+		"00:00:02 | 12345 | GradleDaemon | 100MB | 200MB | 300MB | metaspace=86"
+
+	samples, err := ParseData(data, time.Now())
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(samples))
+	}
+
+	if samples[0].Extra["metaspace"] != 85.5 || samples[0].Extra["code_cache"] != 12 {
+		t.Errorf("Unexpected extra metrics: %v", samples[0].Extra)
+	}
+	if samples[0].GCTime != 100 || samples[0].RSS != 300 {
+		t.Errorf("Core fields should still parse: gc=%d rss=%d", samples[0].GCTime, samples[0].RSS)
+	}
+	if samples[1].Extra["metaspace"] != 86 || samples[1].RSS != 300 {
+		t.Errorf("Unexpected second sample: %+v", samples[1])
+	}
+
+	jsonData, err := json.Marshal(samples[0])
+	if err != nil {
+		t.Fatalf("Failed to marshal sample: %v", err)
+	}
+	var unmarshaled models.Sample
+	if err := json.Unmarshal(jsonData, &unmarshaled); err != nil {
+		t.Fatalf("Failed to unmarshal sample: %v", err)
+	}
+	if len(unmarshaled.Extra) != 2 || unmarshaled.Extra["metaspace"] != 85.5 {
+		t.Errorf("Extra metrics did not round-trip: %v", unmarshaled.Extra)
+	}
+}
+
+func TestParseExtraMetrics_SkipsMalformedPairs(t *testing.T) {
+	extra := ParseExtraMetrics("metaspace=85; bogus ;=3;code_cache=abc")
+	if len(extra) != 1 || extra["metaspace"] != 85 {
+		t.Errorf("Expected only metaspace to parse, got %v", extra)
+	}
+	if ParseExtraMetrics("bogus=") != nil {
+		t.Error("Expected nil map when no pairs parse")
+	}
+}
+
+func TestNewBackfillRun_SkippedByStaleSweep(t *testing.T) {
+	now := time.Now()
+	startTime := now.Add(-30 * 24 * time.Hour)
+
+	runDoc := NewBackfillRun("old-run", startTime, []models.Sample{{PID: "1"}}, now, false)
+
+	if !runDoc.Finished || !runDoc.Backfill {
+		t.Fatalf("Expected backfilled run to be finished and flagged: %+v", runDoc)
+	}
+	if !runDoc.StartTime.Equal(startTime) {
+		t.Errorf("Expected original start time %v, got %v", startTime, runDoc.StartTime)
+	}
+	// Even with a cutoff far in the future the run must not be considered stale
+	if IsStaleRun(&runDoc, now.Add(24*time.Hour)) {
+		t.Error("Backfilled run should never be picked up by the stale sweep")
+	}
+	if runDoc.ExpireAt.IsZero() {
+		t.Error("Backfilled run should still get a TTL by default")
+	}
+	if retained := NewBackfillRun("old-run", startTime, nil, now, true); !retained.ExpireAt.IsZero() {
+		t.Error("Retained backfilled run should not get a TTL")
+	}
+}
+
+func TestRunExpired_RetainForeverSurvivesRetention(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	old := now.Add(-90 * 24 * time.Hour)
+	runs := []models.RunDoc{
+		{RunID: "old-finished", Finished: true, FinishedAt: old},
+		{RunID: "old-unfinished", CreatedAt: old},
+		{RunID: "old-baseline", Finished: true, FinishedAt: old, RetainForever: true},
+		{RunID: "recent", Finished: true, FinishedAt: now},
+		{RunID: "old-backfill", Finished: true, FinishedAt: old, Backfill: true},
+	}
+
+	var deleted []string
+	for _, runDoc := range runs {
+		if runExpired(&runDoc, cutoff, true) {
+			deleted = append(deleted, runDoc.RunID)
+		}
+	}
+	if expected := []string{"old-finished", "old-unfinished"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("Expected %v deleted, got %v", expected, deleted)
+	}
+	if !runExpired(&runs[4], cutoff, false) {
+		t.Error("Expected an old backfilled run to expire without BACKFILL_SKIP_RETENTION")
+	}
+}
+
+func TestCutoffBefore_RetentionBoundary(t *testing.T) {
+	defer func() { clock.Now = time.Now }()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock.Now = func() time.Time { return now }
+
+	retention := 30 * 24 * time.Hour
+	cutoff := cutoffBefore(retention)
+	if !cutoff.Equal(now.Add(-retention)) {
+		t.Fatalf("Expected the cutoff %v before the fixed clock, got %v", retention, cutoff)
+	}
+	atBoundary := models.RunDoc{Finished: true, FinishedAt: cutoff}
+	if runExpired(&atBoundary, cutoff, false) {
+		t.Error("Expected a run finished exactly at the cutoff to be kept")
+	}
+	justBefore := models.RunDoc{Finished: true, FinishedAt: cutoff.Add(-time.Millisecond)}
+	if !runExpired(&justBefore, cutoff, false) {
+		t.Error("Expected a run finished just before the cutoff to expire")
+	}
+}
+
+func TestParseDataFormat_SelectsParser(t *testing.T) {
+	startTime := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		format string
+		data   string
+		rss    int
+		gcTime int
+	}{
+		{DataFormatPipe6, "00:00:05 | 42 | GradleDaemon | 100MB | 200MB | 300MB", 300, 0},
+		{DataFormatPipe7, "00:00:05 | 42 | GradleDaemon | 100MB | 200MB | 300MB | 0.5s", 300, 500},
+		{DataFormatCSV, "elapsed,pid,name,heap_used,heap_cap,rss,gc\n5,42,GradleDaemon,100,200,300,500", 300, 500},
+		{DataFormatNDJSON, `{"elapsed_time":5,"pid":"42","name":"GradleDaemon","heap_used":100,"heap_cap":200,"rss":300,"gc_time":500}`, 300, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			samples, err := ParseDataFormat(tt.format, tt.data, startTime, DefaultParseConfig)
+			if err != nil {
+				t.Fatalf("ParseDataFormat failed: %v", err)
+			}
+			if len(samples) != 1 {
+				t.Fatalf("Expected 1 sample, got %d", len(samples))
+			}
+			sample := samples[0]
+			if sample.PID != "42" || sample.HeapUsed != 100 || sample.HeapCap != 200 {
+				t.Errorf("Unexpected sample: %+v", sample)
+			}
+			if sample.RSS != tt.rss || sample.GCTime != tt.gcTime {
+				t.Errorf("Expected rss=%d gc=%d, got rss=%d gc=%d", tt.rss, tt.gcTime, sample.RSS, sample.GCTime)
+			}
+			if sample.Timestamp != ToMillis(startTime.Add(5*time.Second)) {
+				t.Errorf("Unexpected timestamp: %d", sample.Timestamp)
+			}
+		})
+	}
+}
+
+func TestParseDataFormat_MonotonicNanoseconds(t *testing.T) {
+	startTime := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	data := "# agent started\n3725250000000 | 42 | GradleDaemon | 100MB | 200MB | 300MB | 0.5s\n1500000 | 7 | KotlinCompileDaemon | 50MB | 80MB | 90MB"
+
+	samples, err := ParseDataFormat(DataFormatMonotonicNS, data, startTime, DefaultParseConfig)
+	if err != nil {
+		t.Fatalf("ParseDataFormat failed: %v", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d", len(samples))
+	}
+	// 3725.25s after the start, 1h02m05s250ms
+	if expected := ToMillis(startTime.Add(time.Hour + 2*time.Minute + 5*time.Second + 250*time.Millisecond)); samples[0].Timestamp != expected {
+		t.Errorf("Expected timestamp %d, got %d", expected, samples[0].Timestamp)
+	}
+	if samples[0].ElapsedTime != 3725 || samples[0].PID != "42" || samples[0].HeapUsed != 100 || samples[0].GCTime != 500 {
+		t.Errorf("Unexpected sample: %+v", samples[0])
+	}
+	if expected := ToMillis(startTime.Add(1500 * time.Microsecond)); samples[1].Timestamp != expected || samples[1].ElapsedTime != 0 {
+		t.Errorf("Expected timestamp %d at 0s elapsed, got %d at %ds", expected, samples[1].Timestamp, samples[1].ElapsedTime)
+	}
+
+	if _, err := ParseDataFormat(DataFormatMonotonicNS, "00:00:05 | 42 | GradleDaemon | 100MB | 200MB | 300MB", startTime, DefaultParseConfig); err == nil {
+		t.Error("Expected monotonic-ns to reject an HH:MM:SS line")
+	}
+}
+
+func TestParseDataFormat_RejectsMismatchedLines(t *testing.T) {
+	pipe7 := "00:00:05 | 42 | GradleDaemon | 100MB | 200MB | 300MB | 0.5s"
+	if _, err := ParseDataFormat(DataFormatPipe6, pipe7, time.Now(), DefaultParseConfig); err == nil {
+		t.Error("Expected v1-pipe6 to reject a 7-field line")
+	}
+	if _, err := ParseDataFormat(DataFormatCSV, "5,42,GradleDaemon,100", time.Now(), DefaultParseConfig); err == nil {
+		t.Error("Expected csv to reject a short line")
+	}
+	if _, err := ParseDataFormat(DataFormatNDJSON, "{not json", time.Now(), DefaultParseConfig); err == nil {
+		t.Error("Expected ndjson to reject malformed JSON")
+	}
+	if _, err := ParseDataFormat("v2-binary", pipe7, time.Now(), DefaultParseConfig); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestTailQuery_LimitedDescendingRead(t *testing.T) {
+	client := newUnreachableClient(t)
+
+	data, err := client.tailQuery("run-1", 20).Serialize()
+	if err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	var request firestorepb.RunQueryRequest
+	if err := proto.Unmarshal(data, &request); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	query := request.GetStructuredQuery()
+
+	if !strings.HasSuffix(request.GetParent(), "/runs/run-1") {
+		t.Errorf("Expected query scoped to the run document, got parent %q", request.GetParent())
+	}
+	if from := query.GetFrom(); len(from) != 1 || from[0].GetCollectionId() != samplesCollection {
+		t.Errorf("Expected query on the samples subcollection, got %v", from)
+	}
+	if query.GetLimit().GetValue() != 20 {
+		t.Errorf("Expected limit 20, got %d", query.GetLimit().GetValue())
+	}
+	orderBy := query.GetOrderBy()
+	if len(orderBy) == 0 || orderBy[0].GetField().GetFieldPath() != "timestamp" ||
+		orderBy[0].GetDirection() != firestorepb.StructuredQuery_DESCENDING {
+		t.Errorf("Expected newest-first order on timestamp, got %v", orderBy)
+	}
+}
+
+func TestTailOf_NewestSamplesOldestFirst(t *testing.T) {
+	var samples []models.Sample
+	for i := 1; i <= 5; i++ {
+		samples = append(samples, models.Sample{Timestamp: int64(i)})
+	}
+
+	tail := TailOf(samples, 2)
+	if len(tail) != 2 || tail[0].Timestamp != 4 || tail[1].Timestamp != 5 {
+		t.Errorf("Expected samples 4 and 5, got %+v", tail)
+	}
+	if len(TailOf(samples, 10)) != 5 {
+		t.Error("Expected all samples when n exceeds the count")
+	}
+
+	// The subcollection query returns newest first; results are reversed for the client
+	newestFirst := []models.Sample{{Timestamp: 5}, {Timestamp: 4}, {Timestamp: 3}}
+	reversed := ReverseSamples(newestFirst)
+	if reversed[0].Timestamp != 3 || reversed[2].Timestamp != 5 {
+		t.Errorf("Expected oldest first after reversing, got %+v", reversed)
+	}
+}
+
+func TestRunCursor_RoundTrip(t *testing.T) {
+	summaries := []models.RunSummary{
+		{RunID: "run-c", UpdatedAtTimestamp: 3000},
+		{RunID: "run-b", UpdatedAtTimestamp: 2000},
+		{RunID: "run-a", UpdatedAtTimestamp: 1000},
+	}
+
+	page, next := PageRuns(summaries, DefaultRunSort, 2)
+	if len(page) != 2 || next == "" {
+		t.Fatalf("Expected a 2-run page with a cursor, got %d runs, cursor %q", len(page), next)
+	}
+	timestamp, runID, err := DecodeRunCursor(next)
+	if err != nil || timestamp != 2000 || runID != "run-b" {
+		t.Errorf("Cursor should point after run-b: %d %q %v", timestamp, runID, err)
+	}
+
+	if _, next := PageRuns(summaries, DefaultRunSort, 3); next != "" {
+		t.Errorf("Expected no cursor on the last page, got %q", next)
+	}
+	if _, _, err := DecodeRunCursor("!!!"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestParseRunSort(t *testing.T) {
+	valid := map[string]RunSort{
+		"":             DefaultRunSort,
+		"updated":      {Field: RunSortUpdated},
+		"started:asc":  {Field: RunSortStarted, Ascending: true},
+		"samples:desc": {Field: RunSortSamples},
+	}
+	for value, want := range valid {
+		if got, err := ParseRunSort(value); err != nil || got != want {
+			t.Errorf("ParseRunSort(%q) = %+v, %v; want %+v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"name", "updated:up", "started:"} {
+		if _, err := ParseRunSort(value); !errors.Is(err, ErrInvalidSort) {
+			t.Errorf("ParseRunSort(%q): expected ErrInvalidSort, got %v", value, err)
+		}
+	}
+}
+
+func TestRunCursor_SortKeys(t *testing.T) {
+	start := time.Date(2025, 1, 2, 3, 4, 5, 6000, time.UTC)
+	summaries := []models.RunSummary{
+		{RunID: "run-a", StartTime: start, SampleCount: 10},
+		{RunID: "run-b", StartTime: start.Add(time.Microsecond), SampleCount: 5},
+	}
+	order := RunSort{Field: RunSortStarted, Ascending: true}
+
+	_, next := PageRuns(summaries, order, 1)
+	key, runID, err := DecodeRunCursor(next)
+	if err != nil || runID != "run-a" || !order.startAfter(key).(time.Time).Equal(start) {
+		t.Fatalf("Cursor should hold run-a's start time: %d %q %v", key, runID, err)
+	}
+	if !order.After(summaries[1], key, runID) || order.After(summaries[0], key, runID) {
+		t.Error("Expected only run-b to follow the cursor")
+	}
+
+	bySamples := RunSort{Field: RunSortSamples}
+	if !bySamples.Less(summaries[0], summaries[1]) {
+		t.Error("Expected the run with more samples first in descending order")
+	}
+}
+
+func TestIsPurgeableFinishedRun_OnlyFinishedAndOldEnough(t *testing.T) {
+	now := time.Now()
+	cutoff := now.Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		run       models.RunDoc
+		purgeable bool
+	}{
+		{"finished long ago", models.RunDoc{Finished: true, FinishedAt: now.Add(-2 * time.Hour)}, true},
+		{"finished recently", models.RunDoc{Finished: true, FinishedAt: now.Add(-time.Minute)}, false},
+		{"unfinished and old", models.RunDoc{CreatedAt: now.Add(-5 * time.Hour)}, false},
+		{"finished without timestamp", models.RunDoc{Finished: true}, false},
+		{"retained forever", models.RunDoc{Finished: true, FinishedAt: now.Add(-2 * time.Hour), RetainForever: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPurgeableFinishedRun(&tt.run, cutoff); got != tt.purgeable {
+				t.Errorf("IsPurgeableFinishedRun() = %v, want %v", got, tt.purgeable)
+			}
+		})
+	}
+}
+
+func TestDeleteFinishedRuns_KeepsRetainedRuns(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	finishedAt := time.Now().Add(-2 * time.Hour)
+
+	for _, run := range []models.RunDoc{
+		{RunID: "run-old", Finished: true, FinishedAt: finishedAt},
+		{RunID: "run-baseline", Finished: true, FinishedAt: finishedAt, RetainForever: true},
+	} {
+		if _, err := client.runRef(run.RunID).Set(ctx, run); err != nil {
+			t.Fatalf("Failed to write run %s: %v", run.RunID, err)
+		}
+	}
+
+	deleted, err := client.DeleteFinishedRuns(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("DeleteFinishedRuns failed: %v", err)
+	}
+	if fmt.Sprint(deleted) != "[run-old]" {
+		t.Errorf("Expected only the unflagged run purged, got %v", deleted)
+	}
+	if _, err := client.GetRun(ctx, "run-baseline"); err != nil {
+		t.Errorf("Expected the retain_forever run to survive the purge, got %v", err)
+	}
+}
+
+func TestBinarySamples_RoundTrip(t *testing.T) {
+	startTime := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	samples := []models.Sample{
+		{ElapsedTime: 5, PID: "12345", Name: "GradleDaemon", HeapUsed: 100, HeapCap: 200, RSS: 300, GCTime: 250},
+		{ElapsedTime: 6, PID: "678", Name: "KotlinDaemon", HeapUsed: 50, HeapCap: 80, RSSMissing: true},
+	}
+
+	data, err := EncodeSamplesBinary(samples)
+	if err != nil {
+		t.Fatalf("EncodeSamplesBinary failed: %v", err)
+	}
+	decoded, err := DecodeSamplesBinary(data, startTime)
+	if err != nil {
+		t.Fatalf("DecodeSamplesBinary failed: %v", err)
+	}
+	if len(decoded) != len(samples) {
+		t.Fatalf("Expected %d samples, got %d", len(samples), len(decoded))
+	}
+	for i, sample := range decoded {
+		expected := samples[i]
+		expected.Timestamp = ToMillis(startTime.Add(time.Duration(expected.ElapsedTime) * time.Second))
+		if sample.Timestamp != expected.Timestamp || sample.PID != expected.PID || sample.Name != expected.Name ||
+			sample.HeapUsed != expected.HeapUsed || sample.HeapCap != expected.HeapCap || sample.RSS != expected.RSS ||
+			sample.RSSMissing != expected.RSSMissing || sample.GCTime != expected.GCTime {
+			t.Errorf("Sample %d did not round-trip: got %+v, want %+v", i, sample, expected)
+		}
+	}
+}
+
+func TestDecodeSamplesBinary_RejectsMalformed(t *testing.T) {
+	data, err := EncodeSamplesBinary([]models.Sample{{ElapsedTime: 1, PID: "1", Name: "GradleDaemon", HeapUsed: 1}})
+	if err != nil {
+		t.Fatalf("EncodeSamplesBinary failed: %v", err)
+	}
+
+	hugeCount := append([]byte("BPW1"), 0xFF, 0xFF, 0xFF, 0xFF)
+	cases := map[string][]byte{
+		"empty":          nil,
+		"bad magic":      append([]byte("XXXX"), data[4:]...),
+		"truncated":      data[:len(data)-3],
+		"trailing bytes": append(append([]byte(nil), data...), 0),
+		"huge count":     hugeCount,
+	}
+	for name, payload := range cases {
+		if _, err := DecodeSamplesBinary(payload, time.Now()); !errors.Is(err, ErrInvalidBinary) {
+			t.Errorf("%s: expected ErrInvalidBinary, got %v", name, err)
+		}
+	}
+}
+
+func TestApplyStartOffsets_AlignsAgentsOnRunTimeline(t *testing.T) {
+	startTime := time.Date(2025, 10, 8, 18, 0, 0, 0, time.UTC)
+	// Both agents report 00:00:10, but the second agent started 30s after the run
+	data := "00:00:10 | 100 | GradleDaemon | 100MB | 200MB | 300MB\n" +
+		"00:00:10 | 200 | KotlinDaemon | 50MB | 100MB | 150MB"
+
+	samples, err := ParseData(data, startTime)
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	offsets := StartOffsets(map[string]models.ProcessInfo{
+		"100": {PID: "100"},
+		"200": {PID: "200", StartOffsetSeconds: 30},
+	})
+	samples = ApplyStartOffsets(samples, offsets)
+
+	if samples[0].Timestamp != ToMillis(startTime.Add(10*time.Second)) {
+		t.Errorf("PID 100 without offset should stay at +10s, got %d", samples[0].Timestamp)
+	}
+	if samples[1].Timestamp != ToMillis(startTime.Add(40*time.Second)) {
+		t.Errorf("PID 200 with a 30s offset should be at +40s, got %d", samples[1].Timestamp)
+	}
+	if samples[1].Timestamp-samples[0].Timestamp != 30000 {
+		t.Errorf("Expected samples 30s apart, got %dms", samples[1].Timestamp-samples[0].Timestamp)
+	}
+	if samples[1].ElapsedTime != 10 {
+		t.Errorf("Elapsed time should stay as reported by the agent, got %d", samples[1].ElapsedTime)
+	}
+}
+
+func TestExportThenDelete(t *testing.T) {
+	var calls []string
+	export := func(runID, bucket string) error {
+		calls = append(calls, "export "+runID+" "+bucket)
+		if runID == "broken" {
+			return errors.New("upload failed")
+		}
+		return nil
+	}
+	remove := func(runIDs []string) ([]string, error) {
+		calls = append(calls, "delete "+strings.Join(runIDs, ","))
+		return runIDs, nil
+	}
+
+	deleted, err := exportThenDelete([]string{"run-1", "broken", "run-2"}, "archive", export, remove)
+	if err != nil {
+		t.Fatalf("exportThenDelete failed: %v", err)
+	}
+	want := []string{"export run-1 archive", "export broken archive", "export run-2 archive", "delete run-1,run-2"}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected exports before deletion %v, got %v", want, calls)
+	}
+	if strings.Join(deleted, ",") != "run-1,run-2" {
+		t.Errorf("A run that failed to export must not be deleted, got %v", deleted)
+	}
+
+	calls = nil
+	if _, err := exportThenDelete([]string{"run-1"}, "", export, remove); err != nil {
+		t.Fatalf("exportThenDelete failed: %v", err)
+	}
+	if strings.Join(calls, "|") != "delete run-1" {
+		t.Errorf("Expected no export without a bucket, got %v", calls)
+	}
+}
+
+func TestParseDataChunk_CarriesPartialLine(t *testing.T) {
+	startTime := time.Unix(1700000000, 0)
+	stream := "00:00:01 | 100 | GradleDaemon | 100MB | 200MB | 300MB\n" +
+		"00:00:02 | 100 | GradleDaemon | 110MB | 200MB | 310MB\n" +
+		"00:00:03 | 100 | GradleDaemon | 120MB | 200MB | 320MB\n"
+
+	// Split mid-line: the heap capacity of the second line is cut after "20"
+	cut := strings.Index(stream, "200MB | 310MB") + 2
+	first, second := stream[:cut], stream[cut:]
+
+	samples, remainder, err := ParseDataChunk(first, startTime)
+	if err != nil {
+		t.Fatalf("ParseDataChunk failed: %v", err)
+	}
+	if len(samples) != 1 || samples[0].ElapsedTime != 1 {
+		t.Fatalf("Expected only the complete first line, got %+v", samples)
+	}
+	if remainder != "00:00:02 | 100 | GradleDaemon | 110MB | 20" {
+		t.Fatalf("Unexpected remainder %q", remainder)
+	}
+
+	samples, remainder, err = ParseDataChunk(remainder+second, startTime)
+	if err != nil {
+		t.Fatalf("ParseDataChunk failed: %v", err)
+	}
+	if remainder != "" {
+		t.Errorf("Expected no remainder after a complete chunk, got %q", remainder)
+	}
+	if len(samples) != 2 || samples[0].ElapsedTime != 2 || samples[0].HeapCap != 200 || samples[1].ElapsedTime != 3 {
+		t.Errorf("Expected the joined line to parse correctly, got %+v", samples)
+	}
+
+	samples, remainder, err = ParseDataChunk("00:00:04 | 100", startTime)
+	if err != nil || len(samples) != 0 || remainder != "00:00:04 | 100" {
+		t.Errorf("Expected a chunk without newline to be carried whole, got %+v %q %v", samples, remainder, err)
+	}
+}
+
+func TestParseData_Phase(t *testing.T) {
+	data := "00:00:01 | 12345 | GradleDaemon | 100MB | 200MB | 300MB | 0.1s | phase=compiling;metaspace=85\n" +
+		"00:00:02 | 12345 | GradleDaemon | 100MB | 200MB | phase=testing\n" +
+		"00:00:03 | 12345 | GradleDaemon | 100MB | 200MB | 300MB"
+
+	samples, err := ParseData(data, time.Now())
+	if err != nil {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(samples))
+	}
+	if samples[0].Phase != "compiling" || samples[0].Extra["metaspace"] != 85 || len(samples[0].Extra) != 1 {
+		t.Errorf("Expected phase compiling next to the metaspace metric, got %+v", samples[0])
+	}
+	if samples[1].Phase != "testing" || samples[1].Extra != nil || !samples[1].RSSMissing {
+		t.Errorf("Expected phase testing on a 5-part line, got %+v", samples[1])
+	}
+	if samples[2].Phase != "" {
+		t.Errorf("Expected no phase on a plain line, got %q", samples[2].Phase)
+	}
+}
+
+func TestThrottleSamples_DropsSubIntervalSamples(t *testing.T) {
+	previous := []models.Sample{
+		{PID: "1", Timestamp: 1000},
+		{PID: "2", Timestamp: 1000},
+	}
+	incoming := []models.Sample{
+		{PID: "1", Timestamp: 1050}, // 50ms after the stored sample
+		{PID: "1", Timestamp: 1100}, // exactly the interval, kept
+		{PID: "1", Timestamp: 1150}, // 50ms after the one just kept
+		{PID: "2", Timestamp: 1500},
+		{PID: "3", Timestamp: 1000}, // first sample of a new PID
+		{PID: "3", Timestamp: 1099},
+	}
+
+	kept := ThrottleSamples(previous, incoming, 100)
+
+	var got []string
+	for _, sample := range kept {
+		got = append(got, fmt.Sprintf("%s@%d", sample.PID, sample.Timestamp))
+	}
+	want := "1@1100,2@1500,3@1000"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Expected %s, got %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestEndTimeLimit_Check(t *testing.T) {
+	end := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	late := []models.Sample{{PID: "1", Timestamp: ToMillis(end.Add(90 * time.Second))}}
+	withinSlack := []models.Sample{{PID: "1", Timestamp: ToMillis(end.Add(30 * time.Second))}}
+	limit := EndTimeLimit{Enabled: true, Slack: time.Minute}
+
+	if err := limit.Check(late, end); !errors.Is(err, ErrSamplesAfterEnd) {
+		t.Errorf("Expected ErrSamplesAfterEnd for a sample past the slack, got %v", err)
+	}
+	if err := limit.Check(withinSlack, end); err != nil {
+		t.Errorf("Expected a sample within the slack to pass, got %v", err)
+	}
+	if err := limit.Check(late, time.Time{}); err != nil {
+		t.Errorf("Expected runs without an end time to accept samples, got %v", err)
+	}
+	if err := (EndTimeLimit{}).Check(late, end); err != nil {
+		t.Errorf("Expected the check to be off by default, got %v", err)
+	}
+}
+
+func TestGetEndTimeLimit_ParsesBool(t *testing.T) {
+	for value, enabled := range map[string]bool{"true": true, "1": true, "TRUE": true, "false": false, "yes": false, "": false} {
+		t.Setenv("REJECT_AFTER_END_TIME", value)
+		if limit := getEndTimeLimit(); limit.Enabled != enabled {
+			t.Errorf("REJECT_AFTER_END_TIME=%q: expected enabled %v, got %v", value, enabled, limit.Enabled)
+		}
+	}
+}
+
+func TestEvictProcesses_KeepsMostRecentlySeen(t *testing.T) {
+	base := time.Now()
+	processInfo := map[string]models.ProcessInfo{}
+	for i := 0; i < 6; i++ {
+		pid := fmt.Sprintf("%d", i)
+		processInfo[pid] = models.ProcessInfo{PID: pid, LastSeen: base.Add(time.Duration(i) * time.Second)}
+	}
+	// The first process reported again is the most active one
+	processInfo["0"] = models.ProcessInfo{PID: "0", LastSeen: base.Add(time.Minute)}
+
+	evicted := EvictProcesses(processInfo, 3)
+	if !reflect.DeepEqual(evicted, []string{"1", "2", "3"}) {
+		t.Errorf("Expected the least recently seen processes evicted, got %v", evicted)
+	}
+	for _, pid := range []string{"0", "4", "5"} {
+		if _, ok := processInfo[pid]; !ok {
+			t.Errorf("Expected process %s to be kept", pid)
+		}
+	}
+
+	if evicted := EvictProcesses(processInfo, 0); evicted != nil || len(processInfo) != 3 {
+		t.Errorf("Expected no cap with max 0, evicted %v", evicted)
+	}
+}
+
+func TestClampTimestamps(t *testing.T) {
+	start := time.UnixMilli(1_700_000_000_000)
+	now := start.Add(time.Minute)
+	samples := []models.Sample{
+		{PID: "1", Timestamp: ToMillis(start) - 5000}, // before the run started
+		{PID: "1", Timestamp: ToMillis(start) + 1000},
+		{PID: "1", Timestamp: ToMillis(now) + 1000}, // in the future
+	}
+
+	clamped, count := ClampTimestamps(samples, start, now)
+	if count != 2 {
+		t.Errorf("Expected 2 clamped samples, got %d", count)
+	}
+	if clamped[0].Timestamp != ToMillis(start) {
+		t.Errorf("Expected a pre-start timestamp to clamp to StartTime, got %d", clamped[0].Timestamp)
+	}
+	if clamped[1].Timestamp != ToMillis(start)+1000 {
+		t.Errorf("Expected an in-window timestamp to be untouched, got %d", clamped[1].Timestamp)
+	}
+	if clamped[2].Timestamp != ToMillis(now) {
+		t.Errorf("Expected a future timestamp to clamp to now, got %d", clamped[2].Timestamp)
+	}
+	if samples[0].Timestamp != ToMillis(start)-5000 {
+		t.Error("ClampTimestamps must not modify its input")
+	}
+}
+
+func TestResumeFinishedRun(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	window := 30 * time.Minute
+	finished := func(status string, ago time.Duration) *models.RunDoc {
+		return &models.RunDoc{
+			Finished:     true,
+			FinishedAt:   now.Add(-ago),
+			ExpireAt:     now.Add(3*time.Hour - ago),
+			FinishStatus: status,
+		}
+	}
+
+	runDoc := finished(FinishStatusStale, 10*time.Minute)
+	resumed, err := ResumeFinishedRun(runDoc, now, window)
+	if err != nil || !resumed {
+		t.Fatalf("Expected a recently stale-finished run to resume, got resumed=%v err=%v", resumed, err)
+	}
+	if runDoc.Finished || !runDoc.FinishedAt.IsZero() || !runDoc.ExpireAt.IsZero() || runDoc.FinishStatus != "" {
+		t.Errorf("Expected the resumed run to be reopened, got %+v", runDoc)
+	}
+
+	if _, err := ResumeFinishedRun(finished(FinishStatusCompleted, time.Minute), now, window); !errors.Is(err, ErrRunFinished) {
+		t.Errorf("Expected a manually finished run to reject samples, got %v", err)
+	}
+	if _, err := ResumeFinishedRun(finished(FinishStatusStale, time.Hour), now, window); !errors.Is(err, ErrRunFinished) {
+		t.Errorf("Expected a stale run outside the window to reject samples, got %v", err)
+	}
+
+	// Without a window finished runs keep accepting samples as before
+	runDoc = finished(FinishStatusCompleted, time.Minute)
+	if resumed, err := ResumeFinishedRun(runDoc, now, 0); err != nil || resumed || !runDoc.Finished {
+		t.Errorf("Expected no change without a window, got resumed=%v err=%v finished=%v", resumed, err, runDoc.Finished)
+	}
+}
+
+func TestFindStaleRuns_FinishesLegacyRunsWithoutFinishedField(t *testing.T) {
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	updated := time.Now().Add(-2 * time.Hour)
+
+	// Written before finished was stored on unfinished runs, so the field is absent
+	legacy := map[string]interface{}{
+		"run_id":               "legacy-run",
+		"start_time":           updated.Add(-time.Hour),
+		"updated_at":           updated,
+		"updated_at_timestamp": ToMillis(updated),
+	}
+	if _, err := client.firestore.Collection("runs").Doc("legacy-run").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write legacy run: %v", err)
+	}
+
+	// Sweeps never run the backfill themselves, so they only match the run after it
+	if staleRuns, err := client.FindStaleRuns(time.Hour); err != nil || len(staleRuns) != 0 {
+		t.Fatalf("Expected no stale runs before the backfill, got %+v, %v", staleRuns, err)
+	}
+	if _, ok := fake.fields("runs/legacy-run")["finished"]; ok {
+		t.Fatalf("Expected the sweep to leave the legacy run untouched")
+	}
+	if err := client.BackfillLegacyRuns(ctx); err != nil {
+		t.Fatalf("BackfillLegacyRuns failed: %v", err)
+	}
+
+	staleRuns, err := client.FindStaleRuns(time.Hour)
+	if err != nil {
+		t.Fatalf("FindStaleRuns failed: %v", err)
+	}
+	if len(staleRuns) != 1 || staleRuns[0].RunID != "legacy-run" {
+		t.Fatalf("Expected the legacy run to be stale, got %+v", staleRuns)
+	}
+	if finished, ok := fake.fields("runs/legacy-run")["finished"]; !ok || finished.GetBooleanValue() {
+		t.Errorf("Expected finished = false to be backfilled, got %v", finished)
+	}
+
+	summary, err := client.SummarizeRuns(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("SummarizeRuns failed: %v", err)
+	}
+	if summary.StaleRuns != 1 {
+		t.Errorf("Expected the legacy run counted as stale, got %+v", summary)
+	}
+}
+
+func TestFindStaleRuns_CutoffFollowsClock(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { clock.Now = time.Now }()
+
+	clock.Now = func() time.Time { return created }
+	if err := client.CreateRun(ctx, "run-1"); err != nil {
+		t.Fatalf("CreateRun failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		now   time.Time
+		stale bool
+	}{
+		{created.Add(59 * time.Minute), false},
+		{created.Add(61 * time.Minute), true},
+	} {
+		clock.Now = func() time.Time { return tc.now }
+		staleRuns, err := client.FindStaleRuns(time.Hour)
+		if err != nil {
+			t.Fatalf("FindStaleRuns failed: %v", err)
+		}
+		if stale := len(staleRuns) == 1; stale != tc.stale {
+			t.Errorf("At %s: expected stale = %v, got %+v", tc.now.Sub(created), tc.stale, staleRuns)
+		}
+	}
+}
+
+func TestStoreSamples_AppliesProcessStartOffset(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	if err := client.StoreProcessInfo(ctx, "run-offset", models.ProcessInfo{PID: "200", Name: "KotlinDaemon", StartOffsetSeconds: 60}); err != nil {
+		t.Fatalf("StoreProcessInfo failed: %v", err)
+	}
+	incoming := []models.Sample{{PID: "100", Timestamp: 5000}, {PID: "200", Timestamp: 5000}}
+	if err := client.StoreSamples(ctx, "run-offset", incoming); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+
+	runDoc, err := client.GetRun(ctx, "run-offset")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	if len(runDoc.Samples) != 2 || runDoc.Samples[0].Timestamp != 5000 || runDoc.Samples[1].Timestamp != 65000 {
+		t.Errorf("Expected only PID 200 shifted by 60s, got %+v", runDoc.Samples)
+	}
+	if incoming[1].Timestamp != 5000 {
+		t.Errorf("Expected the caller's samples left unshifted, got %d", incoming[1].Timestamp)
+	}
+}
+
+func TestStoreProcessInfo_RejectsArchivedRun(t *testing.T) {
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	if err := client.StoreSamples(ctx, "run-archived", []models.Sample{{PID: "1", Timestamp: 1000}}); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if err := client.MarkRunAsFinished(ctx, "run-archived"); err != nil {
+		t.Fatalf("MarkRunAsFinished failed: %v", err)
+	}
+	if err := client.SetRunArchived(ctx, "run-archived"); err != nil {
+		t.Fatalf("SetRunArchived failed: %v", err)
+	}
+
+	err := client.StoreProcessInfo(ctx, "run-archived", models.ProcessInfo{PID: "1", Name: "GradleDaemon"})
+	if !errors.Is(err, ErrRunArchived) {
+		t.Errorf("Expected ErrRunArchived, got %v", err)
+	}
+	if fake.count("processes") != 0 {
+		t.Errorf("Expected no process document for the archived run")
+	}
+	if err := client.StoreSamples(ctx, "run-archived", []models.Sample{{PID: "1", Timestamp: 2000}}); !errors.Is(err, ErrRunArchived) {
+		t.Errorf("Expected ErrRunArchived for samples, got %v", err)
+	}
+}
+
+func TestCreateRun_FailsForExistingRun(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	if err := client.CreateRun(ctx, "run-1"); err != nil {
+		t.Fatalf("CreateRun failed: %v", err)
+	}
+	if err := client.CreateRun(ctx, "run-1"); !errors.Is(err, ErrRunExists) {
+		t.Errorf("Expected ErrRunExists for a second create, got %v", err)
+	}
+	runDoc, err := client.GetRun(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	if runDoc.Finished || runDoc.StartTime.IsZero() || len(runDoc.Samples) != 0 {
+		t.Errorf("Expected an empty unfinished run, got %+v", runDoc)
+	}
+}
+
+func TestDeleteStaleRun_RechecksTheRun(t *testing.T) {
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	stale := time.Now().Add(-time.Hour)
+	put := func(runDoc models.RunDoc) {
+		t.Helper()
+		runDoc.UpdatedAt = stale
+		runDoc.UpdatedAtTimestamp = ToMillis(stale)
+		if _, err := client.runRef(runDoc.RunID).Set(ctx, runDoc); err != nil {
+			t.Fatalf("Failed to write run %s: %v", runDoc.RunID, err)
+		}
+	}
+	put(models.RunDoc{RunID: "run-empty"})
+	put(models.RunDoc{RunID: "run-retained", RetainForever: true})
+	put(models.RunDoc{RunID: "run-ingested"})
+
+	if err := client.DeleteStaleRun(ctx, "run-empty", 5*time.Minute); err != nil {
+		t.Fatalf("DeleteStaleRun failed: %v", err)
+	}
+	if fake.fields("runs/run-empty") != nil {
+		t.Error("Expected the empty stale run deleted")
+	}
+
+	// Flagged or ingested into after the sweep read them, these runs are kept
+	if err := client.DeleteStaleRun(ctx, "run-retained", 5*time.Minute); !errors.Is(err, ErrRunChanged) {
+		t.Errorf("Expected ErrRunChanged for a retained run, got %v", err)
+	}
+	if err := client.StoreSamples(ctx, "run-ingested", []models.Sample{{PID: "1", Timestamp: 1000, HeapUsed: 100}}); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if err := client.DeleteStaleRun(ctx, "run-ingested", 5*time.Minute); !errors.Is(err, ErrRunChanged) {
+		t.Errorf("Expected ErrRunChanged for a run that stored samples, got %v", err)
+	}
+	if fake.fields("runs/run-retained") == nil || fake.fields("runs/run-ingested") == nil {
+		t.Error("Expected the changed runs kept")
+	}
+}
+
+func TestRunTagsInWindow_ReadsOnlyTags(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	now := time.Now()
+	for runID, updated := range map[string]time.Time{"run-recent": now.Add(-time.Minute), "run-old": now.Add(-time.Hour)} {
+		runDoc := models.RunDoc{
+			RunID:              runID,
+			UpdatedAt:          updated,
+			UpdatedAtTimestamp: ToMillis(updated),
+			Tags:               map[string]string{"team": "ios"},
+			Samples:            []models.Sample{{PID: "1", HeapUsed: 100}},
+		}
+		if _, err := client.runRef(runID).Set(ctx, runDoc); err != nil {
+			t.Fatalf("Failed to write run %s: %v", runID, err)
+		}
+	}
+
+	runs, err := client.RunTagsInWindow(ctx, now.Add(-10*time.Minute), now)
+	if err != nil {
+		t.Fatalf("RunTagsInWindow failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].RunID != "run-recent" || runs[0].Tags["team"] != "ios" {
+		t.Fatalf("Expected the recent run with its tags, got %+v", runs)
+	}
+	if len(runs[0].Samples) != 0 {
+		t.Errorf("Expected samples not to be read, got %d", len(runs[0].Samples))
+	}
+}
+
+func TestRunStatsInWindow_NewestFirstWithinLimit(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		updated := now.Add(-time.Duration(i) * time.Minute)
+		runDoc := models.RunDoc{
+			RunID:              fmt.Sprintf("run-%d", i),
+			UpdatedAt:          updated,
+			UpdatedAtTimestamp: ToMillis(updated),
+			PeakHeapUsedMB:     100 * i,
+			Samples:            []models.Sample{{PID: "1", HeapUsed: 100 * i}},
+		}
+		if _, err := client.runRef(runDoc.RunID).Set(ctx, runDoc); err != nil {
+			t.Fatalf("Failed to write run %s: %v", runDoc.RunID, err)
+		}
+	}
+
+	runs, err := client.RunStatsInWindow(ctx, now.Add(-time.Hour), now, 2)
+	if err != nil {
+		t.Fatalf("RunStatsInWindow failed: %v", err)
+	}
+	if len(runs) != 2 || runs[0].RunID != "run-1" || runs[1].RunID != "run-2" {
+		t.Fatalf("Expected the 2 most recently updated runs, got %+v", runs)
+	}
+	if runs[1].PeakHeapUsedMB != 200 || len(runs[1].Samples) != 0 {
+		t.Errorf("Expected the peak without samples, got %+v", runs[1])
+	}
+}
+
+func TestBackfillLegacyRuns_CountsSamplesForSampleSort(t *testing.T) {
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Written before sample_count was stored, so the field is absent
+	legacy := map[string]interface{}{
+		"run_id":   "legacy-run",
+		"finished": true,
+		"samples": []models.Sample{
+			{PID: "1", HeapUsed: 100},
+			{PID: "1", HeapUsed: 110},
+			{PID: "1", HeapUsed: 120},
+		},
+	}
+	if _, err := client.firestore.Collection("runs").Doc("legacy-run").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write legacy run: %v", err)
+	}
+	if err := client.CreateRun(ctx, "new-run"); err != nil {
+		t.Fatalf("CreateRun failed: %v", err)
+	}
+
+	bySamples := RunSort{Field: RunSortSamples}
+	summaries, _, err := client.ListRuns(ctx, "", bySamples, 10, "")
+	if err != nil {
+		t.Fatalf("ListRuns failed: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].RunID != "new-run" {
+		t.Fatalf("Expected the legacy run left out before the backfill, got %+v", summaries)
+	}
+
+	if err := client.BackfillLegacyRuns(ctx); err != nil {
+		t.Fatalf("BackfillLegacyRuns failed: %v", err)
+	}
+	if count := fake.fields("runs/legacy-run")["sample_count"]; count.GetIntegerValue() != 3 {
+		t.Errorf("Expected sample_count = 3 to be backfilled, got %v", count)
+	}
+	summaries, _, err = client.ListRuns(ctx, "", bySamples, 10, "")
+	if err != nil {
+		t.Fatalf("ListRuns failed: %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].RunID != "legacy-run" || summaries[0].SampleCount != 3 {
+		t.Errorf("Expected the legacy run first with 3 samples after the backfill, got %+v", summaries)
+	}
+}
+
+func TestRunIDPrefix_QueriesFilterOnNamespace(t *testing.T) {
+	t.Setenv("RUN_ID_PREFIX", "team-b-")
+	t.Setenv("STALE_SCAN_LIMIT", "1")
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	stale := time.Now().Add(-2 * time.Hour)
+
+	// Another team's runs share the collection, sort first and were updated more recently
+	for i := 1; i <= 2; i++ {
+		updated := stale.Add(time.Duration(i) * time.Minute)
+		other := models.RunDoc{RunID: fmt.Sprintf("run-%d", i), UpdatedAt: updated, UpdatedAtTimestamp: ToMillis(updated), Namespace: "team-a-"}
+		if _, err := client.firestore.Collection("runs").Doc("team-a-"+other.RunID).Set(ctx, other); err != nil {
+			t.Fatalf("Failed to write run %s: %v", other.RunID, err)
+		}
+	}
+	// Written before the namespace was stored, so the field is absent
+	legacy := map[string]interface{}{
+		"run_id":               "legacy-run",
+		"finished":             false,
+		"updated_at":           stale,
+		"updated_at_timestamp": ToMillis(stale),
+	}
+	if _, err := client.firestore.Collection("runs").Doc("team-b-legacy-run").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write legacy run: %v", err)
+	}
+	if err := client.BackfillLegacyRuns(ctx); err != nil {
+		t.Fatalf("BackfillLegacyRuns failed: %v", err)
+	}
+
+	staleRuns, err := client.FindStaleRuns(time.Hour)
+	if err != nil {
+		t.Fatalf("FindStaleRuns failed: %v", err)
+	}
+	if len(staleRuns) != 1 || staleRuns[0].RunID != "legacy-run" {
+		t.Fatalf("Expected this namespace's stale run within the scan limit, got %+v", staleRuns)
+	}
+	if namespace := fake.fields("runs/team-b-legacy-run")["namespace"]; namespace.GetStringValue() != "team-b-" {
+		t.Errorf("Expected the namespace to be backfilled, got %v", namespace)
+	}
+
+	if err := client.CreateRun(ctx, "new-run"); err != nil {
+		t.Fatalf("CreateRun failed: %v", err)
+	}
+	summaries, next, err := client.ListRuns(ctx, "", DefaultRunSort, 1, "")
+	if err != nil {
+		t.Fatalf("ListRuns failed: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].RunID != "new-run" || next == "" {
+		t.Fatalf("Expected a page of this namespace's newest run, got %+v (next %q)", summaries, next)
+	}
+	summaries, _, err = client.ListRuns(ctx, "", DefaultRunSort, 1, next)
+	if err != nil {
+		t.Fatalf("ListRuns failed: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].RunID != "legacy-run" {
+		t.Errorf("Expected the legacy run on the next page, got %+v", summaries)
+	}
+}
+
+func TestEachSample_SubcollectionAfterLegacyInlineSamples(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "true")
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Stored inline before the subcollection was enabled
+	legacy := models.RunDoc{RunID: "run-1", Samples: []models.Sample{{PID: "1", Timestamp: 1000}}}
+	if _, err := client.runRef("run-1").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+	if err := client.writeSamples(ctx, "run-1", []models.Sample{{PID: "1", Timestamp: 3000}, {PID: "1", Timestamp: 2000}}); err != nil {
+		t.Fatalf("writeSamples failed: %v", err)
+	}
+
+	var timestamps []int64
+	err := client.EachSample(ctx, "run-1", func(sample models.Sample) error {
+		timestamps = append(timestamps, sample.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachSample failed: %v", err)
+	}
+	if fmt.Sprint(timestamps) != "[1000 2000 3000]" {
+		t.Errorf("Expected inline samples first, then the subcollection by timestamp, got %v", timestamps)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = client.EachSample(ctx, "run-1", func(models.Sample) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected EachSample to stop at the first error, got %v after %d calls", err, calls)
+	}
+	if err := client.EachSample(ctx, "missing", func(models.Sample) error { return nil }); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected not found for a missing run, got %v", err)
+	}
+}
+
+func TestGetRunHeap_ReadsMaintainedHeapOnly(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+	samples := []models.Sample{
+		{PID: "1", Timestamp: 1000, HeapUsed: 300},
+		{PID: "2", Timestamp: 1000, HeapUsed: 900},
+	}
+	if err := client.StoreSamples(ctx, "run-1", samples); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if err := client.StoreSamples(ctx, "run-1", []models.Sample{{PID: "2", Timestamp: 2000, HeapUsed: 400}}); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+
+	runDoc, err := client.GetRunHeap(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetRunHeap failed: %v", err)
+	}
+	if runDoc.PeakHeapUsedMB != 900 || CurrentHeapUsed(runDoc.LatestHeap) != 400 {
+		t.Errorf("Expected peak 900 and current 400, got %d and %d", runDoc.PeakHeapUsedMB, CurrentHeapUsed(runDoc.LatestHeap))
+	}
+	if len(runDoc.Samples) != 0 {
+		t.Errorf("Expected samples not to be read, got %d", len(runDoc.Samples))
+	}
+	if _, err := client.GetRunHeap(ctx, "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected not found for a missing run, got %v", err)
+	}
+}
+
+func TestStoreSamples_QuietLogsForUnsampledIngests(t *testing.T) {
+	client, _ := newFakeFirestoreClient(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	samples, err := ParseData("00:00:01 | 1 | GradleDaemon | 100MB | 200MB | 300MB", time.Now())
+	if err != nil || len(samples) != 1 {
+		t.Fatalf("ParseData failed: %v", err)
+	}
+	quiet := WithVerboseLogs(context.Background(), false)
+	if err := client.StoreSamples(quiet, "run-1", samples); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if err := client.StoreProcessInfo(quiet, "run-1", models.ProcessInfo{PID: "1", Name: "GradleDaemon"}); err != nil {
+		t.Fatalf("StoreProcessInfo failed: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Expected no logs for an unsampled ingest, got %q", logs.String())
+	}
+
+	if err := client.StoreSamples(context.Background(), "run-1", samples); err != nil {
+		t.Fatalf("StoreSamples failed: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Successfully stored 1 samples") {
+		t.Errorf("Expected progress logs without WithVerboseLogs, got %q", logs.String())
+	}
+}
+
+func TestTailSamples_SubcollectionIncludesLegacyInlineSamples(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "1")
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Stored inline before the subcollection was enabled
+	legacy := models.RunDoc{RunID: "run-1", Samples: []models.Sample{{PID: "1", Timestamp: 1000}, {PID: "1", Timestamp: 2000}}}
+	if _, err := client.runRef("run-1").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+	if err := client.writeSamples(ctx, "run-1", []models.Sample{{PID: "1", Timestamp: 3000}}); err != nil {
+		t.Fatalf("writeSamples failed: %v", err)
+	}
+
+	for n, want := range map[int]string{1: "[3000]", 2: "[2000 3000]", 5: "[1000 2000 3000]"} {
+		samples, err := client.TailSamples(ctx, "run-1", n)
+		if err != nil {
+			t.Fatalf("TailSamples(%d) failed: %v", n, err)
+		}
+		var timestamps []int64
+		for _, sample := range samples {
+			timestamps = append(timestamps, sample.Timestamp)
+		}
+		if fmt.Sprint(timestamps) != want {
+			t.Errorf("TailSamples(%d): expected %s, got %v", n, want, timestamps)
+		}
+	}
+}
+
+func TestGetRunSince_ReadsOnlyNewerSubcollectionSamples(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "true")
+	client, _ := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	// Stored inline before the subcollection was enabled
+	legacy := models.RunDoc{RunID: "run-1", Provider: "github", Samples: []models.Sample{{PID: "1", Timestamp: 1000}}}
+	if _, err := client.runRef("run-1").Set(ctx, legacy); err != nil {
+		t.Fatalf("Failed to write run: %v", err)
+	}
+	if err := client.writeSamples(ctx, "run-1", []models.Sample{{PID: "1", Timestamp: 2000}, {PID: "1", Timestamp: 3000}}); err != nil {
+		t.Fatalf("writeSamples failed: %v", err)
+	}
+
+	runDoc, err := client.GetRunSince(ctx, "run-1", 2000)
+	if err != nil {
+		t.Fatalf("GetRunSince failed: %v", err)
+	}
+	var timestamps []int64
+	for _, sample := range runDoc.Samples {
+		timestamps = append(timestamps, sample.Timestamp)
+	}
+	if fmt.Sprint(timestamps) != "[1000 3000]" {
+		t.Errorf("Expected the inline sample and the subcollection sample after 2000, got %v", timestamps)
+	}
+
+	meta, err := client.GetRunMeta(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetRunMeta failed: %v", err)
+	}
+	if meta.Provider != "github" || len(meta.Samples) != 0 {
+		t.Errorf("Expected only the run's provider and no samples, got %+v", meta)
+	}
+	if _, err := client.GetRunMeta(ctx, "run-missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a not found error for a missing run, got %v", err)
+	}
+}
+
+func TestStoreBackfill_SamplesSubcollection(t *testing.T) {
+	t.Setenv("SAMPLES_SUBCOLLECTION", "true")
+	t.Setenv("BACKFILL_SKIP_RETENTION", "1")
+	client, fake := newFakeFirestoreClient(t)
+	ctx := context.Background()
+
+	samples := []models.Sample{{PID: "1", Timestamp: 1000, HeapUsed: 100}, {PID: "1", Timestamp: 2000, HeapUsed: 200}}
+	if err := client.StoreBackfill(ctx, "run-1", time.Now().Add(-time.Hour), samples); err != nil {
+		t.Fatalf("StoreBackfill failed: %v", err)
+	}
+	if inline := fake.fields("runs/run-1")["samples"]; len(inline.GetArrayValue().GetValues()) != 0 {
+		t.Errorf("Expected no inline samples, got %v", inline)
+	}
+	if n := fake.count("runs/run-1/samples"); n != 2 {
+		t.Errorf("Expected 2 samples in the subcollection, got %d", n)
+	}
+	runDoc, err := client.GetRun(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("GetRun failed: %v", err)
+	}
+	if len(runDoc.Samples) != 2 || runDoc.SampleCount != 2 || !runDoc.ExpireAt.IsZero() {
+		t.Errorf("Expected 2 retained samples read back, got %d (count %d, expire_at %v)", len(runDoc.Samples), runDoc.SampleCount, runDoc.ExpireAt)
+	}
+}
+
+func TestStoreSamples_ConcurrentAgentsMergeByMachine(t *testing.T) {
+	for _, subcollection := range []bool{false, true} {
+		t.Run(fmt.Sprintf("subcollection=%v", subcollection), func(t *testing.T) {
+			t.Setenv("SAMPLES_SUBCOLLECTION", strconv.FormatBool(subcollection))
+			// Throttling reads the samples already stored, inline or the subcollection tail
+			t.Setenv("MIN_SAMPLE_INTERVAL_MS", "500")
+			client, _ := newFakeFirestoreClient(t)
+			ctx := context.Background()
+			const batches = 10
+
+			// Two agents report the same PID from different machines at the same time
+			var wg sync.WaitGroup
+			for _, machine := range []string{"agent-a", "agent-b"} {
+				wg.Add(1)
+				go func(machine string) {
+					defer wg.Done()
+					for i := 0; i < batches; i++ {
+						samples := SetMachine([]models.Sample{{PID: "4242", Name: "GradleDaemon", Timestamp: int64(1000 * i), HeapUsed: 100}}, machine)
+						if err := client.StoreSamples(ctx, "run-multi", samples); err != nil {
+							t.Errorf("%s batch %d: StoreSamples failed: %v", machine, i, err)
+						}
+						if err := client.StoreProcessInfo(ctx, "run-multi", models.ProcessInfo{PID: "4242", Name: "GradleDaemon", Machine: machine}); err != nil {
+							t.Errorf("%s batch %d: StoreProcessInfo failed: %v", machine, i, err)
+						}
+					}
+				}(machine)
+			}
+			wg.Wait()
+
+			runDoc, err := client.GetRun(ctx, "run-multi")
+			if err != nil {
+				t.Fatalf("GetRun failed: %v", err)
+			}
+			perMachine := make(map[string]int)
+			for _, sample := range runDoc.Samples {
+				perMachine[sample.Machine]++
+			}
+			if perMachine["agent-a"] != batches || perMachine["agent-b"] != batches || runDoc.SampleCount != 2*batches {
+				t.Errorf("Expected %d samples from each machine, got %v (count %d)", batches, perMachine, runDoc.SampleCount)
+			}
+
+			processDoc, err := client.GetProcesses(ctx, "run-multi")
+			if err != nil {
+				t.Fatalf("GetProcesses failed: %v", err)
+			}
+			for _, key := range []string{"agent-a/4242", "agent-b/4242"} {
+				if info, ok := processDoc.ProcessInfo[key]; !ok || info.PID != "4242" {
+					t.Errorf("Expected process info under %q, got %v", key, processDoc.ProcessInfo)
+				}
+			}
+		})
+	}
+}
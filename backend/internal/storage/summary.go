@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/api/iterator"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/clock"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// SummarizeRuns counts runs by state for GET /admin/summary. Unfinished runs, which the
+// stale sweep keeps few, are read as projections of their summary fields and split into
+// active and stale at staleTimeout; finished runs are only counted.
+func (c *Client) SummarizeRuns(ctx context.Context, staleTimeout time.Duration) (models.SystemSummary, error) {
+	if err := c.breaker.allow(); err != nil {
+		return models.SystemSummary{}, err
+	}
+	summary, err := c.summarizeRuns(ctx, staleTimeout)
+	c.breaker.record(err)
+	return summary, err
+}
+
+// summarizeRuns is the SummarizeRuns implementation, called through the circuit breaker
+func (c *Client) summarizeRuns(ctx context.Context, staleTimeout time.Duration) (models.SystemSummary, error) {
+	iter := c.runsQuery().
+		Select("run_id", "start_time", "updated_at", "finished", "sample_count").
+		Where("finished", "==", false).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var unfinished []models.RunSummary
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return models.SystemSummary{}, err
+		}
+
+		runID, ok := c.runIDOf(doc.Ref)
+		if !ok {
+			continue
+		}
+
+		var summary models.RunSummary
+		if err := doc.DataTo(&summary); err != nil {
+			log.Printf("❌ Error parsing run summary %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		summary.RunID = runID
+		unfinished = append(unfinished, summary)
+	}
+
+	finished, err := c.countFinishedRuns(ctx)
+	if err != nil {
+		return models.SystemSummary{}, err
+	}
+	return SummarizeRunStates(unfinished, finished, cutoffBefore(staleTimeout), clock.Now()), nil
+}
+
+// countFinishedRuns counts finished runs with an aggregation query, filtered to the
+// RUN_ID_PREFIX namespace by runsQuery
+func (c *Client) countFinishedRuns(ctx context.Context) (int, error) {
+	query := c.runsQuery().Where("finished", "==", true)
+	result, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := result["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("unexpected count result for finished runs")
+	}
+	return int(count.GetIntegerValue()), nil
+}
+
+// SummarizeRunStates builds the summary of the unfinished runs, which are stale when last
+// updated before cutoff like in IsStaleRun, and of finished runs counted separately
+func SummarizeRunStates(unfinished []models.RunSummary, finished int, cutoff time.Time, now time.Time) models.SystemSummary {
+	summary := models.SystemSummary{FinishedRuns: finished, GeneratedAt: now}
+	var oldest *models.RunSummary
+	for i, run := range unfinished {
+		if run.UpdatedAt.Before(cutoff) {
+			summary.StaleRuns++
+			continue
+		}
+		summary.ActiveRuns++
+		summary.ActiveSamples += run.SampleCount
+		if oldest == nil || run.StartTime.Before(oldest.StartTime) {
+			oldest = &unfinished[i]
+		}
+	}
+	if oldest != nil {
+		summary.OldestActiveRunID = oldest.RunID
+		summary.OldestActiveAgeSeconds = int64(now.Sub(oldest.StartTime).Seconds())
+	}
+	return summary
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+// Limits on run tags, enforced by MergeTags
+const (
+	MaxRunTags        = 20
+	MaxTagKeyLength   = 64
+	MaxTagValueLength = 256
+)
+
+// ErrInvalidTags is returned for tags that break the count or length limits
+var ErrInvalidTags = errors.New("invalid tags")
+
+// MergeTags returns existing with set applied and remove deleted, enforcing the tag limits.
+// existing is not modified.
+func MergeTags(existing map[string]string, set map[string]string, remove []string) (map[string]string, error) {
+	merged := make(map[string]string, len(existing)+len(set))
+	for key, value := range existing {
+		merged[key] = value
+	}
+	for key, value := range set {
+		if key == "" || len(key) > MaxTagKeyLength {
+			return nil, fmt.Errorf("%w: key %q must be 1 to %d characters", ErrInvalidTags, key, MaxTagKeyLength)
+		}
+		if len(value) > MaxTagValueLength {
+			return nil, fmt.Errorf("%w: value of %q exceeds %d characters", ErrInvalidTags, key, MaxTagValueLength)
+		}
+		merged[key] = value
+	}
+	for _, key := range remove {
+		delete(merged, key)
+	}
+	if len(merged) > MaxRunTags {
+		return nil, fmt.Errorf("%w: a run has at most %d tags", ErrInvalidTags, MaxRunTags)
+	}
+	return merged, nil
+}
+
+// UpdateRunTags merges set into the run's tags and removes the keys in remove,
+// returning the resulting tags. Archived runs fail with ErrRunArchived.
+func (c *Client) UpdateRunTags(ctx context.Context, runID string, set map[string]string, remove []string) (map[string]string, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	tags, err := c.updateRunTags(ctx, runID, set, remove)
+	c.breaker.record(err)
+	return tags, err
+}
+
+// updateRunTags is the UpdateRunTags implementation, called through the circuit breaker.
+// The read and write share a transaction so concurrent updates can't exceed MaxRunTags.
+func (c *Client) updateRunTags(ctx context.Context, runID string, set map[string]string, remove []string) (map[string]string, error) {
+	doc := c.runRef(runID)
+
+	var tags map[string]string
+	err := c.firestore.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			return err
+		}
+		var runDoc models.RunDoc
+		if err := snapshot.DataTo(&runDoc); err != nil {
+			return err
+		}
+		if runDoc.Archived {
+			return ErrRunArchived
+		}
+
+		tags, err = MergeTags(runDoc.Tags, set, remove)
+		if err != nil {
+			return err
+		}
+		return tx.Update(doc, []firestore.Update{{Path: "tags", Value: tags}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+const (
+	// FinishStatusCompleted is reported for runs finished by their agent
+	FinishStatusCompleted = "completed"
+	// FinishStatusStale is reported for runs finished by the stale sweep
+	FinishStatusStale = "stale"
+
+	// DefaultWebhookRetries is how many times a failed finish notification is resent before
+	// giving up, overridable with FINISH_WEBHOOK_RETRIES
+	DefaultWebhookRetries = 2
+	// DefaultWebhookBackoff is the delay before the first retry, overridable with FINISH_WEBHOOK_BACKOFF
+	DefaultWebhookBackoff = time.Second
+	// DefaultWebhookTimeout bounds a single delivery attempt, overridable with FINISH_WEBHOOK_TIMEOUT
+	DefaultWebhookTimeout = 10 * time.Second
+	// MaxWebhookRetries caps FINISH_WEBHOOK_RETRIES, so a misconfigured value cannot keep
+	// a delivery goroutine alive for hours
+	MaxWebhookRetries = 10
+	// MaxWebhookBackoff caps the delay between retries, including FINISH_WEBHOOK_BACKOFF itself
+	MaxWebhookBackoff = time.Minute
+)
+
+type finishStatusKey struct{}
+
+// WithFinishStatus attaches the reason a run is being finished to ctx so
+// MarkRunAsFinished can report it in the finish webhook
+func WithFinishStatus(ctx context.Context, status string) context.Context {
+	return context.WithValue(ctx, finishStatusKey{}, status)
+}
+
+func finishStatus(ctx context.Context) string {
+	if status, ok := ctx.Value(finishStatusKey{}).(string); ok && status != "" {
+		return status
+	}
+	return FinishStatusCompleted
+}
+
+// FinishNotification is the JSON payload POSTed to FINISH_WEBHOOK_URL when a run finishes
+type FinishNotification struct {
+	RunID           string    `json:"run_id"`
+	Status          string    `json:"status"`
+	PeakHeapUsedMB  int       `json:"peak_heap_used_mb"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// NewFinishNotification summarizes a finished run for the webhook
+func NewFinishNotification(runDoc *models.RunDoc, status string) FinishNotification {
+	notification := FinishNotification{
+		RunID:      runDoc.RunID,
+		Status:     status,
+		FinishedAt: runDoc.FinishedAt,
+	}
+	for _, sample := range runDoc.Samples {
+		if sample.HeapUsed > notification.PeakHeapUsedMB {
+			notification.PeakHeapUsedMB = sample.HeapUsed
+		}
+	}
+	if !runDoc.StartTime.IsZero() && runDoc.FinishedAt.After(runDoc.StartTime) {
+		notification.DurationSeconds = runDoc.FinishedAt.Sub(runDoc.StartTime).Seconds()
+	}
+	return notification
+}
+
+// finishWebhook delivers finish notifications to a configured URL
+type finishWebhook struct {
+	url      string
+	client   *http.Client
+	attempts int           // Deliveries tried before giving up, the first one and its retries
+	backoff  time.Duration // Delay before the first retry, doubled for each following one up to MaxWebhookBackoff
+}
+
+// newFinishWebhook returns a webhook for url, or nil when url is empty. Retries, backoff and
+// the per-attempt timeout are read from FINISH_WEBHOOK_RETRIES, FINISH_WEBHOOK_BACKOFF and
+// FINISH_WEBHOOK_TIMEOUT (e.g. "500ms"). Retries and backoff are capped at
+// MaxWebhookRetries and MaxWebhookBackoff.
+func newFinishWebhook(url string) *finishWebhook {
+	if url == "" {
+		return nil
+	}
+	retries := getEnvInt("FINISH_WEBHOOK_RETRIES", DefaultWebhookRetries)
+	if retries > MaxWebhookRetries {
+		log.Printf("⚠️  WARNING: FINISH_WEBHOOK_RETRIES %d exceeds the maximum, using %d", retries, MaxWebhookRetries)
+		retries = MaxWebhookRetries
+	}
+	backoff := getWebhookDuration("FINISH_WEBHOOK_BACKOFF", DefaultWebhookBackoff)
+	if backoff > MaxWebhookBackoff {
+		log.Printf("⚠️  WARNING: FINISH_WEBHOOK_BACKOFF %v exceeds the maximum, using %v", backoff, MaxWebhookBackoff)
+		backoff = MaxWebhookBackoff
+	}
+	return &finishWebhook{
+		url:      url,
+		client:   &http.Client{Timeout: getWebhookDuration("FINISH_WEBHOOK_TIMEOUT", DefaultWebhookTimeout)},
+		attempts: retries + 1,
+		backoff:  backoff,
+	}
+}
+
+// getWebhookDuration reads a positive duration from name, def when unset or invalid
+func getWebhookDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️  WARNING: invalid %s %q, using %v", name, value, def)
+		return def
+	}
+	return d
+}
+
+// notify sends the notification in the background so finishing never waits on the webhook,
+// nor fails when every attempt does
+func (w *finishWebhook) notify(notification FinishNotification) {
+	if w == nil {
+		return
+	}
+	go func() {
+		if err := w.send(notification); err != nil {
+			log.Printf("❌ Finish webhook for run %s failed: %v", notification.RunID, err)
+		}
+	}()
+}
+
+// send POSTs the notification, retrying failed attempts with exponential backoff
+func (w *finishWebhook) send(notification FinishNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			log.Printf("📣 Sent finish webhook for run %s", notification.RunID)
+			return nil
+		}
+		if attempt >= w.attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("⚠️  Finish webhook attempt %d for run %s failed: %v", attempt, notification.RunID, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, MaxWebhookBackoff)
+	}
+}
+
+// post makes a single delivery attempt, any non-2xx response is an error
+func (w *finishWebhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cdsap/build-process-watcher/backend/internal/models"
+)
+
+func TestNewFinishNotification(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	runDoc := &models.RunDoc{
+		RunID:      "run-1",
+		StartTime:  start,
+		FinishedAt: start.Add(90 * time.Second),
+		Samples: []models.Sample{
+			{PID: "1", HeapUsed: 512},
+			{PID: "2", HeapUsed: 2048},
+			{PID: "1", HeapUsed: 1024},
+		},
+	}
+
+	notification := NewFinishNotification(runDoc, FinishStatusStale)
+	if notification.RunID != "run-1" || notification.Status != FinishStatusStale {
+		t.Errorf("Unexpected notification identity: %+v", notification)
+	}
+	if notification.PeakHeapUsedMB != 2048 {
+		t.Errorf("Expected peak heap 2048, got %d", notification.PeakHeapUsedMB)
+	}
+	if notification.DurationSeconds != 90 {
+		t.Errorf("Expected a 90s duration, got %v", notification.DurationSeconds)
+	}
+}
+
+func TestFinishStatusDefaultsToCompleted(t *testing.T) {
+	if status := finishStatus(context.Background()); status != FinishStatusCompleted {
+		t.Errorf("Expected %q, got %q", FinishStatusCompleted, status)
+	}
+	ctx := WithFinishStatus(context.Background(), FinishStatusStale)
+	if status := finishStatus(ctx); status != FinishStatusStale {
+		t.Errorf("Expected %q, got %q", FinishStatusStale, status)
+	}
+}
+
+func TestFinishWebhookRetriesAndDelivers(t *testing.T) {
+	var attempts int32
+	received := make(chan FinishNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var notification FinishNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		received <- notification
+	}))
+	defer server.Close()
+
+	webhook := newFinishWebhook(server.URL)
+	webhook.backoff = time.Millisecond
+	webhook.notify(FinishNotification{RunID: "run-1", Status: FinishStatusCompleted, PeakHeapUsedMB: 300})
+
+	select {
+	case notification := <-received:
+		if notification.RunID != "run-1" || notification.PeakHeapUsedMB != 300 {
+			t.Errorf("Unexpected payload: %+v", notification)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered")
+	}
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Errorf("Expected a retry after the failed attempt, got %d attempts", got)
+	}
+}
+
+func TestFinishWebhookGivesUp(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	webhook := newFinishWebhook(server.URL)
+	webhook.backoff = time.Millisecond
+	if err := webhook.send(FinishNotification{RunID: "run-1"}); err == nil {
+		t.Error("Expected an error once every attempt failed")
+	}
+	if got := atomic.LoadInt32(&attempts); got != DefaultWebhookRetries+1 {
+		t.Errorf("Expected %d attempts, got %d", DefaultWebhookRetries+1, got)
+	}
+
+	if newFinishWebhook("") != nil {
+		t.Error("Expected no webhook without a URL")
+	}
+}
+
+func TestFinishWebhookConfiguredRetries(t *testing.T) {
+	t.Setenv("FINISH_WEBHOOK_RETRIES", "2")
+	t.Setenv("FINISH_WEBHOOK_BACKOFF", "1ms")
+	t.Setenv("FINISH_WEBHOOK_TIMEOUT", "2s")
+
+	var attempts int32
+	release := make(chan struct{})
+	received := make(chan FinishNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var notification FinishNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		received <- notification
+	}))
+	defer server.Close()
+
+	webhook := newFinishWebhook(server.URL)
+	if webhook.attempts != 3 || webhook.backoff != time.Millisecond || webhook.client.Timeout != 2*time.Second {
+		t.Fatalf("Expected 3 attempts, 1ms backoff and a 2s timeout, got %d, %v and %v", webhook.attempts, webhook.backoff, webhook.client.Timeout)
+	}
+
+	// The finish returns while the endpoint has not even answered the first attempt
+	webhook.notify(FinishNotification{RunID: "run-flaky", Status: FinishStatusCompleted})
+	close(release)
+
+	select {
+	case notification := <-received:
+		if notification.RunID != "run-flaky" {
+			t.Errorf("Unexpected payload: %+v", notification)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered")
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("Expected two failed attempts and a successful third, got %d attempts", got)
+	}
+
+	// Without retries the first failure is final
+	t.Setenv("FINISH_WEBHOOK_RETRIES", "0")
+	atomic.StoreInt32(&attempts, 0)
+	if err := newFinishWebhook(server.URL).send(FinishNotification{RunID: "run-flaky"}); err == nil || atomic.LoadInt32(&attempts) != 1 {
+		t.Errorf("Expected a single failed attempt, got %d attempts and error %v", atomic.LoadInt32(&attempts), err)
+	}
+}
+
+func TestFinishWebhookCapsRetriesAndBackoff(t *testing.T) {
+	t.Setenv("FINISH_WEBHOOK_RETRIES", "1000")
+	t.Setenv("FINISH_WEBHOOK_BACKOFF", "24h")
+
+	webhook := newFinishWebhook("http://example.invalid/hook")
+	if webhook.attempts != MaxWebhookRetries+1 || webhook.backoff != MaxWebhookBackoff {
+		t.Errorf("Expected %d attempts and a %v backoff, got %d and %v", MaxWebhookRetries+1, MaxWebhookBackoff, webhook.attempts, webhook.backoff)
+	}
+}
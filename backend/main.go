@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/cdsap/build-process-watcher/backend/internal/auth"
 	"github.com/cdsap/build-process-watcher/backend/internal/cleanup"
 	"github.com/cdsap/build-process-watcher/backend/internal/handlers"
@@ -31,6 +33,13 @@ func main() {
 	}
 	defer storageClient.Close()
 
+	// Legacy runs get the fields queries filter on in the background, requests never wait on it
+	go func() {
+		if err := storageClient.BackfillLegacyRuns(ctx); err != nil {
+			log.Printf("❌ Error backfilling legacy runs: %v", err)
+		}
+	}()
+
 	// Initialize handlers
 	h := handlers.NewHandlers(storageClient)
 
@@ -39,11 +48,26 @@ func main() {
 
 	// Set up HTTP routes
 	http.HandleFunc("/healthz", h.Health)
+	http.HandleFunc("/config", h.Config)
+	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/auth/run/", h.Auth)
+	http.HandleFunc("/auth/validate", h.ValidateAuth)
 	http.HandleFunc("/ingest", h.Ingest)
+	http.HandleFunc("/ingest/validate", h.ValidateIngest)
+	http.HandleFunc("/runs", h.ListRuns)
 	http.HandleFunc("/runs/", h.GetRun)
+	http.HandleFunc("/runs:statuses", h.RunStatuses)
+	http.HandleFunc("/runs:search", h.SearchRuns)
+	http.HandleFunc("/stats/aggregate", h.AggregateStats)
+	http.HandleFunc("/labels", h.Labels)
 	http.HandleFunc("/finish/", h.FinishRun)
+	http.HandleFunc("/batch", h.Batch)
 	http.HandleFunc("/cleanup/stale", cleanupService.HandleManualStaleCleanup)
+	http.HandleFunc("/admin/runs/", h.AdminRuns)
+	http.HandleFunc("/admin/rotate-secret", h.RotateAdminSecret)
+	http.HandleFunc("/admin/import", h.ImportRuns)
+	http.HandleFunc("/admin/summary", h.AdminSummary)
+	http.HandleFunc("/admin/cleanup/finished", cleanupService.HandleFinishedCleanup)
 
 	// Add a simple test endpoint
 	http.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
@@ -58,13 +82,41 @@ func main() {
 	log.Printf("🚀 Server starting on port %s", port)
 	log.Printf("📊 Monitoring endpoints:")
 	log.Printf("   - GET  /healthz")
-	log.Printf("   - POST /auth/run/{runId}")
+	log.Printf("   - GET  /config")
+	log.Printf("   - GET  /metrics (Prometheus)")
+	log.Printf("   - POST /auth/run/{runId}?force={true|false}")
+	log.Printf("   - POST /auth/validate")
 	log.Printf("   - POST /ingest (JWT required)")
-	log.Printf("   - GET  /runs/{runId}")
+	log.Printf("   - POST /ingest/validate")
+	log.Printf("   - GET  /runs?provider={provider}&sort={updated|started|samples}[:asc|desc]&limit={n}&cursor={cursor}")
+	log.Printf("   - GET|HEAD /runs/{runId}?since_ts={timestamp}&as_of_ts={timestamp} (X-Peak-Heap, X-Current-Heap)")
+	log.Printf("   - POST /runs:statuses")
+	log.Printf("   - GET  /runs:search?min_peak_heap={MB}")
+	log.Printf("   - GET  /stats/aggregate?from={rfc3339}&to={rfc3339}")
+	log.Printf("   - GET  /labels")
+	log.Printf("   - GET  /runs/{runId}/export.csv?columns={a,b}&include_meta=true")
+	log.Printf("   - GET  /runs/{runId}/samples.ndjson")
+	log.Printf("   - GET  /runs/{runId}/metrics.prom")
+	log.Printf("   - GET  /runs/{runId}/export/anonymized")
+	log.Printf("   - GET  /runs/{runId}/stats")
+	log.Printf("   - GET  /runs/{runId}/processes?max_flags={n}")
+	log.Printf("   - GET  /runs/{runId}/retention")
+	log.Printf("   - POST|DELETE /runs/{runId}/tags (JWT or Admin required)")
+	log.Printf("   - GET  /runs/{runId}/tail?n={count}")
+	log.Printf("   - GET  /runs/{runId}/stream (SSE, Origin checked against ALLOWED_ORIGINS)")
 	log.Printf("   - POST /finish/{runId} (JWT required)")
+	log.Printf("   - POST /batch (JWT required)")
 	log.Printf("   - POST /cleanup/stale (Admin required)")
+	log.Printf("   - GET  /admin/runs/{runId}/history (Admin required)")
+	log.Printf("   - GET  /admin/runs/{runId}/schema (Admin required)")
+	log.Printf("   - POST /admin/runs/{runId}/pause|resume|archive|retain|release (Admin required)")
+	log.Printf("   - POST /admin/runs/{runId}/compact?budget={n} (Admin required)")
+	log.Printf("   - POST /admin/rotate-secret (Admin required)")
+	log.Printf("   - POST /admin/import (gzipped NDJSON of run archives, Admin required)")
+	log.Printf("   - GET  /admin/summary (Admin required)")
+	log.Printf("   - POST /admin/cleanup/finished?older_than={duration} (Admin required)")
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, handlers.NewServerHandler(http.DefaultServeMux)); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }